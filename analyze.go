@@ -0,0 +1,423 @@
+/*
+Offline analysis of connection logs.
+
+	gotcpspy analyze -log-file log-....log
+	gotcpspy analyze -format json -log-file log-1.log log-2.log.gz
+
+reads logs written earlier, text or -format json, compressed or not, and
+reports per direction the bytes and packets with their smallest, average
+and largest size, how often each byte value occurs in the payloads, and
+for -proto http logs the URLs requested and the status codes answered.
+JSON logs also give a histogram of the time between packets; text logs
+carry no per-packet timestamps.
+
+Text logs name the peer the bytes came from rather than the direction.
+The proxy's address towards the target is in the default log names, so
+the bytes from that peer go server→client and the rest client→server;
+with a -log-name-template that leaves it out the directions are named
+after the peers instead.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Upper bounds of the inter-packet timing buckets, plus one bucket for
+// everything slower
+var timing_buckets = []time.Duration{time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond, time.Second, 10 * time.Second}
+
+type direction_totals struct {
+	bytes    int64
+	packets  int
+	min_size int
+	max_size int
+}
+
+type text_packet struct {
+	peer    string
+	length  int
+	payload []byte
+}
+
+type LogAnalyzer struct {
+	files      int
+	directions map[string]*direction_totals
+	timing     []int // one more than timing_buckets
+	byte_count [256]int64
+	urls       map[string]int
+	statuses   map[int]int
+}
+
+func NewLogAnalyzer() *LogAnalyzer {
+	return &LogAnalyzer{
+		directions: make(map[string]*direction_totals),
+		timing:     make([]int, len(timing_buckets)+1),
+		urls:       make(map[string]int),
+		statuses:   make(map[int]int),
+	}
+}
+
+type DirectionReport struct {
+	Direction string  `json:"direction"`
+	Bytes     int64   `json:"bytes"`
+	Packets   int     `json:"packets"`
+	MinSize   int     `json:"min_size"`
+	AvgSize   float64 `json:"avg_size"`
+	MaxSize   int     `json:"max_size"`
+}
+
+type TimingBucket struct {
+	Range   string `json:"range"` // e.g. "<10ms", ">=10s"
+	Packets int    `json:"packets"`
+}
+
+type ByteCount struct {
+	Byte  byte  `json:"byte"`
+	Count int64 `json:"count"`
+}
+
+type ValueCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+type AnalysisReport struct {
+	Files         int               `json:"files"`
+	Directions    []DirectionReport `json:"directions"`
+	Timing        []TimingBucket    `json:"timing,omitempty"`       // JSON logs only
+	ByteFrequency []ByteCount       `json:"byte_frequency"`         // most frequent first, unseen bytes left out
+	URLs          []ValueCount      `json:"urls,omitempty"`         // HTTP logs only
+	StatusCodes   []ValueCount      `json:"status_codes,omitempty"` // HTTP logs only
+}
+
+// Adds the log at path to the figures
+func (a *LogAnalyzer) LoadFile(path string) error {
+	b, err := read_log(path)
+	if err != nil {
+		return err
+	}
+	a.files += 1
+	if first := bytes.TrimSpace(b); len(first) > 0 && first[0] == '{' {
+		return a.load_json(path, b)
+	}
+	a.load_text(path, b)
+	return nil
+}
+
+func (a *LogAnalyzer) load_json(path string, b []byte) error {
+	var last time.Time
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+		var e LogEvent
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		switch {
+		case e.Event == "received" || e.Event == "datagram":
+			a.packet(e.Direction, e.Length, hex_dump_bytes(e.HexPayload))
+			if !last.IsZero() {
+				a.gap(e.Timestamp.Sub(last))
+			}
+			last = e.Timestamp
+		case e.HTTP != nil && e.Event == "http_request":
+			a.urls[e.HTTP.URL] += 1
+		case e.HTTP != nil && e.Event == "http_response":
+			a.statuses[e.HTTP.StatusCode] += 1
+		}
+	}
+}
+
+func (a *LogAnalyzer) load_text(path string, b []byte) {
+	var packets []*text_packet
+	var current *text_packet // while its hex dump lines follow
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if current != nil {
+			if d, ok := hex_dump_line(line); ok {
+				current.payload = append(current.payload, d...)
+				continue
+			}
+			current = nil
+		}
+		if peer, n, ok := text_packet_header(line); ok {
+			current = &text_packet{peer: peer, length: n}
+			packets = append(packets, current)
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "HTTP request from "); ok {
+			if f := strings.Fields(after_colon(rest)); len(f) >= 2 {
+				a.urls[f[1]] += 1
+			}
+		} else if rest, ok := strings.CutPrefix(line, "HTTP response from "); ok {
+			if f := strings.Fields(after_colon(rest)); len(f) >= 2 {
+				if code, err := strconv.Atoi(f[1]); err == nil {
+					a.statuses[code] += 1
+				}
+			}
+		}
+	}
+	directions := text_directions(filepath.Base(path), packets)
+	for _, p := range packets {
+		a.packet(directions[p.peer], p.length, p.payload)
+	}
+}
+
+// The peer and length of a "Received" or "--- Datagram" line
+func text_packet_header(line string) (peer string, n int, ok bool) {
+	switch {
+	case strings.HasPrefix(line, "Received (#") && !strings.Contains(line, " from shadow "):
+	case strings.HasPrefix(line, "--- Datagram (#"):
+		line = strings.TrimSuffix(line, " ---")
+	default:
+		return "", 0, false
+	}
+	i := strings.Index(line, ")")
+	if i < 0 {
+		return "", 0, false
+	}
+	count, peer, found := strings.Cut(strings.TrimSpace(line[i+1:]), " bytes from ")
+	if !found {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(count)
+	return peer, n, err == nil
+}
+
+// Maps the peers of a text log to directions: the one in the log name is
+// the proxy's end towards the target, see the top
+func text_directions(log_name string, packets []*text_packet) map[string]string {
+	directions := make(map[string]string)
+	var named []string
+	for _, p := range packets {
+		if _, seen := directions[p.peer]; seen {
+			continue
+		}
+		directions[p.peer] = "from " + p.peer
+		if strings.Contains(log_name, "-"+p.peer+"-") || strings.Contains(log_name, "-"+p.peer+".") {
+			named = append(named, p.peer)
+		}
+	}
+	if len(named) != 1 {
+		return directions
+	}
+	for peer := range directions {
+		directions[peer] = client_to_server
+	}
+	directions[named[0]] = server_to_client
+	return directions
+}
+
+func after_colon(s string) string {
+	if _, rest, ok := strings.Cut(s, ": "); ok {
+		return rest
+	}
+	return ""
+}
+
+// The bytes of one hex.Dump line
+func hex_dump_line(line string) ([]byte, bool) {
+	if len(line) < 11 || line[8:10] != "  " {
+		return nil, false
+	}
+	if _, err := strconv.ParseUint(line[:8], 16, 32); err != nil {
+		return nil, false
+	}
+	digits := line[10:]
+	if i := strings.Index(digits, "  |"); i >= 0 {
+		digits = digits[:i]
+	}
+	b, err := hex.DecodeString(strings.ReplaceAll(digits, " ", ""))
+	return b, err == nil
+}
+
+func hex_dump_bytes(dump string) []byte {
+	var b []byte
+	for _, line := range strings.Split(dump, "\n") {
+		if d, ok := hex_dump_line(line); ok {
+			b = append(b, d...)
+		}
+	}
+	return b
+}
+
+func (a *LogAnalyzer) packet(direction string, n int, payload []byte) {
+	if direction == "" {
+		direction = "unknown"
+	}
+	t := a.directions[direction]
+	if t == nil {
+		t = &direction_totals{min_size: n}
+		a.directions[direction] = t
+	}
+	t.bytes += int64(n)
+	t.packets += 1
+	t.min_size = min(t.min_size, n)
+	t.max_size = max(t.max_size, n)
+	for _, c := range payload {
+		a.byte_count[c] += 1
+	}
+}
+
+func (a *LogAnalyzer) gap(d time.Duration) {
+	i := sort.Search(len(timing_buckets), func(i int) bool { return d < timing_buckets[i] })
+	a.timing[i] += 1
+}
+
+func timing_range(i int) string {
+	if i == len(timing_buckets) {
+		return ">=" + timing_buckets[i-1].String()
+	}
+	return "<" + timing_buckets[i].String()
+}
+
+// Most frequent first, ties in the order of the values
+func sorted_counts[K comparable](m map[K]int, name func(K) string) []ValueCount {
+	var counts []ValueCount
+	for k, n := range m {
+		counts = append(counts, ValueCount{name(k), n})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Value < counts[j].Value
+	})
+	return counts
+}
+
+func (a *LogAnalyzer) Report() AnalysisReport {
+	r := AnalysisReport{Files: a.files, Directions: []DirectionReport{}, ByteFrequency: []ByteCount{}}
+	for name, t := range a.directions {
+		r.Directions = append(r.Directions, DirectionReport{
+			Direction: name,
+			Bytes:     t.bytes,
+			Packets:   t.packets,
+			MinSize:   t.min_size,
+			AvgSize:   float64(t.bytes) / float64(t.packets),
+			MaxSize:   t.max_size,
+		})
+	}
+	sort.Slice(r.Directions, func(i, j int) bool { return r.Directions[i].Direction < r.Directions[j].Direction })
+	timed := 0
+	for _, n := range a.timing {
+		timed += n
+	}
+	if timed > 0 {
+		for i, n := range a.timing {
+			r.Timing = append(r.Timing, TimingBucket{timing_range(i), n})
+		}
+	}
+	for c, n := range a.byte_count {
+		if n > 0 {
+			r.ByteFrequency = append(r.ByteFrequency, ByteCount{byte(c), n})
+		}
+	}
+	sort.SliceStable(r.ByteFrequency, func(i, j int) bool { return r.ByteFrequency[i].Count > r.ByteFrequency[j].Count })
+	r.URLs = sorted_counts(a.urls, func(u string) string { return u })
+	r.StatusCodes = sorted_counts(a.statuses, strconv.Itoa)
+	return r
+}
+
+const table_top_bytes = 16
+
+func (r AnalysisReport) write_table(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "%d log file(s)\n\n", r.Files)
+	fmt.Fprintln(w, "DIRECTION\tBYTES\tPACKETS\tMIN\tAVG\tMAX")
+	for _, d := range r.Directions {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.1f\t%d\n", d.Direction, d.Bytes, d.Packets, d.MinSize, d.AvgSize, d.MaxSize)
+	}
+	if len(r.Timing) > 0 {
+		fmt.Fprintln(w, "\nBETWEEN PACKETS\tCOUNT")
+		for _, t := range r.Timing {
+			fmt.Fprintf(w, "%s\t%d\n", t.Range, t.Packets)
+		}
+	}
+	var total int64
+	for _, c := range r.ByteFrequency {
+		total += c.Count
+	}
+	if total > 0 {
+		fmt.Fprintln(w, "\nBYTE\tCOUNT\tSHARE")
+		for i, c := range r.ByteFrequency {
+			if i == table_top_bytes {
+				fmt.Fprintf(w, "(%d more)\t\t\n", len(r.ByteFrequency)-i)
+				break
+			}
+			fmt.Fprintf(w, "0x%02X %s\t%d\t%.1f%%\n", c.Byte, printable(string([]byte{c.Byte})), c.Count, 100*float64(c.Count)/float64(total))
+		}
+	}
+	for _, list := range []struct {
+		title  string
+		counts []ValueCount
+	}{{"URL", r.URLs}, {"STATUS", r.StatusCodes}} {
+		if len(list.counts) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s\tCOUNT\n", list.title)
+		for _, c := range list.counts {
+			fmt.Fprintf(w, "%s\t%d\n", c.Value, c.Count)
+		}
+	}
+	w.Flush()
+}
+
+// gotcpspy analyze ...; returns the exit code
+func analyze_command(args []string) int {
+	fs := flag.NewFlagSet("analyze", flag.ContinueOnError)
+	log_file := fs.String("log-file", "", "log to analyze, more may follow the flags")
+	format := fs.String("format", "table", "report as table or json")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: gotcpspy analyze [-format table|json] -log-file log ... [log ...]\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	paths := fs.Args()
+	if *log_file != "" {
+		paths = append([]string{*log_file}, paths...)
+	}
+	if len(paths) == 0 || (*format != "table" && *format != "json") {
+		fs.Usage()
+		return 2
+	}
+	a := NewLogAnalyzer()
+	for _, path := range paths {
+		if err := a.LoadFile(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to analyze %s, %v\n", path, err)
+			return 1
+		}
+	}
+	r := a.Report()
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		enc.Encode(r)
+	} else {
+		r.write_table(os.Stdout)
+	}
+	return 0
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A short HTTP session: two requests and a reply from the client's side,
+// which the server answers in one packet
+func analyze_test_events() []*LogEvent {
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	var events []*LogEvent
+	offset := map[string]int{}
+	for i, p := range []struct {
+		direction, peer, payload string
+		after                    time.Duration
+	}{
+		{client_to_server, "127.0.0.1-50000", "aaaa", 0},
+		{client_to_server, "127.0.0.1-50000", "ab", 5 * time.Millisecond},
+		{server_to_client, "10.0.0.1-80", "bbbbbbbb", 2 * time.Second},
+	} {
+		e := new_event(1, p.direction, "received", p.peer)
+		e.Timestamp = start.Add(p.after)
+		e.PacketSeq, e.ByteOffset, e.Length = i, offset[p.peer], len(p.payload)
+		e.HexPayload = hex.Dump([]byte(p.payload))
+		offset[p.peer] += len(p.payload)
+		sent := new_event(1, p.direction, "sent", "elsewhere")
+		sent.PacketSeq = i
+		events = append(events, e, sent)
+	}
+	for _, url := range []string{"/a", "/b", "/a"} {
+		e := new_event(1, client_to_server, "http_request", "127.0.0.1-50000")
+		e.HTTP = &HTTPRecord{Method: "GET", URL: url, Proto: "HTTP/1.1"}
+		events = append(events, e)
+	}
+	for _, status := range []struct {
+		code int
+		text string
+	}{{200, "200 OK"}, {404, "404 Not Found"}, {200, "200 OK"}} {
+		e := new_event(1, server_to_client, "http_response", "10.0.0.1-80")
+		e.HTTP = &HTTPRecord{Proto: "HTTP/1.1", Status: status.text, StatusCode: status.code}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestLogAnalyzer(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "log-2026.01.02-03.04.05-0001-127.0.0.1-8080-10.0.0.1-80.log")
+	var text, json bytes.Buffer
+	for _, e := range analyze_test_events() {
+		(&TextLogger{&text}).Log(e)
+		NewSlogLogger(&json, "json").Log(e)
+	}
+	os.WriteFile(name, text.Bytes(), 0644)
+	os.WriteFile(name+".json", json.Bytes(), 0644)
+
+	directions := []DirectionReport{ // sorted by name
+		{Direction: client_to_server, Bytes: 6, Packets: 2, MinSize: 2, AvgSize: 3, MaxSize: 4},
+		{Direction: server_to_client, Bytes: 8, Packets: 1, MinSize: 8, AvgSize: 8, MaxSize: 8},
+	}
+	frequency := []ByteCount{{'b', 9}, {'a', 5}}
+	urls := []ValueCount{{"/a", 2}, {"/b", 1}}
+	statuses := []ValueCount{{"200", 2}, {"404", 1}}
+	for _, tt := range []struct {
+		log    string
+		timing []TimingBucket
+	}{
+		{name, nil}, // no timestamps in text logs
+		{name + ".json", []TimingBucket{{"<1ms", 0}, {"<10ms", 1}, {"<100ms", 0}, {"<1s", 0}, {"<10s", 1}, {">=10s", 0}}},
+	} {
+		a := NewLogAnalyzer()
+		if err := a.LoadFile(tt.log); err != nil {
+			t.Fatal(err)
+		}
+		r := a.Report()
+		want := AnalysisReport{Files: 1, Directions: directions, Timing: tt.timing, ByteFrequency: frequency, URLs: urls, StatusCodes: statuses}
+		if !reflect.DeepEqual(r, want) {
+			t.Errorf("%s reported\n%+v\nwant\n%+v", filepath.Base(tt.log), r, want)
+		}
+	}
+
+	// both together, and a compressed one
+	compressed := filepath.Join(dir, "log-2026.01.02-03.04.05-0002-127.0.0.1-8080-10.0.0.1-80.log.gz")
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(text.Bytes())
+	w.Close()
+	os.WriteFile(compressed, gz.Bytes(), 0644)
+	a := NewLogAnalyzer()
+	for _, log := range []string{name, compressed} {
+		if err := a.LoadFile(log); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r := a.Report(); r.Files != 2 || len(r.Directions) != 2 || r.Directions[0].Packets+r.Directions[1].Packets != 6 || r.URLs[0].Count != 4 {
+		t.Errorf("two logs reported as %+v", r)
+	}
+	if err := NewLogAnalyzer().LoadFile(filepath.Join(dir, "missing.log")); err == nil {
+		t.Error("a missing log loaded")
+	}
+}
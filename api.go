@@ -0,0 +1,195 @@
+/*
+HTTP/JSON API (-api-addr).
+
+	GET /connections                                  finished connections, oldest first
+	GET /connections/{id}/events?offset=0&limit=100   recorded events of a connection
+	GET /connections/{id}/download/binary?direction=client|server
+	GET /events/stream                                live events of all connections (SSE)
+
+The last -history-size finished connections are kept with their events,
+as far as they fit (registry.go); /connections/{id}/events reports how
+many were dropped.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+)
+
+var (
+	api_addr     *string = flag.String("api-addr", "", "serve the HTTP/JSON API on this address, e.g. :8001")
+	history_size *int    = flag.Int("history-size", 1000, "finished connections kept for the API")
+)
+
+const (
+	api_default_limit = 100
+	api_max_limit     = 1000
+)
+
+// Live events for /events/stream
+var live_events = NewBroadcaster()
+
+func api_enabled() bool {
+	return *api_addr != ""
+}
+
+func start_api() {
+	if !api_enabled() {
+		return
+	}
+	connections.SetHistorySize(*history_size)
+	ln, err := net.Listen("tcp", *api_addr)
+	if err != nil {
+		die("Unable to start API, %v", err)
+	}
+	fmt.Printf("API on http://%s/\n", ln.Addr())
+	go http.Serve(ln, api_handler())
+}
+
+func api_handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /connections", api_connections)
+	mux.HandleFunc("GET /connections/{id}/events", api_events)
+	mux.HandleFunc("GET /connections/{id}/download/binary", api_download)
+	mux.HandleFunc("GET /events/stream", api_stream)
+	return mux
+}
+
+// Copies the events of a connection to its logger, recording them on the way
+func tap_events(in, out chan *LogEvent, stats *ConnectionInfo) {
+	for e := range in {
+		if e != nil {
+			stats.record(e)
+			if live_events.Subscribers() > 0 {
+				if msg, err := json.Marshal(e); err == nil {
+					live_events.Publish(msg)
+				}
+			}
+		}
+		out <- e
+		if e == nil {
+			return
+		}
+	}
+}
+
+func write_json(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+func write_error(w http.ResponseWriter, status int, format string, v ...interface{}) {
+	write_json(w, status, map[string]string{"error": fmt.Sprintf(format, v...)})
+}
+
+func lookup_connection(w http.ResponseWriter, r *http.Request) *ConnectionInfo {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		write_error(w, http.StatusBadRequest, "invalid connection id %q", r.PathValue("id"))
+		return nil
+	}
+	c := connections.Lookup(id)
+	if c == nil {
+		write_error(w, http.StatusNotFound, "no connection %d", id)
+	}
+	return c
+}
+
+// Reads a non negative query parameter
+func query_int(r *http.Request, name string, def int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, s)
+	}
+	return n, nil
+}
+
+func api_connections(w http.ResponseWriter, r *http.Request) {
+	list := connections.History()
+	if list == nil {
+		list = []ConnectionInfo{}
+	}
+	write_json(w, http.StatusOK, list)
+}
+
+func api_events(w http.ResponseWriter, r *http.Request) {
+	c := lookup_connection(w, r)
+	if c == nil {
+		return
+	}
+	offset, err := query_int(r, "offset", 0)
+	if err != nil {
+		write_error(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	limit, err := query_int(r, "limit", api_default_limit)
+	if err != nil || limit == 0 || limit > api_max_limit {
+		write_error(w, http.StatusBadRequest, "limit must be 1 to %d", api_max_limit)
+		return
+	}
+	events, total := c.Events(offset, limit)
+	write_json(w, http.StatusOK, struct {
+		Total   int         `json:"total"`
+		Dropped int         `json:"dropped"`
+		Offset  int         `json:"offset"`
+		Events  []*LogEvent `json:"events"`
+	}{total, c.Dropped(), offset, events})
+}
+
+func api_download(w http.ResponseWriter, r *http.Request) {
+	c := lookup_connection(w, r)
+	if c == nil {
+		return
+	}
+	side := r.URL.Query().Get("direction")
+	if side != "client" && side != "server" {
+		write_error(w, http.StatusBadRequest, "direction must be client or server")
+		return
+	}
+	name := c.BinaryLog(side)
+	if name == "" {
+		write_error(w, http.StatusNotFound, "connection %d has no binary log", c.ID)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(name)))
+	http.ServeFile(w, r, name)
+}
+
+// Server-sent events, one JSON LogEvent per message
+func api_stream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		write_error(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	events := live_events.Subscribe()
+	defer live_events.Unsubscribe(events)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case msg := <-events:
+			fmt.Fprintf(w, "data: %s\n\n", msg)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
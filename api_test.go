@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An API server over a registry of its own with one finished connection
+// of five events and a client binary log
+func start_test_api(t *testing.T) (*httptest.Server, *ConnectionInfo) {
+	saved := connections
+	connections = NewConnectionRegistry()
+	t.Cleanup(func() { connections = saved })
+	connections.SetHistorySize(10)
+	c := connections.Add(1, "8080", test_addr, test_addr)
+	for i := 0; i < 5; i++ {
+		e := new_event(1, client_to_server, "received", "127.0.0.1-50000")
+		e.PacketSeq = i
+		c.record(e)
+	}
+	name := filepath.Join(t.TempDir(), "log-binary-0001.log")
+	os.WriteFile(name, []byte("hello"), 0644)
+	c.set_binary_log("client", name)
+	connections.Remove(c)
+	s := httptest.NewServer(api_handler())
+	t.Cleanup(s.Close)
+	return s, c
+}
+
+func TestAPIEndpoints(t *testing.T) {
+	s, c := start_test_api(t)
+	tests := []struct {
+		path         string
+		status       int
+		content_type string
+		body         string // contained in the response
+	}{
+		{"/connections", 200, "application/json", fmt.Sprintf(`"id":%d`, c.ID)},
+		{fmt.Sprintf("/connections/%d/events", c.ID), 200, "application/json", `"total":5,"dropped":0,"offset":0`},
+		{fmt.Sprintf("/connections/%d/events?offset=3&limit=1", c.ID), 200, "application/json", `"packet_seq":3`},
+		{fmt.Sprintf("/connections/%d/events?limit=0", c.ID), 400, "application/json", `"error"`},
+		{fmt.Sprintf("/connections/%d/events?offset=-1", c.ID), 400, "application/json", `"error"`},
+		{"/connections/x/events", 400, "application/json", "invalid connection id"},
+		{"/connections/99/events", 404, "application/json", "no connection 99"},
+		{fmt.Sprintf("/connections/%d/download/binary?direction=client", c.ID), 200, "application/octet-stream", "hello"},
+		{fmt.Sprintf("/connections/%d/download/binary?direction=server", c.ID), 404, "application/json", "has no binary log"},
+		{fmt.Sprintf("/connections/%d/download/binary", c.ID), 400, "application/json", "direction must be"},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(s.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || resp.Header.Get("Content-Type") != tt.content_type {
+			t.Errorf("GET %s: %d %s, want %d %s", tt.path, resp.StatusCode, resp.Header.Get("Content-Type"), tt.status, tt.content_type)
+		}
+		if !strings.Contains(string(body), tt.body) {
+			t.Errorf("GET %s: %s, want %s in it", tt.path, body, tt.body)
+		}
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/connections/%d/events?offset=1&limit=2", s.URL, c.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var page struct {
+		Total  int
+		Offset int
+		Events []LogEvent
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 5 || page.Offset != 1 || len(page.Events) != 2 || page.Events[0].PacketSeq != 1 {
+		t.Errorf("page %+v, want events 1 and 2 of 5", page)
+	}
+}
+
+func TestAPIEventStream(t *testing.T) {
+	s, c := start_test_api(t)
+	resp, err := http.Get(s.URL + "/events/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type %s", ct)
+	}
+	for live_events.Subscribers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	in, out := make(chan *LogEvent), make(chan *LogEvent, 2)
+	go tap_events(in, out, c)
+	in <- log_message(1, "connected", "Connected to example.com:80")
+	in <- nil
+
+	lines := make(chan string)
+	go func() {
+		r := bufio.NewReader(resp.Body)
+		line, _ := r.ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		if !strings.HasPrefix(line, "data: {") || !strings.Contains(line, `"event":"connected"`) {
+			t.Errorf("stream sent %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event on the stream")
+	}
+}
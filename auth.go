@@ -0,0 +1,86 @@
+/*
+Client authentication (-auth-token).
+
+With -auth-token set, a client has to open its connection with
+
+	GOTCPSPY-AUTH: <token>\r\n
+
+before anything is proxied, even before a SOCKS5 or HTTP CONNECT
+handshake. The proxy answers OK\r\n and carries on with whatever follows
+the line, or answers DENIED\r\n and hangs up. The token is compared in
+constant time. Failures go to stderr with the client's address and are
+counted in gotcpspy_auth_failures_total.
+
+The line is sent in the clear, before any TLS of -tls. UDP has no
+connections to authenticate, -auth-token is for TCP and Unix listeners.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var auth_token *string = flag.String("auth-token", "", "clients must send \"GOTCPSPY-AUTH: <token>\" as their first line")
+
+const (
+	auth_prefix = "GOTCPSPY-AUTH: "
+	auth_max    = 512 // the whole line
+	auth_wait   = 10 * time.Second
+)
+
+// Reads the auth line from conn and answers it. reader gives back what
+// the client sent after the line; read it instead of conn from now on.
+// err is only for a line that couldn't be read or answered.
+func AuthMiddleware(conn net.Conn, token string) (authenticated bool, reader io.Reader, err error) {
+	br := bufio.NewReaderSize(conn, auth_max)
+	conn.SetReadDeadline(time.Now().Add(auth_wait))
+	line, err := br.ReadSlice('\n')
+	conn.SetReadDeadline(time.Time{})
+	if err == bufio.ErrBufferFull {
+		err = fmt.Errorf("no auth line in the first %d bytes", auth_max)
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	got, ok := strings.CutPrefix(strings.TrimRight(string(line), "\r\n"), auth_prefix)
+	authenticated = ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+	answer := "DENIED\r\n"
+	if authenticated {
+		answer = "OK\r\n"
+	}
+	if _, err := conn.Write([]byte(answer)); err != nil {
+		return false, nil, err
+	}
+	rest, _ := br.Peek(br.Buffered())
+	return authenticated, io.MultiReader(bytes.NewReader(bytes.Clone(rest)), conn), nil
+}
+
+// Checks the client's token, if -auth-token; the returned connection
+// replaces conn. A client that fails is closed and nil returned.
+func authenticate(conn net.Conn) net.Conn {
+	if *auth_token == "" {
+		return conn
+	}
+	ok, r, err := AuthMiddleware(conn, *auth_token)
+	if ok {
+		return &preamble_conn{conn, r}
+	}
+	metrics.error(&metrics.auth_failures)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Authentication failed for %s, %v\n", conn.RemoteAddr(), err)
+	} else {
+		fmt.Fprintf(os.Stderr, "Authentication failed for %s, wrong token\n", conn.RemoteAddr())
+	}
+	conn.Close()
+	return nil
+}
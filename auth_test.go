@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	for _, tt := range []struct {
+		name, sent    string
+		authenticated bool
+		answer, rest  string
+	}{
+		{"right token", "GOTCPSPY-AUTH: s3cret\r\nGET / HTTP/1.0\r\n", true, "OK\r\n", "GET / HTTP/1.0\r\n"},
+		{"right token, only LF", "GOTCPSPY-AUTH: s3cret\nhello", true, "OK\r\n", "hello"},
+		{"wrong token", "GOTCPSPY-AUTH: guess\r\nhello", false, "DENIED\r\n", ""},
+		{"token with a prefix in common", "GOTCPSPY-AUTH: s3cretive\r\n", false, "DENIED\r\n", ""},
+		{"no token", "GOTCPSPY-AUTH: \r\n", false, "DENIED\r\n", ""},
+		{"no auth line", "GET / HTTP/1.0\r\n", false, "DENIED\r\n", ""},
+	} {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(tt.sent))
+		}()
+		answered := make(chan string, 1)
+		go func() {
+			b := make([]byte, 16)
+			n, _ := client.Read(b)
+			answered <- string(b[:n])
+		}()
+		ok, r, err := AuthMiddleware(server, "s3cret")
+		if err != nil || ok != tt.authenticated {
+			t.Errorf("%s: authenticated %v, %v, want %v", tt.name, ok, err, tt.authenticated)
+		}
+		if answer := <-answered; answer != tt.answer {
+			t.Errorf("%s: answered %q, want %q", tt.name, answer, tt.answer)
+		}
+		client.Close()
+		if ok {
+			if rest, _ := io.ReadAll(r); string(rest) != tt.rest {
+				t.Errorf("%s: %q after the auth line, want %q", tt.name, rest, tt.rest)
+			}
+		}
+		server.Close()
+	}
+}
+
+// A line too long to be the auth line is an error, not a DENIED
+func TestAuthMiddlewareLongLine(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		client.Write([]byte(strings.Repeat("x", auth_max+1)))
+		client.Close()
+	}()
+	if ok, _, err := AuthMiddleware(server, "s3cret"); ok || err == nil || !strings.Contains(err.Error(), "no auth line") {
+		t.Errorf("authenticated %v, %v", ok, err)
+	}
+}
+
+// Through the proxy a client with the token is echoed, one without is
+// turned away and counted
+func TestProxyAuthToken(t *testing.T) {
+	saved_token, saved_dir := *auth_token, *output_dir
+	t.Cleanup(func() { *auth_token, *output_dir = saved_token, saved_dir })
+	*auth_token = "s3cret"
+	*output_dir = t.TempDir()
+	init_log_names()
+	buffer_pool = NewBufferPool(*buf_size)
+
+	echo := start_echo_server(t)
+	host, port, _ := net.SplitHostPort(echo.Addr().String())
+	m := &mapping{listen_port: free_port(t), host: host, port: port, log_prefix: filepath.Join(*output_dir, "log")}
+	p := NewProxy(m)
+	sessions := make(chan *Session, 1)
+	p.OnConnection(func(s *Session) { sessions <- s })
+	run_proxy(t, p)
+
+	failures := atomic.LoadInt64(&metrics.auth_failures)
+	conn := dial_proxy(t, m.listen_port)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GOTCPSPY-AUTH: guess\r\nhello"))
+	if b, _ := io.ReadAll(conn); string(b) != "DENIED\r\n" {
+		t.Errorf("the wrong token got %q", b)
+	}
+	conn.Close()
+	if n := atomic.LoadInt64(&metrics.auth_failures) - failures; n != 1 {
+		t.Errorf("%d failures counted", n)
+	}
+
+	conn = dial_proxy(t, m.listen_port)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GOTCPSPY-AUTH: s3cret\r\nhello"))
+	b := make([]byte, len("OK\r\nhello"))
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "OK\r\nhello" {
+		t.Errorf("the right token got %q, %v", b, err)
+	}
+	conn.Close()
+	<-sessions
+	active_connections.Wait()
+	if n := atomic.LoadInt64(&metrics.auth_failures) - failures; n != 1 {
+		t.Errorf("%d failures counted", n)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+Log backends.
+
+By default every connection gets its own log files. A backend stores the
+events of all connections somewhere else instead: the store is opened
+once at startup and hands out a LogBackend per connection, which the
+connection logger feeds in place of the files. Events then carry their
+raw payload, so the binary logs are not written either.
+
+The stores register themselves by name in backends, which -log-backend
+picks from; a new one needs a file with a BackendStore and an init that
+calls backends.Register. The log files themselves are FileBackends, one
+per connection, opened by the connection loggers rather than a store.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Receives the events of one connection, in order
+type LogBackend interface {
+	WriteEvent(e *LogEvent) error
+	Close() error
+}
+
+// Shared by all connections
+type BackendStore interface {
+	Open(conn_n int, local_info, remote_info string) (LogBackend, error)
+	Close() error
+}
+
+var (
+	log_store       BackendStore   // nil when logging to files
+	backend_loggers sync.WaitGroup // the store outlives them
+)
+
+var log_backend *string = flag.String("log-backend", "file", "where log events go: file, syslog, fifo or elasticsearch")
+
+// Opens a store with its settings from the command line
+type BackendConstructor func() (BackendStore, error)
+
+// The log backends by name
+type BackendRegistry struct {
+	mu           sync.Mutex
+	constructors map[string]BackendConstructor
+}
+
+var backends = NewBackendRegistry()
+
+func NewBackendRegistry() *BackendRegistry {
+	return &BackendRegistry{constructors: make(map[string]BackendConstructor)}
+}
+
+// Adds a backend, from an init function; a name can only be taken once
+func (r *BackendRegistry) Register(name string, open BackendConstructor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.constructors[name]; ok {
+		panic("log backend " + name + " registered twice")
+	}
+	r.constructors[name] = open
+}
+
+// Opens the store of the backend called name
+func (r *BackendRegistry) Open(name string) (BackendStore, error) {
+	r.mu.Lock()
+	open, ok := r.constructors[name]
+	r.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown log backend %q, use one of %s", name, strings.Join(r.Names(), ", "))
+	}
+	return open()
+}
+
+func (r *BackendRegistry) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.constructors))
+	for name := range r.constructors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	// no store, the connection loggers write FileBackends
+	backends.Register("file", func() (BackendStore, error) { return nil, nil })
+}
+
+// Opens the store selected on the command line, if any
+func open_log_store() {
+	backend := *log_backend
+	if *output_fifo != "" { // and -output-fifo for -log-backend fifo
+		if backend != "file" && backend != "fifo" {
+			die("-output-fifo conflicts with -log-backend %s", backend)
+		}
+		backend = "fifo"
+	}
+	store, err := backends.Open(backend)
+	if err != nil {
+		die("Unable to open log backend, %v", err)
+	}
+	log_store = store
+}
+
+func close_log_store() {
+	if log_store != nil {
+		backend_loggers.Wait()
+		if err := log_store.Close(); err != nil {
+			fmt.Printf("Closing log backend failed, %v\n", err)
+		}
+	}
+}
+
+// Counterpart of connection_logger that feeds a backend until the nil event
+func backend_logger(events chan *LogEvent, conn_n int, local_info, remote_info string, opened chan error) {
+	defer backend_loggers.Done()
+	backend, err := log_store.Open(conn_n, local_info, remote_info)
+	if err != nil {
+		opened <- fmt.Errorf("unable to open log backend: %w", err)
+		discard_events(events)
+		return
+	}
+	opened <- nil
+	defer backend.Close()
+	for e := range events {
+		if e == nil {
+			return
+		}
+		if err := backend.WriteEvent(e); err != nil {
+			fmt.Printf("Log backend failed, %v\n", err)
+		}
+	}
+}
+
+// The events of one connection in its log file, in the -format of the
+// Logger
+type FileBackend struct {
+	f      *RotatingFile
+	logger Logger
+}
+
+func OpenFileBackend(log_name string) (*FileBackend, error) {
+	f, err := CreateRotatingFile(log_name, *max_log_size)
+	if err != nil {
+		return nil, err
+	}
+	return &FileBackend{f, tee_logger(new_logger(f))}, nil
+}
+
+func (b *FileBackend) WriteEvent(e *LogEvent) error {
+	err := b.logger.Log(e)
+	b.f.Sync()
+	return err
+}
+
+func (b *FileBackend) Sync() error {
+	return b.f.Sync()
+}
+
+func (b *FileBackend) Rotate() error {
+	return b.f.Rotate()
+}
+
+func (b *FileBackend) Close() error {
+	return b.f.Close()
+}
+
+// Keeps the events of all connections in memory, for programs that embed
+// the proxy and look at what went through. It keeps everything, so it is
+// not one of the -log-backend choices; set log_store to one instead.
+type MemoryBackend struct {
+	mu     sync.Mutex
+	events []*LogEvent
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{}
+}
+
+func (m *MemoryBackend) Open(conn_n int, local_info, remote_info string) (LogBackend, error) {
+	return m, nil
+}
+
+func (m *MemoryBackend) WriteEvent(e *LogEvent) error {
+	m.mu.Lock()
+	m.events = append(m.events, e)
+	m.mu.Unlock()
+	return nil
+}
+
+// The events so far, of all connections in the order they came
+func (m *MemoryBackend) Events() []*LogEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*LogEvent(nil), m.events...)
+}
+
+// Closing a connection's backend keeps its events
+func (m *MemoryBackend) Close() error {
+	return nil
+}
+
+// Stands in for binary_logger, the payloads travel with the events
+func discard_logger(data chan []byte) {
+	for b := range data {
+		if len(b) == 0 {
+			return
+		}
+	}
+}
+
+// The raw payload of an event, only kept when a backend wants it
+func raw_payload(b []byte) []byte {
+	if log_store == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
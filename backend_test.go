@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// A session through the proxy with a MemoryBackend as the log store: the
+// events arrive in order, with the payloads they carried
+func TestMemoryBackendProxy(t *testing.T) {
+	init_log_names()
+	buffer_pool = NewBufferPool(*buf_size)
+	saved_dir, saved_store := *output_dir, log_store
+	t.Cleanup(func() { *output_dir, log_store = saved_dir, saved_store })
+	*output_dir = t.TempDir()
+	store := NewMemoryBackend()
+	log_store = store
+
+	echo := start_echo_server(t)
+	host, port, _ := net.SplitHostPort(echo.Addr().String())
+	logs := t.TempDir()
+	m := &mapping{listen_port: free_port(t), host: host, port: port, log_prefix: filepath.Join(logs, "log")}
+	p := NewProxy(m)
+	sessions := make(chan *Session, 1)
+	p.OnConnection(func(s *Session) { sessions <- s })
+	run_proxy(t, p)
+
+	conn := dial_proxy(t, m.listen_port)
+	for _, msg := range []string{"ping", "pong!"} {
+		conn.Write([]byte(msg))
+		reply := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != msg {
+			t.Fatalf("reply %q, %v", reply, err)
+		}
+	}
+	conn.Close()
+	<-sessions // after the connection was counted
+	active_connections.Wait()
+	backend_loggers.Wait()
+
+	var kinds []string
+	var from_client, from_server string
+	for _, e := range store.Events() {
+		if e.ConnID != 1 {
+			t.Errorf("%s event of connection %d", e.Event, e.ConnID)
+		}
+		if len(kinds) == 0 || kinds[len(kinds)-1] != e.Event {
+			kinds = append(kinds, e.Event)
+		}
+		if e.Event == "received" {
+			if len(e.Raw) != e.Length {
+				t.Errorf("received %d bytes, %d of them kept", e.Length, len(e.Raw))
+			}
+			if e.Direction == client_to_server {
+				from_client += string(e.Raw)
+			} else {
+				from_server += string(e.Raw)
+			}
+		}
+	}
+	if len(kinds) == 0 || kinds[0] != "connected" || kinds[len(kinds)-1] != "finished" {
+		t.Errorf("events %v, want connected first and finished last", kinds)
+	}
+	if from_client != "pingpong!" || from_server != "pingpong!" {
+		t.Errorf("received %q from the client and %q from the server", from_client, from_server)
+	}
+	if names, _ := filepath.Glob(filepath.Join(logs, "*")); len(names) != 0 {
+		t.Errorf("log files %v written next to the backend", names)
+	}
+}
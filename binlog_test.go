@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBinaryLogRoundTrip(t *testing.T) {
+	start := time.Date(2026, 1, 2, 3, 4, 5, 6789, time.UTC)
+	records := []Record{
+		{start, []byte("GET / HTTP/1.1\r\n\r\n")},
+		{start.Add(time.Microsecond), nil}, // an empty chunk keeps its place
+		{start.Add(time.Second), random_bytes(100000)},
+		{start.Add(time.Hour), []byte{0}},
+	}
+	var buf bytes.Buffer
+	w := NewBinaryLogWriter(&buf)
+	for _, r := range records {
+		if err := w.WriteRecord(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := time.Now()
+	if n, err := w.Write([]byte("stamped now")); n != 11 || err != nil {
+		t.Fatalf("Write returned %d, %v", n, err)
+	}
+	size := 0
+	for _, r := range records {
+		size += binlog_header_size + len(r.Data)
+	}
+	if buf.Len() != size+binlog_header_size+11 {
+		t.Errorf("log of %d bytes, want %d", buf.Len(), size+binlog_header_size+11)
+	}
+
+	got, err := read_records(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(records)+1 {
+		t.Fatalf("read %d records, want %d", len(got), len(records)+1)
+	}
+	for i, r := range records {
+		if !got[i].Time.Equal(r.Time) || !bytes.Equal(got[i].Data, r.Data) {
+			t.Errorf("record %d read back as %s, %d bytes, want %s, %d bytes", i, got[i].Time, len(got[i].Data), r.Time, len(r.Data))
+		}
+	}
+	last := got[len(records)]
+	if string(last.Data) != "stamped now" || last.Time.Before(before) || last.Time.After(time.Now()) {
+		t.Errorf("the written record read back as %q at %s", last.Data, last.Time)
+	}
+}
+
+func TestBinaryLogReaderErrors(t *testing.T) {
+	var buf bytes.Buffer
+	NewBinaryLogWriter(&buf).WriteRecord(Record{time.Now(), []byte("hello")})
+	log := buf.Bytes()
+	huge := binary.LittleEndian.AppendUint32(make([]byte, 8), binlog_max_record+1)
+	tests := []struct {
+		name string
+		log  []byte
+		want error // nil for one that isn't an io error
+	}{
+		{"empty", nil, io.EOF},
+		{"cut in the header", log[:binlog_header_size-1], io.ErrUnexpectedEOF},
+		{"cut after the header", log[:binlog_header_size], io.ErrUnexpectedEOF},
+		{"cut in the payload", log[:len(log)-1], io.ErrUnexpectedEOF},
+		{"not a framed log", huge, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewBinaryLogReader(bytes.NewReader(tt.log)).Next()
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("Next returned %v, want %v", err, tt.want)
+			}
+			if tt.want == nil && (err == nil || !strings.Contains(err.Error(), "not a framed binary log")) {
+				t.Errorf("Next returned %v", err)
+			}
+		})
+	}
+	// read_records returns what came before a cut
+	cut := append(append([]byte(nil), log...), log[:len(log)-2]...)
+	if records, err := read_records(bytes.NewReader(cut)); len(records) != 1 || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("read_records of a cut log returned %d records, %v", len(records), err)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Pinned BPF maps through bpf(2), for ebpf.go. Linux only, elsewhere
+open_ebpf_map is left refusing -ebpf-map.
+
+The map is opened read-only with BPF_OBJ_GET, its key and value sizes
+come from BPF_OBJ_GET_INFO_BY_FD, and every lookup is one
+BPF_MAP_LOOKUP_ELEM.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	bpf_map_lookup_elem    = 1
+	bpf_obj_get            = 7
+	bpf_obj_get_info_by_fd = 15
+
+	bpf_f_rdonly = 1 << 3
+)
+
+// The syscall package has no SYS_BPF. 64-bit only: the pointers in
+// union bpf_attr are __u64, and are kept as unsafe.Pointer fields so that
+// what they point to is neither collected nor moved with the stack.
+var sys_bpf = map[string]uintptr{
+	"amd64":   321,
+	"arm64":   280,
+	"loong64": 280,
+	"ppc64":   361,
+	"ppc64le": 361,
+	"riscv64": 280,
+	"s390x":   351,
+}
+
+func init() {
+	if runtime.GOOS == "linux" {
+		open_ebpf_map = open_pinned_map
+	}
+}
+
+type pinned_map struct {
+	fd         int
+	key_size   int
+	value_size int
+}
+
+func bpf(cmd uintptr, attr unsafe.Pointer, size uintptr) (uintptr, error) {
+	nr, ok := sys_bpf[runtime.GOARCH]
+	if !ok {
+		return 0, fmt.Errorf("bpf(2) is not known on %s", runtime.GOARCH)
+	}
+	r, _, errno := syscall.Syscall(nr, cmd, uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return r, nil
+}
+
+func open_pinned_map(path string) (ebpf_map, error) {
+	name, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	get := struct {
+		pathname   unsafe.Pointer
+		bpf_fd     uint32
+		file_flags uint32
+	}{pathname: unsafe.Pointer(name), file_flags: bpf_f_rdonly}
+	fd, err := bpf(bpf_obj_get, unsafe.Pointer(&get), unsafe.Sizeof(get))
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(int(fd))
+
+	// The start of struct bpf_map_info
+	var info struct {
+		map_type    uint32
+		id          uint32
+		key_size    uint32
+		value_size  uint32
+		max_entries uint32
+		map_flags   uint32
+	}
+	get_info := struct {
+		bpf_fd   uint32
+		info_len uint32
+		info     unsafe.Pointer
+	}{bpf_fd: uint32(fd), info_len: uint32(unsafe.Sizeof(info)), info: unsafe.Pointer(&info)}
+	_, err = bpf(bpf_obj_get_info_by_fd, unsafe.Pointer(&get_info), unsafe.Sizeof(get_info))
+	if err != nil {
+		syscall.Close(int(fd))
+		return nil, fmt.Errorf("not a BPF map, %v", err)
+	}
+	return &pinned_map{fd: int(fd), key_size: int(info.key_size), value_size: int(info.value_size)}, nil
+}
+
+func (m *pinned_map) KeySize() int   { return m.key_size }
+func (m *pinned_map) ValueSize() int { return m.value_size }
+
+func (m *pinned_map) Lookup(key, value []byte) (bool, error) {
+	if len(key) != m.key_size || len(value) != m.value_size {
+		return false, errors.New("key or value of the wrong size")
+	}
+	attr := struct {
+		map_fd uint32
+		_      uint32
+		key    unsafe.Pointer
+		value  unsafe.Pointer
+		flags  uint64
+	}{map_fd: uint32(m.fd), key: unsafe.Pointer(&key[0]), value: unsafe.Pointer(&value[0])}
+	_, err := bpf(bpf_map_lookup_elem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err == syscall.ENOENT {
+		return false, nil
+	}
+	return err == nil, err
+}
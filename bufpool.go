@@ -0,0 +1,55 @@
+/*
+Read buffers for pass_through.
+
+Each direction of a connection takes a buffer of -buf-size when its copy
+starts and hands it back when the connection ends, so an open connection
+holds two, idle or not. The sync.Pool lets the next connections reuse
+them instead of allocating their own, which is what adds up with many
+short connections; -buf-size makes them smaller where there are many
+long ones.
+*/
+
+package main
+
+import (
+	"flag"
+	"sync"
+)
+
+var buf_size *int = flag.Int("buf-size", 32768, "size of the read buffers used to copy data")
+
+// Checks -buf-size and sets up buffer_pool
+func init_buffer_pool() {
+	if *buf_size <= 0 {
+		die("-buf-size must be positive")
+	}
+	buffer_pool = NewBufferPool(*buf_size)
+}
+
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func NewBufferPool(size int) *BufferPool {
+	p := &BufferPool{size: size}
+	p.pool.New = func() interface{} {
+		b := make([]byte, size)
+		return &b
+	}
+	return p
+}
+
+// Returns a buffer of the pool's slab size
+func (p *BufferPool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+// Hands a buffer back; buffers of another size are left to the GC
+func (p *BufferPool) Put(b []byte) {
+	if cap(b) != p.size {
+		return
+	}
+	b = b[:p.size]
+	p.pool.Put(&b)
+}
@@ -0,0 +1,546 @@
+/*
+Passive capture (-capture-file).
+
+Instead of proxying, gotcpspy can log the TCP connections in a pcap
+file. The two streams of each connection are put back together in
+sequence order, and every connection gets the logs a proxied one would:
+hex dumps or the -proto decoders, in files or a -log-backend. Nothing is
+forwarded.
+
+	-capture-file dump.pcap -proto http
+
+Files are read without any dependencies, classic pcap only (pcapng can
+be converted with editcap -F pcap). To look at part of a capture, filter
+it first with tcpdump -r all.pcap -w some.pcap "tcp port 80". Capturing
+on an interface would need libpcap or a raw socket for every system, so
+record the file with tcpdump instead.
+
+The connection's client is the side that sent the SYN. For connections
+already open when the capture started the lower port is taken for the
+server. Segments that arrive early wait for the missing ones, up to
+capture_max_pending of them; then the gap is logged and skipped.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+)
+
+var capture_file *string = flag.String("capture-file", "", "log the TCP connections in this pcap file instead of proxying")
+
+const (
+	capture_max_pending = 1024 // out of order segments per direction
+	capture_idle        = 5 * time.Minute
+	capture_sweep_every = 1000 // packets
+)
+
+// Where captured packets come from
+type CaptureSource interface {
+	ReadPacket() (data []byte, ts time.Time, err error) // io.EOF after the last
+	LinkType() int                                      // a LINKTYPE_ value
+	Close() error
+}
+
+// Link types that can be decoded
+const (
+	linktype_null      = 0
+	linktype_ethernet  = 1
+	linktype_linux_sll = 113
+	linktype_ipv4      = 228
+	linktype_ipv6      = 229
+)
+
+// A classic pcap file
+type pcap_file_source struct {
+	r         io.Reader
+	order     binary.ByteOrder
+	nanos     bool
+	link_type int
+}
+
+func open_pcap_file(r io.Reader) (*pcap_file_source, error) {
+	h := make([]byte, 24)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, fmt.Errorf("no pcap header, %v", err)
+	}
+	s := &pcap_file_source{r: r}
+	switch {
+	case binary.LittleEndian.Uint32(h) == pcap_magic:
+		s.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(h) == pcap_magic:
+		s.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(h) == pcap_magic_nanos:
+		s.order, s.nanos = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(h) == pcap_magic_nanos:
+		s.order, s.nanos = binary.BigEndian, true
+	default:
+		return nil, fmt.Errorf("not a pcap file (pcapng has to be converted first)")
+	}
+	s.link_type = int(s.order.Uint32(h[20:]) & 0xffff)
+	return s, nil
+}
+
+const pcap_magic_nanos = 0xa1b23c4d
+
+func (s *pcap_file_source) ReadPacket() ([]byte, time.Time, error) {
+	h := make([]byte, 16)
+	if _, err := io.ReadFull(s.r, h); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("truncated packet header")
+		}
+		return nil, time.Time{}, err
+	}
+	sec, frac := int64(s.order.Uint32(h)), int64(s.order.Uint32(h[4:]))
+	if !s.nanos {
+		frac *= 1000
+	}
+	n := s.order.Uint32(h[8:])
+	if n > 1<<20 {
+		return nil, time.Time{}, fmt.Errorf("packet of %d bytes, the file is damaged", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(s.r, data); err != nil {
+		return nil, time.Time{}, fmt.Errorf("truncated packet, %v", err)
+	}
+	return data, time.Unix(sec, frac), nil
+}
+
+func (s *pcap_file_source) LinkType() int { return s.link_type }
+
+func (s *pcap_file_source) Close() error {
+	if c, ok := s.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// What the reassembly needs of a TCP segment
+type tcp_segment struct {
+	src, dst netip.AddrPort
+	seq      uint32
+	flags    byte
+	payload  []byte
+}
+
+const (
+	tcp_flags_fin = 0x01
+	tcp_flags_syn = 0x02
+	tcp_flags_rst = 0x04
+)
+
+// Digs the TCP segment out of a captured frame; false for anything else
+func decode_tcp_segment(link_type int, frame []byte) (*tcp_segment, bool) {
+	var ip []byte
+	switch link_type {
+	case linktype_ethernet:
+		if len(frame) < 14 {
+			return nil, false
+		}
+		ether_type, rest := binary.BigEndian.Uint16(frame[12:]), frame[14:]
+		for (ether_type == 0x8100 || ether_type == 0x88a8) && len(rest) >= 4 { // VLAN tags
+			ether_type, rest = binary.BigEndian.Uint16(rest[2:]), rest[4:]
+		}
+		if ether_type != 0x0800 && ether_type != 0x86dd {
+			return nil, false
+		}
+		ip = rest
+	case linktype_linux_sll:
+		if len(frame) < 16 {
+			return nil, false
+		}
+		ip = frame[16:]
+	case linktype_null: // the address family, in the byte order of the capturing host
+		if len(frame) < 4 {
+			return nil, false
+		}
+		ip = frame[4:]
+	case linktype_raw, linktype_ipv4, linktype_ipv6:
+		ip = frame
+	default:
+		return nil, false
+	}
+	if len(ip) < 1 {
+		return nil, false
+	}
+
+	var src, dst netip.Addr
+	var tcp []byte
+	switch ip[0] >> 4 {
+	case 4:
+		if len(ip) < 20 {
+			return nil, false
+		}
+		ihl, total := int(ip[0]&0x0f)*4, int(binary.BigEndian.Uint16(ip[2:]))
+		if ip[9] != 6 || ihl < 20 || total < ihl || total > len(ip) {
+			return nil, false
+		}
+		if binary.BigEndian.Uint16(ip[6:])&0x3fff != 0 { // fragments aren't put back together
+			return nil, false
+		}
+		src, dst = netip.AddrFrom4([4]byte(ip[12:16])), netip.AddrFrom4([4]byte(ip[16:20]))
+		tcp = ip[ihl:total]
+	case 6:
+		if len(ip) < 40 {
+			return nil, false
+		}
+		length := int(binary.BigEndian.Uint16(ip[4:]))
+		if 40+length > len(ip) {
+			return nil, false
+		}
+		next, rest := ip[6], ip[40:40+length]
+		for next == 0 || next == 43 || next == 60 { // hop-by-hop, routing, destination options
+			if len(rest) < 8 || len(rest) < (int(rest[1])+1)*8 {
+				return nil, false
+			}
+			next, rest = rest[0], rest[(int(rest[1])+1)*8:]
+		}
+		if next != 6 {
+			return nil, false
+		}
+		src, dst = netip.AddrFrom16([16]byte(ip[8:24])), netip.AddrFrom16([16]byte(ip[24:40]))
+		tcp = rest
+	default:
+		return nil, false
+	}
+
+	if len(tcp) < tcp_header_size {
+		return nil, false
+	}
+	offset := int(tcp[12]>>4) * 4
+	if offset < tcp_header_size || offset > len(tcp) {
+		return nil, false
+	}
+	return &tcp_segment{
+		src:     netip.AddrPortFrom(src, binary.BigEndian.Uint16(tcp)),
+		dst:     netip.AddrPortFrom(dst, binary.BigEndian.Uint16(tcp[2:])),
+		seq:     binary.BigEndian.Uint32(tcp[4:]),
+		flags:   tcp[13],
+		payload: tcp[offset:],
+	}, true
+}
+
+// A connection, whichever way its packets go
+type capture_flow struct {
+	a, b netip.AddrPort
+}
+
+func flow_of(s *tcp_segment) capture_flow {
+	if s.src.Compare(s.dst) < 0 {
+		return capture_flow{s.src, s.dst}
+	}
+	return capture_flow{s.dst, s.src}
+}
+
+// One direction of a captured connection
+type capture_half struct {
+	direction string
+	peer      string
+	next      uint32 // sequence number of the next byte to log
+	synced    bool
+	fin       bool
+	pending   map[uint32][]byte // arrived before their turn
+	offset    int
+	packet_n  int
+	parser    *StreamParser
+	binary    chan []byte
+}
+
+type capture_conn struct {
+	conn_n         int
+	client, server netip.AddrPort
+	halves         [2]*capture_half // client to server, server to client
+	logger         chan *LogEvent
+	from_logger    chan []byte
+	to_logger      chan []byte
+	protocol       Protocol
+	log_name       string
+	decoding       bool // the parsers are set up
+	first, last    time.Time
+}
+
+// Reassembles the connections of one capture
+type Capturer struct {
+	ctx     context.Context
+	m       *mapping
+	conns   map[capture_flow]*capture_conn
+	conn_n  int
+	packets int
+}
+
+func NewCapturer(ctx context.Context, m *mapping) *Capturer {
+	return &Capturer{ctx: ctx, m: m, conns: make(map[capture_flow]*capture_conn)}
+}
+
+// Reads src until it ends or ctx is done, then closes what is left
+func (c *Capturer) Run(src CaptureSource) error {
+	type packet struct {
+		data []byte
+		ts   time.Time
+		err  error
+	}
+	packets := make(chan packet, 64)
+	go func() {
+		for {
+			data, ts, err := src.ReadPacket()
+			packets <- packet{data, ts, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	defer c.close_all()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return nil
+		case p := <-packets:
+			if p.err == io.EOF {
+				return nil
+			} else if p.err != nil {
+				return p.err
+			}
+			if s, ok := decode_tcp_segment(src.LinkType(), p.data); ok {
+				c.segment(s, p.ts)
+			}
+		}
+	}
+}
+
+func (c *Capturer) segment(s *tcp_segment, ts time.Time) {
+	if c.packets += 1; c.packets%capture_sweep_every == 0 {
+		c.sweep(ts)
+	}
+	flow := flow_of(s)
+	conn := c.conns[flow]
+	if conn == nil {
+		if s.flags&tcp_flags_rst != 0 {
+			return
+		}
+		var err error
+		if conn, err = c.open(s, ts); err != nil {
+			fmt.Fprintf(os.Stderr, "Captured connection %s to %s not logged, %v\n", s.src, s.dst, err)
+			return
+		}
+		c.conns[flow] = conn
+	}
+	conn.last = ts
+	half := conn.halves[0]
+	if s.src != conn.client {
+		half = conn.halves[1]
+	}
+	if s.flags&tcp_flags_syn != 0 {
+		half.next, half.synced = s.seq+1, true
+	} else if !half.synced {
+		half.next, half.synced = s.seq, true // joined a running connection
+	}
+	if len(s.payload) > 0 {
+		conn.add(half, s.seq, s.payload, ts)
+	}
+	switch {
+	case s.flags&tcp_flags_rst != 0:
+		c.close(flow, "reset by "+half.peer)
+	case s.flags&tcp_flags_fin != 0:
+		half.fin = true
+		if conn.halves[0].fin && conn.halves[1].fin {
+			c.close(flow, "closed by both sides")
+		}
+	}
+}
+
+// Starts the logs of a connection first seen in s
+func (c *Capturer) open(s *tcp_segment, ts time.Time) (*capture_conn, error) {
+	client, server := s.src, s.dst
+	switch {
+	case s.flags&tcp_flags_syn != 0:
+		// the SYN comes from the client, the SYN-ACK from the server
+		if s.flags&tcp_flags_ack != 0 {
+			client, server = s.dst, s.src
+		}
+	case s.dst.Port() > s.src.Port():
+		client, server = s.dst, s.src
+	}
+	c.conn_n += 1
+	conn := &capture_conn{conn_n: c.conn_n, client: client, server: server, protocol: Protocol(*proto), first: ts, last: ts}
+	local_info, remote_info := capture_peer(client), capture_peer(server)
+	var err error
+	conn.logger, conn.from_logger, conn.to_logger, _, err = start_loggers(c.ctx, c.m, conn.conn_n, local_info, remote_info, *log_tag, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn.logger = NewFormattingLogger(conn.logger).Events()
+	conn.log_name = log_file_name(c.m, conn.conn_n, local_info, remote_info, *log_tag, "")
+	conn.halves[0] = &capture_half{direction: client_to_server, peer: local_info, pending: make(map[uint32][]byte), binary: conn.from_logger}
+	conn.halves[1] = &capture_half{direction: server_to_client, peer: remote_info, pending: make(map[uint32][]byte), binary: conn.to_logger}
+	how := "from its start"
+	if s.flags&tcp_flags_syn == 0 {
+		how = "already open"
+	}
+	e := log_message(conn.conn_n, "connected", "Captured connection from %s to %s, %s, at %s", client, server, how, format_time(ts))
+	e.Timestamp = ts
+	conn.logger <- e
+	return conn, nil
+}
+
+func capture_peer(a netip.AddrPort) string {
+	return printable_addr(net.TCPAddrFromAddrPort(a))
+}
+
+// Logs payload once it is its turn; what came early waits in pending
+func (conn *capture_conn) add(half *capture_half, seq uint32, payload []byte, ts time.Time) {
+	if d := int32(half.next - seq); d > 0 { // retransmitted, in part or all
+		if int(d) >= len(payload) {
+			return
+		}
+		seq, payload = half.next, payload[d:]
+	}
+	if seq != half.next {
+		if _, ok := half.pending[seq]; !ok || len(half.pending[seq]) < len(payload) {
+			half.pending[seq] = append([]byte(nil), payload...)
+		}
+		if len(half.pending) > capture_max_pending {
+			conn.skip_gap(half, ts)
+		}
+		return
+	}
+	conn.deliver(half, payload, ts)
+	conn.drain(half, ts)
+}
+
+// Logs the pending segments that are now in order
+func (conn *capture_conn) drain(half *capture_half, ts time.Time) {
+	for len(half.pending) > 0 {
+		progress := false
+		for seq, b := range half.pending {
+			d := int32(half.next - seq)
+			if d < 0 {
+				continue
+			}
+			delete(half.pending, seq)
+			if int(d) < len(b) {
+				conn.deliver(half, b[d:], ts)
+			}
+			progress = true
+		}
+		if !progress {
+			return
+		}
+	}
+}
+
+// Gives up on the missing bytes before the earliest pending segment
+func (conn *capture_conn) skip_gap(half *capture_half, ts time.Time) {
+	first, found := uint32(0), false
+	for seq := range half.pending {
+		if !found || int32(seq-first) < 0 {
+			first, found = seq, true
+		}
+	}
+	if !found {
+		return
+	}
+	e := log_message(conn.conn_n, "capture_gap", "%d bytes from %s missing from the capture, skipped", first-half.next, half.peer)
+	e.Timestamp, e.Direction = ts, half.direction
+	conn.logger <- e
+	half.next = first
+	conn.drain(half, ts)
+}
+
+func (conn *capture_conn) deliver(half *capture_half, b []byte, ts time.Time) {
+	if !conn.decoding {
+		conn.start_decoding(half, b)
+	}
+	half.next += uint32(len(b))
+	if half.parser != nil {
+		half.parser.Feed(b)
+	} else {
+		e := new_event(conn.conn_n, half.direction, "received", half.peer)
+		e.Timestamp = ts
+		e.PacketSeq, e.ByteOffset, e.Length = half.packet_n, half.offset, len(b)
+		e.dump_later(b)
+		e.Raw = raw_payload(b)
+		conn.logger <- e
+	}
+	half.packet_n += 1
+	half.offset += len(b)
+	half.binary <- b
+}
+
+// Sets the parsers up on the first data, which -proto auto looks at
+func (conn *capture_conn) start_decoding(half *capture_half, first []byte) {
+	conn.decoding = true
+	if conn.protocol == "auto" {
+		conn.protocol = ProtoRaw
+		if half.direction == client_to_server {
+			conn.protocol = ProtocolDetector{}.Detect(first[:min(len(first), proto_preamble_size)])
+		}
+		conn.logger <- log_message(conn.conn_n, "protocol", "Protocol %s, detected from the first captured bytes", conn.protocol)
+	}
+	conn.halves[0].parser, conn.halves[1].parser = new_protocol_parsers(conn.protocol, conn.conn_n, conn.logger,
+		conn.halves[0].peer, conn.halves[1].peer, conn.log_name)
+}
+
+// Logs the rest of a connection and stops its loggers
+func (c *Capturer) close(flow capture_flow, why string) {
+	conn := c.conns[flow]
+	delete(c.conns, flow)
+	for _, half := range conn.halves {
+		for len(half.pending) > 0 {
+			conn.skip_gap(half, conn.last)
+		}
+		if half.parser != nil {
+			half.parser.Close()
+		}
+	}
+	e := log_message(conn.conn_n, "finished", "Finished, %s, at %s, duration %s", why,
+		format_time(conn.last), conn.last.Sub(conn.first).String())
+	e.Timestamp = conn.last
+	conn.logger <- e
+	stop_loggers(conn.logger, conn.from_logger, conn.to_logger)
+}
+
+// Closes the connections that have been quiet for capture_idle
+func (c *Capturer) sweep(now time.Time) {
+	for flow, conn := range c.conns {
+		if now.Sub(conn.last) > capture_idle {
+			c.close(flow, "idle")
+		}
+	}
+}
+
+func (c *Capturer) close_all() {
+	for flow := range c.conns {
+		c.close(flow, "still open when the capture ended")
+	}
+}
+
+// -capture-file: logs what is captured instead of proxying, until the
+// file ends or a signal
+func capture(m *mapping) {
+	f, err := os.Open(*capture_file)
+	if err != nil {
+		die("Unable to open the capture, %v", err)
+	}
+	src, err := open_pcap_file(f)
+	if err != nil {
+		f.Close()
+		die("Unable to read %s, %v", *capture_file, err)
+	}
+	fmt.Printf("Reading the TCP connections in %s\n", *capture_file)
+	defer src.Close()
+	c := NewCapturer(cancel_on_signal(), m)
+	if err := c.Run(src); err != nil && !errors.Is(err, os.ErrClosed) {
+		fmt.Fprintf(os.Stderr, "Capture ended, %v\n", err)
+	}
+	close_log_store()
+	fmt.Printf("%d connections captured\n", c.conn_n)
+}
@@ -0,0 +1,238 @@
+/*
+Deleting old log files (-max-log-age).
+
+	-max-log-age 7d -cleanup-interval 1h
+
+checks -output-dir every -cleanup-interval and deletes the log files
+last written more than -max-log-age ago. Ages are Go durations, or whole
+days with a d suffix. Only names gotcpspy gives its files are touched:
+those the -log-prefix and -log-name-template in use produce, with their
+rotated parts, compressed, .timing and .eml variants, the -pcap files
+and summary-<time>-<conn>.json. Anything else in the directory,
+-output-dir defaulting to the current one, is left alone, and
+subdirectories are only looked at as deep as the template goes.
+
+With -dry-run-cleanup the files are listed instead of deleted.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A duration that also takes whole days, as in 7d
+type log_age time.Duration
+
+func (a *log_age) String() string {
+	return time.Duration(*a).String()
+}
+
+func (a *log_age) Set(value string) error {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%q is not a number of days", value)
+		}
+		*a = log_age(time.Duration(n) * 24 * time.Hour)
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*a = log_age(d)
+	return nil
+}
+
+var (
+	max_log_age      log_age
+	cleanup_interval *time.Duration = flag.Duration("cleanup-interval", time.Hour, "how often -max-log-age looks for old log files")
+	dry_run_cleanup  *bool          = flag.Bool("dry-run-cleanup", false, "with -max-log-age, print the files that would be deleted instead of deleting them")
+)
+
+func init() {
+	flag.Var(&max_log_age, "max-log-age", "delete log files older than this, e.g. 7d or 12h (0 keeps them)")
+}
+
+// Deletes the log files under dir older than max_age
+type CleanupWorker struct {
+	dir      string
+	names    *log_file_names
+	max_age  time.Duration
+	interval time.Duration
+	dry_run  bool
+}
+
+func NewCleanupWorker(dir string, names *log_file_names, max_age, interval time.Duration, dry_run bool) *CleanupWorker {
+	if dir == "" {
+		dir = "."
+	}
+	return &CleanupWorker{dir: dir, names: names, max_age: max_age, interval: interval, dry_run: dry_run}
+}
+
+// Scans right away, then every interval until ctx is done
+func (w *CleanupWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		if _, err := w.ScanAndDelete(); err != nil {
+			fmt.Fprintf(os.Stderr, "Log cleanup in %s, %v\n", w.dir, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// One pass over dir. Returns how many files were deleted, or would be with
+// dry_run; a file that can't be deleted doesn't stop the others.
+func (w *CleanupWorker) ScanAndDelete() (int, error) {
+	cutoff := time.Now().Add(-w.max_age)
+	n, freed := 0, int64(0)
+	var first error
+	err := filepath.WalkDir(w.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(w.dir, path)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if rel != "." && strings.Count(rel, "/") >= w.names.depth {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !w.names.match(rel) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			return nil
+		}
+		if w.dry_run {
+			fmt.Printf("Log cleanup would delete %s, last written %s\n", path, format_time(info.ModTime()))
+		} else if err := os.Remove(path); err != nil {
+			if first == nil {
+				first = err
+			}
+			return nil
+		}
+		n += 1
+		freed += info.Size()
+		return nil
+	})
+	if err == nil {
+		err = first
+	}
+	if n > 0 {
+		verb := "deleted"
+		if w.dry_run {
+			verb = "would delete"
+		}
+		fmt.Printf("Log cleanup: %s %d files older than %s in %s, %s\n", verb, n, w.max_age, w.dir, tui_bytes(freed))
+	}
+	return n, err
+}
+
+// The names gotcpspy gives its files, as slash separated paths relative
+// to -output-dir
+type log_file_names struct {
+	patterns []*regexp.Regexp
+	depth    int // how many directories down they can be
+}
+
+func (n *log_file_names) match(rel string) bool {
+	for _, p := range n.patterns {
+		if p.MatchString(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stand-ins for the parts of a name that differ from one connection to
+// the next, and what they become in the patterns
+var log_name_samples = []struct{ sample, pattern string }{
+	{"\x00time\x00", `[0-9]{4}\.[0-9]{2}\.[0-9]{2}-[0-9]{2}\.[0-9]{2}\.[0-9]{2}`},
+	{"\x00conn\x00", `[0-9]{4,}`},
+	{"\x00addr\x00", `[^/]+`},
+	{"\x00tag\x00", `[^/]*`},
+}
+
+// Turns a name made of the samples into a pattern matching all those names
+func sample_pattern(name string) string {
+	p := regexp.QuoteMeta(name)
+	for _, s := range log_name_samples {
+		p = strings.ReplaceAll(p, s.sample, s.pattern)
+	}
+	return p
+}
+
+// What the mappings, -log-name-template and -tag can produce under dir
+func written_names(dir string, maps []*mapping) *log_file_names {
+	if dir == "" {
+		dir = "."
+	}
+	n := &log_file_names{}
+	add := func(sample, pattern string) {
+		if rel, err := filepath.Rel(dir, sample); err == nil {
+			rel = filepath.ToSlash(rel)
+			n.patterns = append(n.patterns, regexp.MustCompile("^"+sample_pattern(rel)+pattern+"$"))
+			n.depth = max(n.depth, strings.Count(rel, "/"))
+		}
+	}
+	tags := []string{*log_tag}
+	if *accept_tags {
+		tags = append(tags, "\x00tag\x00")
+	}
+	const any_time, any_conn, any_addr = "\x00time\x00", "\x00conn\x00", "\x00addr\x00"
+	suffixes := `(\.[0-9]+)?(\.gz)?(\.timing)?`
+	for _, m := range maps {
+		for _, tag := range tags {
+			v := log_name_vars{Prefix: filepath.Base(m.log_prefix), Time: any_time, ConnID: any_conn,
+				LocalAddr: any_addr, RemoteAddr: any_addr, ListenPort: m.listen_port, Tag: tag, Kind: "log"}
+			name := log_path(m, v)
+			add(name, suffixes)
+			add(strings.TrimSuffix(name, ".log"), `-[0-9]+\.eml`)
+			v.Kind, v.Peer = "binary", any_addr
+			add(log_path(m, v), suffixes)
+		}
+		add(fmt.Sprintf("%s-%s-%s-%s-%s.pcap", m.log_prefix, any_time, any_conn, any_addr, any_addr), "")
+		summary := "summary-"
+		if m.namespace != "" {
+			summary += m.namespace + "-"
+		}
+		add(filepath.Join(dir, summary+any_time+"-"+any_conn), `(-[^/]+)?\.json`)
+	}
+	return n
+}
+
+// Starts the -max-log-age worker
+func start_cleanup(maps []*mapping) {
+	if max_log_age <= 0 {
+		return
+	}
+	if *cleanup_interval <= 0 {
+		die("-cleanup-interval must be positive")
+	}
+	w := NewCleanupWorker(*output_dir, written_names(*output_dir, maps), time.Duration(max_log_age), *cleanup_interval, *dry_run_cleanup)
+	go w.Run(context.Background())
+}
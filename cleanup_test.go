@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleanupWorker(t *testing.T) {
+	const stamp = "2026.01.02-03.04.05"
+	tests := []struct {
+		name     string
+		template string
+		prefix   string
+		deleted  []string
+		kept     []string
+	}{
+		{"default names", default_log_name_template, "log",
+			[]string{
+				"log-" + stamp + "-0001-127.0.0.1-50000-example.com-80.log",
+				"log-" + stamp + "-0001-127.0.0.1-50000-example.com-80.log.1",
+				"log-" + stamp + "-0002-127.0.0.1-50001-example.com-80.log.gz",
+				"log-" + stamp + "-0002-127.0.0.1-50001-example.com-80.log.2.gz",
+				"log-binary-" + stamp + "-0001-127.0.0.1-50000.log",
+				"log-binary-" + stamp + "-0001-127.0.0.1-50000.log.timing",
+				"log-" + stamp + "-0001-127.0.0.1-50000-example.com-80-1.eml",
+				"log-" + stamp + "-0001-127.0.0.1-50000-example.com-80.pcap",
+				"summary-" + stamp + "-0001.json",
+				"summary-" + stamp + "-12345-canary.json",
+			},
+			[]string{
+				"nginx/access.log",
+				"capture.pcap",
+				"mail/x.eml",
+				"notes.json",
+				"summary.json",
+				"error.log",
+				"log-binary-yesterday.log",
+				"old/log-" + stamp + "-0001-127.0.0.1-50000-example.com-80.log",
+			}},
+		{"another prefix", default_log_name_template, "traffic",
+			[]string{"traffic-" + stamp + "-0001-127.0.0.1-50000-example.com-80.log"},
+			[]string{"log-" + stamp + "-0001-127.0.0.1-50000-example.com-80.log"}},
+		{"subdirectories of the template", `{{.ListenPort}}/{{.Kind}}/{{.ConnID}}{{.Peer}}.log`, "log",
+			[]string{"8080/log/0001.log", "8080/binary/0001127.0.0.1-50000.log"},
+			[]string{"8080/log/deeper/0001.log", "8081/log/0001.log", "8080/log/access.log", "8080/binary/x.log"}},
+	}
+	saved_template, saved_dir := *log_name_template, *output_dir
+	t.Cleanup(func() {
+		*log_name_template, *output_dir = saved_template, saved_dir
+		init_log_names()
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			*log_name_template, *output_dir = tt.template, dir
+			init_log_names()
+			old := time.Now().Add(-48 * time.Hour)
+			for _, name := range append(append([]string{}, tt.deleted...), tt.kept...) {
+				path := filepath.Join(dir, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(path, old, old); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// a log of the right name that is still recent
+			recent := filepath.Join(dir, filepath.FromSlash(tt.deleted[0]))
+			recent = recent[:len(recent)-len(filepath.Ext(recent))] + ".log.9"
+			os.WriteFile(recent, []byte("x"), 0644)
+
+			m := &mapping{listen_port: "8080", log_prefix: filepath.Join(dir, tt.prefix)}
+			w := NewCleanupWorker(dir, written_names(dir, []*mapping{m}), 24*time.Hour, time.Hour, false)
+			n, err := w.ScanAndDelete()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(tt.deleted) {
+				t.Errorf("deleted %d files, want %d", n, len(tt.deleted))
+			}
+			for _, name := range tt.deleted {
+				if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err == nil {
+					t.Errorf("%s is still there", name)
+				}
+			}
+			for _, name := range append(tt.kept, recent[len(dir)+1:]) {
+				if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+					t.Errorf("%s was deleted", name)
+				}
+			}
+		})
+	}
+}
+
+func TestCleanupDryRun(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "summary-2026.01.02-03.04.05-0001.json")
+	os.WriteFile(name, []byte("{}"), 0644)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(name, old, old)
+	m := &mapping{listen_port: "8080", log_prefix: filepath.Join(dir, "log")}
+	w := NewCleanupWorker(dir, written_names(dir, []*mapping{m}), time.Minute, time.Hour, true)
+	if n, err := w.ScanAndDelete(); n != 1 || err != nil {
+		t.Errorf("ScanAndDelete() = %d, %v, want 1 file", n, err)
+	}
+	if _, err := os.Stat(name); err != nil {
+		t.Errorf("the dry run deleted %s", name)
+	}
+}
+
+func TestLogAge(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		err   bool
+	}{
+		{"7d", 7 * 24 * time.Hour, false},
+		{"0d", 0, false},
+		{"12h", 12 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"-1d", 0, true},
+		{"xd", 0, true},
+		{"week", 0, true},
+	}
+	for _, tt := range tests {
+		var a log_age
+		err := a.Set(tt.value)
+		if (err != nil) != tt.err || (err == nil && time.Duration(a) != tt.want) {
+			t.Errorf("Set(%q) = %v, %v, want %v, error %v", tt.value, time.Duration(a), err, tt.want, tt.err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Compressed log files (-compress).
+
+With -compress gzip the connection logs and binary logs are written
+through a compressor and get a .gz extension. The compressor is flushed
+after every write, so a file is readable up to the last event even if
+the proxy is killed. Rotated parts are numbered in front of the
+extension: log-....log.1.gz. gzip is the only format, zstd would need a
+package from outside the standard library.
+
+-decompress-log prints a log file decompressed, whatever made it.
+*/
+
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	compress       *string = flag.String("compress", "", "compress log files: gzip")
+	decompress_log *string = flag.String("decompress-log", "", "print this compressed log file to stdout and exit")
+)
+
+// A compressing writer that can be flushed without ending the stream
+type log_compression interface {
+	io.WriteCloser
+	Flush() error
+}
+
+type log_compressor struct {
+	ext        string
+	new_writer func(w io.Writer) (log_compression, error)
+	new_reader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	gzip_compressor = &log_compressor{
+		ext:        ".gz",
+		new_writer: func(w io.Writer) (log_compression, error) { return gzip.NewWriter(w), nil },
+		new_reader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	}
+
+	log_compressors = map[string]*log_compressor{"gzip": gzip_compressor}
+)
+
+// The compressor selected with -compress, nil for none
+func selected_compressor() *log_compressor {
+	return log_compressors[*compress]
+}
+
+// Checks -compress
+func init_compression() {
+	if *compress == "" {
+		return
+	}
+	if selected_compressor() == nil {
+		die("Unknown -compress %q, use gzip", *compress)
+	}
+}
+
+// Adds the extension of the -compress format to a log file name
+func compressed_name(name string) string {
+	if c := selected_compressor(); c != nil {
+		return name + c.ext
+	}
+	return name
+}
+
+// The compressor a file name's extension asks for, nil if none
+func compressor_for(name string) *log_compressor {
+	for _, c := range log_compressors {
+		if strings.HasSuffix(name, c.ext) {
+			return c
+		}
+	}
+	return nil
+}
+
+// Reads a whole log file, decompressing it if its name says so
+func read_log(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c := compressor_for(path)
+	if c == nil {
+		return io.ReadAll(f)
+	}
+	r, err := c.new_reader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		// still being written, or the proxy died: everything up to
+		// the last flush is there
+		fmt.Fprintf(os.Stderr, "%s is truncated\n", path)
+		err = nil
+	}
+	return b, err
+}
+
+// -decompress-log; returns the exit code
+func decompress_to_stdout(path string) int {
+	b, err := read_log(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read %s, %v\n", path, err)
+		return 1
+	}
+	os.Stdout.Write(b)
+	return 0
+}
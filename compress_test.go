@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Logs written with -compress gzip read back as written, before the file
+// is closed (up to the last Sync) and across rotated parts
+func TestCompressedLogRoundTrip(t *testing.T) {
+	saved := *compress
+	t.Cleanup(func() { *compress = saved })
+	*compress = "gzip"
+	init_compression()
+
+	name := compressed_name(filepath.Join(t.TempDir(), "log-0001.log"))
+	if !strings.HasSuffix(name, ".log.gz") {
+		t.Fatalf("compressed name %s", name)
+	}
+	r, err := CreateRotatingFile(name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := strings.Repeat("Connected to example.com:80\n", 100)
+	r.Write([]byte(first))
+	r.Sync()
+	if b, err := read_log(name); err != nil || string(b) != first {
+		t.Errorf("read %d bytes of the open log, %v, want the %d synced", len(b), err, len(first))
+	}
+
+	r.Rotate()
+	second := "Closed 127.0.0.1-50000 after the other side disconnected\n"
+	r.Write([]byte(second))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	part := log_part_name(name, 1)
+	if !strings.HasSuffix(part, ".log.1.gz") {
+		t.Errorf("rotated part %s", part)
+	}
+	for path, want := range map[string]string{name: first, part: second} {
+		if b, err := read_log(path); err != nil || string(b) != want {
+			t.Errorf("%s read back as %q, %v, want %q", path, b, err, want)
+		}
+	}
+
+	// a file without a compressed extension is read as it is
+	plain := filepath.Join(t.TempDir(), "log-0002.log")
+	os.WriteFile(plain, []byte(second), 0644)
+	if b, err := read_log(plain); err != nil || string(b) != second {
+		t.Errorf("plain log read back as %q, %v", b, err)
+	}
+}
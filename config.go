@@ -0,0 +1,261 @@
+/*
+Configuration file support (-config).
+
+The file is a JSON object whose keys are the flag names, plus an optional
+"target" list with one entry per listen port:
+
+	{
+		"format": "json",
+		"drain-timeout": "10s",
+		"target": [
+			{"listen_port": "8080", "host": "example.com", "port": "80"},
+			{"listen_port": "8443", "host": "example.com", "port": "443"}
+		]
+	}
+
+Flags given on the command line win over the file, the file wins over the
+defaults. Durations are written as strings, as on the command line. TOML
+would need a third party parser, so only JSON is read.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+var config_file *string = flag.String("config", "", "JSON configuration file, command line flags override its values")
+
+// Set once the -config file is loaded
+var config *Config
+
+// One listen port and where its connections are forwarded
+type TargetConfig struct {
+	ListenPort string `json:"listen_port"`
+	Host       string `json:"host"`
+	Port       string `json:"port"`
+}
+
+// Mirrors the flags; the json names are the flag names
+type Config struct {
+	Host       string `json:"host"`
+	Port       string `json:"port"`
+	ListenPort string `json:"listen_port"`
+	BindAddr   string `json:"bind-addr"`
+	IPv6Only   bool   `json:"ipv6-only"`
+	ReusePort  bool   `json:"reuseport"`
+
+	ListenSocket  string `json:"listen-socket"`
+	SocketMode    string `json:"socket-mode"`
+	SocketCleanup bool   `json:"socket-cleanup"`
+
+	Proto     string `json:"proto"`
+	Mode      string `json:"mode"`
+	Format    string `json:"format"`
+	OutputDir string `json:"output-dir"`
+	LogPrefix string `json:"log-prefix"`
+
+	BufSize           int     `json:"buf-size"`
+	MaxBody           int     `json:"max-body"`
+	MaxLogSize        int64   `json:"max-log-size"`
+	LogRotateCount    int     `json:"log-rotate-count"`
+	AppendLog         bool    `json:"append-log"`
+	ProfileDir        string  `json:"profile-dir"`
+	ProfileSampleRate int     `json:"profile-sample-rate"`
+	PCAP              bool    `json:"pcap"`
+	Summary           bool    `json:"summary"`
+	DrainTimeout      string  `json:"drain-timeout"`
+	PIDFile           string  `json:"pid-file"`
+	IdleTimeout       string  `json:"idle-timeout"`
+	MaxDuration       string  `json:"max-duration"`
+	MetricsAddr       string  `json:"metrics-addr"`
+	PprofAddr         string  `json:"pprof-addr"`
+	PprofToken        string  `json:"pprof-token"`
+	StatsInterval     string  `json:"stats-interval"`
+	StatsFormat       string  `json:"stats-format"`
+	CaptureFile       string  `json:"capture-file"`
+	MaxLogAge         string  `json:"max-log-age"`
+	CleanupInterval   string  `json:"cleanup-interval"`
+	DryRunCleanup     bool    `json:"dry-run-cleanup"`
+	DashboardAddr     string  `json:"dashboard-addr"`
+	APIAddr           string  `json:"api-addr"`
+	HistorySize       int     `json:"history-size"`
+	MaxConns          int     `json:"max-conns"`
+	RateLimit         float64 `json:"rate-limit-per-ip"`
+	RateLimitTTL      string  `json:"rate-limit-ttl"`
+	DedupWindow       string  `json:"dedup-window"`
+	DedupAction       string  `json:"dedup-action"`
+	DedupCacheSize    int     `json:"dedup-cache-size"`
+	AuthToken         string  `json:"auth-token"`
+	AllowCIDR         string  `json:"allow-cidr"` // comma separated
+	DenyCIDR          string  `json:"deny-cidr"`  // comma separated
+	KnockSequence     string  `json:"knock-sequence"`
+	KnockTTL          string  `json:"knock-ttl"`
+	NoDNSCache        bool    `json:"no-dns-cache"`
+	Upstream          string  `json:"upstream"` // comma separated
+	UpstreamSOCKS5    string  `json:"upstream-socks5"`
+	EBPFMap           string  `json:"ebpf-map"`
+	PoolSize          int     `json:"pool-size"`
+	PoolIdleTimeout   string  `json:"pool-idle-timeout"`
+	PoolMaxConns      int     `json:"pool-max-conns"`
+	TFO               bool    `json:"tfo"`
+	RemapPort         string  `json:"remap-port"` // comma separated
+	NoLog             bool    `json:"no-log"`
+	Grep              string  `json:"grep"`
+	GrepContext       int     `json:"grep-context"`
+	MeasureLatency    bool    `json:"measure-latency"`
+	HexOnly           bool    `json:"hex-only"`
+	BinaryOnly        bool    `json:"binary-only"`
+	Tee               bool    `json:"tee"`
+	Fanout            string  `json:"fanout"` // comma separated
+	LBStrategy        string  `json:"lb-strategy"`
+	HealthInterval    string  `json:"health-interval"`
+	DiffReference     string  `json:"diff-reference"`
+	MirrorHost        string  `json:"mirror-host"`
+	MirrorPort        int     `json:"mirror-port"`
+	ShowPasswords     bool    `json:"show-passwords"`
+	FTPDataProxy      bool    `json:"ftp-data-proxy"`
+	Watch             bool    `json:"watch"`
+	WatchBufferSize   int     `json:"watch-buffer-size"`
+	WatchBackoff      string  `json:"watch-backoff"`
+	HookCmd           string  `json:"hook-cmd"`
+	HookTimeout       string  `json:"hook-timeout"`
+	HookConcurrency   int     `json:"hook-concurrency"`
+	WebhookURL        string  `json:"webhook-url"`
+	WebhookWorkers    int     `json:"webhook-workers"`
+	WebhookHMACSecret string  `json:"webhook-hmac-secret"`
+
+	TLS           bool   `json:"tls"`
+	CACert        string `json:"ca-cert"`
+	CAKey         string `json:"ca-key"`
+	TLSSkipVerify bool   `json:"tls-skip-verify"`
+	PinSHA256     string `json:"pin-sha256"` // comma separated
+	PinCA         string `json:"pin-ca"`
+	ClientCACert  string `json:"client-ca-cert"`
+	UpstreamCert  string `json:"upstream-cert"`
+	UpstreamKey   string `json:"upstream-key"`
+
+	RecordTiming    bool    `json:"record-timing"`
+	TUI             bool    `json:"tui"`
+	ReplayFile      string  `json:"replay-file"`
+	ReplaySpeed     float64 `json:"replay-speed"`
+	ReplayExpect    string  `json:"replay-expect"`
+	ReplayTolerance float64 `json:"replay-tolerance"`
+
+	ThrottleClientBPS int     `json:"throttle-client-bps"`
+	ThrottleServerBPS int     `json:"throttle-server-bps"`
+	ThrottleBurst     int     `json:"throttle-burst"`
+	LatencyClientMS   int     `json:"latency-client-ms"`
+	LatencyServerMS   int     `json:"latency-server-ms"`
+	LatencyJitterMS   int     `json:"latency-jitter-ms"`
+	LossRate          float64 `json:"loss-rate"`
+	LossSeed          int64   `json:"loss-seed"`
+	DryRun            bool    `json:"dry-run"`
+	InjectFile        string  `json:"inject-file"`
+	RulesFile         string  `json:"rules-file"`
+	FilterRegex       string  `json:"filter-regex"`
+	FilterLog         string  `json:"filter-log"`
+
+	LogBackend      string `json:"log-backend"`
+	SyslogAddr      string `json:"syslog-addr"`
+	SyslogFacility  string `json:"syslog-facility"`
+	OutputFIFO      string `json:"output-fifo"`
+	ESURL           string `json:"es-url"`
+	ESIndex         string `json:"es-index"`
+	ESBatchSize     int    `json:"es-batch-size"`
+	ESFlushInterval string `json:"es-flush-interval"`
+	Compress        string `json:"compress"`
+	LogNameTemplate string `json:"log-name-template"`
+	Tag             string `json:"tag"`
+	AcceptTags      bool   `json:"accept-tags"`
+	BinaryFormat    string `json:"binary-format"`
+
+	Targets []TargetConfig `json:"target"`
+
+	present map[string]bool // keys found in the file
+}
+
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	// The zero values don't tell "absent" from "set to 0"
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	c.present = make(map[string]bool)
+	for k := range keys {
+		c.present[k] = true
+	}
+	for i, t := range c.Targets {
+		if t.ListenPort == "" {
+			return nil, fmt.Errorf("%s: target %d has no listen_port", path, i)
+		}
+	}
+	return c, nil
+}
+
+// Sets every flag found in the file that was not given on the command line
+func (c *Config) Apply() error {
+	on_command_line := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { on_command_line[f.Name] = true })
+
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		if !c.present[name] || on_command_line[name] || flag.Lookup(name) == nil {
+			continue
+		}
+		if err := flag.Set(name, fmt.Sprint(v.Field(i).Interface())); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Loads and applies -config, if given. Must run right after flag.Parse.
+func load_config() {
+	if *config_file == "" {
+		return
+	}
+	var err error
+	if config, err = LoadConfig(*config_file); err != nil {
+		die("Unable to load config, %v", err)
+	}
+	if err = config.Apply(); err != nil {
+		die("Invalid config %s, %v", *config_file, err)
+	}
+}
+
+// The targets of the config file. Targets without host or port use
+// -host and -port.
+func configured_targets() []TargetConfig {
+	if config == nil {
+		return nil
+	}
+	targets := make([]TargetConfig, len(config.Targets))
+	for i, t := range config.Targets {
+		if t.Host == "" {
+			t.Host = *host
+		}
+		if t.Port == "" {
+			t.Port = *port
+		}
+		targets[i] = t
+	}
+	return targets
+}
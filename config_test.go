@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes a config file for the test and returns its path
+func write_config(t *testing.T, json string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(json), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		args []string
+		want map[string]string
+	}{
+		{"defaults without the keys", `{}`, nil,
+			map[string]string{"summary": "true", "drain-timeout": "5s", "format": "text", "buf-size": "4096"}},
+		{"the file over the defaults", `{"format": "json", "drain-timeout": "10s", "buf-size": 8192}`, nil,
+			map[string]string{"summary": "true", "drain-timeout": "10s", "format": "json", "buf-size": "8192"}},
+		{"zero values in the file", `{"summary": false, "grep-context": 0}`, nil,
+			map[string]string{"summary": "false", "grep-context": "0", "format": "text"}},
+		{"the command line over the file", `{"format": "json", "summary": false}`, []string{"-format", "hex", "-summary"},
+			map[string]string{"summary": "true", "format": "hex", "drain-timeout": "5s"}},
+		{"the default given on the command line", `{"format": "json"}`, []string{"-format", "text"},
+			map[string]string{"format": "text"}},
+		{"keys without a flag", `{"es-url": "http://es:9200", "format": "json"}`, nil,
+			map[string]string{"format": "json"}},
+	}
+	saved := flag.CommandLine
+	t.Cleanup(func() { flag.CommandLine = saved })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("gotcpspy", flag.ContinueOnError)
+			fs.Bool("summary", true, "")
+			fs.Duration("drain-timeout", 5*time.Second, "")
+			fs.String("format", "text", "")
+			fs.Int("buf-size", 4096, "")
+			fs.Int("grep-context", -1, "")
+			flag.CommandLine = fs
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			c, err := LoadConfig(write_config(t, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Apply(); err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.want {
+				if got := fs.Lookup(name).Value.String(); got != want {
+					t.Errorf("-%s is %s, want %s", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		file string
+		err  string
+	}{
+		{`{"no-such-flag": 1}`, "unknown field"},
+		{`{"buf-size": "big"}`, "cannot unmarshal"},
+		{`{"target": [{"host": "example.com", "port": "80"}]}`, "target 0 has no listen_port"},
+		{`{"format": "json"`, "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		_, err := LoadConfig(write_config(t, tt.file))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("LoadConfig(%s) error %v, want %q", tt.file, err, tt.err)
+		}
+	}
+}
+
+func TestConfigApplyInvalidValue(t *testing.T) {
+	saved := flag.CommandLine
+	t.Cleanup(func() { flag.CommandLine = saved })
+	fs := flag.NewFlagSet("gotcpspy", flag.ContinueOnError)
+	fs.Duration("drain-timeout", 5*time.Second, "")
+	flag.CommandLine = fs
+	c, err := LoadConfig(write_config(t, `{"drain-timeout": "soon"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Apply(); err == nil || !strings.HasPrefix(err.Error(), "drain-timeout: ") {
+		t.Errorf("Apply error %v, want one about drain-timeout", err)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+HTTP CONNECT tunnel mode.
+
+The client asks for its target with "CONNECT host:port HTTP/1.1"; once
+the tunnel is up everything after the request headers is proxied as is.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// Hands bufio one byte at a time, so it never reads past the request
+// headers into the tunnelled data
+type byte_reader struct {
+	r io.Reader
+}
+
+func (b byte_reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return b.r.Read(p[:1])
+}
+
+// Reads the CONNECT request line and headers, returning the target.
+// Other methods are answered with 405 Method Not Allowed.
+func ReadHTTPConnect(conn net.Conn) (target string, err error) {
+	r := bufio.NewReader(byte_reader{conn})
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Fields(line)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "HTTP/1.") {
+		io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return "", fmt.Errorf("malformed request line %q", strings.TrimSpace(line))
+	}
+	if parts[0] != "CONNECT" {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\nAllow: CONNECT\r\nConnection: close\r\n\r\n")
+		return "", fmt.Errorf("method %s not allowed", parts[0])
+	}
+	if _, _, err := net.SplitHostPort(parts[1]); err != nil {
+		io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return "", err
+	}
+
+	for { // skip the headers up to the blank line
+		h, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if strings.TrimRight(h, "\r\n") == "" {
+			break
+		}
+	}
+	if r.Buffered() > 0 {
+		return "", errors.New("unexpected read-ahead") // byte_reader prevents this
+	}
+	return parts[1], nil
+}
+
+// Tells the client whether the tunnel is established
+func WriteHTTPConnectResponse(conn net.Conn, success bool) error {
+	if success {
+		_, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return err
+	}
+	_, err := io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n")
+	return err
+}
@@ -0,0 +1,293 @@
+/*
+Pool of upstream connections (-pool-size).
+
+	-pool-size 4 -pool-idle-timeout 30s -pool-max-conns 100
+
+keeps up to 4 connections to each target open and idle, so that a new
+client gets one straight away instead of waiting for a dial. Every
+connection taken is replaced in the background. The pool fills for the
+fixed targets when gotcpspy starts, and for the others (-upstream,
+-mode socks5 ...) once the first client asks for them. Idle connections
+are closed after -pool-idle-timeout and only replaced on the next
+client, so a target nobody uses stops being held open. -pool-max-conns
+caps the connections to one target, idle and in use; a client that
+would go over it waits for one to be released.
+
+A connection goes back into the pool only if no byte went over it. One
+that carried a client's session is closed afterwards: gotcpspy passes
+the client's FIN on to the target, and it can't know where one
+exchange ends for the next client to start cleanly. The gain is the
+dial, and for servers that speak first (SMTP, FTP, SSH) their greeting,
+which is waiting when the client arrives.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	pool_size         *int           = flag.Int("pool-size", 0, "keep this many idle connections to each target, 0 for no pool")
+	pool_idle_timeout *time.Duration = flag.Duration("pool-idle-timeout", 90*time.Second, "close pooled connections idle for longer than this")
+	pool_max_conns    *int           = flag.Int("pool-max-conns", 0, "with -pool-size, at most this many connections to each target, 0 for no limit")
+)
+
+// How long Get waits for a pooled connection to show it was closed
+const pool_alive_check = time.Millisecond
+
+type ConnectionPool struct {
+	network      string
+	size         int
+	max          int // 0 for no limit
+	idle_timeout time.Duration
+
+	mu      sync.Mutex
+	targets map[string]*pool_target
+}
+
+type pool_target struct {
+	idle    []*pooled_conn // oldest first
+	open    int            // idle, in use and being dialed
+	dialing int
+	wake    chan struct{} // closed when a connection is released
+}
+
+var conn_pool *ConnectionPool // nil without -pool-size
+
+func NewConnectionPool(network string, size, max int, idle_timeout time.Duration) *ConnectionPool {
+	p := &ConnectionPool{
+		network:      network,
+		size:         size,
+		max:          max,
+		idle_timeout: idle_timeout,
+		targets:      make(map[string]*pool_target),
+	}
+	go p.close_idle()
+	return p
+}
+
+// A connection handed out by the pool
+type pooled_conn struct {
+	net.Conn
+	target string
+	since  time.Time // idle since, while in the pool
+	used   atomic.Bool
+	peeked []byte // read by the check in Get, given back first
+}
+
+func (c *pooled_conn) Read(b []byte) (int, error) {
+	c.used.Store(true)
+	if len(c.peeked) > 0 {
+		n := copy(b, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *pooled_conn) Write(b []byte) (int, error) {
+	c.used.Store(true)
+	return c.Conn.Write(b)
+}
+
+func (c *pooled_conn) CloseWrite() error {
+	c.used.Store(true)
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+func (c *pooled_conn) Close() error {
+	c.used.Store(true)
+	return c.Conn.Close()
+}
+
+// Whether an idle connection is still open; what the server sent in the
+// meantime is kept for the first Read
+func (c *pooled_conn) alive() bool {
+	b := make([]byte, 4096)
+	c.Conn.SetReadDeadline(time.Now().Add(pool_alive_check))
+	n, err := c.Conn.Read(b)
+	c.Conn.SetReadDeadline(time.Time{})
+	c.peeked = append(c.peeked, b[:n]...)
+	return err == nil || errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// Called with p.mu held
+func (p *ConnectionPool) target(addr string) *pool_target {
+	t := p.targets[addr]
+	if t == nil {
+		t = &pool_target{wake: make(chan struct{})}
+		p.targets[addr] = t
+	}
+	return t
+}
+
+// Wakes up the clients waiting in Get, called with p.mu held
+func (t *pool_target) signal() {
+	close(t.wake)
+	t.wake = make(chan struct{})
+}
+
+// Called with p.mu held, after a connection left t
+func (t *pool_target) release() {
+	t.open -= 1
+	t.signal()
+}
+
+// A connection to target, idle from the pool or dialed now. Waits while
+// target is at -pool-max-conns, until ctx is done.
+func (p *ConnectionPool) Get(ctx context.Context, target string) (net.Conn, error) {
+	for {
+		p.mu.Lock()
+		t := p.target(target)
+		if n := len(t.idle); n > 0 {
+			c := t.idle[n-1]
+			t.idle = t.idle[:n-1]
+			p.mu.Unlock()
+			if !c.alive() {
+				c.Conn.Close()
+				p.mu.Lock()
+				t.release()
+				p.mu.Unlock()
+				continue
+			}
+			p.fill(target)
+			return c, nil
+		}
+		if p.max == 0 || t.open < p.max {
+			t.open += 1
+			p.mu.Unlock()
+			conn, err := dial_target(p.network, target)
+			if err != nil {
+				p.mu.Lock()
+				t.release()
+				p.mu.Unlock()
+				return nil, err
+			}
+			p.fill(target)
+			return &pooled_conn{Conn: conn, target: target}, nil
+		}
+		wake := t.wake
+		p.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Takes back a connection from Get. It is pooled again if it was never
+// used, otherwise closed.
+func (p *ConnectionPool) Put(conn net.Conn) {
+	c, ok := conn.(*pooled_conn)
+	if !ok {
+		conn.Close()
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := p.target(c.target)
+	if !c.used.Load() && len(t.idle)+t.dialing < p.size {
+		c.since = time.Now()
+		t.idle = append(t.idle, c)
+		t.signal()
+		return
+	}
+	c.Conn.Close()
+	t.release()
+}
+
+// Dials in the background until target has -pool-size idle connections
+func (p *ConnectionPool) fill(target string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := p.target(target)
+	for len(t.idle)+t.dialing < p.size && (p.max == 0 || t.open < p.max) {
+		t.open += 1
+		t.dialing += 1
+		go func() {
+			conn, err := dial_target(p.network, target)
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			t.dialing -= 1
+			if err != nil {
+				t.release() // the client's own dial reports it
+				return
+			}
+			t.idle = append(t.idle, &pooled_conn{Conn: conn, target: target, since: time.Now()})
+			t.signal()
+		}()
+	}
+}
+
+// Closes the connections idle for longer than -pool-idle-timeout
+func (p *ConnectionPool) close_idle() {
+	interval := max(p.idle_timeout/2, time.Second)
+	for range time.Tick(interval) {
+		cutoff := time.Now().Add(-p.idle_timeout)
+		p.mu.Lock()
+		for _, t := range p.targets {
+			kept := t.idle[:0]
+			for _, c := range t.idle {
+				if c.since.Before(cutoff) {
+					c.Conn.Close()
+					t.release()
+				} else {
+					kept = append(kept, c)
+				}
+			}
+			clear(t.idle[len(kept):])
+			t.idle = kept
+		}
+		p.mu.Unlock()
+	}
+}
+
+// Connects to target for a client, through the pool with -pool-size or
+// with TCP Fast Open if the client spoke first (see tfo.go)
+func connect_target(ctx context.Context, network, target string, fast_open bool) (net.Conn, error) {
+	if fast_open {
+		return dial_target_with(tfo_dialer, network, target)
+	}
+	if conn_pool == nil {
+		return dial_target(network, target)
+	}
+	return conn_pool.Get(ctx, target)
+}
+
+// Hands a connection from connect_target back once the client is done
+func release_target(conn net.Conn) {
+	if conn_pool != nil {
+		conn_pool.Put(conn)
+	}
+}
+
+// Sets up the pool and fills it for the targets known in advance
+func init_conn_pool(mappings []*mapping, dynamic_target bool) {
+	if *pool_size <= 0 {
+		return
+	}
+	if *proto == "udp" {
+		die("-pool-size only works with TCP and Unix targets")
+	}
+	if *pool_max_conns > 0 && *pool_max_conns < *pool_size {
+		die("-pool-max-conns has to be at least -pool-size")
+	}
+	conn_pool = NewConnectionPool(mappings[0].target_network(), *pool_size, *pool_max_conns, *pool_idle_timeout)
+	for _, m := range mappings {
+		if !dynamic_target && m.pool == nil {
+			conn_pool.fill(m.target())
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A server that speaks first, greeting each connection with its number,
+// then echoes. accepted counts the connections.
+func start_greeting_server(t *testing.T) (net.Listener, *int64) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	accepted := new(int64)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(c, "conn %d\n", atomic.AddInt64(accepted, 1))
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln, accepted
+}
+
+// Waits until cond holds, which the pool's dials in the background make so
+func wait_for(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("still waiting for %s", what)
+		}
+	}
+}
+
+func (p *ConnectionPool) idle_count(target string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.target(target).idle)
+}
+
+// Closes what the pool holds at the end of a test
+func (p *ConnectionPool) close_all() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, t := range p.targets {
+		for _, c := range t.idle {
+			c.Conn.Close()
+		}
+		t.idle = nil
+	}
+}
+
+// A connection handed back unused is the next one handed out; one that
+// carried data is closed, and the next client gets a new one
+func TestConnectionPoolReuse(t *testing.T) {
+	ln, accepted := start_greeting_server(t)
+	target := ln.Addr().String()
+	p := NewConnectionPool("tcp", 1, 1, time.Minute)
+	defer p.close_all()
+	p.fill(target)
+	wait_for(t, "the pool to fill", func() bool { return p.idle_count(target) == 1 && atomic.LoadInt64(accepted) == 1 })
+
+	first, err := p.Get(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(first)
+	second, err := p.Get(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != first || atomic.LoadInt64(accepted) != 1 {
+		t.Errorf("got %v after %v, %d connections dialed, want the same one", second.LocalAddr(), first.LocalAddr(), atomic.LoadInt64(accepted))
+	}
+
+	// at -pool-max-conns, the next client waits for this one
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	if c, err := p.Get(ctx, target); err == nil {
+		t.Errorf("got a second connection %v over -pool-max-conns", c.LocalAddr())
+	}
+	cancel()
+
+	if greeting, err := bufio.NewReader(second).ReadString('\n'); err != nil || greeting != "conn 1\n" {
+		t.Errorf("greeted with %q, %v", greeting, err)
+	}
+	p.Put(second) // used, so closed
+	third, err := p.Get(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == second {
+		t.Error("a used connection handed out again")
+	}
+	wait_for(t, "a second connection dialed", func() bool { return atomic.LoadInt64(accepted) == 2 })
+	third.Close()
+}
+
+// Two clients one after the other through the proxy: each is served by a
+// connection the pool dialed before it came, whose greeting is waiting
+func TestProxyConnectionPool(t *testing.T) {
+	saved_dir, saved_pool := *output_dir, conn_pool
+	t.Cleanup(func() { *output_dir, conn_pool = saved_dir, saved_pool })
+	*output_dir = t.TempDir()
+	init_log_names()
+	buffer_pool = NewBufferPool(*buf_size)
+
+	ln, accepted := start_greeting_server(t)
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	m := &mapping{listen_port: free_port(t), host: host, port: port, log_prefix: filepath.Join(*output_dir, "log")}
+	conn_pool = NewConnectionPool("tcp", 1, 0, time.Minute)
+	t.Cleanup(conn_pool.close_all)
+	conn_pool.fill(m.target())
+	proxy := NewProxy(m)
+	sessions := make(chan *Session, 2)
+	proxy.OnConnection(func(s *Session) { sessions <- s })
+	run_proxy(t, proxy)
+
+	for n := int64(1); n <= 2; n++ {
+		wait_for(t, "a connection dialed in advance", func() bool { return atomic.LoadInt64(accepted) == n })
+		conn := dial_proxy(t, m.listen_port)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		if greeting, err := r.ReadString('\n'); err != nil || greeting != fmt.Sprintf("conn %d\n", n) {
+			t.Errorf("client %d greeted with %q, %v", n, greeting, err)
+		}
+		conn.Write([]byte("ping\n"))
+		if reply, err := r.ReadString('\n'); err != nil || reply != "ping\n" {
+			t.Errorf("client %d got %q, %v", n, reply, err)
+		}
+		conn.Close()
+		<-sessions
+	}
+	active_connections.Wait()
+}
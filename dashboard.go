@@ -0,0 +1,206 @@
+/*
+Live dashboard (-dashboard-addr).
+
+The page at / shows the active connections; it keeps itself up to date
+from /ws, a WebSocket that streams the connection registry as JSON. The
+registry can change with every chunk forwarded, so the snapshots go out
+at most every dashboard_interval. Each browser tab gets its own goroutine
+and queue; a tab that can't keep up misses snapshots, never the proxy.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var dashboard_addr *string = flag.String("dashboard-addr", "", "serve a live dashboard on this address, e.g. :8000")
+
+const dashboard_interval = 250 * time.Millisecond
+
+//go:embed dashboard.html
+var dashboard_html []byte
+
+// Fans messages out to the subscribers
+type Broadcaster struct {
+	mu   sync.Mutex
+	subs map[chan []byte]bool
+}
+
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{subs: make(map[chan []byte]bool)}
+}
+
+func (b *Broadcaster) Subscribe() chan []byte {
+	ch := make(chan []byte, 8)
+	b.mu.Lock()
+	b.subs[ch] = true
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *Broadcaster) Unsubscribe(ch chan []byte) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+}
+
+func (b *Broadcaster) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+func (b *Broadcaster) Publish(msg []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- msg:
+		default: // slow tab, it gets the next one
+		}
+	}
+}
+
+type dashboard struct {
+	registry *ConnectionRegistry
+	updates  *Broadcaster
+	dirty    chan bool
+}
+
+func start_dashboard() {
+	if *dashboard_addr == "" {
+		return
+	}
+	d := &dashboard{registry: connections, updates: NewBroadcaster(), dirty: make(chan bool, 1)}
+	connections.SetListener(d.changed)
+	go d.publish()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", d.page)
+	mux.HandleFunc("/ws", d.websocket)
+	ln, err := net.Listen("tcp", *dashboard_addr)
+	if err != nil {
+		die("Unable to start dashboard, %v", err)
+	}
+	fmt.Printf("Dashboard on http://%s/\n", ln.Addr())
+	go http.Serve(ln, mux)
+}
+
+func (d *dashboard) changed() {
+	select {
+	case d.dirty <- true:
+	default:
+	}
+}
+
+// Sends a snapshot after changes, at most every dashboard_interval
+func (d *dashboard) publish() {
+	for range d.dirty {
+		d.updates.Publish(d.snapshot())
+		time.Sleep(dashboard_interval)
+	}
+}
+
+func (d *dashboard) snapshot() []byte {
+	msg, _ := json.Marshal(struct {
+		Time        time.Time        `json:"time"`
+		Connections []ConnectionInfo `json:"connections"`
+	}{time.Now(), d.registry.Snapshot()})
+	return msg
+}
+
+func (d *dashboard) page(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboard_html)
+}
+
+// One goroutine per tab: the current state first, then every update
+func (d *dashboard) websocket(w http.ResponseWriter, r *http.Request) {
+	conn, rw, err := websocket_accept(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	updates := d.updates.Subscribe()
+	defer d.updates.Unsubscribe(updates)
+
+	closed := make(chan bool)
+	go func() {
+		// Only reading tells us the tab went away
+		io.Copy(io.Discard, rw)
+		close(closed)
+	}()
+	msg := d.snapshot()
+	for {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := websocket_write_text(rw.Writer, msg); err != nil {
+			return
+		}
+		select {
+		case msg = <-updates:
+		case <-closed:
+			return
+		}
+	}
+}
+
+// Completes the server side of the WebSocket handshake (RFC 6455)
+func websocket_accept(w http.ResponseWriter, r *http.Request) (net.Conn, *bufio.ReadWriter, error) {
+	key := r.Header.Get("Sec-Websocket-Key")
+	if !is_websocket_upgrade(r.Header) || key == "" {
+		http.Error(w, "WebSocket upgrade expected", http.StatusBadRequest)
+		return nil, nil, fmt.Errorf("not a WebSocket request")
+	}
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, nil, fmt.Errorf("connection can't be hijacked")
+	}
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, rw, nil
+}
+
+// Writes one unmasked text frame, as servers do
+func websocket_write_text(w *bufio.Writer, msg []byte) error {
+	header := []byte{0x81, 0}
+	switch n := len(msg); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	w.Write(header)
+	w.Write(msg)
+	return w.Flush()
+}
@@ -0,0 +1,97 @@
+/*
+Live runtime profiling (-pprof-addr).
+
+	-pprof-addr localhost:6060 -pprof-token s3cret
+
+serves the net/http/pprof endpoints under /debug/pprof/: goroutine
+dumps, heap and allocation profiles, CPU profiles and execution traces,
+for example
+
+	curl -H 'Authorization: Bearer s3cret' 'http://localhost:6060/debug/pprof/goroutine?debug=2'
+	curl -H 'Authorization: Bearer s3cret' -o cpu.pprof 'http://localhost:6060/debug/pprof/profile?seconds=30'
+	go tool pprof cpu.pprof
+
+The server starts right after the flags and -config are read, before
+any listener, so a slow or stuck startup can be looked at too. It stops
+with the listeners on SIGINT or SIGTERM.
+
+The endpoints show the program's memory and can slow it down, so keep
+the address local. With -pprof-token every request needs
+"Authorization: Bearer <token>"; without it a warning goes to stderr.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	pprof_addr  *string = flag.String("pprof-addr", "", "serve net/http/pprof on this address, e.g. localhost:6060")
+	pprof_token *string = flag.String("pprof-token", "", "with -pprof-addr, require \"Authorization: Bearer <token>\"")
+)
+
+var pprof_server *http.Server
+
+// Turns away requests without the -pprof-token
+func pprof_auth(next http.Handler) http.Handler {
+	if *pprof_token == "" {
+		return next
+	}
+	want := []byte("Bearer " + *pprof_token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(strings.TrimSpace(r.Header.Get("Authorization")))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func start_pprof_server() {
+	if *pprof_addr == "" {
+		return
+	}
+	if *pprof_token == "" {
+		fmt.Fprintf(os.Stderr, "Warning: -pprof-addr %s has no authentication, anyone who can reach it can read the process memory; set -pprof-token\n", *pprof_addr)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index) // and the named profiles below it
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	ln, err := net.Listen("tcp", *pprof_addr)
+	if err != nil {
+		die("Unable to start pprof server, %v", err)
+	}
+	fmt.Printf("pprof on http://%s/debug/pprof/\n", ln.Addr())
+	pprof_server = &http.Server{Handler: pprof_auth(mux)}
+	go pprof_server.Serve(ln)
+}
+
+// Shuts the pprof server down once ctx is done
+func stop_pprof_server_on(ctx context.Context) {
+	if pprof_server == nil {
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if pprof_server.Shutdown(sctx) != nil {
+			pprof_server.Close() // a CPU profile or trace still running
+		}
+	}()
+}
@@ -0,0 +1,154 @@
+/*
+Duplicate connection detection (-dedup-window).
+
+	-dedup-window 2s -dedup-action close
+
+Some network setups (a SPAN port mirrored into the listener, a load
+balancer retrying on two paths) deliver the same stream twice. Every
+new connection waits up to dedup_wait for the client's first bytes and
+is hashed with the client IP, the target and up to dedup_prefix of
+those bytes. If a connection with the same hash arrived within
+-dedup-window, "Possible duplicate connection detected" goes to stderr
+and, with -dedup-action close, the new one is closed before the target
+is dialed. The default action, warn, lets it through.
+
+The last -dedup-cache-size hashes are kept; a goroutine drops those
+older than the window and, if there are still too many, the least
+recently seen. A client that sends nothing within dedup_wait is not
+checked. Protocols where the server speaks first only start later.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	dedup_window     *time.Duration = flag.Duration("dedup-window", 0, "warn about connections with the same client IP, target and first bytes within this long, 0 to not check")
+	dedup_action     *string        = flag.String("dedup-action", "warn", "what to do with a duplicate connection, warn or close")
+	dedup_cache_size *int           = flag.Int("dedup-cache-size", 4096, "recent connections kept for -dedup-window")
+)
+
+const (
+	dedup_prefix = 64 // payload bytes hashed
+	dedup_wait   = proto_detect_wait
+)
+
+type DeduplicationFilter struct {
+	window time.Duration
+	size   int
+	recent sync.Map // [sha256.Size]byte -> *dedup_entry, the latest connection
+}
+
+type dedup_entry struct {
+	conn_n    int
+	last_seen int64 // unix nanoseconds
+}
+
+var dedup_filter *DeduplicationFilter // nil without -dedup-window
+
+func NewDeduplicationFilter(window time.Duration, size int) *DeduplicationFilter {
+	f := &DeduplicationFilter{window: window, size: size}
+	go f.evict()
+	return f
+}
+
+func dedup_key(client_ip, target string, payload []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte(client_ip))
+	h.Write([]byte{0})
+	h.Write([]byte(target))
+	h.Write([]byte{0})
+	h.Write(payload[:min(len(payload), dedup_prefix)])
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
+
+// Records the connection and returns the connection it duplicates, and how
+// long ago that one was seen; 0 if it doesn't duplicate a recent one
+func (f *DeduplicationFilter) Check(conn_n int, client_ip, target string, payload []byte) (int, time.Duration) {
+	key := dedup_key(client_ip, target, payload)
+	now := time.Now()
+	e := &dedup_entry{conn_n: conn_n, last_seen: now.UnixNano()}
+	v, loaded := f.recent.Swap(key, e)
+	if !loaded {
+		return 0, 0
+	}
+	prev := v.(*dedup_entry)
+	ago := now.Sub(time.Unix(0, prev.last_seen))
+	if ago > f.window {
+		return 0, 0
+	}
+	return prev.conn_n, ago
+}
+
+// Drops the hashes older than the window, then the least recently seen
+// ones beyond the cache size
+func (f *DeduplicationFilter) evict() {
+	for range time.Tick(max(f.window/2, 100*time.Millisecond)) {
+		cutoff := time.Now().Add(-f.window).UnixNano()
+		type seen struct {
+			key any
+			at  int64
+		}
+		var kept []seen
+		f.recent.Range(func(k, v any) bool {
+			at := v.(*dedup_entry).last_seen
+			if at < cutoff {
+				f.recent.CompareAndDelete(k, v)
+			} else {
+				kept = append(kept, seen{k, at})
+			}
+			return true
+		})
+		if len(kept) <= f.size {
+			continue
+		}
+		sort.Slice(kept, func(i, j int) bool { return kept[i].at < kept[j].at })
+		for _, s := range kept[:len(kept)-f.size] {
+			f.recent.Delete(s.key)
+		}
+	}
+}
+
+func init_dedup() {
+	if *dedup_window <= 0 {
+		return
+	}
+	if *dedup_action != "warn" && *dedup_action != "close" {
+		die("-dedup-action has to be warn or close")
+	}
+	if *proto == "udp" {
+		die("-dedup-window only works with TCP and Unix listeners")
+	}
+	dedup_filter = NewDeduplicationFilter(*dedup_window, max(*dedup_cache_size, 1))
+}
+
+// Checks a new connection against the recent ones. false if it is a
+// duplicate to be closed; the returned connection replaces local.
+func dedup_connection(local net.Conn, conn_n int, target string) (net.Conn, bool) {
+	if dedup_filter == nil {
+		return local, true
+	}
+	local, payload := peek_client(local, dedup_prefix, dedup_wait)
+	if len(payload) == 0 {
+		return local, true
+	}
+	ip := client_ip(local.RemoteAddr())
+	prev, ago := dedup_filter.Check(conn_n, ip, target, payload)
+	if prev == 0 {
+		return local, true
+	}
+	fmt.Fprintf(os.Stderr, "Possible duplicate connection detected: connection %d from %s to %s has the same first bytes as connection %d, %s earlier\n",
+		conn_n, ip, target, prev, ago.Round(time.Millisecond))
+	return local, *dedup_action != "close"
+}
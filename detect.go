@@ -0,0 +1,125 @@
+/*
+Protocol detection (-proto auto).
+
+The client's first bytes pick the decoder: up to proto_preamble_size
+bytes are read before any copying starts, and handed back to the
+connection through an io.MultiReader so the target and the loggers
+still see the whole stream. Protocols where the server speaks first
+(MySQL, SMTP, ...) give the client nothing to go by; after
+proto_detect_wait the connection is logged as raw TCP.
+
+TLS and SSH are recognized but have no decoder, they are still logged
+as hex dumps. In -tls mode detection runs on the decrypted stream.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	proto_preamble_size = 16
+	proto_detect_wait   = 500 * time.Millisecond
+)
+
+// A protocol as named by -proto
+type Protocol string
+
+const (
+	ProtoRaw      Protocol = "tcp"
+	ProtoHTTP     Protocol = "http"
+	ProtoHTTP2    Protocol = "h2" // gRPC looks the same until its first request
+	ProtoTLS      Protocol = "tls"
+	ProtoSSH      Protocol = "ssh"
+	ProtoMQTT     Protocol = "mqtt"
+	ProtoRedis    Protocol = "redis"
+	ProtoPostgres Protocol = "postgres"
+)
+
+var http_methods = []string{"GET ", "POST ", "PUT ", "HEAD ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+type ProtocolDetector struct{}
+
+// Names the protocol a client preamble belongs to, ProtoRaw if none fits
+func (ProtocolDetector) Detect(preamble []byte) Protocol {
+	p := preamble
+	switch {
+	case len(p) == 0:
+		return ProtoRaw
+	case bytes.HasPrefix(p, []byte("PRI * HTTP/2")):
+		return ProtoHTTP2
+	case len(p) >= 2 && p[0] == 0x16 && p[1] == 0x03:
+		return ProtoTLS
+	case bytes.HasPrefix(p, []byte("SSH-")):
+		return ProtoSSH
+	case p[0] == 0x10: // CONNECT
+		return ProtoMQTT
+	case p[0] == '*' || p[0] == '+': // not ':', an integer only comes from the server
+		return ProtoRedis
+	}
+	for _, m := range http_methods {
+		if bytes.HasPrefix(p, []byte(m)) {
+			return ProtoHTTP
+		}
+	}
+	if len(p) >= 8 { // startup message or SSLRequest: length, then a version code
+		switch binary.BigEndian.Uint32(p[4:8]) {
+		case 0x00030000, pg_ssl_request, pg_gss_request, pg_cancel:
+			return ProtoPostgres
+		}
+	}
+	return ProtoRaw
+}
+
+// A connection that reads the already consumed preamble first
+type preamble_conn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *preamble_conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Waits up to wait for the client's first bytes and returns up to n of
+// them, fewer if that's all there is so far. The returned connection
+// replaces conn: a plain TCP connection is only peeked at and stays as it
+// is, so that -no-log can still splice it, others give the bytes back.
+func peek_client(conn net.Conn, n int, wait time.Duration) (net.Conn, []byte) {
+	conn.SetReadDeadline(time.Now().Add(wait))
+	defer conn.SetReadDeadline(time.Time{})
+	b := make([]byte, n)
+	if tc, ok := conn.(*net.TCPConn); ok {
+		rc, err := tc.SyscallConn()
+		if err != nil {
+			return conn, nil
+		}
+		n = 0
+		rc.Read(func(fd uintptr) bool {
+			n, _, err = syscall.Recvfrom(int(fd), b, syscall.MSG_PEEK)
+			return err != syscall.EAGAIN
+		})
+		return conn, b[:max(n, 0)]
+	}
+	n, _ = conn.Read(b) // errors come back on the next read
+	b = b[:n]
+	return &preamble_conn{conn, io.MultiReader(bytes.NewReader(b), conn)}, b
+}
+
+// Waits for the client's first bytes and detects the protocol from them.
+// The returned connection replaces conn, it gives those n bytes back.
+func detect_protocol(conn net.Conn) (c net.Conn, detected Protocol, n int) {
+	b := make([]byte, proto_preamble_size)
+	conn.SetReadDeadline(time.Now().Add(proto_detect_wait))
+	n, _ = conn.Read(b) // errors come back on the next read
+	conn.SetReadDeadline(time.Time{})
+	b = b[:n]
+	detected = ProtocolDetector{}.Detect(b)
+	return &preamble_conn{conn, io.MultiReader(bytes.NewReader(b), conn)}, detected, n
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// A PostgreSQL message that starts with its length and a version code
+func pg_startup(code uint32) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, 8)
+	binary.BigEndian.PutUint32(b[4:], code)
+	return b
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name     string
+		preamble []byte
+		want     Protocol
+	}{
+		{"nothing", nil, ProtoRaw},
+		{"HTTP/2 preface", []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"), ProtoHTTP2},
+		{"TLS ClientHello", []byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01}, ProtoTLS},
+		{"TLS alert", []byte{0x15, 0x03, 0x03}, ProtoRaw},
+		{"SSH banner", []byte("SSH-2.0-OpenSSH_9.6\r\n"), ProtoSSH},
+		{"MQTT CONNECT", []byte{0x10, 0x1a, 0x00, 0x04, 'M', 'Q', 'T', 'T'}, ProtoMQTT},
+		{"Redis command", []byte("*1\r\n$4\r\nPING\r\n"), ProtoRedis},
+		{"Redis simple string", []byte("+PING\r\n"), ProtoRedis},
+		{"colon", []byte(":1\r\n"), ProtoRaw}, // an integer reply, no client sends one
+		{"GET", []byte("GET / HTTP/1.1\r\n"), ProtoHTTP},
+		{"CONNECT", []byte("CONNECT example.com:443 HTTP/1.1\r\n"), ProtoHTTP},
+		{"lower case method", []byte("get / HTTP/1.1\r\n"), ProtoRaw},
+		{"method without a space", []byte("GETX"), ProtoRaw},
+		{"PostgreSQL startup", pg_startup(0x00030000), ProtoPostgres},
+		{"PostgreSQL SSLRequest", pg_startup(pg_ssl_request), ProtoPostgres},
+		{"PostgreSQL GSSENCRequest", pg_startup(pg_gss_request), ProtoPostgres},
+		{"PostgreSQL CancelRequest", pg_startup(pg_cancel), ProtoPostgres},
+		{"PostgreSQL version 2", pg_startup(0x00020000), ProtoRaw},
+		{"short PostgreSQL", pg_startup(0x00030000)[:7], ProtoRaw},
+		{"binary", []byte{0x00, 0x01, 0x02, 0x03}, ProtoRaw},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (ProtocolDetector{}).Detect(tt.preamble); got != tt.want {
+				t.Errorf("Detect(%q) = %s, want %s", tt.preamble, got, tt.want)
+			}
+		})
+	}
+}
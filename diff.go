@@ -0,0 +1,249 @@
+/*
+Diff mode (-diff-reference).
+
+Every connection is also opened to a reference server, which gets the
+same client bytes as the target. Only the target's responses go back to
+the client; the reference's are collected, and once the connection is
+over both response streams are compared with Myers' diff. Each
+difference is logged with the bytes of both sides, which makes it easy
+to check that a new server version answers exactly like the old one.
+
+Responses are compared up to diff_max_bytes; streams that need more than
+diff_max_edits insertions and deletions are only reported as different,
+from the first byte where they part.
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var diff_reference *string = flag.String("diff-reference", "", "host:port of a reference server whose responses are compared to the target's")
+
+const (
+	diff_max_bytes = 1 << 20
+	diff_max_edits = 1000
+	diff_wait      = 2 * time.Second // for the reference to finish answering
+)
+
+// The reference side of one connection
+type DiffSession struct {
+	reference net.Conn
+	mu        sync.Mutex
+	primary   []byte
+	ref       []byte
+	truncated bool
+	write_err error // the reference stopped taking client data
+	done      chan bool
+}
+
+// Connects to -diff-reference, nil without it. In TLS mode the reference
+// is spoken to over TLS too.
+func start_diff_session() (*DiffSession, error) {
+	if *diff_reference == "" {
+		return nil, nil
+	}
+	conn, err := dial_target("tcp", *diff_reference)
+	if err != nil {
+		return nil, err
+	}
+	if *tls_mode {
+		server_name, _, _ := net.SplitHostPort(*diff_reference)
+		tls_conn, err := tls_connect(conn, server_name)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tls_conn
+	}
+	d := &DiffSession{reference: conn, done: make(chan bool)}
+	go d.read_reference()
+	return d, nil
+}
+
+func (d *DiffSession) read_reference() {
+	defer close(d.done)
+	b := make([]byte, 32*1024)
+	for {
+		n, err := d.reference.Read(b)
+		d.mu.Lock()
+		d.ref = d.keep(d.ref, b[:n])
+		d.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Appends b to buf up to diff_max_bytes; needs d.mu
+func (d *DiffSession) keep(buf, b []byte) []byte {
+	if room := diff_max_bytes - len(buf); len(b) > room {
+		b = b[:room]
+		d.truncated = true
+	}
+	return append(buf, b...)
+}
+
+// Sees a chunk pass_through handled: client data, as forwarded, is sent
+// to the reference too; target data, as received, is kept for the diff
+func (d *DiffSession) observe(direction string, received, forwarded []byte) {
+	if direction == client_to_server {
+		if d.write_err == nil {
+			_, d.write_err = d.reference.Write(forwarded)
+		}
+		return
+	}
+	d.mu.Lock()
+	d.primary = d.keep(d.primary, received)
+	d.mu.Unlock()
+}
+
+// Waits for the reference to finish, then logs how its responses differ
+func (d *DiffSession) finish(conn_n int, logger chan *LogEvent) {
+	if d == nil {
+		return
+	}
+	if cw, ok := d.reference.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	select {
+	case <-d.done:
+	case <-time.After(diff_wait):
+	}
+	d.reference.Close()
+	<-d.done
+
+	d.mu.Lock()
+	primary, ref, truncated := d.primary, d.ref, d.truncated
+	d.mu.Unlock()
+	if d.write_err != nil {
+		logger <- log_message(conn_n, "diff", "Reference %s stopped taking client data, %v", *diff_reference, d.write_err)
+	}
+	note := ""
+	if truncated {
+		note = fmt.Sprintf(", compared up to %d bytes", diff_max_bytes)
+	}
+
+	hunks, ok := diff_bytes(primary, ref)
+	switch {
+	case !ok:
+		at := 0
+		for at < len(primary) && at < len(ref) && primary[at] == ref[at] {
+			at++
+		}
+		logger <- log_message(conn_n, "diff", "Responses differ too much to diff, target %d bytes, reference %d bytes, first difference at %08X%s",
+			len(primary), len(ref), at, note)
+	case len(hunks) == 0:
+		logger <- log_message(conn_n, "diff", "Responses identical, %d bytes%s", len(primary), note)
+	default:
+		logger <- log_message(conn_n, "diff", "Responses differ in %d places, target %d bytes, reference %d bytes%s",
+			len(hunks), len(primary), len(ref), note)
+		for _, h := range hunks {
+			e := log_message(conn_n, "diff", "Difference at target %08X, reference %08X: target has %d bytes, reference %d bytes",
+				h.primary_at, h.reference_at, len(h.primary), len(h.reference))
+			e.HexPayload = "target:\n" + hex.Dump(h.primary) + "reference:\n" + hex.Dump(h.reference)
+			logger <- e
+		}
+	}
+}
+
+// A run of bytes that differs between the two streams
+type diff_hunk struct {
+	primary_at, reference_at int
+	primary, reference       []byte
+}
+
+// Myers' O(ND) diff of a and b, as the places where they differ. false if
+// the streams need more than diff_max_edits edits.
+func diff_bytes(a, b []byte) ([]diff_hunk, bool) {
+	n, m := len(a), len(b)
+	offset := diff_max_edits + 1
+	v := make([]int, 2*diff_max_edits+3)
+	var trace [][]int
+	for d := 0; d <= diff_max_edits; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1] // down: insert from b
+			} else {
+				x = v[offset+k-1] + 1 // right: delete from a
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return diff_hunks(trace, offset, a, b), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Walks the trace back from the end and groups the edits into hunks
+func diff_hunks(trace [][]int, offset int, a, b []byte) []diff_hunk {
+	// edits[i] is 0 for a common byte, '-' for a byte only in a, '+' only in b
+	var edits []byte
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prev_k int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prev_k = k + 1
+		} else {
+			prev_k = k - 1
+		}
+		prev_x := v[offset+prev_k]
+		prev_y := prev_x - prev_k
+		for x > prev_x && y > prev_y {
+			edits = append(edits, 0)
+			x, y = x-1, y-1
+		}
+		if d > 0 {
+			if x == prev_x {
+				edits = append(edits, '+')
+			} else {
+				edits = append(edits, '-')
+			}
+		}
+		x, y = prev_x, prev_y
+	}
+
+	var hunks []diff_hunk
+	var h *diff_hunk
+	x, y = 0, 0
+	for i := len(edits) - 1; i >= 0; i-- {
+		switch edits[i] {
+		case 0:
+			if h != nil {
+				hunks = append(hunks, *h)
+				h = nil
+			}
+			x, y = x+1, y+1
+			continue
+		}
+		if h == nil {
+			h = &diff_hunk{primary_at: x, reference_at: y}
+		}
+		if edits[i] == '-' {
+			h.primary = append(h.primary, a[x])
+			x++
+		} else {
+			h.reference = append(h.reference, b[y])
+			y++
+		}
+	}
+	if h != nil {
+		hunks = append(hunks, *h)
+	}
+	return hunks
+}
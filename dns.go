@@ -0,0 +1,242 @@
+/*
+DNS cache for the upstream target.
+
+A -host given as a name would be resolved again for every connection.
+Instead the addresses are kept for the TTL of the DNS answer and
+refreshed in the background while connections keep using them; a name
+nobody connected to during a TTL is dropped instead. Connections take
+turns with the addresses, and fall through to the next one when an
+address doesn't answer.
+
+net.Resolver doesn't report TTLs, so the cache reads them from the
+answers as they come in over UDP. Names that come from /etc/hosts, or
+answers that had to be retried over TCP, are kept for dns_default_ttl.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var no_dns_cache *bool = flag.Bool("no-dns-cache", false, "resolve the target for every connection instead of caching its addresses")
+
+const (
+	dns_default_ttl = 30 * time.Second
+	dns_min_ttl     = 5 * time.Second // even if the answer says 0
+)
+
+type dns_entry struct {
+	ready chan bool // closed once the first lookup is done
+	mu    sync.Mutex
+	addrs []net.IP
+	err   error
+	used  bool   // since the last refresh
+	next  uint32 // round robin position, atomic
+}
+
+// Caches the addresses of target host names
+type CachingResolver struct {
+	mu      sync.Mutex
+	entries map[string]*dns_entry
+}
+
+var dns_cache = NewCachingResolver()
+
+func NewCachingResolver() *CachingResolver {
+	return &CachingResolver{entries: make(map[string]*dns_entry)}
+}
+
+// Returns the addresses of host, rotated by one for every call. Concurrent
+// callers for a name that isn't cached yet share a single lookup.
+func (r *CachingResolver) Lookup(host string) ([]net.IP, error) {
+	r.mu.Lock()
+	e, ok := r.entries[host]
+	if !ok {
+		e = &dns_entry{ready: make(chan bool)}
+		r.entries[host] = e
+		go r.refresh(host, e)
+	}
+	r.mu.Unlock()
+	<-e.ready
+
+	e.mu.Lock()
+	addrs, err := e.addrs, e.err
+	e.used = true
+	e.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	start := int(atomic.AddUint32(&e.next, 1)-1) % len(addrs)
+	return append(append([]net.IP(nil), addrs[start:]...), addrs[:start]...), nil
+}
+
+// Looks host up, then again whenever the TTL runs out, for as long as
+// the entry is being used. A failed first lookup isn't cached, so the
+// next connection tries again; later failures keep the old addresses.
+func (r *CachingResolver) refresh(host string, e *dns_entry) {
+	for first := true; ; first = false {
+		addrs, ttl, err := lookup_with_ttl(host)
+		if err != nil && first {
+			e.err = err
+			close(e.ready)
+			break
+		}
+		if err != nil {
+			ttl = dns_min_ttl // keep the old addresses for now
+		} else {
+			e.mu.Lock()
+			e.addrs = addrs
+			e.mu.Unlock()
+		}
+		if first {
+			close(e.ready)
+		}
+		time.Sleep(ttl)
+
+		e.mu.Lock()
+		used := e.used
+		e.used = false
+		e.mu.Unlock()
+		if !used {
+			break
+		}
+	}
+	r.mu.Lock()
+	delete(r.entries, host)
+	r.mu.Unlock()
+}
+
+// Resolves host and reports the lowest TTL of the answers
+func lookup_with_ttl(host string) ([]net.IP, time.Duration, error) {
+	var mu sync.Mutex
+	ttl := uint32(0)
+	seen := false
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			c, err := d.DialContext(ctx, network, address)
+			if u, ok := c.(*net.UDPConn); ok {
+				// Still a PacketConn, so the resolver keeps using UDP framing
+				return &ttl_conn{u, func(t uint32) {
+					mu.Lock()
+					if !seen || t < ttl {
+						ttl, seen = t, true
+					}
+					mu.Unlock()
+				}}, nil
+			}
+			return c, err
+		},
+	}
+	ips, err := resolver.LookupIP(context.Background(), "ip", host)
+	if err != nil {
+		return nil, 0, err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !seen {
+		return ips, dns_default_ttl, nil
+	}
+	if d := time.Duration(ttl) * time.Second; d > dns_min_ttl {
+		return ips, d, nil
+	}
+	return ips, dns_min_ttl, nil
+}
+
+// Passes DNS answers through, reporting their TTLs on the way
+type ttl_conn struct {
+	*net.UDPConn
+	report func(ttl uint32)
+}
+
+func (c *ttl_conn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if err == nil {
+		if ttl, ok := dns_answer_ttl(b[:n]); ok {
+			c.report(ttl)
+		}
+	}
+	return n, err
+}
+
+// The lowest TTL of the answer records of a DNS message
+func dns_answer_ttl(msg []byte) (uint32, bool) {
+	if len(msg) < 12 {
+		return 0, false
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+	i := 12
+	for q := 0; q < questions; q++ {
+		if i = skip_dns_name(msg, i); i < 0 || i+4 > len(msg) {
+			return 0, false
+		}
+		i += 4 // type, class
+	}
+	var ttl uint32
+	found := false
+	for a := 0; a < answers; a++ {
+		if i = skip_dns_name(msg, i); i < 0 || i+10 > len(msg) {
+			return 0, false
+		}
+		t := binary.BigEndian.Uint32(msg[i+4:])
+		if !found || t < ttl {
+			ttl, found = t, true
+		}
+		i += 10 + int(binary.BigEndian.Uint16(msg[i+8:]))
+	}
+	return ttl, found
+}
+
+// Returns the offset past the name at i, or -1
+func skip_dns_name(msg []byte, i int) int {
+	for i < len(msg) {
+		switch l := int(msg[i]); {
+		case l == 0:
+			return i + 1
+		case l&0xc0 == 0xc0: // compression pointer, ends the name
+			return i + 2
+		default:
+			i += l + 1
+		}
+	}
+	return -1
+}
+
+// Connects to target, going through the cached addresses of its host or
+// -upstream-socks5
+func dial_target(network, target string) (net.Conn, error) {
+	return dial_target_with(&net.Dialer{}, network, target)
+}
+
+// dial_target with the socket options of d
+func dial_target_with(d *net.Dialer, network, target string) (net.Conn, error) {
+	if *upstream_socks5 != "" && network == "tcp" {
+		ctx, cancel := context.WithTimeout(context.Background(), socks5_dial_timeout)
+		defer cancel()
+		return DialViaSocks5(ctx, *upstream_socks5, target)
+	}
+	host, port, err := net.SplitHostPort(target)
+	if *no_dns_cache || network != "tcp" || err != nil || net.ParseIP(host) != nil {
+		return d.Dial(network, target)
+	}
+	addrs, err := dns_cache.Lookup(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range addrs {
+		var conn net.Conn
+		if conn, err = d.Dial(network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
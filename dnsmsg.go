@@ -0,0 +1,371 @@
+/*
+DNS over TCP decoding for the connection log (-proto dns).
+
+Over TCP every DNS message comes with a 2 byte length, queries and
+responses alike, so both directions decode the same way: the header
+flags and response code, the questions and the resource records of the
+answer, authority and additional sections. The common record types are
+shown the way dig shows them, others as hex. A zone transfer is a
+series of responses, each logged on its own. For DNS over TLS (port
+853) combine it with -tls.
+
+The messages are read by hand, like the answers the DNS cache goes
+through in dns.go, rather than with golang.org/x/net/dns/dnsmessage,
+which would be the program's first dependency.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+const dns_max_pointers = 64 // compression pointers followed per name
+
+type DNSQuestion struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+}
+
+type DNSResource struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+	TTL   uint32 `json:"ttl"`
+	Data  string `json:"data"`
+}
+
+type DNSRecord struct {
+	ID         uint16         `json:"id"`
+	Response   bool           `json:"response"`
+	Opcode     string         `json:"opcode"`
+	RCode      string         `json:"rcode,omitempty"` // of a response
+	Flags      []string       `json:"flags,omitempty"` // aa, tc, rd, ra, ad, cd
+	Length     int            `json:"length"`
+	Questions  []DNSQuestion  `json:"questions,omitempty"`
+	Answers    []*DNSResource `json:"answers,omitempty"`
+	Authority  []*DNSResource `json:"authority,omitempty"`
+	Additional []*DNSResource `json:"additional,omitempty"`
+}
+
+var dns_types = map[uint16]string{
+	1: "A", 2: "NS", 5: "CNAME", 6: "SOA", 12: "PTR", 13: "HINFO", 15: "MX",
+	16: "TXT", 28: "AAAA", 33: "SRV", 35: "NAPTR", 39: "DNAME", 41: "OPT",
+	43: "DS", 46: "RRSIG", 47: "NSEC", 48: "DNSKEY", 50: "NSEC3", 64: "SVCB",
+	65: "HTTPS", 99: "SPF", 251: "IXFR", 252: "AXFR", 255: "ANY", 257: "CAA",
+}
+
+var dns_classes = map[uint16]string{1: "IN", 3: "CH", 4: "HS", 254: "NONE", 255: "ANY"}
+
+var dns_opcodes = []string{"QUERY", "IQUERY", "STATUS", "3", "NOTIFY", "UPDATE"}
+
+var dns_rcodes = []string{"NOERROR", "FORMERR", "SERVFAIL", "NXDOMAIN", "NOTIMP",
+	"REFUSED", "YXDOMAIN", "YXRRSET", "NXRRSET", "NOTAUTH", "NOTZONE"}
+
+// The header flags after QR, opcode and before the response code, by bit
+var dns_flags = []struct {
+	bit  uint16
+	name string
+}{{0x0400, "aa"}, {0x0200, "tc"}, {0x0100, "rd"}, {0x0080, "ra"}, {0x0020, "ad"}, {0x0010, "cd"}}
+
+func dns_name_of(names map[uint16]string, v uint16, prefix string) string {
+	if s, ok := names[v]; ok {
+		return s
+	}
+	return fmt.Sprintf("%s%d", prefix, v) // RFC 3597 style
+}
+
+func dns_code_of(names []string, v int) string {
+	if v < len(names) {
+		return names[v]
+	}
+	return fmt.Sprint(v)
+}
+
+var errDNSShort = errors.New("DNS message too short")
+
+// Walks one DNS message, the offsets are relative to its start because of
+// the compression pointers
+type dns_reader struct {
+	msg []byte
+	i   int
+	err error
+}
+
+func (r *dns_reader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if r.i+n > len(r.msg) {
+		r.err = errDNSShort
+		return nil
+	}
+	b := r.msg[r.i : r.i+n]
+	r.i += n
+	return b
+}
+
+func (r *dns_reader) uint16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *dns_reader) uint32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+// Reads the name at the current offset, following compression pointers
+func (r *dns_reader) name() string {
+	if r.err != nil {
+		return ""
+	}
+	name, end, err := dns_read_name(r.msg, r.i)
+	if err != nil {
+		r.err = err
+		return ""
+	}
+	r.i = end
+	return name
+}
+
+// Returns the name at i and the offset past it
+func dns_read_name(msg []byte, i int) (string, int, error) {
+	var labels []string
+	end, pointers := -1, 0
+	for {
+		if i >= len(msg) {
+			return "", 0, errDNSShort
+		}
+		l := int(msg[i])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = i + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xc0 == 0xc0:
+			if i+1 >= len(msg) {
+				return "", 0, errDNSShort
+			}
+			if pointers += 1; pointers > dns_max_pointers {
+				return "", 0, errors.New("DNS name compression loop")
+			}
+			if end < 0 {
+				end = i + 2
+			}
+			i = int(binary.BigEndian.Uint16(msg[i:]) & 0x3fff)
+		case l&0xc0 != 0:
+			return "", 0, fmt.Errorf("DNS label type %02x", l&0xc0)
+		default:
+			if i+1+l > len(msg) {
+				return "", 0, errDNSShort
+			}
+			labels = append(labels, dns_escape_label(msg[i+1:i+1+l]))
+			i += l + 1
+		}
+	}
+}
+
+func dns_escape_label(b []byte) string {
+	var s strings.Builder
+	for _, c := range b {
+		switch {
+		case c == '.' || c == '\\':
+			s.WriteString("\\" + string(c))
+		case c < '!' || c > '~':
+			fmt.Fprintf(&s, "\\%03d", c)
+		default:
+			s.WriteByte(c)
+		}
+	}
+	return s.String()
+}
+
+// Decodes a DNS message (without the TCP length)
+func ParseDNSMessage(msg []byte) (*DNSRecord, error) {
+	r := &dns_reader{msg: msg}
+	id, flags := r.uint16(), r.uint16()
+	counts := []int{int(r.uint16()), int(r.uint16()), int(r.uint16()), int(r.uint16())}
+	if r.err != nil {
+		return nil, r.err
+	}
+	rec := &DNSRecord{
+		ID:       id,
+		Response: flags&0x8000 != 0,
+		Opcode:   dns_code_of(dns_opcodes, int(flags>>11&0xf)),
+		Length:   len(msg),
+	}
+	for _, f := range dns_flags {
+		if flags&f.bit != 0 {
+			rec.Flags = append(rec.Flags, f.name)
+		}
+	}
+	rcode := int(flags & 0xf)
+	for q := 0; q < counts[0] && r.err == nil; q++ {
+		name := r.name()
+		t, class := r.uint16(), r.uint16()
+		rec.Questions = append(rec.Questions, DNSQuestion{name, dns_name_of(dns_types, t, "TYPE"), dns_name_of(dns_classes, class, "CLASS")})
+	}
+	sections := []*[]*DNSResource{&rec.Answers, &rec.Authority, &rec.Additional}
+	for s, section := range sections {
+		for n := 0; n < counts[s+1] && r.err == nil; n++ {
+			rr := r.resource()
+			if rr == nil {
+				break
+			}
+			if rr.Type == "OPT" { // EDNS, carries the upper bits of the response code
+				rcode |= int(rr.TTL>>24) << 4
+			}
+			*section = append(*section, rr)
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if rec.Response {
+		rec.RCode = dns_code_of(dns_rcodes, rcode)
+	}
+	return rec, nil
+}
+
+func (r *dns_reader) resource() *DNSResource {
+	name := r.name()
+	t, class, ttl := r.uint16(), r.uint16(), r.uint32()
+	start := r.i + 2
+	data := r.take(int(r.uint16()))
+	if r.err != nil {
+		return nil
+	}
+	rr := &DNSResource{Name: name, Type: dns_name_of(dns_types, t, "TYPE"), Class: dns_name_of(dns_classes, class, "CLASS"), TTL: ttl}
+	if t == 41 {
+		rr.Class = "" // the requestor's UDP payload size instead
+		rr.Data = fmt.Sprintf("udp %d, version %d, flags %04x", class, ttl>>16&0xff, ttl&0xffff)
+		return rr
+	}
+	var err error
+	if rr.Data, err = dns_rdata(r.msg, start, data, t); err != nil {
+		rr.Data = "\\# " + hex.EncodeToString(data) // undecodable, as RFC 3597 writes it
+	}
+	return rr
+}
+
+// The record data in presentation format; names inside it may point
+// anywhere in msg
+func dns_rdata(msg []byte, start int, data []byte, t uint16) (string, error) {
+	d := &dns_reader{msg: msg[:start+len(data)], i: start}
+	var s string
+	switch t {
+	case 1, 28: // A, AAAA
+		if (t == 1 && len(data) != 4) || (t == 28 && len(data) != 16) {
+			return "", errDNSShort
+		}
+		s = net.IP(data).String()
+	case 2, 5, 12, 39: // NS, CNAME, PTR, DNAME
+		s = d.name()
+	case 15: // MX
+		pref := d.uint16()
+		s = fmt.Sprintf("%d %s", pref, d.name())
+	case 6: // SOA
+		mname, rname := d.name(), d.name()
+		s = fmt.Sprintf("%s %s %d %d %d %d %d", mname, rname, d.uint32(), d.uint32(), d.uint32(), d.uint32(), d.uint32())
+	case 33: // SRV
+		prio, weight, port := d.uint16(), d.uint16(), d.uint16()
+		s = fmt.Sprintf("%d %d %d %s", prio, weight, port, d.name())
+	case 16, 99: // TXT, SPF
+		var parts []string
+		for d.err == nil && d.i < len(d.msg) {
+			l := d.take(1)
+			if l == nil {
+				break
+			}
+			parts = append(parts, fmt.Sprintf("%q", d.take(int(l[0]))))
+		}
+		s = strings.Join(parts, " ")
+	case 257: // CAA
+		flags := d.take(1)
+		if flags == nil {
+			return "", errDNSShort
+		}
+		l := d.take(1)
+		if l == nil {
+			return "", errDNSShort
+		}
+		tag := d.take(int(l[0]))
+		s = fmt.Sprintf("%d %s %q", flags[0], tag, d.msg[d.i:])
+		d.i = len(d.msg)
+	default:
+		return "\\# " + hex.EncodeToString(data), nil
+	}
+	if d.err != nil {
+		return "", d.err
+	}
+	return s, nil
+}
+
+func new_dns_parsers(conn_n int, logger chan *LogEvent, client_peer, server_peer string) (request, response *StreamParser) {
+	request = NewStreamParser(conn_n, client_to_server, client_peer, logger, decode_dns)
+	response = NewStreamParser(conn_n, server_to_client, server_peer, logger, decode_dns)
+	return
+}
+
+func decode_dns(r *bufio.Reader) (*LogEvent, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	rec, err := ParseDNSMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &LogEvent{Event: "dns_message", Length: len(msg) + 2, DNS: rec}, nil
+}
+
+func format_dns(e *LogEvent) string {
+	rec := e.DNS
+	var b strings.Builder
+	kind := "query"
+	if rec.Response {
+		kind = "response"
+	}
+	fmt.Fprintf(&b, "DNS %s from %s, id %d, %s", kind, e.Peer, rec.ID, rec.Opcode)
+	if rec.Response {
+		b.WriteString(", " + rec.RCode)
+	}
+	if len(rec.Flags) > 0 {
+		b.WriteString(", flags " + strings.Join(rec.Flags, " "))
+	}
+	fmt.Fprintf(&b, ", %d bytes\n", rec.Length)
+	for _, q := range rec.Questions {
+		fmt.Fprintf(&b, "  question: %s %s %s\n", q.Name, q.Class, q.Type)
+	}
+	for _, section := range []struct {
+		name string
+		rrs  []*DNSResource
+	}{{"answer", rec.Answers}, {"authority", rec.Authority}, {"additional", rec.Additional}} {
+		for _, rr := range section.rrs {
+			if rr.Type == "OPT" {
+				fmt.Fprintf(&b, "  %s: EDNS %s\n", section.name, rr.Data)
+				continue
+			}
+			fmt.Fprintf(&b, "  %s: %s %d %s %s %s\n", section.name, rr.Name, rr.TTL, rr.Class, rr.Type, rr.Data)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// The wire form of a name, uncompressed
+func dns_wire_name(name string) []byte {
+	var b []byte
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if l != "" {
+			b = append(append(b, byte(len(l))), l...)
+		}
+	}
+	return append(b, 0)
+}
+
+func dns_u16(v ...uint16) []byte {
+	var b []byte
+	for _, x := range v {
+		b = binary.BigEndian.AppendUint16(b, x)
+	}
+	return b
+}
+
+func dns_rr(name []byte, t, class uint16, ttl uint32, data ...[]byte) []byte {
+	d := bytes.Join(data, nil)
+	b := append(append([]byte{}, name...), dns_u16(t, class)...)
+	b = binary.BigEndian.AppendUint32(b, ttl)
+	return append(append(b, dns_u16(uint16(len(d)))...), d...)
+}
+
+// Pointer to the question name, right after the header
+var dns_ptr_question = []byte{0xc0, 12}
+
+// A query for www.example.com AAAA with EDNS and the response to it,
+// answers of every decoded type, with compressed names
+func dns_test_messages() (query, response []byte) {
+	query = bytes.Join([][]byte{
+		dns_u16(0xbeef, 0x0100, 1, 0, 0, 1), // rd
+		dns_wire_name("www.example.com"), dns_u16(28, 1),
+		dns_rr([]byte{0}, 41, 1232, 0x00008000), // EDNS version 0, DO
+	}, nil)
+	response = bytes.Join([][]byte{
+		dns_u16(0xbeef, 0x8580, 1, 7, 1, 0), // qr aa rd ra, NOERROR
+		dns_wire_name("www.example.com"), dns_u16(28, 1),
+		dns_rr(dns_ptr_question, 5, 1, 300, []byte{4, 'w', 'e', 'b', '1', 0xc0, 16}), // web1.example.com.
+		dns_rr([]byte{4, 'w', 'e', 'b', '1', 0xc0, 16}, 28, 1, 60,
+			[]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}),
+		dns_rr([]byte{0xc0, 16}, 1, 1, 60, []byte{192, 0, 2, 1}),
+		dns_rr([]byte{0xc0, 16}, 15, 1, 3600, dns_u16(10), dns_wire_name("mail.example.com")),
+		dns_rr([]byte{0xc0, 16}, 16, 1, 3600, []byte("\x0bv=spf1 -all\x05hello")),
+		dns_rr(dns_wire_name("_sip._tcp.example.com"), 33, 1, 86400, dns_u16(0, 5, 5060), dns_wire_name("sip.example.com")),
+		dns_rr([]byte{0xc0, 16}, 257, 1, 86400, []byte("\x00\x05issueletsencrypt.org")),
+		dns_rr([]byte{0xc0, 16}, 6, 1, 900, dns_wire_name("ns1.example.com"), dns_wire_name("hostmaster.example.com"),
+			[]byte{0x78, 0x49, 0x4f, 0x88, 0, 0, 0x1c, 0x20, 0, 0, 0x0e, 0x10, 0, 0x09, 0x3a, 0x80, 0, 0, 0x01, 0x2c}),
+	}, nil)
+	return
+}
+
+func TestParseDNSMessage(t *testing.T) {
+	query, response := dns_test_messages()
+	for _, tt := range []struct {
+		msg  []byte
+		want string
+	}{
+		{query, "DNS query from 127.0.0.1-53, id 48879, QUERY, flags rd, 44 bytes\n" +
+			"  question: www.example.com. IN AAAA\n" +
+			"  additional: EDNS udp 1232, version 0, flags 8000\n"},
+		{response, "DNS response from 127.0.0.1-53, id 48879, QUERY, NOERROR, flags aa rd ra, 326 bytes\n" +
+			"  question: www.example.com. IN AAAA\n" +
+			"  answer: www.example.com. 300 IN CNAME web1.example.com.\n" +
+			"  answer: web1.example.com. 60 IN AAAA 2001:db8::1\n" +
+			"  answer: example.com. 60 IN A 192.0.2.1\n" +
+			"  answer: example.com. 3600 IN MX 10 mail.example.com.\n" +
+			"  answer: example.com. 3600 IN TXT \"v=spf1 -all\" \"hello\"\n" +
+			"  answer: _sip._tcp.example.com. 86400 IN SRV 0 5 5060 sip.example.com.\n" +
+			"  answer: example.com. 86400 IN CAA 0 issue \"letsencrypt.org\"\n" +
+			"  authority: example.com. 900 IN SOA ns1.example.com. hostmaster.example.com. 2018070408 7200 3600 604800 300\n"},
+	} {
+		rec, err := ParseDNSMessage(tt.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := format_dns(&LogEvent{Peer: "127.0.0.1-53", DNS: rec})
+		if got != tt.want {
+			t.Errorf("decoded as\n%s\nwant\n%s", got, tt.want)
+		}
+	}
+}
+
+func TestParseDNSMessageCodes(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		msg   []byte
+		check func(*DNSRecord) bool
+	}{
+		{"NXDOMAIN truncated", bytes.Join([][]byte{dns_u16(1, 0x8203, 0, 0, 0, 0)}, nil),
+			func(r *DNSRecord) bool { return r.RCode == "NXDOMAIN" && strings.Join(r.Flags, " ") == "tc" }},
+		{"NOTIFY", dns_u16(1, 0x2000, 0, 0, 0, 0),
+			func(r *DNSRecord) bool { return r.Opcode == "NOTIFY" && !r.Response && r.RCode == "" }},
+		{"BADVERS from the EDNS upper bits", bytes.Join([][]byte{dns_u16(1, 0x8000, 0, 0, 0, 1), dns_rr([]byte{0}, 41, 1232, 0x01000000)}, nil),
+			func(r *DNSRecord) bool { return r.RCode == "16" }},
+		{"unknown type and class", bytes.Join([][]byte{dns_u16(1, 0x8000, 1, 1, 0, 0),
+			dns_wire_name("x"), dns_u16(65280, 65280), dns_rr(dns_ptr_question, 65280, 1, 0, []byte{0xca, 0xfe})}, nil),
+			func(r *DNSRecord) bool {
+				return r.Questions[0] == DNSQuestion{"x.", "TYPE65280", "CLASS65280"} && r.Answers[0].Data == `\# cafe`
+			}},
+		{"escaped label", bytes.Join([][]byte{dns_u16(1, 0, 1, 0, 0, 0), []byte("\x03a.b\x02\x00\\\x00"), dns_u16(1, 1)}, nil),
+			func(r *DNSRecord) bool { return r.Questions[0].Name == `a\.b.\000\\.` }},
+		{"A of the wrong size", bytes.Join([][]byte{dns_u16(1, 0x8000, 0, 1, 0, 0), dns_rr([]byte{0}, 1, 1, 0, []byte{1, 2, 3})}, nil),
+			func(r *DNSRecord) bool { return r.Answers[0].Data == `\# 010203` }},
+	} {
+		rec, err := ParseDNSMessage(tt.msg)
+		if err != nil || !tt.check(rec) {
+			t.Errorf("%s: %+v, %v", tt.name, rec, err)
+		}
+	}
+}
+
+func TestParseDNSMessageErrors(t *testing.T) {
+	_, response := dns_test_messages()
+	for _, tt := range []struct {
+		name string
+		msg  []byte
+	}{
+		{"short header", dns_u16(1, 0, 1)},
+		{"missing question", dns_u16(1, 0, 1, 0, 0, 0)},
+		{"cut off in an answer", response[:len(response)-10]},
+		{"pointer loop", bytes.Join([][]byte{dns_u16(1, 0, 1, 0, 0, 0), []byte{0xc0, 12}, dns_u16(1, 1)}, nil)},
+		{"pointer past the end", bytes.Join([][]byte{dns_u16(1, 0, 1, 0, 0, 0), []byte{0xc0, 0xff}, dns_u16(1, 1)}, nil)},
+		{"reserved label type", bytes.Join([][]byte{dns_u16(1, 0, 1, 0, 0, 0), []byte{0x40, 0}, dns_u16(1, 1)}, nil)},
+	} {
+		if rec, err := ParseDNSMessage(tt.msg); err == nil {
+			t.Errorf("%s: accepted as %+v", tt.name, rec)
+		}
+	}
+}
+
+// The TCP length prefix, messages split across chunks and a zone transfer
+// answered by several messages in a row
+func TestDecodeDNSStream(t *testing.T) {
+	query, response := dns_test_messages()
+	framed := func(msgs ...[]byte) []byte {
+		var b []byte
+		for _, m := range msgs {
+			b = append(append(b, dns_u16(uint16(len(m)))...), m...)
+		}
+		return b
+	}
+	axfr := bytes.Join([][]byte{dns_u16(2, 0, 1, 0, 0, 0), dns_wire_name("example.com"), dns_u16(252, 1)}, nil)
+	soa := bytes.Join([][]byte{dns_u16(2, 0x8400, 0, 1, 0, 0),
+		dns_rr(dns_wire_name("example.com"), 6, 1, 900, []byte{0, 0}, make([]byte, 20))}, nil)
+	a := bytes.Join([][]byte{dns_u16(2, 0x8400, 0, 1, 0, 0), dns_rr(dns_wire_name("example.com"), 1, 1, 900, []byte{192, 0, 2, 1})}, nil)
+	for _, chunk := range []int{1, 3, 1 << 20} {
+		logger := make(chan *LogEvent)
+		request, reply := new_dns_parsers(1, logger, "127.0.0.1-50000", "127.0.0.1-53")
+		events := feed_parsers(t, logger, []*StreamParser{request, reply},
+			[][]byte{framed(query, axfr), framed(response, soa, a, soa)}, chunk)
+		var got []string
+		for _, e := range events {
+			if e.DNS == nil {
+				t.Fatalf("chunks of %d: a %s event, the decoder gave up", chunk, e.Event)
+			}
+			got = append(got, strings.SplitN(format_dns(e), "\n", 2)[0])
+		}
+		want := []string{
+			"DNS query from 127.0.0.1-50000, id 48879, QUERY, flags rd, 44 bytes",
+			"DNS query from 127.0.0.1-50000, id 2, QUERY, 29 bytes",
+			"DNS response from 127.0.0.1-53, id 48879, QUERY, NOERROR, flags aa rd ra, 326 bytes",
+			"DNS response from 127.0.0.1-53, id 2, QUERY, NOERROR, flags aa, 57 bytes",
+			"DNS response from 127.0.0.1-53, id 2, QUERY, NOERROR, flags aa, 39 bytes",
+			"DNS response from 127.0.0.1-53, id 2, QUERY, NOERROR, flags aa, 57 bytes",
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("chunks of %d logged\n%s\nwant\n%s", chunk, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
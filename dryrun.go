@@ -0,0 +1,30 @@
+/*
+Dry run mode.
+
+With -dry-run the target is still dialed, so the client sees a working
+connection, but nothing it sends is written upstream. Every chunk is
+logged as usual together with what would have been forwarded. The server
+never gets a request to answer, so its side of the connection isn't read
+at all; the connection lasts until the client disconnects or the idle
+timeout fires.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+var dry_run *bool = flag.Bool("dry-run", false, "log the client's traffic without forwarding it to the target")
+
+// The server→client copier has nothing to do in a dry run
+func dry_run_idle(c *Channel) bool {
+	return *dry_run && c.direction == server_to_client
+}
+
+// Turns the sent event of a chunk that was kept from the target into a dry_run one
+func dry_run_event(e *LogEvent, n int) {
+	e.Event = "dry_run"
+	e.Message = fmt.Sprintf("[DRY-RUN] Would have forwarded %d bytes to %s", n, e.Peer)
+}
@@ -0,0 +1,139 @@
+/*
+Targets from a pinned eBPF map (-ebpf-map).
+
+	-host default.svc -port 80 -listen_port 8080 -ebpf-map /sys/fs/bpf/gotcpspy_targets
+
+looks up every client's IP address in the BPF hash map pinned at that
+path, which some other program (a CNI plugin, an operator, bpftool)
+fills in. A client with an entry is sent to the target in it; everyone
+else goes to -host/-port, or -map, -upstream as usual. Entries are
+read when a client connects, so changes apply to new connections
+straight away.
+
+The map's key is the client address in network byte order: 4 bytes
+for a map of IPv4 clients, 16 for IPv6 (there IPv4 clients appear as
+::ffff:a.b.c.d). The value is either an address and port in network
+byte order, 6 bytes for IPv4 or 18 for IPv6, or a host:port string,
+padded with NULs to the value size, for example
+
+	bpftool map update pinned /sys/fs/bpf/gotcpspy_targets \
+		key 10 0 0 7 value 10 0 1 20 0x1f 0x90
+
+to send 10.0.0.7 to 10.0.1.20:8080.
+
+Maps are read with the bpf(2) system call, no library needed; that is
+Linux only, and bpf.go sets open_ebpf_map there. Elsewhere -ebpf-map is
+refused.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var ebpf_map_path *string = flag.String("ebpf-map", "", "send clients to the target for their IP in the BPF hash map pinned here")
+
+// What EBPFTargetResolver needs of a map
+type ebpf_map interface {
+	KeySize() int
+	ValueSize() int
+	// Fills value for key, false if there is no entry
+	Lookup(key, value []byte) (bool, error)
+}
+
+// Opens the map pinned at path, set by bpf.go on Linux
+var open_ebpf_map = func(path string) (ebpf_map, error) {
+	return nil, errors.New("eBPF maps are only supported on Linux")
+}
+
+type EBPFTargetResolver struct {
+	m ebpf_map
+}
+
+var ebpf_resolver *EBPFTargetResolver // nil without -ebpf-map
+
+func NewEBPFTargetResolver(m ebpf_map) (*EBPFTargetResolver, error) {
+	if k := m.KeySize(); k != net.IPv4len && k != net.IPv6len {
+		return nil, fmt.Errorf("map keys of %d bytes, not an IPv4 or IPv6 address", k)
+	}
+	return &EBPFTargetResolver{m: m}, nil
+}
+
+// The target for clientIP, if the map has one
+func (r *EBPFTargetResolver) Resolve(clientIP string) (target string, found bool) {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return "", false
+	}
+	key := ip.To16()
+	if r.m.KeySize() == net.IPv4len {
+		if key = ip.To4(); key == nil {
+			return "", false
+		}
+	}
+	value := make([]byte, r.m.ValueSize())
+	found, err := r.m.Lookup(key, value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to look up %s in %s, %v\n", clientIP, *ebpf_map_path, err)
+		return "", false
+	}
+	if !found {
+		return "", false
+	}
+	if target, err = ebpf_target_value(value); err != nil {
+		fmt.Fprintf(os.Stderr, "Ignoring the entry for %s in %s, %v\n", clientIP, *ebpf_map_path, err)
+		return "", false
+	}
+	return target, true
+}
+
+// Decodes a map value, an address and port or a host:port string
+func ebpf_target_value(v []byte) (string, error) {
+	switch len(v) {
+	case net.IPv4len + 2, net.IPv6len + 2:
+		ip := net.IP(v[:len(v)-2])
+		port := binary.BigEndian.Uint16(v[len(v)-2:])
+		return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+	}
+	s, _, _ := strings.Cut(string(v), "\x00")
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return "", fmt.Errorf("value %q is not host:port", s)
+	}
+	return s, nil
+}
+
+// The target the map has for the client at addr
+func ebpf_target(addr net.Addr) (string, bool) {
+	if ebpf_resolver == nil {
+		return "", false
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "", false
+	}
+	return ebpf_resolver.Resolve(host)
+}
+
+func init_ebpf_map() {
+	if *ebpf_map_path == "" {
+		return
+	}
+	if *proto == "udp" || unix_mode() || *mode != "forward" {
+		die("-ebpf-map only works for TCP clients with a fixed target")
+	}
+	m, err := open_ebpf_map(*ebpf_map_path)
+	if err != nil {
+		die("Unable to open %s, %v", *ebpf_map_path, err)
+	}
+	if ebpf_resolver, err = NewEBPFTargetResolver(m); err != nil {
+		die("Unable to use %s, %v", *ebpf_map_path, err)
+	}
+}
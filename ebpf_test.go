@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// An ebpf_map in memory, keyed by the key bytes
+type mock_ebpf_map struct {
+	key_size, value_size int
+	entries              map[string][]byte
+	err                  error
+}
+
+func (m *mock_ebpf_map) KeySize() int   { return m.key_size }
+func (m *mock_ebpf_map) ValueSize() int { return m.value_size }
+
+func (m *mock_ebpf_map) Lookup(key, value []byte) (bool, error) {
+	if m.err != nil {
+		return false, m.err
+	}
+	v, ok := m.entries[string(key)]
+	copy(value, v)
+	return ok, nil
+}
+
+func TestEBPFTargetResolverResolve(t *testing.T) {
+	ipv4 := &mock_ebpf_map{key_size: 4, value_size: 6, entries: map[string][]byte{
+		"\x0a\x00\x00\x07": {10, 0, 1, 20, 0x1f, 0x90},
+	}}
+	ipv6 := &mock_ebpf_map{key_size: 16, value_size: 18, entries: map[string][]byte{
+		"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01": {
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0x01, 0xbb},
+		"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x0a\x00\x00\x07": {
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 10, 0, 1, 21, 0, 80},
+	}}
+	names := &mock_ebpf_map{key_size: 4, value_size: 32, entries: map[string][]byte{
+		"\x0a\x00\x00\x07": []byte("backend.internal:8080"),
+		"\x0a\x00\x00\x08": []byte("no port"),
+	}}
+	broken := &mock_ebpf_map{key_size: 4, value_size: 6, err: errors.New("EPERM")}
+	tests := []struct {
+		name   string
+		m      *mock_ebpf_map
+		client string
+		target string
+		found  bool
+	}{
+		{"IPv4 entry", ipv4, "10.0.0.7", "10.0.1.20:8080", true},
+		{"IPv4 without an entry", ipv4, "10.0.0.8", "", false},
+		{"IPv6 client of an IPv4 map", ipv4, "2001:db8::1", "", false},
+		{"IPv4-mapped client of an IPv4 map", ipv4, "::ffff:10.0.0.7", "10.0.1.20:8080", true},
+		{"IPv6 entry", ipv6, "2001:db8::1", "[2001:db8::2]:443", true},
+		{"IPv4 client of an IPv6 map", ipv6, "10.0.0.7", "10.0.1.21:80", true},
+		{"host:port value", names, "10.0.0.7", "backend.internal:8080", true},
+		{"value that isn't host:port", names, "10.0.0.8", "", false},
+		{"not an address", ipv4, "localhost", "", false},
+		{"failing lookup", broken, "10.0.0.7", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewEBPFTargetResolver(tt.m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			target, found := r.Resolve(tt.client)
+			if target != tt.target || found != tt.found {
+				t.Errorf("Resolve(%q) = %q, %v, want %q, %v", tt.client, target, found, tt.target, tt.found)
+			}
+		})
+	}
+}
+
+func TestNewEBPFTargetResolverKeySize(t *testing.T) {
+	if _, err := NewEBPFTargetResolver(&mock_ebpf_map{key_size: 8, value_size: 6}); err == nil {
+		t.Error("a map with 8 byte keys was accepted")
+	}
+}
@@ -0,0 +1,49 @@
+/*
+Errors that end a single connection.
+
+Problems found at startup (bad flags, a listener that can't be opened)
+still go through die, before anything needs cleaning up. Once connections
+are being served nothing below the accept loop exits the process: a
+connection that can't be handshaked, dialed or logged returns a
+ProxyError, the accept loop reports it and the other connections carry
+on.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+type ProxyError struct {
+	ConnID int
+	Msg    string // what was being attempted
+	Err    error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("%s, %v", e.Msg, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+func connection_error(conn_n int, err error, format string, v ...interface{}) *ProxyError {
+	return &ProxyError{ConnID: conn_n, Msg: fmt.Sprintf(format, v...), Err: err}
+}
+
+// Runs one connection and reports why it couldn't be served, if it wasn't
+func serve_connection(ctx context.Context, local net.Conn, conn_n int, m *mapping) {
+	defer profile_connection(conn_n)()
+	err := process_connection(ctx, local, conn_n, m)
+	var pe *ProxyError
+	if errors.As(err, &pe) {
+		fmt.Printf("Connection %d: %v\n", pe.ConnID, pe)
+	} else if err != nil {
+		fmt.Printf("%v\n", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A log that can't be created and a target that can't be reached end the
+// connection with a ProxyError, where they used to end the process
+func TestProcessConnectionErrors(t *testing.T) {
+	saved_dir := *output_dir
+	t.Cleanup(func() { *output_dir = saved_dir })
+	*output_dir = t.TempDir()
+	init_log_names()
+	buffer_pool = NewBufferPool(*buf_size)
+
+	echo := start_echo_server(t)
+	host, port, _ := net.SplitHostPort(echo.Addr().String())
+	not_a_dir := filepath.Join(*output_dir, "file")
+	os.WriteFile(not_a_dir, nil, 0644)
+	for _, tt := range []struct {
+		name, port, log_prefix, msg string
+		path_error                  bool // from the file system
+	}{
+		{"bad output directory", port, filepath.Join(not_a_dir, "log"), "Unable to log the connection", true},
+		{"target down", free_port(t), filepath.Join(*output_dir, "log"), "Unable to connect to 127.0.0.1:", false},
+	} {
+		client, local := tcp_pair(t)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		m := &mapping{host: host, port: tt.port, log_prefix: tt.log_prefix}
+		active_connections.Add(1)
+		err := process_connection(context.Background(), local, 7, m)
+		var pe *ProxyError
+		var path_err *fs.PathError
+		if !errors.As(err, &pe) || pe.ConnID != 7 || !strings.HasPrefix(pe.Msg, tt.msg) || errors.As(err, &path_err) != tt.path_error {
+			t.Errorf("%s: returned %#v, want a ProxyError %q", tt.name, err, tt.msg)
+		}
+		if b, err := io.ReadAll(client); len(b) != 0 || err != nil {
+			t.Errorf("%s: the client got %q, %v, want the connection closed", tt.name, b, err)
+		}
+		client.Close()
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Fan-out to shadow upstreams (-fanout).
+
+	-fanout 10.0.0.1:80,10.0.0.2:80,10.0.0.3:80
+
+takes the place of -host and -port: the first address is the target,
+the others are shadows. Every connection is opened to all of them, the
+client's bytes are sent to each, as forwarded to the target, and only
+the target's responses go back to the client. What the shadows answer
+is logged as hex dumps and then thrown away, to watch a new version of
+a service handle real traffic.
+
+A shadow never holds the target up: its chunks are queued without
+blocking and dropped while it is slow, and once the connection is over
+it gets fanout_wait to finish its responses. A shadow that can't be
+reached is logged and left out.
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Repeated -fanout flags, each a comma separated list of host:port
+type fanout_flags []string
+
+func (f *fanout_flags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *fanout_flags) Set(value string) error {
+	for _, addr := range strings.Split(value, ",") {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("%q is not host:port, %v", addr, err)
+		}
+		*f = append(*f, addr)
+	}
+	return nil
+}
+
+var fanout fanout_flags
+
+func init() {
+	flag.Var(&fanout, "fanout", "target,shadow,... host:port list: the target answers the client, the shadows get copies of its data")
+}
+
+const (
+	fanout_queue_size    = 256
+	fanout_write_timeout = time.Second
+	fanout_wait          = 2 * time.Second // for the shadows to finish answering
+)
+
+// One shadow of a connection
+type fanout_upstream struct {
+	addr     string
+	conn     net.Conn
+	queue    chan []byte
+	sent     chan bool // closed when the queue is drained
+	done     chan bool // closed when the responses end
+	dropped  int64
+	offset   int
+	packet_n int
+}
+
+// The shadows of one connection
+type FanOutSession struct {
+	conn_n  int
+	logger  chan *LogEvent
+	shadows []*fanout_upstream
+}
+
+// Connects to the shadows, all at once; nil without -fanout
+func NewFanOutSession(conn_n int, logger chan *LogEvent) *FanOutSession {
+	if len(fanout) < 2 {
+		return nil
+	}
+	s := &FanOutSession{conn_n: conn_n, logger: logger}
+	conns := make([]net.Conn, len(fanout)-1)
+	errs := make([]error, len(conns))
+	var wg sync.WaitGroup
+	for i, addr := range fanout[1:] {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conns[i], errs[i] = dial_shadow(addr)
+		}()
+	}
+	wg.Wait()
+	for i, addr := range fanout[1:] {
+		if errs[i] != nil {
+			logger <- log_message(conn_n, "fanout", "Unable to connect to shadow %s, %v", addr, errs[i])
+			continue
+		}
+		u := &fanout_upstream{addr: addr, conn: conns[i], queue: make(chan []byte, fanout_queue_size),
+			sent: make(chan bool), done: make(chan bool)}
+		s.shadows = append(s.shadows, u)
+		go s.send_loop(u)
+		go s.read_loop(u)
+	}
+	return s
+}
+
+// In TLS mode the shadows are spoken to over TLS too
+func dial_shadow(addr string) (net.Conn, error) {
+	conn, err := dial_target("tcp", addr)
+	if err != nil || !*tls_mode {
+		return conn, err
+	}
+	server_name, _, _ := net.SplitHostPort(addr)
+	tls_conn, err := tls_connect(conn, server_name)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tls_conn, nil
+}
+
+// Queues a copy of b for every shadow; never blocks
+func (s *FanOutSession) Write(b []byte) {
+	for _, u := range s.shadows {
+		d := make([]byte, len(b))
+		copy(d, b)
+		select {
+		case u.queue <- d:
+		default:
+			atomic.AddInt64(&u.dropped, int64(len(b)))
+		}
+	}
+}
+
+func (s *FanOutSession) send_loop(u *fanout_upstream) {
+	defer close(u.sent)
+	failed := false
+	for b := range u.queue {
+		if failed {
+			atomic.AddInt64(&u.dropped, int64(len(b)))
+			continue
+		}
+		u.conn.SetWriteDeadline(time.Now().Add(fanout_write_timeout))
+		if _, err := u.conn.Write(b); err != nil {
+			s.logger <- log_message(s.conn_n, "fanout", "Shadow %s stopped taking client data, %v", u.addr, err)
+			atomic.AddInt64(&u.dropped, int64(len(b)))
+			failed = true
+		}
+	}
+}
+
+// Logs the shadow's responses, they go nowhere else
+func (s *FanOutSession) read_loop(u *fanout_upstream) {
+	defer close(u.done)
+	b := make([]byte, 32*1024)
+	for {
+		n, err := u.conn.Read(b)
+		if n > 0 {
+			e := new_event(s.conn_n, server_to_client, "fanout_received", u.addr)
+			e.PacketSeq, e.ByteOffset, e.Length = u.packet_n, u.offset, n
+			e.HexPayload = hex.Dump(b[:n])
+			s.logger <- e
+			u.packet_n += 1
+			u.offset += n
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Sends the shadows what is still queued, gives them fanout_wait to
+// answer, and hangs up. Has to come before the loggers are stopped.
+func (s *FanOutSession) finish() {
+	if s == nil {
+		return
+	}
+	deadline := time.Now().Add(fanout_wait)
+	for _, u := range s.shadows {
+		close(u.queue)
+	}
+	for _, u := range s.shadows {
+		select {
+		case <-u.sent:
+			half_close(u.conn)
+			select {
+			case <-u.done:
+			case <-time.After(time.Until(deadline)):
+			}
+		case <-time.After(time.Until(deadline)):
+		}
+		u.conn.Close()
+		<-u.sent
+		<-u.done
+		msg := fmt.Sprintf("Shadow %s answered %d bytes", u.addr, u.offset)
+		if n := atomic.LoadInt64(&u.dropped); n > 0 {
+			msg += fmt.Sprintf(", missed %d bytes of client data", n)
+		}
+		s.logger <- log_message(s.conn_n, "fanout", "%s", msg)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Records what one connection sends until it half-closes, writing back
+// each chunk if echo is set and answer first otherwise
+func start_recording_server(t *testing.T, echo bool, answer string) (net.Listener, chan []byte) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	received := make(chan []byte, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer c.Close()
+		var b bytes.Buffer
+		c.Write([]byte(answer))
+		if echo {
+			io.Copy(io.MultiWriter(&b, c), c)
+		} else {
+			io.Copy(&b, c)
+		}
+		received <- b.Bytes()
+	}()
+	return l, received
+}
+
+// What the client sends reaches the target and the shadow byte for byte,
+// and only the target's answer gets back to the client
+func TestProxyFanOut(t *testing.T) {
+	saved_fanout, saved_dir := fanout, *output_dir
+	t.Cleanup(func() { fanout, *output_dir = saved_fanout, saved_dir })
+	*output_dir = t.TempDir()
+	init_log_names()
+	buffer_pool = NewBufferPool(*buf_size)
+
+	target, to_target := start_recording_server(t, true, "")
+	shadow, to_shadow := start_recording_server(t, false, "from the shadow")
+	fanout = fanout_flags{target.Addr().String(), shadow.Addr().String()}
+	host, port, _ := net.SplitHostPort(target.Addr().String())
+	m := &mapping{listen_port: free_port(t), host: host, port: port, log_prefix: filepath.Join(*output_dir, "log")}
+	p := NewProxy(m)
+	sessions := make(chan *Session, 1)
+	p.OnConnection(func(s *Session) { sessions <- s })
+	run_proxy(t, p)
+
+	conn := dial_proxy(t, m.listen_port)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	sent := random_bytes(100000)
+	for b := sent; len(b) > 0; b = b[min(len(b), 7000):] {
+		if _, err := conn.Write(b[:min(len(b), 7000)]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	reply, err := io.ReadAll(conn)
+	if err != nil || !bytes.Equal(reply, sent) {
+		t.Errorf("the client got %d bytes back, %v, want the %d it sent", len(reply), err, len(sent))
+	}
+	conn.Close()
+	if got := <-to_target; !bytes.Equal(got, sent) {
+		t.Errorf("the target got %d bytes, want %d", len(got), len(sent))
+	}
+	if got := <-to_shadow; !bytes.Equal(got, sent) {
+		t.Errorf("the shadow got %d bytes, want %d", len(got), len(sent))
+	}
+	<-sessions
+	active_connections.Wait()
+
+	names, _ := filepath.Glob(filepath.Join(*output_dir, "log-*-0001-*.log"))
+	var log []byte
+	for _, name := range names {
+		if !strings.Contains(name, "binary") {
+			log, _ = os.ReadFile(name)
+		}
+	}
+	for _, want := range []string{"15 bytes from shadow " + shadow.Addr().String() + ", not forwarded",
+		"Shadow " + shadow.Addr().String() + " answered 15 bytes\n"} {
+		if !strings.Contains(string(log), want) {
+			t.Errorf("%q not logged in %v:\n%.2000s", want, names, log)
+		}
+	}
+}
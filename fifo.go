@@ -0,0 +1,142 @@
+/*
+Named pipe output (-output-fifo).
+
+All connections are logged into one FIFO instead of files, in the -format
+of the connection logs, so the live traffic can be piped straight into
+grep, awk or anything else that reads a stream. In the text format every
+line starts with the connection number. The pipe is opened without
+blocking: while nobody reads it, and whenever the reader can't keep up,
+events are discarded instead of holding up the connections. A count of
+the discarded events is written once a reader is back.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+var output_fifo *string = flag.String("output-fifo", "", "log all connections to this named pipe, created if needed, instead of files")
+
+func init() {
+	backends.Register("fifo", func() (BackendStore, error) {
+		if *output_fifo == "" {
+			return nil, fmt.Errorf("-log-backend fifo needs -output-fifo")
+		}
+		return OpenFIFOBackend(*output_fifo)
+	})
+}
+
+type FIFOBackend struct {
+	mu        sync.Mutex
+	path      string
+	fd        int // -1 while no reader is attached
+	discarded int
+}
+
+// Creates the FIFO at path unless there already is one
+func OpenFIFOBackend(path string) (*FIFOBackend, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	if err == nil && fi.Mode()&os.ModeNamedPipe == 0 {
+		return nil, fmt.Errorf("%s exists and is not a named pipe", path)
+	}
+	if err != nil {
+		if err := syscall.Mkfifo(path, 0600); err != nil {
+			return nil, fmt.Errorf("unable to create %s, %v", path, err)
+		}
+	}
+	return &FIFOBackend{path: path, fd: -1}, nil
+}
+
+func (f *FIFOBackend) Open(conn_n int, local_info, remote_info string) (LogBackend, error) {
+	c := &fifo_connection{fifo: f, conn_n: conn_n}
+	c.logger = new_logger(&c.buf)
+	return c, nil
+}
+
+func (f *FIFOBackend) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fd >= 0 {
+		syscall.Close(f.fd)
+		f.fd = -1
+	}
+	return nil
+}
+
+// Writes b if a reader has room for all of it, discards it otherwise.
+// The raw syscalls keep the runtime from waiting for the pipe to drain.
+func (f *FIFOBackend) write(b []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fd < 0 {
+		fd, err := syscall.Open(f.path, syscall.O_WRONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+		if err != nil { // ENXIO: no reader
+			f.discarded += 1
+			return
+		}
+		f.fd = fd
+		if f.discarded > 0 {
+			f.write_all([]byte(fmt.Sprintf("[gotcpspy] %d events discarded while no reader was attached\n", f.discarded)))
+			f.discarded = 0
+		}
+	}
+	if !f.write_all(b) {
+		f.discarded += 1
+	}
+}
+
+// Gives up when the pipe is full, or the reader has gone away
+func (f *FIFOBackend) write_all(b []byte) bool {
+	for len(b) > 0 {
+		n, err := syscall.Write(f.fd, b)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, syscall.EAGAIN) { // EPIPE
+				syscall.Close(f.fd)
+				f.fd = -1
+			}
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
+
+type fifo_connection struct {
+	fifo   *FIFOBackend
+	conn_n int
+	buf    bytes.Buffer
+	logger Logger
+}
+
+func (c *fifo_connection) WriteEvent(e *LogEvent) error {
+	c.buf.Reset()
+	if err := c.logger.Log(e); err != nil {
+		return err
+	}
+	out := c.buf.Bytes()
+	if *log_format == "text" { // slog records have conn_id already
+		prefix := []byte(fmt.Sprintf("%04d ", c.conn_n))
+		lines := bytes.SplitAfter(bytes.TrimSuffix(out, []byte("\n")), []byte("\n"))
+		out = append(append(prefix, bytes.Join(lines, prefix)...), '\n')
+	}
+	c.fifo.write(out)
+	return nil
+}
+
+func (c *fifo_connection) Close() error {
+	return nil
+}
@@ -0,0 +1,142 @@
+/*
+Regex content filter (-filter-regex, -filter-log).
+
+Chunks are matched against the expression as they are forwarded and every
+match is written to the filter log with some context around it, the
+match itself between >>> and <<<, followed by the named groups. Matching
+runs in its own goroutine on copies of the chunks; when it falls behind,
+chunks are skipped (and counted) rather than holding up the connection.
+Matches that span two chunks are not found.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	filter_regex *string = flag.String("filter-regex", "", "log chunks matching this regular expression to -filter-log")
+	filter_log   *string = flag.String("filter-log", "filter.log", "file for the -filter-regex matches")
+)
+
+const (
+	filter_queue   = 1024
+	filter_context = 32 // bytes shown on each side of a match
+)
+
+type filter_chunk struct {
+	re        *regexp.Regexp // in effect when the chunk was offered
+	conn_n    int
+	direction string
+	peer      string
+	offset    int
+	data      []byte
+}
+
+type ContentFilter struct {
+	re      *regexp.Regexp // nil with -rules-file, which has the current one
+	f       *os.File
+	queue   chan filter_chunk
+	skipped int64
+}
+
+var content_filter *ContentFilter // nil without -filter-regex or -rules-file
+
+// An empty expr leaves the expression to the rule engine
+func NewContentFilter(expr, log_name string) (*ContentFilter, error) {
+	var re *regexp.Regexp
+	if expr != "" {
+		var err error
+		if re, err = regexp.Compile(expr); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(log_name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	cf := &ContentFilter{re: re, f: f, queue: make(chan filter_chunk, filter_queue)}
+	go cf.run()
+	return cf, nil
+}
+
+// Queues a copy of data without ever blocking the caller
+func (cf *ContentFilter) Offer(conn_n int, direction, peer string, offset int, data []byte) {
+	re := cf.re
+	if rule_engine != nil {
+		re = rule_engine.Rules().filter
+	}
+	if re == nil {
+		return
+	}
+	c := filter_chunk{re, conn_n, direction, peer, offset, append([]byte(nil), data...)}
+	select {
+	case cf.queue <- c:
+	default:
+		atomic.AddInt64(&cf.skipped, 1)
+	}
+}
+
+func (cf *ContentFilter) run() {
+	for c := range cf.queue {
+		if n := atomic.SwapInt64(&cf.skipped, 0); n > 0 {
+			fmt.Fprintf(cf.f, "[SKIPPED] %d chunks, the filter fell behind\n", n)
+		}
+		s := string(c.data)
+		for _, m := range c.re.FindAllStringSubmatchIndex(s, -1) {
+			cf.f.WriteString(cf.entry(c, s, m))
+		}
+	}
+}
+
+func (cf *ContentFilter) entry(c filter_chunk, s string, m []int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[MATCH] %s conn %d %s from %s at %08X: %q\n", format_time(time.Now()),
+		c.conn_n, c.direction, c.peer, c.offset+m[0], s[m[0]:m[1]])
+	from, to := m[0]-filter_context, m[1]+filter_context
+	if from < 0 {
+		from = 0
+	}
+	if to > len(s) {
+		to = len(s)
+	}
+	fmt.Fprintf(&b, "    %s>>>%s<<<%s\n", printable(s[from:m[0]]), printable(s[m[0]:m[1]]), printable(s[m[1]:to]))
+	for i, name := range c.re.SubexpNames() {
+		if name != "" && m[2*i] >= 0 {
+			fmt.Fprintf(&b, "    %s = %q\n", name, s[m[2*i]:m[2*i+1]])
+		}
+	}
+	return b.String()
+}
+
+// Replaces control characters and non ASCII bytes by dots, like hex.Dump
+func printable(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c < 32 || c > 126 {
+			b[i] = '.'
+		}
+	}
+	return string(b)
+}
+
+func init_filter() {
+	if *filter_regex == "" && rule_engine == nil {
+		return
+	}
+	expr := *filter_regex
+	if rule_engine != nil {
+		expr = ""
+	}
+	var err error
+	if content_filter, err = NewContentFilter(expr, *filter_log); err != nil {
+		die("Unable to set up the content filter, %v", err)
+	}
+}
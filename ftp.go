@@ -0,0 +1,409 @@
+/*
+FTP control channel decoding for the connection log (-proto ftp).
+
+Commands and replies are text lines (RFC 959); each command is logged as
+one line and each reply, multi-line ones included, as one entry with the
+command it answers:
+
+	C→S: USER anonymous
+	C→S: PASS [REDACTED]
+	S→C: 230 Login successful. (PASS)
+
+Passwords are only shown with -show-passwords. The data channel
+addresses negotiated with PORT, EPRT, PASV and EPSV are logged with the
+command or reply that carries them.
+
+File transfers and listings use separate data connections, which by
+default go straight from the client to the server. With -ftp-data-proxy
+the passive mode replies (227, 229) are rewritten to point at a port of
+ours instead, and the data connection is proxied through it and logged
+on the control connection with its byte counts. Active mode (PORT, EPRT)
+is left alone, the server connects to the client directly.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	show_passwords *bool = flag.Bool("show-passwords", false, "log passwords instead of [REDACTED]")
+	ftp_proxy_data *bool = flag.Bool("ftp-data-proxy", false, "with -proto ftp, also proxy the passive mode data connections")
+)
+
+const (
+	ftp_max_line     = 8192
+	ftp_queue        = 256 // pipelined commands waiting for their reply
+	ftp_data_timeout = 30 * time.Second
+	ftp_reply_wait   = 100 * time.Millisecond // for the command parser to catch up
+)
+
+type FTPRecord struct {
+	Command   string `json:"command,omitempty"`
+	Argument  string `json:"argument,omitempty"`
+	Code      int    `json:"code,omitempty"`
+	Text      string `json:"text,omitempty"` // of a reply, the lines joined with \n
+	InReplyTo string `json:"in_reply_to,omitempty"`
+	DataAddr  string `json:"data_addr,omitempty"` // host:port from PORT, EPRT, PASV or EPSV
+}
+
+var (
+	ftp_host_port = regexp.MustCompile(`(\d{1,3}),(\d{1,3}),(\d{1,3}),(\d{1,3}),(\d{1,3}),(\d{1,3})`)
+	ftp_epsv_port = regexp.MustCompile(`\((.)(.)(.)(\d+)(.)\)`)
+)
+
+// Turns command and reply lines into records. A reply that spans several
+// lines is collected until its last one.
+type FTPParser struct {
+	code  int // of the multi-line reply being read, 0 between replies
+	lines []string
+}
+
+func (p *FTPParser) ParseCommand(line string) *FTPRecord {
+	line = strings.TrimRight(line, "\r\n")
+	cmd, arg, _ := strings.Cut(line, " ")
+	rec := &FTPRecord{Command: strings.ToUpper(cmd), Argument: arg}
+	switch rec.Command {
+	case "PASS":
+		if !*show_passwords && arg != "" {
+			rec.Argument = "[REDACTED]"
+		}
+	case "PORT":
+		rec.DataAddr = ftp_parse_host_port(arg)
+	case "EPRT": // |1|132.235.1.2|6275|, the first character is the delimiter
+		if len(arg) > 1 {
+			f := strings.Split(arg, arg[:1])
+			if len(f) >= 4 {
+				rec.DataAddr = net.JoinHostPort(f[2], f[3])
+			}
+		}
+	}
+	return rec
+}
+
+// Returns nil, and no error, until the last line of a reply
+func (p *FTPParser) ParseReply(line string) (*FTPRecord, error) {
+	line = strings.TrimRight(line, "\r\n")
+	code, sep, text := ftp_reply_code(line)
+	if p.code == 0 {
+		if code == 0 {
+			return nil, fmt.Errorf("FTP reply %q has no reply code", line)
+		}
+		if sep == '-' {
+			p.code, p.lines = code, []string{text}
+			return nil, nil
+		}
+		return ftp_reply(code, text), nil
+	}
+	if code != p.code || sep != ' ' { // a line inside the reply
+		p.lines = append(p.lines, line)
+		return nil, nil
+	}
+	rec := ftp_reply(p.code, strings.Join(append(p.lines, text), "\n"))
+	p.code, p.lines = 0, nil
+	return rec, nil
+}
+
+// The three digit code of a reply line and the character after it
+func ftp_reply_code(line string) (code int, sep byte, text string) {
+	if len(line) < 3 {
+		return 0, 0, ""
+	}
+	n, err := strconv.Atoi(line[:3])
+	if err != nil || n < 100 || n > 599 {
+		return 0, 0, ""
+	}
+	if len(line) == 3 {
+		return n, ' ', ""
+	}
+	if line[3] != ' ' && line[3] != '-' {
+		return 0, 0, ""
+	}
+	return n, line[3], line[4:]
+}
+
+func ftp_reply(code int, text string) *FTPRecord {
+	rec := &FTPRecord{Code: code, Text: text}
+	switch code {
+	case 227:
+		rec.DataAddr = ftp_parse_host_port(text)
+	case 229:
+		if m := ftp_epsv_port.FindStringSubmatch(text); m != nil {
+			rec.DataAddr = ":" + m[4] // on the server's address
+		}
+	}
+	return rec
+}
+
+// h1,h2,h3,h4,p1,p2 as used by PORT and PASV
+func ftp_parse_host_port(s string) string {
+	m := ftp_host_port.FindStringSubmatch(s)
+	if m == nil {
+		return ""
+	}
+	var n [6]int
+	for i := range n {
+		n[i], _ = strconv.Atoi(m[i+1])
+		if n[i] > 255 {
+			return ""
+		}
+	}
+	return net.JoinHostPort(fmt.Sprintf("%d.%d.%d.%d", n[0], n[1], n[2], n[3]), strconv.Itoa(n[4]<<8|n[5]))
+}
+
+func new_ftp_parsers(conn_n int, logger chan *LogEvent, client_peer, server_peer string) (request, response *StreamParser) {
+	commands := make(chan string, ftp_queue)
+	request = NewStreamParser(conn_n, client_to_server, client_peer, logger, decode_ftp_command(commands))
+	response = NewStreamParser(conn_n, server_to_client, server_peer, logger, decode_ftp_reply(commands))
+	return
+}
+
+func read_ftp_line(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > ftp_max_line {
+		return "", fmt.Errorf("FTP line longer than %d bytes", ftp_max_line)
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(line), nil
+}
+
+func decode_ftp_command(commands chan string) decode_func {
+	p := &FTPParser{}
+	return func(r *bufio.Reader) (*LogEvent, error) {
+		line, err := read_ftp_line(r)
+		if err != nil {
+			return nil, err
+		}
+		rec := p.ParseCommand(line)
+		if rec.Command == "" {
+			return nil, nil // empty line
+		}
+		select {
+		case commands <- rec.Command:
+		default:
+		}
+		return &LogEvent{Event: "ftp_command", FTP: rec}, nil
+	}
+}
+
+func decode_ftp_reply(commands chan string) decode_func {
+	p := &FTPParser{}
+	greeted := false
+	return func(r *bufio.Reader) (*LogEvent, error) {
+		line, err := read_ftp_line(r)
+		if err != nil {
+			return nil, err
+		}
+		rec, err := p.ParseReply(line)
+		if rec == nil {
+			return nil, err
+		}
+		// the greeting and 1yz preliminary replies answer no command of their own
+		if greeted && rec.Code >= 200 {
+			select {
+			case rec.InReplyTo = <-commands:
+			case <-time.After(ftp_reply_wait):
+			}
+		}
+		greeted = true
+		return &LogEvent{Event: "ftp_reply", FTP: rec}, nil
+	}
+}
+
+func format_ftp(e *LogEvent) string {
+	rec := e.FTP
+	var s string
+	if e.Event == "ftp_command" {
+		s = "C→S: " + rec.Command
+		if rec.Argument != "" {
+			s += " " + rec.Argument
+		}
+	} else {
+		s = fmt.Sprintf("S→C: %d %s", rec.Code, rec.Text)
+		if rec.InReplyTo != "" {
+			s += " (" + rec.InReplyTo + ")"
+		}
+	}
+	if rec.DataAddr != "" {
+		s += ", data connection " + rec.DataAddr
+	}
+	return s + "\n"
+}
+
+// The data connections of one control connection, with -ftp-data-proxy
+type ftp_data_proxy struct {
+	conn_n    int
+	logger    chan *LogEvent
+	listen_ip string // where the client reached us
+	server_ip string
+	mu        sync.Mutex
+	closers   []io.Closer
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+func new_ftp_data_proxy(conn_n int, logger chan *LogEvent, local, remote net.Conn) *ftp_data_proxy {
+	listen_ip, _, _ := net.SplitHostPort(local.LocalAddr().String())
+	server_ip, _, _ := net.SplitHostPort(remote.RemoteAddr().String())
+	return &ftp_data_proxy{conn_n: conn_n, logger: logger, listen_ip: listen_ip, server_ip: server_ip}
+}
+
+// Points the passive mode replies in a chunk from the server at a port
+// of ours. Only replies that are complete within the chunk are rewritten,
+// which in practice is all of them.
+func (d *ftp_data_proxy) rewrite(b []byte) []byte {
+	if !bytes.Contains(b, []byte("227 ")) && !bytes.Contains(b, []byte("229 ")) {
+		return b
+	}
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	changed := false
+	for i, l := range lines {
+		if r := d.rewrite_line(l); r != nil {
+			lines[i], changed = r, true
+		}
+	}
+	if !changed {
+		return b
+	}
+	return bytes.Join(lines, nil)
+}
+
+func (d *ftp_data_proxy) rewrite_line(line []byte) []byte {
+	if !bytes.HasSuffix(line, []byte("\n")) {
+		return nil
+	}
+	code, sep, text := ftp_reply_code(strings.TrimRight(string(line), "\r\n"))
+	if sep != ' ' || (code != 227 && code != 229) {
+		return nil
+	}
+	rec := ftp_reply(code, text)
+	if rec.DataAddr == "" {
+		return nil
+	}
+	target := rec.DataAddr
+	if strings.HasPrefix(target, ":") {
+		target = net.JoinHostPort(d.server_ip, target[1:])
+	}
+	ip := net.ParseIP(d.listen_ip)
+	if code == 227 && ip.To4() == nil { // PASV can't describe anything else
+		return nil
+	}
+	port, err := d.listen(target)
+	if err != nil {
+		d.logger <- log_message(d.conn_n, "ftp_data", "Unable to proxy FTP data connection to %s, %v", target, err)
+		return nil
+	}
+	ending := line[len(bytes.TrimRight(line, "\r\n")):]
+	var s string
+	if code == 227 {
+		v4 := ip.To4()
+		s = fmt.Sprintf("227 Entering Passive Mode (%d,%d,%d,%d,%d,%d).", v4[0], v4[1], v4[2], v4[3], port>>8, port&0xff)
+	} else {
+		s = fmt.Sprintf("229 Entering Extended Passive Mode (|||%d|)", port)
+	}
+	d.logger <- log_message(d.conn_n, "ftp_data", "FTP data connection to %s goes through port %d", target, port)
+	return append([]byte(s), ending...)
+}
+
+func (d *ftp_data_proxy) track(c io.Closer) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		c.Close()
+		return false
+	}
+	d.closers = append(d.closers, c)
+	return true
+}
+
+func (d *ftp_data_proxy) is_closed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.closed
+}
+
+// Opens a port for one data connection to target and returns its number
+func (d *ftp_data_proxy) listen(target string) (int, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(d.listen_ip, "0"))
+	if err != nil {
+		return 0, err
+	}
+	if !d.track(ln) {
+		return 0, net.ErrClosed
+	}
+	d.wg.Add(1)
+	go d.serve(ln, target)
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (d *ftp_data_proxy) serve(ln net.Listener, target string) {
+	defer d.wg.Done()
+	defer ln.Close()
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(ftp_data_timeout))
+	client, err := ln.Accept()
+	if err != nil {
+		if d.is_closed() { // never used, and the control connection is over
+			return
+		}
+		d.logger <- log_message(d.conn_n, "ftp_data", "No FTP data connection for %s, %v", target, err)
+		return
+	}
+	ln.Close()
+	server, err := net.DialTimeout("tcp", target, ftp_data_timeout)
+	if err != nil {
+		client.Close()
+		d.logger <- log_message(d.conn_n, "ftp_data", "Unable to connect to FTP data port %s, %v", target, err)
+		return
+	}
+	if !d.track(client) || !d.track(server) {
+		client.Close()
+		server.Close()
+		return
+	}
+	started := time.Now()
+	var up int64
+	done := make(chan bool)
+	go func() {
+		n, _ := io.Copy(server, client)
+		atomic.StoreInt64(&up, n)
+		if cw, ok := server.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		close(done)
+	}()
+	down, _ := io.Copy(client, server)
+	client.Close()
+	<-done
+	server.Close()
+	d.logger <- log_message(d.conn_n, "ftp_data", "FTP data connection %s to %s done, %d bytes to the server, %d bytes to the client, %s",
+		client.RemoteAddr(), target, atomic.LoadInt64(&up), down, time.Since(started).Round(time.Millisecond))
+}
+
+// Ends the data connections that are still open, before the control
+// connection's log is closed
+func (d *ftp_data_proxy) close() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.closed = true
+	for _, c := range d.closers {
+		c.Close()
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An anonymous download, an active mode and an extended passive mode
+// listing, after the examples in RFC 959 and RFC 2428
+const (
+	ftp_test_commands = "USER anonymous\r\n" +
+		"PASS guest@example.com\r\n" +
+		"SYST\r\n" +
+		"FEAT\r\n" +
+		"\r\n" +
+		"type I\r\n" +
+		"PASV\r\n" +
+		"RETR readme.txt\r\n" +
+		"PORT 192,168,1,20,7,138\r\n" +
+		"EPRT |2|::1|6275|\r\n" +
+		"EPSV\r\n" +
+		"LIST\r\n" +
+		"QUIT\r\n"
+	ftp_test_replies = "220 FTP server ready.\r\n" +
+		"331 Anonymous login ok, send your email address as password.\r\n" +
+		"230 Anonymous access granted.\r\n" +
+		"215 UNIX Type: L8\r\n" +
+		"211-Features:\r\n" +
+		" MDTM\r\n" +
+		" EPSV\r\n" +
+		"211 End\r\n" +
+		"200 Type set to I\r\n" +
+		"227 Entering Passive Mode (192,168,1,10,195,80).\r\n" +
+		"150 Opening BINARY mode data connection for readme.txt (1024 bytes)\r\n" +
+		"226 Transfer complete\r\n" +
+		"200 PORT command successful\r\n" +
+		"200 EPRT command successful\r\n" +
+		"229 Entering Extended Passive Mode (|||50001|)\r\n" +
+		"150 Opening ASCII mode data connection for file list\r\n" +
+		"226 Transfer complete\r\n" +
+		"221 Goodbye.\r\n"
+)
+
+func TestDecodeFTPStream(t *testing.T) {
+	want := []string{
+		"C→S: USER anonymous",
+		"C→S: PASS [REDACTED]",
+		"C→S: SYST",
+		"C→S: FEAT",
+		"C→S: TYPE I",
+		"C→S: PASV",
+		"C→S: RETR readme.txt",
+		"C→S: PORT 192,168,1,20,7,138, data connection 192.168.1.20:1930",
+		"C→S: EPRT |2|::1|6275|, data connection [::1]:6275",
+		"C→S: EPSV",
+		"C→S: LIST",
+		"C→S: QUIT",
+		"S→C: 220 FTP server ready.",
+		"S→C: 331 Anonymous login ok, send your email address as password. (USER)",
+		"S→C: 230 Anonymous access granted. (PASS)",
+		"S→C: 215 UNIX Type: L8 (SYST)",
+		"S→C: 211 Features:\n MDTM\n EPSV\nEnd (FEAT)",
+		"S→C: 200 Type set to I (TYPE)",
+		"S→C: 227 Entering Passive Mode (192,168,1,10,195,80). (PASV), data connection 192.168.1.10:50000",
+		"S→C: 150 Opening BINARY mode data connection for readme.txt (1024 bytes)",
+		"S→C: 226 Transfer complete (RETR)",
+		"S→C: 200 PORT command successful (PORT)",
+		"S→C: 200 EPRT command successful (EPRT)",
+		"S→C: 229 Entering Extended Passive Mode (|||50001|) (EPSV), data connection :50001",
+		"S→C: 150 Opening ASCII mode data connection for file list",
+		"S→C: 226 Transfer complete (LIST)",
+		"S→C: 221 Goodbye. (QUIT)",
+	}
+	for _, chunk := range []int{1, 7, 1 << 20} {
+		logger := make(chan *LogEvent)
+		request, response := new_ftp_parsers(1, logger, "127.0.0.1-50000", "127.0.0.1-21")
+		events := feed_parsers(t, logger, []*StreamParser{request, response},
+			[][]byte{[]byte(ftp_test_commands), []byte(ftp_test_replies)}, chunk)
+		var got []string
+		for _, e := range events {
+			if e.FTP == nil {
+				t.Fatalf("chunks of %d: a %s event, the decoder gave up", chunk, e.Event)
+			}
+			got = append(got, strings.TrimSuffix(format_ftp(e), "\n"))
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("chunks of %d logged\n%s\nwant\n%s", chunk, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+func TestFTPParseCommandPasswords(t *testing.T) {
+	saved := *show_passwords
+	t.Cleanup(func() { *show_passwords = saved })
+	p := &FTPParser{}
+	for _, tt := range []struct {
+		show bool
+		line string
+		want string
+	}{
+		{false, "PASS secret\r\n", "[REDACTED]"},
+		{false, "pass secret\r\n", "[REDACTED]"},
+		{false, "PASS\r\n", ""}, // nothing to hide
+		{true, "PASS secret\r\n", "secret"},
+	} {
+		*show_passwords = tt.show
+		if rec := p.ParseCommand(tt.line); rec.Command != "PASS" || rec.Argument != tt.want {
+			t.Errorf("-show-passwords=%v: %q gave %s %q, want %q", tt.show, tt.line, rec.Command, rec.Argument, tt.want)
+		}
+	}
+}
+
+func TestFTPParseReply(t *testing.T) {
+	for _, tt := range []struct {
+		lines []string
+		want  *FTPRecord
+	}{
+		{[]string{"200 OK\r\n"}, &FTPRecord{Code: 200, Text: "OK"}},
+		{[]string{"200\r\n"}, &FTPRecord{Code: 200}},
+		// RFC 959 4.2: lines inside a multi-line reply may start with digits
+		{[]string{"123-First line\r\n", "Second line\r\n", "  234 A line beginning with numbers\r\n", "123 The last line\r\n"},
+			&FTPRecord{Code: 123, Text: "First line\nSecond line\n  234 A line beginning with numbers\nThe last line"}},
+		{[]string{"211-Status\r\n", "211-still going\r\n", "211 done\r\n"}, &FTPRecord{Code: 211, Text: "Status\n211-still going\ndone"}},
+		{[]string{"227 Entering Passive Mode (10,0,0,1,256,1)\r\n"}, &FTPRecord{Code: 227, Text: "Entering Passive Mode (10,0,0,1,256,1)"}},
+		{[]string{"229 Extended Passive Mode OK (!!!6446!)\r\n"}, &FTPRecord{Code: 229, Text: "Extended Passive Mode OK (!!!6446!)", DataAddr: ":6446"}},
+	} {
+		p := &FTPParser{}
+		var rec *FTPRecord
+		for i, line := range tt.lines {
+			var err error
+			if rec, err = p.ParseReply(line); err != nil {
+				t.Fatalf("%q: %v", line, err)
+			}
+			if (rec != nil) != (i == len(tt.lines)-1) {
+				t.Errorf("%q ended the reply early or not at all", line)
+			}
+		}
+		if rec == nil || *rec != *tt.want {
+			t.Errorf("%q parsed as %+v, want %+v", tt.lines, rec, tt.want)
+		}
+	}
+	for _, line := range []string{"hello\r\n", "20 short\r\n", "600 out of range\r\n", "200x\r\n"} {
+		if rec, err := (&FTPParser{}).ParseReply(line); err == nil {
+			t.Errorf("%q accepted as %+v", line, rec)
+		}
+	}
+}
+
+// With -ftp-data-proxy a PASV reply points at a port of ours that leads
+// to the port the server gave
+func TestFTPDataProxyPassive(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		c, err := server.Accept()
+		if err != nil {
+			return
+		}
+		c.Write([]byte("readme contents\n"))
+		c.Close()
+	}()
+	port := server.Addr().(*net.TCPAddr).Port
+
+	logger := make(chan *LogEvent, 10)
+	d := &ftp_data_proxy{conn_n: 1, logger: logger, listen_ip: "127.0.0.1", server_ip: "127.0.0.1"}
+	defer d.close()
+	reply := "150 Here it comes\r\n227 Entering Passive Mode (127,0,0,1," + strconv.Itoa(port>>8) + "," + strconv.Itoa(port&0xff) + ").\r\n"
+	out := string(d.rewrite([]byte(reply)))
+	m := regexp.MustCompile(`^150 Here it comes\r\n227 Entering Passive Mode \(127,0,0,1,(\d+),(\d+)\)\.\r\n$`).FindStringSubmatch(out)
+	if m == nil {
+		t.Fatalf("rewritten to %q", out)
+	}
+	p1, _ := strconv.Atoi(m[1])
+	p2, _ := strconv.Atoi(m[2])
+	if p1<<8|p2 == port {
+		t.Fatal("the reply still points at the server")
+	}
+	c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(p1<<8|p2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(c)
+	c.Close()
+	if err != nil || string(b) != "readme contents\n" {
+		t.Errorf("read %q, %v through the data proxy", b, err)
+	}
+	var msgs []string
+	for len(msgs) < 2 {
+		select {
+		case e := <-logger:
+			msgs = append(msgs, e.Message)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("logged only %q", msgs)
+		}
+	}
+	if !strings.Contains(msgs[0], "goes through port") || !strings.Contains(msgs[1], "16 bytes to the client") {
+		t.Errorf("logged %q", msgs)
+	}
+
+	// no complete passive reply, nothing to rewrite
+	for _, s := range []string{"200 OK\r\n", "227 Entering Passive Mode (127,0,0,1,4,1)."} {
+		if out := string(d.rewrite([]byte(s))); out != s {
+			t.Errorf("%q rewritten to %q", s, out)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Fuzz targets for the protocol decoders.
+
+	go test -fuzz=FuzzMQTTParser -fuzztime=60s $(ls *.go)
+
+Each target feeds the bytes to the decoder of both directions the way a
+StreamParser does, one message after the other until an error, and fails
+on a panic or on a decoder that returns a message without having read
+anything. The seeds are valid messages, given here and in
+testdata/fuzz/<target>/ in the go test corpus format; go test -fuzz adds
+the inputs that found a crash there as well.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+// Runs decode over data until it fails, which is how every stream ends
+func fuzz_decode(t *testing.T, data []byte, decode decode_func) {
+	r := bufio.NewReader(bytes.NewReader(data))
+	for i := 0; ; i++ {
+		if i > len(data) {
+			t.Fatalf("%d messages out of %d bytes, the decoder doesn't consume its input", i, len(data))
+		}
+		if _, err := decode(r); err != nil {
+			return
+		}
+	}
+}
+
+func FuzzMQTTParser(f *testing.F) {
+	f.Add([]byte("\x10\x0f\x00\x04MQTT\x04\x02\x00\x3c\x00\x03abc"))             // CONNECT
+	f.Add([]byte("\x20\x02\x00\x00"))                                            // CONNACK
+	f.Add([]byte("\x32\x09\x00\x03a/b\x00\x01hi"))                               // PUBLISH, QoS 1
+	f.Add([]byte("\x82\x08\x00\x01\x00\x03a/b\x01\x90\x03\x00\x01\x01\xc0\x00")) // SUBSCRIBE, SUBACK, PINGREQ
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzz_decode(t, data, decode_mqtt)
+		ParseMQTTPacket(data)
+	})
+}
+
+func FuzzRESPParser(f *testing.F) {
+	f.Add([]byte("*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"))
+	f.Add([]byte("+OK\r\n-ERR wrong type\r\n:42\r\n$-1\r\n*-1\r\n"))
+	f.Add([]byte("*2\r\n*1\r\n:1\r\n$5\r\nhello\r\n"))
+	f.Add([]byte("PING\r\nSET a b\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, inline := range []bool{true, false} {
+			p := NewRESPParser(bufio.NewReader(bytes.NewReader(data)), inline)
+			for i := 0; ; i++ {
+				if i > len(data) {
+					t.Fatalf("%d RESP values out of %d bytes", i, len(data))
+				}
+				if _, _, err := p.Next(); err != nil {
+					break
+				}
+			}
+		}
+	})
+}
+
+func FuzzHTTPParser(f *testing.F) {
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	f.Add([]byte("POST /form HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\na=1"))
+	f.Add([]byte("PUT /up HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhi\r\n0\r\n\r\n"))
+	f.Add([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nhi"))
+	f.Add([]byte("HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 204 No Content\r\n\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzz_decode(t, data, decode_http_request(make(chan http_exchange, len(data)+1), nil))
+		// an exchange for every response, the parser waits for one otherwise
+		exchanges := make(chan http_exchange, len(data)+1)
+		for i := 0; i <= len(data); i++ {
+			exchanges <- http_exchange{method: "GET", seq: i}
+		}
+		fuzz_decode(t, data, decode_http_response(exchanges, nil))
+	})
+}
+
+func FuzzPostgreSQLParser(f *testing.F) {
+	f.Add([]byte("\x00\x00\x00\x12\x00\x03\x00\x00user\x00bob\x00\x00" + // StartupMessage
+		"Q\x00\x00\x00\x0dSELECT 1\x00")) // Query
+	f.Add([]byte("\x00\x00\x00\x08\x04\xd2\x16\x2f"))  // SSLRequest
+	f.Add([]byte("R\x00\x00\x00\x08\x00\x00\x00\x00" + // AuthenticationOk
+		"T\x00\x00\x00\x1a\x00\x01a\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x17\x00\x04\xff\xff\xff\xff\x00\x00" + // RowDescription
+		"D\x00\x00\x00\x0b\x00\x01\x00\x00\x00\x011" + // DataRow
+		"Z\x00\x00\x00\x05I")) // ReadyForQuery
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frontend := &PostgreSQLParser{}
+		fuzz_decode(t, data, decode_postgres(frontend.ParseFrontend, pg_request_latency(nil)))
+		backend := &PostgreSQLParser{}
+		fuzz_decode(t, data, decode_postgres(backend.ParseBackend, pg_response_latency(nil)))
+	})
+}
@@ -0,0 +1,169 @@
+/*
+gotcpspy generate-cert: a CA for TLS interception.
+
+	gotcpspy generate-cert -out-dir certs [-algo rsa|ecdsa] [-validity-years 10]
+
+writes a new CA to certs/ca.crt and certs/ca.key, ready for -ca-cert and
+-ca-key, with a 2048 bit RSA key or, with -algo ecdsa, a P-256 one. The
+CA may only sign certificates and CRLs, and only leaf certificates.
+certs/leaf.crt and certs/leaf.key are a certificate for -leaf-host
+signed by it, made the way -tls makes them, for trying out a client's
+trust of the CA against a test server. leaf.crt has the CA certificate
+after the leaf.
+
+Existing files are never overwritten. Keys are PKCS #8 and only
+readable by their owner.
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A new CA key pair and its self-signed certificate, in DER
+func generate_ca(algo, name string, validity_years int) (crypto.Signer, []byte, error) {
+	var key crypto.Signer
+	var err error
+	switch algo {
+	case "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, nil, fmt.Errorf("unknown key algorithm %s", algo)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name, Organization: []string{"gotcpspy"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(validity_years, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, der, nil
+}
+
+// Writes PEM blocks to a file that must not exist yet
+func write_pem(path string, mode os.FileMode, blocks ...*pem.Block) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	for _, b := range blocks {
+		if err = pem.Encode(f, b); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+func write_key(path string, key any) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return write_pem(path, 0600, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// Writes the CA and a leaf certificate for leaf_host to dir
+func generate_cert_files(dir, algo, name, leaf_host string, validity_years int) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	files := []string{"ca.crt", "ca.key", "leaf.crt", "leaf.key"}
+	for i, f := range files {
+		files[i] = filepath.Join(dir, f)
+		if _, err := os.Stat(files[i]); err == nil {
+			return fmt.Errorf("%s already exists", files[i])
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	ca_crt, ca_key, leaf_crt, leaf_key := files[0], files[1], files[2], files[3]
+
+	key, der, err := generate_ca(algo, name, validity_years)
+	if err != nil {
+		return err
+	}
+	if err = write_key(ca_key, key); err != nil {
+		return err
+	}
+	if err = write_pem(ca_crt, 0644, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+		return err
+	}
+
+	ca, err := load_cert_authority(ca_crt, ca_key)
+	if err != nil {
+		return err
+	}
+	leaf, err := ca.leaf(leaf_host)
+	if err != nil {
+		return err
+	}
+	if err = write_key(leaf_key, leaf.PrivateKey); err != nil {
+		return err
+	}
+	var chain []*pem.Block
+	for _, c := range leaf.Certificate {
+		chain = append(chain, &pem.Block{Type: "CERTIFICATE", Bytes: c})
+	}
+	return write_pem(leaf_crt, 0644, chain...)
+}
+
+// The generate-cert subcommand, returns the exit status
+func generate_cert_command(args []string) int {
+	fs := flag.NewFlagSet("generate-cert", flag.ContinueOnError)
+	out_dir := fs.String("out-dir", ".", "directory for ca.crt, ca.key, leaf.crt and leaf.key")
+	algo := fs.String("algo", "rsa", "CA key, rsa (2048 bit) or ecdsa (P-256)")
+	validity_years := fs.Int("validity-years", 10, "years the CA certificate is valid")
+	name := fs.String("name", "gotcpspy interception CA", "common name of the CA")
+	leaf_host := fs.String("leaf-host", "localhost", "host name or IP address of the leaf certificate")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: gotcpspy generate-cert -out-dir dir [-algo rsa|ecdsa] [-validity-years n]\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 || *validity_years <= 0 || (*algo != "rsa" && *algo != "ecdsa") {
+		fs.Usage()
+		return 2
+	}
+	if err := generate_cert_files(*out_dir, *algo, *name, *leaf_host, *validity_years); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to generate the certificates, %v\n", err)
+		return 1
+	}
+	fmt.Printf("Wrote %s and %s, use them with -ca-cert and -ca-key\n",
+		filepath.Join(*out_dir, "ca.crt"), filepath.Join(*out_dir, "ca.key"))
+	return 0
+}
@@ -13,14 +13,18 @@ https://pragprog.com/magazines/2012-06/the-beauty-of-concurrency-in-go
 package main
 
 import (
-    "encoding/hex"
+    "context"
+ 	"errors"
  	"flag"
  	"fmt"
+ 	"io"
  	"net"
  	"os"
     "runtime"
  	"strings"
+ 	"sync"
  	"time"
+ 	"unicode"
 )
 
 // Global variables
@@ -28,42 +32,80 @@ var (
     host *string = flag.String("host", "", "target host or address")
     port *string = flag.String("port", "0", "target port")
     listen_port *string = flag.String("listen_port", "0", "listen port")
+    proto *string = flag.String("proto", "tcp", "protocol to proxy: tcp, udp, unix, http, grpc, h2, mqtt, redis, postgres, mysql, ftp, smtp, dns, modbus or auto")
+    mode *string = flag.String("mode", "forward", "forward to -host/-port, or socks5 or http-connect to let clients pick the target")
+    hex_only *bool = flag.Bool("hex-only", false, "write only the hex dump log of each connection, no binary logs")
+    binary_only *bool = flag.Bool("binary-only", false, "write only the binary logs of each connection, no hex dump log")
+
+    cert_authority *CertAuthority  // set when -ca-cert/-ca-key are given
+    buffer_pool *BufferPool
 )
 
 // Upon error, write error to Stderr
 func die(format string, v ...interface{}) {
+    stop_tui()
     os.Stderr.WriteString(fmt.Sprintf(format+"\n", v...))
     os.Exit(1)
 }
 
 // Hex dump logger
-func connection_logger(data chan []byte, conn_n int, local_info, remote_info string) {
- 	log_name := fmt.Sprintf("log-%s-%04d-%s-%s.log", 
-                          format_time(time.Now()), conn_n, local_info, remote_info)
-  logger_loop(data, log_name)
+func connection_logger(ctx context.Context, events chan *LogEvent, log_name string, opened chan error, grep *StreamingGrepFilter) {
+ 	if err := event_logger_loop(ctx, events, log_name, opened, grep); err != nil {
+ 	    discard_events(events)
+ 	}
 }
 
 // Binary dump logger
-func binary_logger(data chan []byte, conn_n int, peer string) {
- 	log_name := fmt.Sprintf("log-binary-%s-%04d-%s.log",
- 	                        format_time(time.Now()), conn_n, peer)
- 	logger_loop(data, log_name)
+func binary_logger(ctx context.Context, data chan []byte, log_name string, opened chan error) {
+ 	if err := logger_loop(ctx, data, log_name, opened); err != nil {
+ 	    discard_logger(data)
+ 	}
 }
 
-// Creates a log file, and then blocks for data
-func logger_loop(data chan []byte, log_name string) {
-    f, err := os.Create(log_name)
+// Creates a log file, reports on opened whether that worked, and then
+// blocks for data
+func logger_loop(ctx context.Context, data chan []byte, log_name string, opened chan error) error {
+    f, err := CreateRotatingFile(log_name, *max_log_size)
  	if err != nil {
- 	    die("Unable to create file %s, %v\n", log_name, err)
+ 	    err = fmt.Errorf("unable to create file %s: %w", log_name, err)
+ 	    opened <- err
+ 	    return err
  	}
  	defer f.Close()     // Ensures that the file will be closed
+ 	var w io.Writer = f
+ 	if framed_binary_logs() {
+ 	    w = NewBinaryLogWriter(f)
+ 	}
+ 	var timing *timing_writer
+ 	if *record_timing {
+ 	    if timing, err = create_timing_file(log_name); err != nil {
+ 	        err = fmt.Errorf("unable to create file %s.timing: %w", log_name, err)
+ 	        opened <- err
+ 	        return err
+ 	    }
+ 	    defer timing.Close()
+ 	}
+ 	opened <- nil
+ 	done := ctx.Done()
  	for {
- 	    b := <-data       // wait for data on channel 'data'
- 	    if len(b) == 0 {  // if empty data is received, we exit
- 	        break
+ 	    select {
+ 	    case b := <-data: // wait for data on channel 'data'
+ 	        if len(b) == 0 {  // if empty data is received, we exit
+ 	            return nil
+ 	        }
+ 	        if timing != nil {
+ 	            timing.record(len(b), time.Now())
+ 	        }
+ 	        w.Write(b)
+ 	        f.Sync()
+ 	    case <-rotation.wait():
+ 	        f.Rotate()
+ 	    case <-done:
+ 	        // the connection is going away, what was logged is final;
+ 	        // its last data and the stop sentinel are still on their way
+ 	        f.Sync()
+ 	        done = nil
  	    }
- 	    f.Write(b)
- 	    f.Sync()
  	}
 }
 
@@ -71,115 +113,725 @@ func format_time(t time.Time) string {
     return t.Format("2006.01.02-15.04.05")  // year.month.day-hour.minute.second
 }
 
+// Turns an address into a file name component: 127.0.0.1-8080, and for
+// IPv6 the colons become underscores, [fe80::1%eth0]:80 is fe80__1_eth0-80
 func printable_addr(a net.Addr) string {
-    return strings.Replace(a.String(), ":", "-", -1)
+    if a.String() == "" || a.String() == "@" { // client end of a Unix socket
+        return "unnamed"
+    }
+    host, port, err := net.SplitHostPort(a.String())
+    if err != nil {
+        return sanitize_name(a.String())
+    }
+    return sanitize_name(host) + "-" + port
+}
+
+// Keeps letters, digits, dots and dashes
+func sanitize_name(s string) string {
+    return strings.Map(func(r rune) rune {
+        if r < 128 && (r == '.' || r == '-' || unicode.IsLetter(r) || unicode.IsDigit(r)) {
+            return r
+        }
+        return '_'
+    }, s)
 }
  
 type Channel struct {
     from, to              net.Conn
-    logger, binary_logger chan []byte
+    conn_n                int
+    direction             string
+    logger                chan *LogEvent
+    binary_logger         chan []byte
+    pcap                  *PCAPWriter   // nil unless -pcap
+    parser                *StreamParser // nil when logging raw hex dumps
+    injector              *Injector     // nil unless -inject-file has rules for this direction
+    rules_version         int           // -rules-file version the injector was built from
+    stats                 *ConnectionInfo
+    timeouts              *conn_timeouts // shared by both directions
+    session               *SessionStats
+    diff                  *DiffSession   // nil unless -diff-reference
     ack                   chan bool
+    ctx                   context.Context // cancelled to abandon the connection
+    mirror                *MirrorConn
+    fanout                *FanOutSession // nil unless -fanout, only client to server
+    rewrite               func([]byte) []byte // changes what is forwarded, after injection
+    splice                bool // -no-log and no hooks, see can_splice
+    w                     *LoggingWriter
+}
+
+// The channel's LoggingWriter, so that whatever writes before pass_through
+// (-proto smtp) keeps the packet numbers and offsets going
+func (c *Channel) logging_writer() *LoggingWriter {
+	if c.w == nil {
+		c.w = NewLoggingWriter(c)
+	}
+	return c.w
+}
+
+// Starts a log event for this side of the connection
+func (c *Channel) event(kind, peer string) *LogEvent {
+	return new_event(c.conn_n, c.direction, kind, peer)
+}
+
+// Reads one direction for io.Copy, riding out the idle checks of the
+// timeouts. The error that ended the copy is kept for the disconnect event.
+// Whoever reads has to close c.from once the connection's context is done
+// (close_on_cancel), which is what ends a blocked Read.
+type channel_reader struct {
+	c   *Channel
+	err error
+}
+
+func (r *channel_reader) Read(b []byte) (int, error) {
+	for {
+		r.c.timeouts.before_read(r.c.from)
+		n, err := r.c.from.Read(b)
+		if err != nil && r.c.ctx.Err() != nil {
+			err = r.c.ctx.Err() // the socket was closed by close_on_cancel
+		}
+		if err != nil && r.c.timeouts.retry(err) {
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		if err != nil {
+			r.err = err
+		}
+		return n, err
+	}
+}
+
+// Closes the reading side of c once the connection's context is done;
+// the returned stop undoes that for when the reading is over
+func (c *Channel) close_on_cancel() (stop func() bool) {
+	from := c.from
+	return context.AfterFunc(c.ctx, func() { from.Close() })
+}
+
+// Everything that happens to a chunk on its way through: the logs,
+// injection, forwarding and the counters. A chunk the peer didn't get is
+// logged as a write_error, Write itself never fails so the copy goes on.
+// The forwarded bytes may differ from the logged ones (injection, -loss),
+// which is why this writes to the peer itself. Nothing keeps b after
+// Write returns, whatever outlives it gets a copy.
+type LoggingWriter struct {
+	c                  *Channel
+	from_peer, to_peer string
+	offset             int
+	packet_n           int
+}
+
+func NewLoggingWriter(c *Channel) *LoggingWriter {
+	return &LoggingWriter{c: c, from_peer: printable_addr(c.from.LocalAddr()), to_peer: printable_addr(c.to.LocalAddr())}
+}
+
+func (w *LoggingWriter) Write(b []byte) (int, error) {
+	c, n := w.c, len(b)
+	if n == 0 {
+		return 0, nil
+	}
+	received := time.Now()
+	c.timeouts.touch()
+	c.session.add(c.direction, n)
+	if content_filter != nil {
+		content_filter.Offer(c.conn_n, c.direction, w.from_peer, w.offset, b)
+	}
+	if c.parser != nil {
+		c.parser.Feed(b) // protocol records replace the hex dump
+	} else {
+		e := c.event("received", w.from_peer)
+		e.PacketSeq, e.ByteOffset, e.Length = w.packet_n, w.offset, n
+		e.dump_later(b)
+		e.Raw = raw_payload(b)
+		c.logger <- e
+	}
+	c.binary_logger <- append([]byte(nil), b...) // b is the copy's buffer, reused once Write returns
+	if c.pcap != nil {
+		c.pcap.WritePacket(c.direction, b, received)
+	}
+	inject_latency(direction_latency(c.direction))
+	out := b
+	c.refresh_injector()
+	if c.injector != nil {
+		var injected []Injection
+		out, injected = c.injector.Apply(b, int64(w.offset))
+		for _, i := range injected {
+			e := c.event("injected", w.to_peer)
+			e.PacketSeq, e.ByteOffset, e.Length = w.packet_n, int(i.At), len(i.Data)
+			e.dump_later(i.Data)
+			e.Raw = raw_payload(i.Data)
+			e.Message = "replace"
+			if i.Rule != nil {
+				e.Message = i.Rule.Mode
+			}
+			c.logger <- e
+		}
+	}
+	if c.rewrite != nil {
+		out = c.rewrite(out)
+	}
+	e := c.event("sent", w.to_peer)
+	if drop_chunk() {
+		e.Event = "dropped"
+	} else if *dry_run {
+		dry_run_event(e, len(out))
+	} else if _, err := c.to.Write(out); err != nil {
+		// received and logged above, but the peer never got it
+		metrics.error(&metrics.write_errors)
+		e.Event = "write_error"
+		e.Message = fmt.Sprintf("Write to %s failed, %d bytes not forwarded: %v", w.to_peer, len(out), err)
+	} else {
+		metrics.forwarded(c.direction, n)
+		global_stats.forwarded(c.direction, n)
+		c.stats.forwarded(c.direction, n)
+		if c.diff != nil {
+			c.diff.observe(c.direction, b, out)
+		}
+		if c.mirror != nil {
+			c.mirror.Write(out)
+		}
+		if c.fanout != nil {
+			c.fanout.Write(out)
+		}
+	}
+	e.PacketSeq, e.ByteOffset, e.Length = w.packet_n, w.offset, n
+	c.logger <- e
+	w.offset += n
+	w.packet_n += 1
+	return n, nil
+}
+
+// Why the copy ended, as the event that closes this direction's log
+func (c *Channel) disconnect_event(peer string, err error) *LogEvent {
+	e := c.event("disconnected", peer)
+	if reason := c.timeouts.reason(); reason != "" {
+		e.Event, e.Message = "timeout", reason
+	} else if err == nil || errors.Is(err, io.EOF) {
+		e.Message = fmt.Sprintf("Clean disconnect from %s", peer)
+	} else if errors.Is(err, errWriteFailed) {
+		e.Message = fmt.Sprintf("Stopped reading from %s, the other side can't be written to", peer)
+	} else if errors.Is(err, context.Canceled) {
+		e.Message = fmt.Sprintf("Closed %s, the connection was cancelled", peer)
+	} else if errors.Is(err, net.ErrClosed) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		// the other direction finished first and closed this socket, or
+		// timed out at the same moment and logged why
+		e.Message = fmt.Sprintf("Closed %s after the other side disconnected", peer)
+	} else {
+		metrics.error(&metrics.read_errors)
+		e.Event = "network_error"
+		e.Message = fmt.Sprintf("Network error from %s: %v", peer, err)
+	}
+	return e
 }
 
 // This is the heart of the program.  It copies both input and output streams
 // to a log (two logs - a binary format and a human readible one).
 // Any I/O errors are treated like disconnects.
 func pass_through(c *Channel) {
-    from_peer := printable_addr(c.from.LocalAddr())
- 	to_peer := printable_addr(c.to.LocalAddr())
- 	
- 	b := make([]byte, 10240)
- 	offset := 0
- 	packet_n := 0
- 	for {
- 	  n, err := c.from.Read(b)
- 	  if err != nil {
- 	      c.logger <- []byte(fmt.Sprintf("Disconnected from %s\n", from_peer))
- 	      break
- 	  }
- 	  if n > 0 {
- 	      c.logger <- []byte(fmt.Sprintf("Received (#%d, %08X)%d bytes from %s\n",
- 	               packet_n, offset, n, from_peer))
- 	      c.logger <- []byte(hex.Dump(b[:n]))
- 	      c.binary_logger <- b[:n]
- 	      c.to.Write(b[:n])
- 	      c.logger <- []byte(fmt.Sprintf("Sent (#%d) to %s\n",
- 	               packet_n, to_peer))
- 	      offset += n
- 	      packet_n += 1
- 	      }
- 	}
- 	c.from.Close()
- 	c.to.Close()
+ 	if dry_run_idle(c) {
+ 	    c.ack <- true
+ 	    return
+ 	}
+ 	w := c.logging_writer()
+ 	r := &channel_reader{c: c}
+ 	stop := c.close_on_cancel()
+ 	defer stop()
+ 	if !copy_unlogged(c, w, r) {
+ 	    b := buffer_pool.Get() // -buf-size, instead of io.Copy's own 32 KB
+ 	    io.CopyBuffer(w, r, b)
+ 	    buffer_pool.Put(b)
+ 	}
+ 	if c.parser != nil {
+ 	    c.parser.Close()
+ 	}
+ 	if c.mirror != nil {
+ 	    c.mirror.Close()
+ 	}
+ 	e := c.disconnect_event(w.from_peer, r.err)
+ 	if e.Event == "disconnected" && (r.err == nil || errors.Is(r.err, io.EOF)) && half_close(c.to) {
+ 	    // the other direction goes on until its side is done as well
+ 	    e.Message += ", half-closed the connection to " + w.to_peer
+ 	} else {
+ 	    c.from.Close()
+ 	    c.to.Close()
+ 	}
+ 	c.logger <- e
  	c.ack <- true       // signal to process_connection to shutdown
 }
 
+// Passes a clean end of stream on as a FIN (TCP half-close, close_notify
+// for TLS); false if conn can't shut down only its writing side
+func half_close(conn net.Conn) bool {
+	for {
+		switch c := conn.(type) {
+		case interface{ CloseWrite() error }:
+			return c.CloseWrite() == nil
+		case *preamble_conn:
+			conn = c.Conn
+		case *remap_conn:
+			c.flush()
+			conn = c.Conn
+		default:
+			return false
+		}
+	}
+}
+
 // Processes the entire connection.
 //  It connects to the remote socket, measures the duration of the connection,
 //  launches the loggers, and finally transfers the two data transferring threads.
-func process_connection(local net.Conn, conn_n int, target string) {
-    remote, err := net.Dial("tcp", target)
+//  In SOCKS5 and HTTP CONNECT mode the target comes from the client's
+//  handshake instead.
+//  In TLS mode both sides are wrapped before any data is copied, so the
+//  loggers see plaintext.
+//  A connection that can't be set up returns a ProxyError, the proxy
+//  itself carries on.
+func process_connection(ctx context.Context, local net.Conn, conn_n int, m *mapping) error {
+	defer active_connections.Done()
+	defer release_slot()
+	accepted := time.Now()
+	metrics.connection_opened()
+	global_stats.connection_opened()
+	defer func() {
+		metrics.connection_closed(time.Since(accepted))
+		global_stats.connection_closed()
+	}()
+	open_conns.add(local)
+	defer open_conns.remove(local)
+	if local = authenticate(local); local == nil {
+		return nil
+	}
+
+	target, via, err := read_target(local, m)
+	if err != nil {
+		local.Close()
+		return connection_error(conn_n, err, "%s handshake failed", *mode)
+	}
+	local, unique := dedup_connection(local, conn_n, target)
+	if !unique {
+		local.Close()
+		return nil
+	}
+
+    local, fast_open := tfo_first_data(local)
+    remote, err := connect_target(ctx, m.target_network(), target, fast_open)
+    if err != nil && *watch_mode {
+        remote, local, err = watch_dial(ctx, local, conn_n, m.target_network(), target, err)
+    }
+    reply_target(local, err == nil)
     if err != nil {
-	    fmt.Printf("Unable to connect to %s, %v\n", target, err)
+	    metrics.error(&metrics.dial_errors)
+	    local.Close()
+	    return connection_error(conn_n, err, "Unable to connect to %s", target)
 	}
-	
+	open_conns.add(remote)
+	defer open_conns.remove(remote)
+	defer release_target(remote) // the pool's own connection, not the wrappers below
+	local = throttle(local, client_bps)
+	remote = throttle(remote, server_bps)
+
+	client_cert := ""
+	if *tls_mode {
+		server_name, _, _ := net.SplitHostPort(target)
+		conn, sni, err := tls_accept(local, cert_authority, server_name)
+		if err == nil {
+			local = conn
+			client_cert = client_cert_description(conn.ConnectionState())
+			if sni != "" {
+				server_name = sni
+			}
+			var upstream net.Conn // a failed handshake returns a nil *tls.Conn
+			if upstream, err = tls_connect(remote, server_name); err == nil {
+				remote = upstream
+			}
+		}
+		if err != nil {
+			local.Close()
+			remote.Close()
+			return connection_error(conn_n, err, "TLS interception failed")
+		}
+	}
+	local, client_tag, err := accept_tag(local)
+	if err != nil {
+		local.Close()
+		remote.Close()
+		return connection_error(conn_n, err, "Unable to read the connection tag")
+	}
+	tag := *log_tag
+	if client_tag != "" {
+		tag = client_tag
+	}
+	diff, err := start_diff_session()
+	if err != nil {
+		local.Close()
+		remote.Close()
+		return connection_error(conn_n, err, "Unable to connect to the diff reference %s", *diff_reference)
+	}
+
+	protocol, preamble_n := Protocol(*proto), 0
+	if protocol == "auto" {
+		local, protocol, preamble_n = detect_protocol(local)
+	}
+
 	local_info := printable_addr(remote.LocalAddr())
     remote_info := printable_addr(remote.RemoteAddr())
 	
 	started := time.Now()
 	
-	logger := make(chan []byte)
-	from_logger := make(chan []byte)
-	to_logger := make(chan []byte)
+	stats := connections.Add(conn_n, m.listen_port, local.RemoteAddr(), remote.RemoteAddr())
+	defer connections.Remove(stats)
+	ctx, cancel := with_max_duration(ctx)
+	defer cancel()
+	// nothing has been copied yet, so a log that can't be written ends it
+	abort := func(err error) error {
+		local.Close()
+		remote.Close()
+		if diff != nil {
+			diff.reference.Close()
+		}
+		return &ProxyError{ConnID: conn_n, Msg: "Unable to log the connection", Err: err}
+	}
+	
+	var pcap *PCAPWriter
+	if *pcap_output {
+		pcap_name := fmt.Sprintf("%s-%s-%04d-%s-%s.pcap", m.log_prefix,
+			format_time(started), conn_n, local_info, remote_info)
+		f, err := os.Create(pcap_name)
+		if err != nil {
+			return abort(fmt.Errorf("unable to create file %s: %w", pcap_name, err))
+		}
+		defer f.Close()
+		pcap = NewPCAPWriter(f, local.RemoteAddr(), remote.RemoteAddr())
+		pcap.WriteGlobalHeader()
+	}
+	logger, from_logger, to_logger, grep, err := start_loggers(ctx, m, conn_n, local_info, remote_info, tag, stats)
+	if err != nil {
+		return abort(err)
+	}
+	sess := m.new_session(conn_n, local.RemoteAddr(), target, stats)
+	logger = NewFormattingLogger(sess.tee(logger)).Events()
 	ack := make(chan bool)
+	timeouts := new_conn_timeouts(ctx)
+	session := &SessionStats{}
+	fan := NewFanOutSession(conn_n, logger)
+	splice := *no_log && len(sess.loggers) == 0
 	
-	go connection_logger(logger, conn_n, local_info, remote_info)
-	go binary_logger(from_logger, conn_n, local_info)
-	go binary_logger(to_logger, conn_n, remote_info)
+	logger <- log_message(conn_n, "connected", "Connected to %s%s at %s",
+	            target, via, format_time(started))
+	if client_cert != "" {
+		logger <- log_message(conn_n, "client_cert", "Client certificate %s", client_cert)
+	}
 	
-	logger <- []byte(fmt.Sprintf("Connected to %s at %s\n",
-	            target, format_time(started)))
+	if client_tag != "" {
+		logger <- log_message(conn_n, "tag", "Tagged %s by the client", client_tag)
+	}
+	if *proto == "auto" {
+		logger <- log_message(conn_n, "protocol", "Protocol %s, detected from the first %d bytes", protocol, preamble_n)
+	}
+	request_parser, response_parser := new_protocol_parsers(protocol, conn_n, logger,
+		printable_addr(local.LocalAddr()), printable_addr(remote.LocalAddr()),
+		log_file_name(m, conn_n, local_info, remote_info, tag, ""))
+	var ftp_data *ftp_data_proxy
+	var response_rewrite func([]byte) []byte
+	if protocol == "ftp" && *ftp_proxy_data {
+		ftp_data = new_ftp_data_proxy(conn_n, logger, local, remote)
+		response_rewrite = ftp_data.rewrite
+	}
 	
-	go pass_through(&Channel{remote, local, logger, to_logger, ack})
-	go pass_through(&Channel{local, remote, logger, from_logger, ack})
+	response := &Channel{from: remote, to: remap(local, server_to_client), conn_n: conn_n, direction: server_to_client,
+		logger: logger, binary_logger: to_logger, pcap: pcap, parser: response_parser,
+		injector: NewInjector(injection_rules, server_to_client), stats: stats, timeouts: timeouts, session: session, diff: diff, ack: ack, ctx: ctx, mirror: new_mirror(), rewrite: response_rewrite, splice: splice}
+	request := &Channel{from: local, to: remap(remote, client_to_server), conn_n: conn_n, direction: client_to_server,
+		logger: logger, binary_logger: from_logger, pcap: pcap, parser: request_parser,
+		injector: NewInjector(injection_rules, client_to_server), stats: stats, timeouts: timeouts, session: session, diff: diff, ack: ack, ctx: ctx, mirror: new_mirror(), fanout: fan, splice: splice}
+	if protocol == "smtp" && !*dry_run {
+		server_name, _, _ := net.SplitHostPort(target)
+		smtp_starttls(conn_n, logger, request, response, server_name)
+	}
+	go pass_through(response)
+	go pass_through(request)
 	<-ack // Make sure that the both copiers gracefully finish.
 	<-ack // a receive statement; result is discarded
+	request.from.Close() // after a half-close both sides are still open
+	request.to.Close()
+	ftp_data.close()
+	fan.finish()
 	
 	finished := time.Now()
 	duration := finished.Sub(started)
-	logger <- []byte(fmt.Sprintf("Finished at %s, duration %s\n",
-	            format_time(started), duration.String()))
+	diff.finish(conn_n, logger)
+	logger <- log_message(conn_n, "finished", "Finished at %s, duration %s",
+	            format_time(started), duration.String())
 	
-	logger <- []byte{}      // Stop logger
+	stop_loggers(logger, from_logger, to_logger)
+	if !grep.kept() {
+		return nil
+	}
+	write_summary(m, conn_n, local.RemoteAddr().String(), remote.RemoteAddr().String(), client_tag,
+		session, started, finished)
+	return nil
+}
+
+// Learns the target from the client in the dynamic modes. via describes
+// how it was chosen, for the log header.
+func read_target(local net.Conn, m *mapping) (string, string, error) {
+	switch *mode {
+	case "socks5":
+		t, err := ReadSOCKS5Request(local)
+		return t, " (SOCKS5 CONNECT)", err
+	case "http-connect":
+		t, err := ReadHTTPConnect(local)
+		return t, " (HTTP CONNECT)", err
+	}
+	if target, ok := ebpf_target(local.RemoteAddr()); ok {
+		return target, " (eBPF map)", nil
+	}
+	target, via := m.next_target(local.RemoteAddr())
+	return target, via, nil
+}
+
+// Reports the outcome of dialing the target to a dynamic mode client
+func reply_target(local net.Conn, success bool) {
+	switch *mode {
+	case "socks5":
+		WriteSOCKS5Response(local, success)
+	case "http-connect":
+		WriteHTTPConnectResponse(local, success)
+	}
+}
+
+// Launches the hex dump logger and the two binary loggers of a connection;
+// with -hex-only or -binary-only the ones left out get a consumer that
+// drops what they are sent. stats, if not nil, learns the binary log
+// names and sees every event.
+// If a log can't be opened the loggers are stopped again and the error
+// returned.
+func start_loggers(ctx context.Context, m *mapping, conn_n int, local_info, remote_info, tag string, stats *ConnectionInfo) (logger chan *LogEvent, from_logger, to_logger chan []byte, grep *StreamingGrepFilter, err error) {
+	logger = make(chan *LogEvent)
+	from_logger = make(chan []byte)
+	to_logger = make(chan []byte)
+
+	events := logger
+	if stats != nil && (api_enabled() || tui_enabled()) {
+		events = make(chan *LogEvent)
+		go tap_events(logger, events, stats)
+	}
+	opened := make(chan error, 3)
+	if *no_log {
+		go discard_events(events)
+		go discard_logger(from_logger)
+		go discard_logger(to_logger)
+	} else if log_store != nil {
+		backend_loggers.Add(1)
+		go backend_logger(events, conn_n, local_info, remote_info, opened)
+		go discard_logger(from_logger)
+		go discard_logger(to_logger)
+		err = <-opened
+	} else {
+		started := 0
+		var binary_logs []string
+		if !*hex_only {
+			binary_logs = []string{
+				log_file_name(m, conn_n, local_info, remote_info, tag, local_info),
+				log_file_name(m, conn_n, local_info, remote_info, tag, remote_info),
+			}
+		}
+		if *binary_only {
+			go discard_events(events)
+		} else {
+			grep = NewStreamingGrepFilter(conn_n, binary_logs...)
+			go connection_logger(ctx, events, log_file_name(m, conn_n, local_info, remote_info, tag, ""), opened, grep)
+			started++
+		}
+		if *hex_only {
+			go discard_logger(from_logger)
+			go discard_logger(to_logger)
+		} else {
+			from_name, to_name := binary_logs[0], binary_logs[1]
+			stats.set_binary_log("client", from_name)
+			stats.set_binary_log("server", to_name)
+			go binary_logger(ctx, from_logger, from_name, opened)
+			go binary_logger(ctx, to_logger, to_name, opened)
+			started += 2
+		}
+		for i := 0; i < started; i++ {
+			if e := <-opened; e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	if err != nil {
+		stop_loggers(logger, from_logger, to_logger)
+	}
+	return
+}
+
+// Sends the stop sentinel to each logger so the log files get closed
+func stop_loggers(logger chan *LogEvent, from_logger, to_logger chan []byte) {
+	logger <- nil           // Stop logger
 	from_logger <- []byte{} // Stop "from" binary logger
 	to_logger <- []byte{}   // Stop "to" binary logger
 }
 
+// Checks -hex-only and -binary-only
+func init_log_kinds() {
+	if *hex_only && *binary_only {
+		die("-hex-only and -binary-only can't be combined, -no-log writes neither")
+	}
+}
+
 // Main function
 //  Launches the TCP/IP listener
 func main() {
     runtime.GOMAXPROCS(runtime.NumCPU())    // use max CPU. Perhaps 2 or 4 is better?
+ 	if len(os.Args) > 1 && os.Args[1] == "analyze" {
+ 	    os.Exit(analyze_command(os.Args[2:]))
+ 	}
+ 	if len(os.Args) > 1 && os.Args[1] == "generate-cert" {
+ 	    os.Exit(generate_cert_command(os.Args[2:]))
+ 	}
  	flag.Parse()
- 	if flag.NFlag() != 3 {
- 	    fmt.Printf("usage: gotcpspy -host target_host -port target_port -listen_port local_port\n")
- 	    flag.PrintDefaults()
- 	    os.Exit(1)
- 	}
- 	target := net.JoinHostPort(*host, *port)
- 	fmt.Printf("Start listening on port %s and forwarding data to %s\n",
- 	            *listen_port, target)
- 	ln, err := net.Listen("tcp", ":"+*listen_port)
- 	if err != nil {
- 	    fmt.Printf("Unable to start listener, %v\n", err)
- 	    os.Exit(1)
+ 	if *show_version {
+ 	    fmt.Print(version_info())
+ 	    return
+ 	}
+ 	load_config()
+ 	start_pprof_server()
+ 	if *decompress_log != "" {
+ 		os.Exit(decompress_to_stdout(*decompress_log))
+ 	}
+ 	write_pid_file()
+ 	defer remove_pid_file() // drain removes it before os.Exit
+ 	init_compression()
+ 	init_append_log()
+ 	init_log_names()
+ 	init_binary_format()
+ 	init_log_kinds()
+ 	init_measure_latency()
+ 	init_log_format()
+ 	init_output_dir()
+ 	init_profiling()
+ 	open_log_store()
+ 	init_tee()
+ 	init_grep()
+ 	init_remap()
+ 	init_buffer_pool()
+ 	rotate_on_sighup()
+ 	init_limits()
+ 	init_ip_filter()
+ 	init_upstream_socks5()
+ 	init_ebpf_map()
+ 	init_tfo()
+ 	init_dedup()
+ 	init_knocking()
+ 	start_metrics_server()
+ 	start_stats()
+ 	start_dashboard()
+ 	start_api()
+ 	start_tui()
+ 	init_injection()
+ 	init_rules()
+ 	init_filter()
+ 	dynamic_target := *mode == "socks5" || *mode == "http-connect"
+ 	mappings := configured_mappings()
+ 	start_cleanup(mappings)
+ 	if *capture_file != "" {
+ 	    capture(mappings[0])
+ 	    return
+ 	}
+ 	for _, m := range mappings {
+ 	    if !m.complete(dynamic_target) {
+ 	        fmt.Printf("usage: gotcpspy -host target_host -port target_port -listen_port local_port\n")
+ 	        fmt.Printf("       gotcpspy -proto unix -port target_socket -listen-socket local_socket\n")
+ 	        fmt.Printf("       gotcpspy -mode socks5|http-connect -listen_port local_port\n")
+ 	        fmt.Printf("       gotcpspy -map local_port:target_host:target_port ...\n")
+ 	        fmt.Printf("       gotcpspy -upstream host:port,host:port,... -listen_port local_port\n")
+ 	        fmt.Printf("       gotcpspy -capture-file dump.pcap\n")
+ 	        fmt.Printf("       gotcpspy -config config.json\n")
+ 	        fmt.Printf("       gotcpspy analyze -log-file log-....log\n")
+ 	        fmt.Printf("       gotcpspy generate-cert -out-dir dir\n")
+ 	        flag.PrintDefaults()
+ 	        os.Exit(1)
+ 	    }
  	}
+ 	if *tls_mode && (*ca_cert == "" || *ca_key == "") {
+ 	    die("TLS mode requires -ca-cert and -ca-key")
+ 	}
+ 	if *ca_cert != "" && *ca_key != "" { // -proto smtp uses it for STARTTLS too
+ 	    var err error
+ 	    if cert_authority, err = load_cert_authority(*ca_cert, *ca_key); err != nil {
+ 	        die("Unable to load CA, %v", err)
+ 	    }
+ 	}
+ 	if *client_ca_cert != "" && cert_authority == nil {
+ 	    die("-client-ca-cert needs -ca-cert and -ca-key, for -tls or -proto smtp")
+ 	}
+ 	init_mtls()
+ 	if *replay_file != "" {
+ 	    replay(mappings[0].target())
+ 	    return
+ 	}
+ 	init_conn_pool(mappings, dynamic_target)
+ 	for _, m := range mappings {
+ 	    if dynamic_target {
+ 	        fmt.Printf("Start listening on %s as a %s proxy\n", m, *mode)
+ 	    } else {
+ 	        fmt.Printf("Start listening on %s and forwarding data to %s\n",
+ 	                    m, m.target_description())
+ 	    }
+ 	}
+ 	if *proto == "udp" {
+ 	    ctx := cancel_on_signal()
+ 	    var stopped sync.WaitGroup
+ 	    stopped.Add(len(mappings))
+ 	    for _, m := range mappings {
+ 	        go listen_udp(ctx, m, &stopped)
+ 	    }
+ 	    stopped.Wait()
+ 	    os.Exit(drain(*drain_timeout))
+ 	}
+ 	ctx := cancel_on_signal()
+ 	stop_pprof_server_on(ctx)
+ 	var loops sync.WaitGroup
+ 	for _, m := range mappings {
+ 	    p := NewProxy(m)
+ 	    add_hook_cmd(p)
+ 	    add_webhook(p)
+ 	    loops.Add(1)
+ 	    go func(p *Proxy) {
+ 	        defer loops.Done()
+ 	        if err := p.Listen(ctx); err != nil {
+ 	            die("Unable to start listener, %v", err)
+ 	        }
+ 	    }(p)
+ 	}
+ 	loops.Wait()
+ 	os.Exit(drain(*drain_timeout))
+}
+
+// Accepts connections for one mapping until shutdown
+func accept_loop(ln net.Listener, m *mapping, shutdown chan bool) {
  	conn_n := 1
  	for {
  	    if conn, err := ln.Accept(); err == nil {
- 	        go process_connection(conn, conn_n, target)
+ 	        if !ip_allowed(conn) || !allow_connection(conn) || !knock_allowed(conn) {
+ 	            continue
+ 	        }
+ 	        if !acquire_slot(shutdown) {
+ 	            conn.Close()
+ 	            return
+ 	        }
+ 	        active_connections.Add(1)
+ 	        go serve_connection(connections_ctx, conn, conn_n, m)
  	        conn_n += 1
  	    } else {
- 	        fmt.Printf("Accept failed, %v\n", err)
+ 	        select {
+ 	        case <-shutdown:
+ 	            return
+ 	        default:
+ 	            fmt.Printf("Accept failed, %v\n", err)
+ 	        }
  	    }
  	}
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The log files a session leaves under -hex-only, -binary-only and
+// neither
+func TestLogKinds(t *testing.T) {
+	saved_hex, saved_binary, saved_dir := *hex_only, *binary_only, *output_dir
+	t.Cleanup(func() { *hex_only, *binary_only, *output_dir = saved_hex, saved_binary, saved_dir })
+	init_log_names()
+	buffer_pool = NewBufferPool(*buf_size)
+	echo := start_echo_server(t)
+	host, port, _ := net.SplitHostPort(echo.Addr().String())
+	for _, tt := range []struct {
+		name                  string
+		hex_only, bin_only    bool
+		hex_logs, binary_logs int
+	}{
+		{"both", false, false, 1, 2},
+		{"-hex-only", true, false, 1, 0},
+		{"-binary-only", false, true, 0, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			*hex_only, *binary_only = tt.hex_only, tt.bin_only
+			*output_dir = t.TempDir()
+			logs := t.TempDir()
+			m := &mapping{listen_port: free_port(t), host: host, port: port, log_prefix: filepath.Join(logs, "log")}
+			p := NewProxy(m)
+			sessions := make(chan *Session, 1)
+			p.OnConnection(func(s *Session) { sessions <- s })
+			run_proxy(t, p)
+
+			conn := dial_proxy(t, m.listen_port)
+			conn.Write([]byte("ping"))
+			io.ReadFull(conn, make([]byte, 4))
+			conn.Close()
+			<-sessions
+			active_connections.Wait()
+
+			var hex_logs, binary_logs int
+			names, _ := filepath.Glob(filepath.Join(logs, "*"))
+			for _, name := range names {
+				b, _ := os.ReadFile(name)
+				switch {
+				case strings.HasPrefix(filepath.Base(name), "log-binary-"):
+					binary_logs += 1
+					if string(b) != "ping" {
+						t.Errorf("binary log %s holds %q", filepath.Base(name), b)
+					}
+				default:
+					hex_logs += 1
+					if !strings.Contains(string(b), "|ping|") {
+						t.Errorf("no hex dump in %s", filepath.Base(name))
+					}
+				}
+			}
+			if hex_logs != tt.hex_logs || binary_logs != tt.binary_logs {
+				t.Errorf("%d hex dump logs and %d binary logs, want %d and %d", hex_logs, binary_logs, tt.hex_logs, tt.binary_logs)
+			}
+		})
+	}
+}
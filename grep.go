@@ -0,0 +1,206 @@
+/*
+Keeping only the connections that match (-grep).
+
+	-proto http -grep 'HTTP/1.1 5[0-9][0-9]' -grep-context 2
+
+Every packet a connection logs is matched against the -grep expression:
+the bytes of plain data, or the text of what a protocol parser decoded
+(an HTTP response, a Redis reply, ...), and network errors and timeouts
+by their message. Until a packet matches, the events of the connection
+are held back instead of going to its hex dump log; on the first match
+they are written out and the rest of the connection is logged as it
+comes. Matching packets are printed to stdout as well, each line
+prefixed with the connection number, like grep prints file names.
+
+A connection that ends without a match leaves no logs: its hex dump log
+stays empty and is removed together with its binary logs, and no
+-summary is written for it. At most
+grep_max_held events are held per connection, the older ones are left
+out and a line says how many.
+
+With -grep-context N only the matching packets and the N packets before
+and after each of them are logged, like grep -C. Packets are all events
+of one direction, so a chunk received and then sent are two; the others,
+connected, finished and so on, are all kept.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	grep_pattern *string = flag.String("grep", "", "only keep the logs of connections with a packet matching this regular expression, and print the matching packets")
+	grep_context *int    = flag.Int("grep-context", -1, "with -grep, only log this many packets before and after each match instead of the whole connection")
+)
+
+const grep_max_held = 4096 // events held back by a connection before a match
+
+var grep_re *regexp.Regexp // nil without -grep
+
+type grep_held struct {
+	e      *LogEvent
+	packet bool
+}
+
+// Decides which events of one connection get logged
+type StreamingGrepFilter struct {
+	conn_n  int
+	files   []string // the binary logs, removed with the hex dump log
+	matched bool
+	held    []grep_held
+	packets int       // packets among held
+	dropped int       // events let go from held
+	after   int       // context packets still to log after the last match
+	done    chan bool // closed by finish
+}
+
+// nil without -grep, the methods let everything through then
+func NewStreamingGrepFilter(conn_n int, binary_logs ...string) *StreamingGrepFilter {
+	if grep_re == nil {
+		return nil
+	}
+	return &StreamingGrepFilter{conn_n: conn_n, files: binary_logs, done: make(chan bool)}
+}
+
+// The events to log now, in order; e is among them or held back
+func (g *StreamingGrepFilter) Filter(e *LogEvent) []*LogEvent {
+	if g == nil {
+		return []*LogEvent{e}
+	}
+	packet, hit := grep_match(e)
+	if hit {
+		g.print(e)
+		g.matched = true
+		g.after = *grep_context
+		return append(g.release(), e)
+	}
+	if g.matched && (*grep_context < 0 || !packet || g.after > 0) {
+		if packet {
+			g.after--
+		}
+		return []*LogEvent{e}
+	}
+	g.hold(e, packet)
+	return nil
+}
+
+func (g *StreamingGrepFilter) hold(e *LogEvent, packet bool) {
+	g.held = append(g.held, grep_held{e, packet})
+	if packet {
+		g.packets++
+	}
+	if *grep_context >= 0 && g.packets > *grep_context {
+		// only the last -grep-context packets can still become context
+		for i, h := range g.held {
+			if h.packet {
+				g.held = append(g.held[:i], g.held[i+1:]...)
+				g.packets--
+				g.dropped++
+				break
+			}
+		}
+	}
+	if len(g.held) > grep_max_held {
+		if g.held[0].packet {
+			g.packets--
+		}
+		g.held = g.held[1:]
+		g.dropped++
+	}
+}
+
+// Hands out what was held back, with a line about what was left out
+// before the first packet
+func (g *StreamingGrepFilter) release() []*LogEvent {
+	var out []*LogEvent
+	note := func() {
+		if g.dropped > 0 {
+			out = append(out, log_message(g.conn_n, "grep_skipped", "--- %d events not matching -grep left out ---", g.dropped))
+			g.dropped = 0
+		}
+	}
+	for _, h := range g.held {
+		if h.packet {
+			note()
+		}
+		out = append(out, h.e)
+	}
+	note()
+	g.held, g.packets = nil, 0
+	return out
+}
+
+// Prints a matching event to stdout, each line prefixed like grep does
+func (g *StreamingGrepFilter) print(e *LogEvent) {
+	var b strings.Builder
+	(&TextLogger{&b}).Log(e)
+	prefix := fmt.Sprintf("%d:", g.conn_n)
+	s := prefix + strings.ReplaceAll(strings.TrimSuffix(b.String(), "\n"), "\n", "\n"+prefix) + "\n"
+	tee_mu.Lock()
+	os.Stdout.WriteString(s)
+	tee_mu.Unlock()
+}
+
+// Removes the logs of a connection without a match, once closed
+func (g *StreamingGrepFilter) finish(log_name string) {
+	if g == nil {
+		return
+	}
+	defer close(g.done)
+	if g.matched {
+		return
+	}
+	for _, name := range append([]string{log_name}, g.files...) {
+		remove_log(name)
+	}
+}
+
+// Whether the connection's logs were kept, waiting for finish to decide;
+// the connection's other files (the summary) follow suit
+func (g *StreamingGrepFilter) kept() bool {
+	if g == nil {
+		return true
+	}
+	<-g.done
+	return g.matched
+}
+
+// Removes a log file with its rotated parts and .timing sidecar
+func remove_log(name string) {
+	os.Remove(name + ".timing")
+	rotations.Prune(name, 0)
+}
+
+// Whether e is a packet, any event about data of one direction, and
+// whether it matches -grep
+func grep_match(e *LogEvent) (bool, bool) {
+	packet := e.Direction != ""
+	if b := e.payload(); b != nil {
+		return packet, grep_re.Match(b)
+	}
+	if _, rec := event_record(e); rec == nil && e.Event != "network_error" && e.Event != "write_error" && e.Event != "timeout" {
+		return packet, false
+	}
+	var b strings.Builder
+	(&TextLogger{&b}).Log(e)
+	return packet, grep_re.MatchString(b.String())
+}
+
+func init_grep() {
+	if *grep_pattern == "" {
+		return
+	}
+	if *no_log || *binary_only || log_store != nil || *append_log {
+		die("-grep works on the connection log files, it can't be combined with -no-log, -binary-only, -log-backend or -append-log")
+	}
+	var err error
+	if grep_re, err = regexp.Compile(*grep_pattern); err != nil {
+		die("Invalid -grep expression, %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func grep_packet(msg string) *LogEvent {
+	e := new_event(1, client_to_server, "received", "127.0.0.1-50000")
+	e.Length = len(msg)
+	e.dump_later([]byte(msg))
+	return e
+}
+
+// Only the match and one packet either side of it are logged, with a
+// line for what was left out before
+func TestStreamingGrepFilterContext(t *testing.T) {
+	saved_re, saved_context, saved_stdout := grep_re, *grep_context, os.Stdout
+	t.Cleanup(func() { grep_re, *grep_context, os.Stdout = saved_re, saved_context, saved_stdout })
+	grep_re, *grep_context = regexp.MustCompile("needle"), 1
+	os.Stdout, _ = os.Open(os.DevNull) // where the match is printed
+
+	g := NewStreamingGrepFilter(1)
+	var logged []string
+	for _, e := range []*LogEvent{log_message(1, "connected", "Connected"),
+		grep_packet("one"), grep_packet("two"), grep_packet("a needle"), grep_packet("four"), grep_packet("five"), grep_packet("six")} {
+		for _, e := range g.Filter(e) {
+			if e.dump != nil {
+				logged = append(logged, string(e.dump))
+			} else {
+				logged = append(logged, e.Message)
+			}
+		}
+	}
+	want := "Connected|--- 1 events not matching -grep left out ---|two|a needle|four"
+	if got := strings.Join(logged, "|"); got != want {
+		t.Errorf("logged %s, want %s", got, want)
+	}
+}
+
+// Of two connections through the proxy only the one that matches leaves
+// its logs and summary, and its matching packets go to stdout
+func TestProxyGrep(t *testing.T) {
+	saved_re, saved_dir, saved_stdout := grep_re, *output_dir, os.Stdout
+	t.Cleanup(func() { grep_re, *output_dir, os.Stdout = saved_re, saved_dir, saved_stdout })
+	grep_re = regexp.MustCompile("needle")
+	*output_dir = t.TempDir()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	printed := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		printed <- string(b)
+	}()
+	os.Stdout = w
+	init_log_names()
+	buffer_pool = NewBufferPool(*buf_size)
+
+	echo := start_echo_server(t)
+	host, port, _ := net.SplitHostPort(echo.Addr().String())
+	m := &mapping{listen_port: free_port(t), host: host, port: port, log_prefix: filepath.Join(*output_dir, "log")}
+	p := NewProxy(m)
+	sessions := make(chan *Session, 2)
+	p.OnConnection(func(s *Session) { sessions <- s })
+	run_proxy(t, p)
+	for _, msg := range []string{"only hay", "a needle"} {
+		conn := dial_proxy(t, m.listen_port)
+		conn.Write([]byte(msg))
+		io.ReadFull(conn, make([]byte, len(msg)))
+		conn.Close()
+		<-sessions
+	}
+	active_connections.Wait()
+	w.Close()
+	os.Stdout = saved_stdout
+
+	names, _ := filepath.Glob(filepath.Join(*output_dir, "*"))
+	var conn_1, conn_2 int
+	for _, name := range names {
+		switch base := filepath.Base(name); {
+		case strings.Contains(base, "-0001"):
+			conn_1 += 1
+		case strings.Contains(base, "-0002"):
+			conn_2 += 1
+		}
+	}
+	if conn_1 != 0 || conn_2 != 4 { // the hex dump log, two binary logs and the summary
+		t.Errorf("%d files left of the connection without a match and %d of the one with, want 0 and 4: %v", conn_1, conn_2, names)
+	}
+	out := <-printed
+	if !strings.HasPrefix(out, "2:Received") || !strings.Contains(out, "2:00000000  61 20 6e 65 65 64 6c 65") || strings.Contains(out, "1:") {
+		t.Errorf("printed\n%s", out)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+gRPC decoding for the connection log (-proto grpc).
+
+gRPC runs over HTTP/2, usually inside TLS, so this is meant to be used
+together with -tls (h2c, HTTP/2 without TLS, works too). Each direction
+is read frame by frame: HEADERS frames give the method, the HTTP status
+and, in the trailers, the gRPC status; the DATA of a stream is split into
+the length prefixed gRPC messages, which are rendered as schema-less
+protobuf JSON or, if that fails, as a hex dump. Other frames are only
+in the binary logs.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+type GRPCRecord struct {
+	StreamID    uint32          `json:"stream_id"`
+	Method      string          `json:"method,omitempty"`
+	Status      string          `json:"status,omitempty"` // HTTP :status
+	GRPCStatus  string          `json:"grpc_status,omitempty"`
+	GRPCMessage string          `json:"grpc_message,omitempty"`
+	Headers     []string        `json:"headers,omitempty"`
+	EndStream   bool            `json:"end_stream,omitempty"`
+	Compressed  bool            `json:"compressed,omitempty"`
+	Length      int             `json:"length,omitempty"`
+	Message     json.RawMessage `json:"message,omitempty"`
+	HexPayload  string          `json:"hex_payload,omitempty"`
+}
+
+// Methods of the streams of one connection; requests name them,
+// responses only carry the stream ID
+type grpc_streams struct {
+	mu      sync.Mutex
+	methods map[uint32]string
+}
+
+func (s *grpc_streams) set(stream uint32, method string) {
+	s.mu.Lock()
+	s.methods[stream] = method
+	s.mu.Unlock()
+}
+
+func (s *grpc_streams) get(stream uint32) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.methods[stream]
+}
+
+// Parsers for both directions of one gRPC connection
+func new_grpc_parsers(conn_n int, logger chan *LogEvent, client_peer, server_peer string) (request, response *StreamParser) {
+	streams := &grpc_streams{methods: make(map[uint32]string)}
+	request = NewStreamParser(conn_n, client_to_server, client_peer, logger, decode_grpc(streams))
+	response = NewStreamParser(conn_n, server_to_client, server_peer, logger, decode_grpc(streams))
+	return
+}
+
+func decode_grpc(streams *grpc_streams) decode_func {
+	h2 := NewHTTP2Reader()
+	data := make(map[uint32][]byte) // undecoded message bytes per stream
+	var pending []*LogEvent
+
+	return func(r *bufio.Reader) (*LogEvent, error) {
+		if len(pending) == 0 {
+			f, err := h2.Next(r)
+			if err != nil {
+				return nil, err
+			}
+			end := f.flags&http2_flag_end_stream != 0
+			switch f.kind {
+			case http2_headers:
+				if path := f.header(":path"); path != "" {
+					streams.set(f.stream, path)
+				}
+				rec := &GRPCRecord{
+					StreamID:    f.stream,
+					Method:      streams.get(f.stream),
+					Status:      f.header(":status"),
+					GRPCStatus:  f.header("grpc-status"),
+					GRPCMessage: f.header("grpc-message"),
+					EndStream:   end,
+				}
+				for _, h := range f.headers {
+					rec.Headers = append(rec.Headers, h.name+": "+h.value)
+				}
+				pending = append(pending, &LogEvent{Event: "grpc_headers", GRPC: rec})
+			case http2_data:
+				data[f.stream] = append(data[f.stream], f.payload...)
+				for {
+					rec, rest := next_grpc_message(data[f.stream])
+					if rec == nil {
+						break
+					}
+					rec.StreamID, rec.Method = f.stream, streams.get(f.stream)
+					rec.EndStream = end && len(rest) == 0
+					pending = append(pending, &LogEvent{Event: "grpc_message", Length: rec.Length, GRPC: rec})
+					data[f.stream] = rest
+				}
+				if end {
+					delete(data, f.stream)
+				}
+			case http2_rst_stream:
+				delete(data, f.stream)
+			}
+		}
+		if len(pending) == 0 {
+			return nil, nil
+		}
+		e := pending[0]
+		pending = pending[1:]
+		return e, nil
+	}
+}
+
+// Splits off the first complete length prefixed message, if there is one
+func next_grpc_message(b []byte) (*GRPCRecord, []byte) {
+	if len(b) < 5 {
+		return nil, b
+	}
+	n := int(binary.BigEndian.Uint32(b[1:5]))
+	if len(b)-5 < n {
+		return nil, b
+	}
+	rec := &GRPCRecord{Compressed: b[0] == 1, Length: n}
+	msg := b[5 : 5+n]
+	if rec.Compressed {
+		// gzip is the only compression every implementation has
+		if z, err := gzip.NewReader(bytes.NewReader(msg)); err == nil {
+			if plain, err := io.ReadAll(z); err == nil {
+				msg = plain
+			}
+		}
+	}
+	if j, err := protobuf_json(msg); err == nil {
+		rec.Message = j
+	} else {
+		if len(msg) > *max_body {
+			msg = msg[:*max_body]
+		}
+		rec.HexPayload = hex.Dump(msg)
+	}
+	return rec, b[5+n:]
+}
@@ -0,0 +1,221 @@
+/*
+HTTP/2 frame logging (-proto h2).
+
+Where -proto grpc only looks at what gRPC puts into HTTP/2, this logs
+every frame: its type, stream and flags, and what it says. HEADERS and
+PUSH_PROMISE come with their header lists, decompressed with the HPACK
+context of their direction (each direction has its own) and put
+together with their CONTINUATION frames. DATA frames give their length
+and a hex preview of the first h2_preview_size bytes; SETTINGS, PING,
+PRIORITY, WINDOW_UPDATE, RST_STREAM and GOAWAY are decoded.
+
+HTTP/2 is normally inside TLS, so this is used with -tls, which then
+offers h2 to both sides; h2c works as is.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const h2_preview_size = 64
+
+type HTTP2FrameRecord struct {
+	Type            string   `json:"type"`
+	StreamID        uint32   `json:"stream_id"`
+	Flags           []string `json:"flags,omitempty"`
+	Length          int      `json:"length"` // of the payload, without padding
+	Headers         []string `json:"headers,omitempty"`
+	PromisedStream  uint32   `json:"promised_stream,omitempty"`
+	Settings        []string `json:"settings,omitempty"`
+	WindowIncrement uint32   `json:"window_increment,omitempty"`
+	ErrorCode       string   `json:"error_code,omitempty"`
+	LastStream      uint32   `json:"last_stream,omitempty"`
+	Dependency      uint32   `json:"dependency,omitempty"`
+	Weight          int      `json:"weight,omitempty"`
+	Exclusive       bool     `json:"exclusive,omitempty"`
+	Data            string   `json:"data,omitempty"` // PING data and GOAWAY debug data
+	HexPreview      string   `json:"hex_preview,omitempty"`
+}
+
+var http2_settings_names = map[uint16]string{
+	0x1: "HEADER_TABLE_SIZE",
+	0x2: "ENABLE_PUSH",
+	0x3: "MAX_CONCURRENT_STREAMS",
+	0x4: "INITIAL_WINDOW_SIZE",
+	0x5: "MAX_FRAME_SIZE",
+	0x6: "MAX_HEADER_LIST_SIZE",
+	0x8: "ENABLE_CONNECT_PROTOCOL",
+	0x9: "NO_RFC7540_PRIORITIES",
+}
+
+var http2_error_names = []string{
+	"NO_ERROR", "PROTOCOL_ERROR", "INTERNAL_ERROR", "FLOW_CONTROL_ERROR",
+	"SETTINGS_TIMEOUT", "STREAM_CLOSED", "FRAME_SIZE_ERROR", "REFUSED_STREAM",
+	"CANCEL", "COMPRESSION_ERROR", "CONNECT_ERROR", "ENHANCE_YOUR_CALM",
+	"INADEQUATE_SECURITY", "HTTP_1_1_REQUIRED",
+}
+
+func http2_error_name(code uint32) string {
+	if int(code) < len(http2_error_names) {
+		return http2_error_names[code]
+	}
+	return fmt.Sprintf("0x%x", code)
+}
+
+// Parsers for both directions of one HTTP/2 connection
+func new_h2_parsers(conn_n int, logger chan *LogEvent, client_peer, server_peer string) (request, response *StreamParser) {
+	request = NewStreamParser(conn_n, client_to_server, client_peer, logger, decode_h2())
+	response = NewStreamParser(conn_n, server_to_client, server_peer, logger, decode_h2())
+	return
+}
+
+func decode_h2() decode_func {
+	h2 := NewHTTP2Reader()
+	return func(r *bufio.Reader) (*LogEvent, error) {
+		f, err := h2.Next(r)
+		if err != nil {
+			return nil, err
+		}
+		rec, err := http2_frame_record(f)
+		if err != nil {
+			return nil, err
+		}
+		return &LogEvent{Event: "h2_frame", Length: rec.Length, HTTP2: rec}, nil
+	}
+}
+
+func http2_frame_record(f *http2_frame) (*HTTP2FrameRecord, error) {
+	rec := &HTTP2FrameRecord{Type: f.name(), StreamID: f.stream, Flags: http2_flag_names(f), Length: len(f.payload)}
+	p := f.payload
+	short := func(n int) error {
+		if len(p) < n {
+			return fmt.Errorf("short %s frame, %d bytes", rec.Type, len(p))
+		}
+		return nil
+	}
+	switch f.kind {
+	case http2_headers, http2_push_promise:
+		for _, h := range f.headers {
+			rec.Headers = append(rec.Headers, h.name+": "+h.value)
+		}
+		rec.PromisedStream = f.promise
+	case http2_data:
+		preview := p
+		if len(preview) > h2_preview_size {
+			preview = preview[:h2_preview_size]
+		}
+		rec.HexPreview = hex.Dump(preview)
+	case http2_settings:
+		for ; len(p) >= 6; p = p[6:] {
+			id, value := binary.BigEndian.Uint16(p), binary.BigEndian.Uint32(p[2:])
+			name, ok := http2_settings_names[id]
+			if !ok {
+				name = fmt.Sprintf("0x%x", id)
+			}
+			rec.Settings = append(rec.Settings, fmt.Sprintf("%s=%d", name, value))
+		}
+	case http2_ping:
+		rec.Data = hex.EncodeToString(p)
+	case http2_priority:
+		if err := short(5); err != nil {
+			return nil, err
+		}
+		dep := binary.BigEndian.Uint32(p)
+		rec.Exclusive, rec.Dependency, rec.Weight = dep&0x80000000 != 0, dep&0x7fffffff, int(p[4])+1
+	case http2_window_update:
+		if err := short(4); err != nil {
+			return nil, err
+		}
+		rec.WindowIncrement = binary.BigEndian.Uint32(p) & 0x7fffffff
+	case http2_rst_stream:
+		if err := short(4); err != nil {
+			return nil, err
+		}
+		rec.ErrorCode = http2_error_name(binary.BigEndian.Uint32(p))
+	case http2_goaway:
+		if err := short(8); err != nil {
+			return nil, err
+		}
+		rec.LastStream = binary.BigEndian.Uint32(p) & 0x7fffffff
+		rec.ErrorCode = http2_error_name(binary.BigEndian.Uint32(p[4:]))
+		rec.Data = printable(string(p[8:]))
+	default:
+		if len(p) > 0 {
+			rec.HexPreview = hex.Dump(p[:min(len(p), h2_preview_size)])
+		}
+	}
+	return rec, nil
+}
+
+// The flags set on f that mean something for its type
+func http2_flag_names(f *http2_frame) []string {
+	var names []string
+	has := func(flag byte, name string) {
+		if f.flags&flag != 0 {
+			names = append(names, name)
+		}
+	}
+	switch f.kind {
+	case http2_data:
+		has(http2_flag_end_stream, "END_STREAM")
+		has(http2_flag_padded, "PADDED")
+	case http2_headers:
+		has(http2_flag_end_stream, "END_STREAM")
+		has(http2_flag_end_headers, "END_HEADERS")
+		has(http2_flag_padded, "PADDED")
+		has(http2_flag_priority, "PRIORITY")
+	case http2_push_promise:
+		has(http2_flag_end_headers, "END_HEADERS")
+		has(http2_flag_padded, "PADDED")
+	case http2_settings, http2_ping:
+		has(http2_flag_ack, "ACK")
+	default:
+		if f.flags != 0 {
+			names = append(names, fmt.Sprintf("0x%02x", f.flags))
+		}
+	}
+	return names
+}
+
+func format_h2(e *LogEvent) string {
+	rec := e.HTTP2
+	var b strings.Builder
+	fmt.Fprintf(&b, "HTTP/2 %s from %s, stream %d, %d bytes", rec.Type, e.Peer, rec.StreamID, rec.Length)
+	if len(rec.Flags) > 0 {
+		b.WriteString(" [" + strings.Join(rec.Flags, " ") + "]")
+	}
+	switch {
+	case rec.PromisedStream != 0:
+		fmt.Fprintf(&b, ", promised stream %d", rec.PromisedStream)
+	case rec.Settings != nil:
+		b.WriteString(": " + strings.Join(rec.Settings, " "))
+	case rec.WindowIncrement != 0:
+		fmt.Fprintf(&b, ", increment %d", rec.WindowIncrement)
+	case rec.Weight != 0:
+		fmt.Fprintf(&b, ", depends on %d, weight %d", rec.Dependency, rec.Weight)
+		if rec.Exclusive {
+			b.WriteString(", exclusive")
+		}
+	}
+	if rec.Type == "GOAWAY" {
+		fmt.Fprintf(&b, ", last stream %d", rec.LastStream)
+	}
+	if rec.ErrorCode != "" {
+		b.WriteString(", " + rec.ErrorCode)
+	}
+	if rec.Data != "" {
+		b.WriteString(": " + rec.Data)
+	}
+	b.WriteString("\n")
+	for _, h := range rec.Headers {
+		b.WriteString(h + "\n")
+	}
+	b.WriteString(rec.HexPreview)
+	return b.String()
+}
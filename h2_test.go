@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+)
+
+func h2_hex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// A frame header in front of payload
+func h2_frame(kind, flags byte, stream uint32, payload ...[]byte) []byte {
+	p := bytes.Join(payload, nil)
+	n := len(p)
+	return append([]byte{byte(n >> 16), byte(n >> 8), byte(n), kind, flags,
+		byte(stream >> 24), byte(stream >> 16), byte(stream >> 8), byte(stream)}, p...)
+}
+
+// The header blocks of RFC 7541 C.4, requests with Huffman coding, and
+// C.6, responses with Huffman coding and a 256 byte table. Each list is
+// decoded with one context, the table sizes are those after each block.
+var hpack_rfc_examples = []struct {
+	name       string
+	max_size   int
+	blocks     []string
+	headers    [][]string
+	table_size []int
+}{
+	{"C.4", 4096, []string{
+		"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+		"8286 84be 5886 a8eb 1064 9cbf",
+		"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+	}, [][]string{
+		{":method: GET", ":scheme: http", ":path: /", ":authority: www.example.com"},
+		{":method: GET", ":scheme: http", ":path: /", ":authority: www.example.com", "cache-control: no-cache"},
+		{":method: GET", ":scheme: https", ":path: /index.html", ":authority: www.example.com", "custom-key: custom-value"},
+	}, []int{57, 110, 164}},
+	{"C.6", 256, []string{
+		"4882 6402 5885 aec3 771a 4b61 96d0 7abe 9410 54d4 44a8 2005 9504 0b81 66e0 82a6 2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8 e9ae 82ae 43d3",
+		"4883 640e ffc1 c0bf",
+		"88c1 6196 d07a be94 1054 d444 a820 0595 040b 8166 e084 a62d 1bff c05a 839b d9ab 77ad 94e7 821d d7f2 e6c7 b335 dfdf cd5b 3960 d5af 2708 7f36 72c1 ab27 0fb5 291f 9587 3160 65c0 03ed 4ee5 b106 3d50 07",
+	}, [][]string{
+		{":status: 302", "cache-control: private", "date: Mon, 21 Oct 2013 20:13:21 GMT", "location: https://www.example.com"},
+		{":status: 307", "cache-control: private", "date: Mon, 21 Oct 2013 20:13:21 GMT", "location: https://www.example.com"},
+		{":status: 200", "cache-control: private", "date: Mon, 21 Oct 2013 20:13:22 GMT", "location: https://www.example.com",
+			"content-encoding: gzip", "set-cookie: foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"},
+	}, []int{222, 222, 215}},
+}
+
+func TestHPACKDecoder(t *testing.T) {
+	for _, tt := range hpack_rfc_examples {
+		d := NewHPACKDecoder()
+		d.max_size = tt.max_size
+		for i, block := range tt.blocks {
+			fields, err := d.Decode(h2_hex(t, block))
+			if err != nil {
+				t.Fatalf("%s block %d: %v", tt.name, i+1, err)
+			}
+			var got []string
+			for _, f := range fields {
+				got = append(got, f.name+": "+f.value)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.headers[i], "\n") {
+				t.Errorf("%s block %d decoded as\n%s\nwant\n%s", tt.name, i+1, strings.Join(got, "\n"), strings.Join(tt.headers[i], "\n"))
+			}
+			if d.size != tt.table_size[i] {
+				t.Errorf("%s block %d: table size %d, want %d", tt.name, i+1, d.size, tt.table_size[i])
+			}
+		}
+	}
+}
+
+func TestHPACKDecoderErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		block string
+	}{
+		{"index 0", "80"},
+		{"index past the dynamic table", "be"},
+		{"string longer than the block", "400a 6b"},
+		{"integer without its end", "ff ff ff"},
+		{"bad Huffman padding", "4081 1800"}, // "a" padded with zeros instead of ones
+	} {
+		if fields, err := NewHPACKDecoder().Decode(h2_hex(t, tt.block)); err == nil {
+			t.Errorf("%s: %s decoded as %v", tt.name, tt.block, fields)
+		}
+	}
+	// A table size update evicts what no longer fits
+	d := NewHPACKDecoder()
+	if _, err := d.Decode(h2_hex(t, "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff 20")); err != nil || len(d.dynamic) != 0 || d.size != 0 {
+		t.Errorf("after a size update to 0: %d entries, %d bytes, %v", len(d.dynamic), d.size, err)
+	}
+}
+
+// A connection with a request split over HEADERS and CONTINUATION, the
+// response with a push and padded DATA, and the control frames of both
+// sides
+func TestDecodeH2Stream(t *testing.T) {
+	request_block := h2_hex(t, hpack_rfc_examples[0].blocks[0])
+	client := bytes.Join([][]byte{
+		[]byte(http2_preface),
+		h2_frame(http2_settings, 0, 0, []byte{0, 2, 0, 0, 0, 0, 0, 4, 0, 0, 0xff, 0xff}),
+		h2_frame(http2_window_update, 0, 0, []byte{0, 0xef, 0, 1}),
+		h2_frame(http2_headers, http2_flag_end_stream, 1, request_block[:6]),
+		h2_frame(http2_continuation, http2_flag_end_headers, 1, request_block[6:]),
+		h2_frame(http2_headers, http2_flag_end_stream|http2_flag_end_headers|http2_flag_priority, 3,
+			[]byte{0x80, 0, 0, 1, 15}, h2_hex(t, hpack_rfc_examples[0].blocks[1])),
+		h2_frame(http2_priority, 0, 5, []byte{0, 0, 0, 3, 255}),
+		h2_frame(http2_settings, http2_flag_ack, 0),
+		h2_frame(http2_ping, 0, 0, []byte("12345678")),
+		h2_frame(http2_rst_stream, 0, 2, []byte{0, 0, 0, 8}),
+		h2_frame(0xfa, 0x5, 0, []byte{0xde, 0xad}),
+	}, nil)
+	server := bytes.Join([][]byte{
+		h2_frame(http2_settings, 0, 0, []byte{0, 3, 0, 0, 0, 100}),
+		h2_frame(http2_settings, http2_flag_ack, 0),
+		h2_frame(http2_push_promise, http2_flag_end_headers, 1, []byte{0, 0, 0, 2}, []byte{0x82, 0x87, 0x85}),
+		h2_frame(http2_headers, http2_flag_end_headers, 1, h2_hex(t, hpack_rfc_examples[1].blocks[0])),
+		h2_frame(http2_data, http2_flag_end_stream|http2_flag_padded, 1, []byte{3}, []byte("hello"), []byte{0, 0, 0}),
+		h2_frame(http2_ping, http2_flag_ack, 0, []byte("12345678")),
+		h2_frame(http2_goaway, 0, 0, []byte{0, 0, 0, 1, 0, 0, 0, 0}, []byte("bye")),
+	}, nil)
+	want := []string{
+		"HTTP/2 SETTINGS from 127.0.0.1-50000, stream 0, 12 bytes: ENABLE_PUSH=0 INITIAL_WINDOW_SIZE=65535",
+		"HTTP/2 WINDOW_UPDATE from 127.0.0.1-50000, stream 0, 4 bytes, increment 15663105",
+		"HTTP/2 HEADERS from 127.0.0.1-50000, stream 1, 17 bytes [END_STREAM END_HEADERS]\n" +
+			":method: GET\n:scheme: http\n:path: /\n:authority: www.example.com",
+		"HTTP/2 HEADERS from 127.0.0.1-50000, stream 3, 12 bytes [END_STREAM END_HEADERS PRIORITY]\n" +
+			":method: GET\n:scheme: http\n:path: /\n:authority: www.example.com\ncache-control: no-cache",
+		"HTTP/2 PRIORITY from 127.0.0.1-50000, stream 5, 5 bytes, depends on 3, weight 256",
+		"HTTP/2 SETTINGS from 127.0.0.1-50000, stream 0, 0 bytes [ACK]",
+		"HTTP/2 PING from 127.0.0.1-50000, stream 0, 8 bytes: 3132333435363738",
+		"HTTP/2 RST_STREAM from 127.0.0.1-50000, stream 2, 4 bytes, CANCEL",
+		"HTTP/2 UNKNOWN(0xfa) from 127.0.0.1-50000, stream 0, 2 bytes [0x05]\n" +
+			"00000000  de ad                                             |..|",
+		"HTTP/2 SETTINGS from 127.0.0.1-443, stream 0, 6 bytes: MAX_CONCURRENT_STREAMS=100",
+		"HTTP/2 SETTINGS from 127.0.0.1-443, stream 0, 0 bytes [ACK]",
+		"HTTP/2 PUSH_PROMISE from 127.0.0.1-443, stream 1, 3 bytes [END_HEADERS], promised stream 2\n" +
+			":method: GET\n:scheme: https\n:path: /index.html",
+		"HTTP/2 HEADERS from 127.0.0.1-443, stream 1, 54 bytes [END_HEADERS]\n" +
+			":status: 302\ncache-control: private\ndate: Mon, 21 Oct 2013 20:13:21 GMT\nlocation: https://www.example.com",
+		"HTTP/2 DATA from 127.0.0.1-443, stream 1, 5 bytes [END_STREAM PADDED]\n" +
+			"00000000  68 65 6c 6c 6f                                    |hello|",
+		"HTTP/2 PING from 127.0.0.1-443, stream 0, 8 bytes [ACK]: 3132333435363738",
+		"HTTP/2 GOAWAY from 127.0.0.1-443, stream 0, 11 bytes, last stream 1, NO_ERROR: bye",
+	}
+	for _, chunk := range []int{1, 10, 1 << 20} {
+		logger := make(chan *LogEvent)
+		request, response := new_h2_parsers(1, logger, "127.0.0.1-50000", "127.0.0.1-443")
+		events := feed_parsers(t, logger, []*StreamParser{request, response}, [][]byte{client, server}, chunk)
+		var got []string
+		for _, e := range events {
+			if e.HTTP2 == nil {
+				t.Fatalf("chunks of %d: a %s event, the decoder gave up", chunk, e.Event)
+			}
+			got = append(got, strings.TrimSuffix(format_h2(e), "\n"))
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("chunks of %d logged\n%s\nwant\n%s", chunk, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+func TestHTTP2ReaderErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		stream []byte
+	}{
+		{"CONTINUATION of another stream", bytes.Join([][]byte{
+			h2_frame(http2_headers, 0, 1, []byte{0x82}),
+			h2_frame(http2_continuation, http2_flag_end_headers, 3, []byte{0x86}),
+		}, nil)},
+		{"DATA in the middle of a header block", bytes.Join([][]byte{
+			h2_frame(http2_headers, 0, 1, []byte{0x82}),
+			h2_frame(http2_data, 0, 1, []byte("x")),
+		}, nil)},
+		{"padding longer than the frame", h2_frame(http2_data, http2_flag_padded, 1, []byte{5, 'x'})},
+		{"short PRIORITY", h2_frame(http2_priority, 0, 1, []byte{0, 0})},
+		{"short GOAWAY", h2_frame(http2_goaway, 0, 0, []byte{0, 0, 0, 1})},
+		{"bad HPACK", h2_frame(http2_headers, http2_flag_end_headers, 1, []byte{0x80})},
+		{"cut off", h2_frame(http2_data, 0, 1, []byte("hello"))[:12]},
+	} {
+		h := NewHTTP2Reader()
+		r := bufio.NewReader(bytes.NewReader(tt.stream))
+		var err error
+		for err == nil {
+			var f *http2_frame
+			if f, err = h.Next(r); err == nil {
+				_, err = http2_frame_record(f)
+			}
+		}
+		if err == io.EOF {
+			t.Errorf("%s: read without an error", tt.name)
+		}
+	}
+}
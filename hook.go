@@ -0,0 +1,137 @@
+/*
+External hook command (-hook-cmd).
+
+The command is run for every connected, received and disconnected event
+(and the network_error and timeout variants of a disconnect) of TCP and
+Unix socket connections, with the details in its environment:
+
+	GOTCPSPY_EVENT      connected, received, disconnected, ...
+	GOTCPSPY_CONN_ID    connection number
+	GOTCPSPY_DIRECTION  client→server or server→client, if the event has one
+	GOTCPSPY_BYTES      payload length of received events
+	GOTCPSPY_PEER       the side the event is about
+
+Hooks run in the background on -hook-concurrency workers, each hook for
+at most -hook-timeout, so they can't hold up a connection. The events of
+a connection all go to the same worker and so run in order, one after
+the other; different connections run side by side. Each worker has a
+queue of hook_queue_size events, and when a slow hook lets it fill up new
+events are dropped. Dropped events and hooks that fail are reported on
+stderr and counted in gotcpspy_hook_errors_total, and otherwise ignored.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+var (
+	hook_cmd         *string        = flag.String("hook-cmd", "", "executable to run for connection events, details in GOTCPSPY_* environment variables")
+	hook_timeout     *time.Duration = flag.Duration("hook-timeout", time.Second, "kill a -hook-cmd that runs longer than this")
+	hook_concurrency *int           = flag.Int("hook-concurrency", 4, "most -hook-cmd processes running at once")
+)
+
+var hook_events = map[string]bool{
+	"connected":     true,
+	"received":      true,
+	"disconnected":  true,
+	"network_error": true,
+	"timeout":       true,
+}
+
+const hook_queue_size = 1024
+
+// One event for the hook
+type hook_run struct {
+	event  string
+	conn_n int
+	env    []string
+}
+
+// Runs the hook from bounded queues with a fixed number of workers
+type HookRunner struct {
+	cmd     string
+	timeout time.Duration
+	queues  []chan hook_run // one per worker
+}
+
+func NewHookRunner(cmd string, timeout time.Duration, workers int) *HookRunner {
+	h := &HookRunner{cmd: cmd, timeout: timeout, queues: make([]chan hook_run, max(workers, 1))}
+	for i := range h.queues {
+		h.queues[i] = make(chan hook_run, hook_queue_size)
+		go h.worker(h.queues[i])
+	}
+	return h
+}
+
+// Queues the hook for e on its connection's worker, or drops it if that
+// queue is full; never blocks
+func (h *HookRunner) Send(e *LogEvent) bool {
+	run := hook_run{e.Event, e.ConnID, []string{
+		"GOTCPSPY_EVENT=" + e.Event,
+		"GOTCPSPY_CONN_ID=" + strconv.Itoa(e.ConnID),
+		"GOTCPSPY_DIRECTION=" + e.Direction,
+		"GOTCPSPY_BYTES=" + strconv.Itoa(e.Length),
+		"GOTCPSPY_PEER=" + e.Peer,
+	}}
+	select {
+	case h.queues[e.ConnID%len(h.queues)] <- run:
+		return true
+	default:
+		metrics.error(&metrics.hook_dropped)
+		fmt.Fprintf(os.Stderr, "Hook queue full, dropped the %s event of connection %d\n", e.Event, e.ConnID)
+		return false
+	}
+}
+
+func (h *HookRunner) worker(queue chan hook_run) {
+	for run := range queue {
+		if err := run_hook(h.cmd, run.env, h.timeout); err != nil {
+			metrics.error(&metrics.hook_failures)
+			fmt.Fprintf(os.Stderr, "Hook %s failed for the %s event of connection %d, %v\n", h.cmd, run.event, run.conn_n, err)
+		}
+	}
+}
+
+// Hands the events a Logger is given to the runner
+type hook_logger struct {
+	runner *HookRunner
+}
+
+func (l *hook_logger) Log(e *LogEvent) error {
+	if hook_events[e.Event] {
+		l.runner.Send(e)
+	}
+	return nil
+}
+
+// Runs cmd with env added to our own environment, killing it after timeout
+func run_hook(cmd string, env []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	c := exec.CommandContext(ctx, cmd)
+	c.Env = append(os.Environ(), env...)
+	c.Stdout, c.Stderr = os.Stdout, os.Stderr
+	return c.Run()
+}
+
+var hook_runner *HookRunner // shared by all listeners
+
+// Hooks -hook-cmd into the connections of p, if given
+func add_hook_cmd(p *Proxy) {
+	if *hook_cmd == "" {
+		return
+	}
+	if hook_runner == nil {
+		hook_runner = NewHookRunner(*hook_cmd, *hook_timeout, *hook_concurrency)
+	}
+	l := &hook_logger{hook_runner}
+	p.OnConnection(func(s *Session) { s.AddLogger(l) })
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes an executable shell script and returns its path
+func write_hook_script(t *testing.T, body string) string {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run the hook")
+	}
+	path := filepath.Join(t.TempDir(), "hook.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHookRunnerEnvironment(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "events")
+	script := write_hook_script(t, `echo "$GOTCPSPY_EVENT|$GOTCPSPY_CONN_ID|$GOTCPSPY_DIRECTION|$GOTCPSPY_BYTES|$GOTCPSPY_PEER" >> `+out+"\n")
+	l := &hook_logger{NewHookRunner(script, time.Second, 2)}
+	events := []*LogEvent{
+		log_message(7, "connected", "Connected to example.com:80"),
+		new_event(7, client_to_server, "received", "127.0.0.1-50000"),
+		new_event(7, client_to_server, "sent", "127.0.0.1-8080"), // not a hook event
+		new_event(7, server_to_client, "received", "example.com-80"),
+		new_event(7, client_to_server, "disconnected", "127.0.0.1-50000"),
+	}
+	events[1].Length, events[3].Length = 5, 1380
+	for _, e := range events {
+		l.Log(e)
+	}
+	want := []string{
+		"connected|7||0|",
+		"received|7|" + client_to_server + "|5|127.0.0.1-50000",
+		"received|7|" + server_to_client + "|1380|example.com-80",
+		"disconnected|7|" + client_to_server + "|0|127.0.0.1-50000",
+	}
+	var lines []string
+	for deadline := time.Now().Add(10 * time.Second); len(lines) < len(want) && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		b, _ := os.ReadFile(out)
+		lines = strings.Split(strings.TrimSpace(string(b)), "\n")
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("the hook ran with\n%s\nwant, in this order\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestHookRunnerDropsWhenFull(t *testing.T) {
+	// no worker takes anything off the queue
+	h := &HookRunner{cmd: "true", queues: []chan hook_run{make(chan hook_run, hook_queue_size)}}
+	e := new_event(1, client_to_server, "received", "127.0.0.1-50000")
+	for i := 0; i < hook_queue_size; i++ {
+		if !h.Send(e) {
+			t.Fatalf("event %d dropped with room in the queue", i)
+		}
+	}
+	if h.Send(e) {
+		t.Error("an event went into a full queue")
+	}
+}
+
+func TestRunHookFailures(t *testing.T) {
+	if err := run_hook(write_hook_script(t, "exit 3\n"), nil, time.Second); err == nil {
+		t.Error("a hook exiting with 3 succeeded")
+	}
+	started := time.Now()
+	if err := run_hook(write_hook_script(t, "exec sleep 5\n"), nil, 100*time.Millisecond); err == nil || time.Since(started) > 2*time.Second {
+		t.Errorf("a hook past its timeout returned %v after %s", err, time.Since(started))
+	}
+}
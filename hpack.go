@@ -0,0 +1,208 @@
+/*
+HPACK header decompression (RFC 7541) for the HTTP/2 decoders.
+
+Only the decoding side is needed. Each direction of a connection has its
+own compression context, so every parser owns its HPACKDecoder.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const hpack_default_table_size = 4096
+
+var err_hpack = errors.New("invalid HPACK block")
+
+type hpack_field struct {
+	name, value string
+}
+
+func (f hpack_field) size() int {
+	return len(f.name) + len(f.value) + 32
+}
+
+type HPACKDecoder struct {
+	dynamic  []hpack_field // newest first
+	size     int
+	max_size int
+}
+
+func NewHPACKDecoder() *HPACKDecoder {
+	return &HPACKDecoder{max_size: hpack_default_table_size}
+}
+
+// Decodes one complete header block
+func (d *HPACKDecoder) Decode(block []byte) ([]hpack_field, error) {
+	var fields []hpack_field
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		case b&0x80 != 0: // indexed field
+			i, rest, err := hpack_integer(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			f, err := d.lookup(i)
+			if err != nil {
+				return nil, err
+			}
+			fields, block = append(fields, f), rest
+		case b&0xc0 == 0x40: // literal, added to the table
+			f, rest, err := d.literal(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.add(f)
+			fields, block = append(fields, f), rest
+		case b&0xe0 == 0x20: // table size update
+			n, rest, err := hpack_integer(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			d.max_size, block = int(n), rest
+			d.evict()
+		default: // literal without indexing or never indexed
+			f, rest, err := d.literal(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			fields, block = append(fields, f), rest
+		}
+	}
+	return fields, nil
+}
+
+func (d *HPACKDecoder) lookup(i uint64) (hpack_field, error) {
+	switch {
+	case i == 0:
+		return hpack_field{}, err_hpack
+	case i <= uint64(len(hpack_static_table)):
+		return hpack_static_table[i-1], nil
+	case i-uint64(len(hpack_static_table)) <= uint64(len(d.dynamic)):
+		return d.dynamic[i-uint64(len(hpack_static_table))-1], nil
+	}
+	return hpack_field{}, fmt.Errorf("%w: index %d out of range", err_hpack, i)
+}
+
+func (d *HPACKDecoder) literal(block []byte, prefix uint) (hpack_field, []byte, error) {
+	i, rest, err := hpack_integer(block, prefix)
+	if err != nil {
+		return hpack_field{}, nil, err
+	}
+	var f hpack_field
+	if i == 0 {
+		if f.name, rest, err = hpack_string(rest); err != nil {
+			return f, nil, err
+		}
+	} else {
+		named, err := d.lookup(i)
+		if err != nil {
+			return f, nil, err
+		}
+		f.name = named.name
+	}
+	f.value, rest, err = hpack_string(rest)
+	return f, rest, err
+}
+
+func (d *HPACKDecoder) add(f hpack_field) {
+	d.dynamic = append([]hpack_field{f}, d.dynamic...)
+	d.size += f.size()
+	d.evict()
+}
+
+func (d *HPACKDecoder) evict() {
+	for d.size > d.max_size && len(d.dynamic) > 0 {
+		d.size -= d.dynamic[len(d.dynamic)-1].size()
+		d.dynamic = d.dynamic[:len(d.dynamic)-1]
+	}
+}
+
+// Reads an integer with an n bit prefix (RFC 7541, 5.1)
+func hpack_integer(b []byte, n uint) (uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, err_hpack
+	}
+	max := uint64(1)<<n - 1
+	v := uint64(b[0]) & max
+	b = b[1:]
+	if v < max {
+		return v, b, nil
+	}
+	for shift := uint(0); len(b) > 0; shift += 7 {
+		if shift > 56 {
+			return 0, nil, err_hpack
+		}
+		c := b[0]
+		b = b[1:]
+		v += uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return v, b, nil
+		}
+	}
+	return 0, nil, err_hpack
+}
+
+// Reads a string literal, Huffman coded or not (RFC 7541, 5.2)
+func hpack_string(b []byte) (string, []byte, error) {
+	if len(b) == 0 {
+		return "", nil, err_hpack
+	}
+	huffman := b[0]&0x80 != 0
+	n, rest, err := hpack_integer(b, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(rest)) < n {
+		return "", nil, err_hpack
+	}
+	s, rest := rest[:n], rest[n:]
+	if !huffman {
+		return string(s), rest, nil
+	}
+	decoded, err := huffman_decode(s)
+	return decoded, rest, err
+}
+
+type huffman_code struct {
+	code   uint32
+	length uint8
+}
+
+var (
+	huffman_once    sync.Once
+	huffman_symbols map[huffman_code]byte
+)
+
+func huffman_decode(b []byte) (string, error) {
+	huffman_once.Do(func() {
+		huffman_symbols = make(map[huffman_code]byte, 256)
+		for sym, code := range hpack_huffman_codes {
+			huffman_symbols[huffman_code{code, hpack_huffman_lengths[sym]}] = byte(sym)
+		}
+	})
+	var s strings.Builder
+	var cur huffman_code
+	for _, c := range b {
+		for bit := 7; bit >= 0; bit-- {
+			cur.code = cur.code<<1 | uint32(c>>uint(bit)&1)
+			cur.length += 1
+			if sym, ok := huffman_symbols[cur]; ok {
+				s.WriteByte(sym)
+				cur = huffman_code{}
+			} else if cur.length > 30 {
+				return "", fmt.Errorf("%w: bad Huffman code", err_hpack)
+			}
+		}
+	}
+	// What's left must be padding, the most significant bits of EOS
+	if cur.length > 7 || cur.code != 1<<cur.length-1 {
+		return "", fmt.Errorf("%w: bad Huffman padding", err_hpack)
+	}
+	return s.String(), nil
+}
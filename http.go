@@ -0,0 +1,165 @@
+/*
+HTTP/1.x decoding for the connection log (-proto http).
+
+Requests and responses are read with net/http, one after the other, so
+keep-alive connections with many exchanges are logged message by message.
+*/
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"net/http"
+	"time"
+)
+
+var max_body *int = flag.Int("max-body", 4096, "HTTP body bytes to include in the log")
+
+type HTTPRecord struct {
+	Method        string      `json:"method,omitempty"`
+	URL           string      `json:"url,omitempty"`
+	Host          string      `json:"host,omitempty"`
+	Proto         string      `json:"proto"`
+	Status        string      `json:"status,omitempty"`
+	StatusCode    int         `json:"status_code,omitempty"`
+	Headers       http.Header `json:"headers"`
+	Body          string      `json:"body,omitempty"`
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+}
+
+// Reads the whole body so the next message can be parsed, keeping the
+// first -max-body bytes for the log
+func read_body(body io.ReadCloser) (string, bool, error) {
+	defer body.Close()
+	b, err := io.ReadAll(io.LimitReader(body, int64(*max_body)))
+	if err != nil {
+		return "", false, err
+	}
+	rest, err := io.Copy(io.Discard, body)
+	return string(b), rest > 0, err
+}
+
+// What the response side needs to know about a request. A response to
+// HEAD has no body; an upgrade request learns whether the server agreed.
+type http_exchange struct {
+	method  string
+	seq     int       // position on the connection, for the LatencyTracker
+	upgrade chan bool // nil unless the request asked for a WebSocket
+}
+
+// Parsers for both directions of one HTTP connection
+func new_http_parsers(conn_n int, logger chan *LogEvent, client_peer, server_peer string) (request, response *StreamParser) {
+	exchanges := make(chan http_exchange, 128)
+	latency := NewLatencyTracker()
+	request = NewStreamParser(conn_n, client_to_server, client_peer, logger, decode_http_request(exchanges, latency))
+	response = NewStreamParser(conn_n, server_to_client, server_peer, logger, decode_http_response(exchanges, latency))
+	return
+}
+
+func decode_http_request(exchanges chan http_exchange, latency *LatencyTracker) decode_func {
+	var ws *WebSocketFrameParser
+	var upgrade chan bool // pending WebSocket handshake
+	seq := 0
+	return func(r *bufio.Reader) (*LogEvent, error) {
+		if upgrade != nil {
+			if _, err := r.Peek(1); err != nil {
+				return nil, err
+			}
+			// The client only sends frames after the 101, give the
+			// response parser a moment to catch up
+			select {
+			case ok := <-upgrade:
+				if ok {
+					ws = &WebSocketFrameParser{}
+				}
+			case <-time.After(5 * time.Second):
+			}
+			upgrade = nil
+		}
+		if ws != nil {
+			return ws.decode(r)
+		}
+
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return nil, err
+		}
+		body, truncated, err := read_body(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		latency.Request(seq, time.Now())
+		x := http_exchange{method: req.Method, seq: seq}
+		seq++
+		if is_websocket_upgrade(req.Header) {
+			x.upgrade = make(chan bool, 1)
+			upgrade = x.upgrade
+		}
+		select {
+		case exchanges <- x:
+		default:
+		}
+		return &LogEvent{Event: "http_request", HTTP: &HTTPRecord{
+			Method:        req.Method,
+			URL:           req.RequestURI,
+			Host:          req.Host,
+			Proto:         req.Proto,
+			Headers:       req.Header,
+			Body:          body,
+			BodyTruncated: truncated,
+		}}, nil
+	}
+}
+
+func decode_http_response(exchanges chan http_exchange, latency *LatencyTracker) decode_func {
+	var ws *WebSocketFrameParser
+	var x *http_exchange // request being answered, kept across 1xx responses
+	return func(r *bufio.Reader) (*LogEvent, error) {
+		if ws != nil {
+			return ws.decode(r)
+		}
+		if _, err := r.Peek(1); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		if x == nil {
+			// The request parser runs on its own and may lag behind
+			select {
+			case next := <-exchanges:
+				x = &next
+			case <-time.After(100 * time.Millisecond):
+				x = &http_exchange{method: "GET", seq: -1}
+			}
+		}
+		resp, err := http.ReadResponse(r, &http.Request{Method: x.method})
+		if err != nil {
+			return nil, err
+		}
+		body, truncated, err := read_body(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		var ms float64
+		if resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			ms = latency.Response(x.seq, start)
+			switched := resp.StatusCode == http.StatusSwitchingProtocols && is_websocket_upgrade(resp.Header)
+			if switched {
+				ws = &WebSocketFrameParser{}
+			}
+			if x.upgrade != nil {
+				x.upgrade <- switched
+			}
+			x = nil
+		}
+		return &LogEvent{Event: "http_response", HTTP: &HTTPRecord{
+			Proto:         resp.Proto,
+			Status:        resp.Status,
+			StatusCode:    resp.StatusCode,
+			Headers:       resp.Header,
+			Body:          body,
+			BodyTruncated: truncated,
+		}, LatencyMS: ms}, nil
+	}
+}
@@ -0,0 +1,163 @@
+/*
+HTTP/2 framing (RFC 9113) for the protocol decoders.
+
+HTTP2Reader reads one direction of a connection frame by frame. Header
+blocks are put back together from their CONTINUATION frames and
+decompressed, padding is removed, so callers see whole frames with their
+headers and data.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const http2_preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	http2_data          = 0x0
+	http2_headers       = 0x1
+	http2_priority      = 0x2
+	http2_rst_stream    = 0x3
+	http2_settings      = 0x4
+	http2_push_promise  = 0x5
+	http2_ping          = 0x6
+	http2_goaway        = 0x7
+	http2_window_update = 0x8
+	http2_continuation  = 0x9
+
+	http2_flag_end_stream  = 0x1
+	http2_flag_ack         = 0x1
+	http2_flag_end_headers = 0x4
+	http2_flag_padded      = 0x8
+	http2_flag_priority    = 0x20
+)
+
+var http2_frame_names = map[byte]string{
+	http2_data:          "DATA",
+	http2_headers:       "HEADERS",
+	http2_priority:      "PRIORITY",
+	http2_rst_stream:    "RST_STREAM",
+	http2_settings:      "SETTINGS",
+	http2_push_promise:  "PUSH_PROMISE",
+	http2_ping:          "PING",
+	http2_goaway:        "GOAWAY",
+	http2_window_update: "WINDOW_UPDATE",
+	http2_continuation:  "CONTINUATION",
+}
+
+type http2_frame struct {
+	kind    byte
+	flags   byte
+	stream  uint32
+	payload []byte        // without padding and priority fields
+	headers []hpack_field // HEADERS and PUSH_PROMISE
+	promise uint32        // stream promised by PUSH_PROMISE
+}
+
+func (f *http2_frame) name() string {
+	if n, ok := http2_frame_names[f.kind]; ok {
+		return n
+	}
+	return fmt.Sprintf("UNKNOWN(0x%x)", f.kind)
+}
+
+// Value of the first header called name
+func (f *http2_frame) header(name string) string {
+	for _, h := range f.headers {
+		if h.name == name {
+			return h.value
+		}
+	}
+	return ""
+}
+
+type HTTP2Reader struct {
+	hpack   *HPACKDecoder
+	started bool
+}
+
+func NewHTTP2Reader() *HTTP2Reader {
+	return &HTTP2Reader{hpack: NewHPACKDecoder()}
+}
+
+// Reads the next frame, skipping the client connection preface
+func (h *HTTP2Reader) Next(r *bufio.Reader) (*http2_frame, error) {
+	if !h.started {
+		// A short stream can't hold the preface, reading the frame will tell
+		if b, _ := r.Peek(len(http2_preface)); string(b) == http2_preface {
+			r.Discard(len(http2_preface))
+		}
+		h.started = true
+	}
+	f, err := read_http2_frame(r)
+	if err != nil {
+		return nil, err
+	}
+	if f.kind != http2_headers && f.kind != http2_push_promise {
+		return f, nil
+	}
+
+	block := f.payload
+	for f.flags&http2_flag_end_headers == 0 {
+		c, err := read_http2_frame(r)
+		if err != nil {
+			return nil, err
+		}
+		if c.kind != http2_continuation || c.stream != f.stream {
+			return nil, fmt.Errorf("expected CONTINUATION of stream %d, got %s", f.stream, c.name())
+		}
+		block = append(block, c.payload...)
+		f.flags |= c.flags & http2_flag_end_headers
+	}
+	f.payload = block
+	if f.headers, err = h.hpack.Decode(block); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func read_http2_frame(r *bufio.Reader) (*http2_frame, error) {
+	hdr := make([]byte, 9)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	length := int(hdr[0])<<16 | int(hdr[1])<<8 | int(hdr[2])
+	f := &http2_frame{
+		kind:   hdr[3],
+		flags:  hdr[4],
+		stream: binary.BigEndian.Uint32(hdr[5:]) & 0x7fffffff,
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+
+	switch f.kind {
+	case http2_data, http2_headers, http2_push_promise:
+		if f.flags&http2_flag_padded != 0 {
+			if len(f.payload) < 1 || int(f.payload[0]) >= len(f.payload) {
+				return nil, fmt.Errorf("bad padding in %s frame", f.name())
+			}
+			f.payload = f.payload[1 : len(f.payload)-int(f.payload[0])]
+		}
+	}
+	switch {
+	case f.kind == http2_headers && f.flags&http2_flag_priority != 0:
+		if len(f.payload) < 5 {
+			return nil, fmt.Errorf("short HEADERS frame")
+		}
+		f.payload = f.payload[5:]
+	case f.kind == http2_push_promise:
+		if len(f.payload) < 4 {
+			return nil, fmt.Errorf("short PUSH_PROMISE frame")
+		}
+		f.promise = binary.BigEndian.Uint32(f.payload) & 0x7fffffff
+		f.payload = f.payload[4:]
+	}
+	return f, nil
+}
@@ -0,0 +1,156 @@
+/*
+Content injection for security testing (-inject-file).
+
+The rules file is a JSON list such as
+
+	[{"direction":"client","offset":100,"bytes":"deadbeef","mode":"replace"}]
+
+direction is "client" (data from the client), "server" or "both"; offset
+counts the original bytes of that direction. offset picks the chunk a rule
+fires on: "prepend" inserts the bytes in front of that chunk, "append"
+after it, and "replace" overwrites the stream starting at exactly offset.
+Every rule fires once per connection and direction. The injected bytes
+are logged as synthetic; the binary logs keep what was really received.
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var inject_file *string = flag.String("inject-file", "", "JSON file with byte injection rules")
+
+var injection_rules []*InjectionRule
+
+type InjectionRule struct {
+	Direction string `json:"direction"`
+	Offset    int64  `json:"offset"`
+	Bytes     string `json:"bytes"` // hex encoded
+	Mode      string `json:"mode"`  // append (default), prepend or replace
+	data      []byte
+}
+
+// One rule applied to a chunk
+type Injection struct {
+	Rule *InjectionRule
+	At   int64 // stream offset the bytes went in at
+	Data []byte
+}
+
+func LoadInjectionRules(path string) ([]*InjectionRule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*InjectionRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := check_injection_rules(rules, path); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Fills in the defaults and decodes the bytes
+func check_injection_rules(rules []*InjectionRule, path string) error {
+	var err error
+	for i, r := range rules {
+		if r.Mode == "" {
+			r.Mode = "append"
+		}
+		switch r.Mode {
+		case "append", "prepend", "replace":
+		default:
+			return fmt.Errorf("%s: rule %d: unknown mode %q", path, i, r.Mode)
+		}
+		switch r.Direction {
+		case "client", "server", "both":
+		default:
+			return fmt.Errorf("%s: rule %d: unknown direction %q", path, i, r.Direction)
+		}
+		if r.data, err = hex.DecodeString(r.Bytes); err != nil {
+			return fmt.Errorf("%s: rule %d: %v", path, i, err)
+		}
+	}
+	return nil
+}
+
+// Applies the rules of one direction of a connection
+type Injector struct {
+	rules   []*InjectionRule
+	fired   []bool
+	replace []byte // rest of a replacement that runs past a chunk
+}
+
+// Returns nil if no rule applies to the direction
+func NewInjector(rules []*InjectionRule, direction string) *Injector {
+	side := "server"
+	if direction == client_to_server {
+		side = "client"
+	}
+	in := &Injector{}
+	for _, r := range rules {
+		if r.Direction == side || r.Direction == "both" {
+			in.rules = append(in.rules, r)
+		}
+	}
+	if len(in.rules) == 0 {
+		return nil
+	}
+	in.fired = make([]bool, len(in.rules))
+	return in
+}
+
+// Returns the chunk as it should be forwarded. offset is the stream offset
+// of the chunk's first byte; chunk itself is left untouched.
+func (in *Injector) Apply(chunk []byte, offset int64) ([]byte, []Injection) {
+	var injected []Injection
+	out := append([]byte(nil), chunk...)
+	if len(in.replace) > 0 {
+		n := copy(out, in.replace)
+		injected = append(injected, Injection{Rule: nil, At: offset, Data: in.replace[:n]})
+		in.replace = in.replace[n:]
+	}
+
+	end := offset + int64(len(chunk))
+	var before, after []byte
+	for i, r := range in.rules {
+		if in.fired[i] || r.Offset < offset || r.Offset >= end {
+			continue
+		}
+		in.fired[i] = true
+		switch r.Mode {
+		case "prepend":
+			before = append(before, r.data...)
+			injected = append(injected, Injection{r, offset, r.data})
+		case "append":
+			after = append(after, r.data...)
+			injected = append(injected, Injection{r, end, r.data})
+		case "replace":
+			n := copy(out[r.Offset-offset:], r.data)
+			in.replace = r.data[n:]
+			injected = append(injected, Injection{r, r.Offset, r.data[:n]})
+		}
+	}
+	if before == nil && after == nil {
+		return out, injected
+	}
+	return append(append(before, out...), after...), injected
+}
+
+// Loads -inject-file, if given
+func init_injection() {
+	if *inject_file == "" {
+		return
+	}
+	var err error
+	if injection_rules, err = LoadInjectionRules(*inject_file); err != nil {
+		die("Unable to load injection rules, %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Client IP allow and deny lists (-allow-cidr, -deny-cidr).
+
+	-allow-cidr 10.0.0.0/8 -allow-cidr 192.168.1.0/24 -deny-cidr 10.1.0.0/16
+
+A client in a -deny-cidr range is always turned away. When there is an
+-allow-cidr, a client has to be in one of its ranges as well. Rejected
+connections are closed as soon as they are accepted, without a byte
+sent, and reported on stderr. IPv4 clients reaching an IPv6 listener
+arrive as IPv4-mapped addresses and are matched as plain IPv4, against
+IPv4 ranges and ::ffff:a.b.c.d ranges alike.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Repeated CIDR flags, each may be a comma separated list, checked as
+// they are given
+type cidr_flags []*net.IPNet
+
+func (f *cidr_flags) String() string {
+	var s []string
+	for _, n := range *f {
+		s = append(s, n.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *cidr_flags) Set(value string) error {
+	for _, cidr := range strings.Split(value, ",") {
+		n, err := parse_cidr(strings.TrimSpace(cidr))
+		if err != nil {
+			return err
+		}
+		*f = append(*f, n)
+	}
+	return nil
+}
+
+var allow_cidrs, deny_cidrs cidr_flags
+
+func init() {
+	flag.Var(&allow_cidrs, "allow-cidr", "only accept clients in this range, e.g. 192.168.1.0/24 (repeatable)")
+	flag.Var(&deny_cidrs, "deny-cidr", "turn away clients in this range (repeatable), checked before -allow-cidr")
+}
+
+// Like net.ParseCIDR, with an IPv4-mapped range turned into the IPv4 one
+func parse_cidr(s string) (*net.IPNet, error) {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if ones, bits := n.Mask.Size(); bits == 128 && ones >= 96 && n.IP.To4() != nil {
+		n = &net.IPNet{IP: n.IP.To4(), Mask: net.CIDRMask(ones-96, 32)}
+	}
+	return n, nil
+}
+
+type IPFilter struct {
+	allow, deny []*net.IPNet
+}
+
+var ip_filter *IPFilter // nil without -allow-cidr and -deny-cidr
+
+func NewIPFilter(allow, deny []*net.IPNet) *IPFilter {
+	return &IPFilter{allow: allow, deny: deny}
+}
+
+// Whether a client at ip may connect
+func (f *IPFilter) Allow(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the client passes the lists, closing the connection if not
+func ip_allowed(conn net.Conn) bool {
+	if ip_filter == nil {
+		return true
+	}
+	var ip net.IP
+	if a, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip = a.IP
+	}
+	if ip_filter.Allow(ip) {
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "Client %s is not allowed to connect, closing connection\n", client_ip(conn.RemoteAddr()))
+	conn.Close()
+	return false
+}
+
+func init_ip_filter() {
+	if len(allow_cidrs) == 0 && len(deny_cidrs) == 0 {
+		return
+	}
+	if *proto == "udp" || unix_mode() {
+		die("-allow-cidr and -deny-cidr only work with TCP listeners")
+	}
+	ip_filter = NewIPFilter(allow_cidrs, deny_cidrs)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// Parses a comma separated list as -allow-cidr does
+func cidrs(t *testing.T, list string) []*net.IPNet {
+	var f cidr_flags
+	if list == "" {
+		return nil
+	}
+	if err := f.Set(list); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestIPFilterAllow(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny string
+		ip          string
+		want        bool
+	}{
+		{"no lists", "", "", "203.0.113.9", true},
+		{"no address", "", "", "", false},
+		{"in the allow list", "10.0.0.0/8, 192.168.1.0/24", "", "192.168.1.20", true},
+		{"outside the allow list", "10.0.0.0/8, 192.168.1.0/24", "", "192.168.2.20", false},
+		{"in the deny list", "", "203.0.113.0/24", "203.0.113.9", false},
+		{"outside the deny list", "", "203.0.113.0/24", "198.51.100.1", true},
+		{"denied inside an allowed range", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.3", false},
+		{"allowed next to a denied range", "10.0.0.0/8", "10.1.0.0/16", "10.2.3.4", true},
+		{"allowed inside a denied range", "10.1.2.0/24", "10.0.0.0/8", "10.1.2.3", false},
+		{"the same range in both", "10.0.0.0/8", "10.0.0.0/8", "10.0.0.1", false},
+		{"empty range", "10.0.0.1/32", "", "10.0.0.1", true},
+		{"next to an empty range", "10.0.0.1/32", "", "10.0.0.2", false},
+		{"IPv4-mapped client", "10.0.0.0/8", "", "::ffff:10.1.2.3", true},
+		{"IPv4-mapped client denied", "", "10.0.0.0/8", "::ffff:10.1.2.3", false},
+		{"IPv4-mapped range", "::ffff:192.168.1.0/120", "", "192.168.1.5", true},
+		{"IPv4-mapped range and client", "::ffff:192.168.1.0/120", "", "::ffff:192.168.1.5", true},
+		{"IPv6 client, IPv4 range", "0.0.0.0/0", "", "2001:db8::1", false},
+		{"IPv6 range", "2001:db8::/32", "", "2001:db8::1", true},
+		{"IPv6 range, IPv4 client", "::/0", "", "10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewIPFilter(cidrs(t, tt.allow), cidrs(t, tt.deny))
+			if got := f.Allow(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("Allow(%s) with -allow-cidr %q -deny-cidr %q = %v, want %v", tt.ip, tt.allow, tt.deny, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCIDRFlags(t *testing.T) {
+	var f cidr_flags
+	if err := f.Set("10.0.0.0/8,::ffff:192.168.0.0/112"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Set("192.0.2.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.String(), "10.0.0.0/8,192.168.0.0/16,192.0.2.0/24"; got != want {
+		t.Errorf("flags %s, want %s", got, want)
+	}
+	for _, bad := range []string{"10.0.0.0", "10.0.0.0/33", "10.0.0.0/8,", "example.com/8"} {
+		var f cidr_flags
+		if err := f.Set(bad); err == nil {
+			t.Errorf("-allow-cidr %q was accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Port knocking (-knock-sequence).
+
+The proxy only accepts a client once its IP has connected to each of the
+knock ports in order, for example
+
+	-knock-sequence 7000,8000,9000
+
+Connections to the knock ports are accepted and closed straight away;
+only the order matters. A wrong port starts the sequence over, and
+progress that stalls for -knock-ttl is forgotten. A completed sequence
+lets the IP connect for -knock-ttl; connections that are already open
+are not affected when it runs out. Connections from other IPs are closed
+as soon as they are accepted.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	knock_sequence *string        = flag.String("knock-sequence", "", "comma separated ports a client must connect to, in order, before it may use the proxy")
+	knock_ttl      *time.Duration = flag.Duration("knock-ttl", 30*time.Second, "how long a knock sequence in progress, and the access it grants, lasts")
+)
+
+type knock_state struct {
+	next    int // index of the port expected next
+	last    time.Time
+	granted time.Time // zero until the sequence is complete
+}
+
+type KnockTracker struct {
+	mu       sync.Mutex
+	sequence []int
+	ttl      time.Duration
+	clients  map[string]*knock_state
+}
+
+var knock_tracker *KnockTracker // nil without -knock-sequence
+
+func NewKnockTracker(sequence []int, ttl time.Duration) *KnockTracker {
+	return &KnockTracker{sequence: sequence, ttl: ttl, clients: make(map[string]*knock_state)}
+}
+
+// Parses the port list of -knock-sequence
+func parse_knock_sequence(s string) ([]int, error) {
+	var ports []int
+	for _, p := range strings.Split(s, ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid knock port %q", p)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// Notes a knock of ip on port and reports whether it completed the sequence
+func (k *KnockTracker) Record(ip string, port int) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := time.Now()
+	s, ok := k.clients[ip]
+	if !ok || now.Sub(s.last) > k.ttl {
+		s = &knock_state{}
+		k.clients[ip] = s
+	}
+	s.last = now
+	switch {
+	case port == k.sequence[s.next]:
+		s.next += 1
+	case port == k.sequence[0]:
+		s.next = 1 // a fresh attempt
+	default:
+		s.next = 0
+	}
+	if s.next < len(k.sequence) {
+		return false
+	}
+	s.next, s.granted = 0, now
+	return true
+}
+
+// Reports whether ip completed the sequence within the last ttl
+func (k *KnockTracker) IsAuthorized(ip string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, ok := k.clients[ip]
+	return ok && !s.granted.IsZero() && time.Since(s.granted) <= k.ttl
+}
+
+// Forgets IPs that haven't knocked for ttl, and whose access ran out
+func (k *KnockTracker) evict() {
+	for range time.Tick(k.ttl) {
+		k.mu.Lock()
+		for ip, s := range k.clients {
+			if time.Since(s.last) > k.ttl && time.Since(s.granted) > k.ttl {
+				delete(k.clients, ip)
+			}
+		}
+		k.mu.Unlock()
+	}
+}
+
+// Accepts on one knock port and records every connection
+func (k *KnockTracker) listen(port int) {
+	ln, err := net.Listen(listen_network("tcp"), net.JoinHostPort(*bind_addr, strconv.Itoa(port)))
+	if err != nil {
+		die("Unable to listen on knock port %d, %v", port, err)
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			continue
+		}
+		ip := client_ip(conn.RemoteAddr())
+		conn.Close()
+		if k.Record(ip, port) {
+			fmt.Printf("Knock sequence completed by %s\n", ip)
+		}
+	}
+}
+
+// Reports whether the client knocked, closing the connection if not
+func knock_allowed(conn net.Conn) bool {
+	if knock_tracker == nil {
+		return true
+	}
+	ip := client_ip(conn.RemoteAddr())
+	if knock_tracker.IsAuthorized(ip) {
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "No knock sequence from %s, closing connection\n", ip)
+	conn.Close()
+	return false
+}
+
+// Starts listening on the knock ports of -knock-sequence, if given
+func init_knocking() {
+	if *knock_sequence == "" {
+		return
+	}
+	if *proto == "udp" || unix_mode() {
+		die("-knock-sequence only works with TCP listeners")
+	}
+	ports, err := parse_knock_sequence(*knock_sequence)
+	if err != nil {
+		die("%v", err)
+	}
+	knock_tracker = NewKnockTracker(ports, *knock_ttl)
+	for _, port := range ports {
+		go knock_tracker.listen(port)
+	}
+	go knock_tracker.evict()
+}
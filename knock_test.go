@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKnockTracker(t *testing.T) {
+	sequence := []int{7000, 8000, 9000}
+	tests := []struct {
+		name   string
+		knocks []int
+		stale  time.Duration // how long ago the knocks before the last one were
+		want   bool
+	}{
+		{"in order", []int{7000, 8000, 9000}, 0, true},
+		{"out of order", []int{8000, 7000, 9000}, 0, false},
+		{"the last one first", []int{9000, 7000, 8000}, 0, false},
+		{"a wrong port in between", []int{7000, 8000, 1234, 9000}, 0, false},
+		{"started over", []int{7000, 8000, 7000, 8000, 9000}, 0, true},
+		{"repeated knock", []int{7000, 7000, 8000, 9000}, 0, true},
+		{"a knock short", []int{7000, 8000}, 0, false},
+		{"nothing", nil, 0, false},
+		{"stalled", []int{7000, 8000, 9000}, time.Minute, false},
+		{"slow but in time", []int{7000, 8000, 9000}, 20 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := NewKnockTracker(sequence, 30*time.Second)
+			completed := false
+			for i, port := range tt.knocks {
+				if i == len(tt.knocks)-1 && tt.stale > 0 {
+					k.clients["192.0.2.1"].last = time.Now().Add(-tt.stale)
+				}
+				completed = k.Record("192.0.2.1", port)
+			}
+			if completed != tt.want || k.IsAuthorized("192.0.2.1") != tt.want {
+				t.Errorf("knocks %v completed %v, authorized %v, want %v", tt.knocks, completed, k.IsAuthorized("192.0.2.1"), tt.want)
+			}
+			if k.IsAuthorized("192.0.2.2") {
+				t.Error("another IP is authorized")
+			}
+		})
+	}
+}
+
+func TestKnockTrackerExpiry(t *testing.T) {
+	k := NewKnockTracker([]int{7000, 8000}, 30*time.Second)
+	k.Record("192.0.2.1", 7000)
+	k.Record("192.0.2.1", 8000)
+	if !k.IsAuthorized("192.0.2.1") {
+		t.Fatal("not authorized after the sequence")
+	}
+	k.clients["192.0.2.1"].granted = time.Now().Add(-31 * time.Second)
+	if k.IsAuthorized("192.0.2.1") {
+		t.Error("still authorized after -knock-ttl")
+	}
+	// knocking again grants access again
+	k.Record("192.0.2.1", 7000)
+	if !k.Record("192.0.2.1", 8000) || !k.IsAuthorized("192.0.2.1") {
+		t.Error("a second sequence didn't authorize again")
+	}
+}
+
+func TestParseKnockSequence(t *testing.T) {
+	ports, err := parse_knock_sequence("7000, 8000,9000")
+	if err != nil || len(ports) != 3 || ports[0] != 7000 || ports[2] != 9000 {
+		t.Errorf("parsed %v, %v", ports, err)
+	}
+	for _, bad := range []string{"", "7000,", "0", "65536", "7000,x"} {
+		if _, err := parse_knock_sequence(bad); err == nil {
+			t.Errorf("-knock-sequence %q was accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+/*
+Latency injection to simulate WAN round trip times.
+
+Every chunk read from one side waits before it is forwarded to the other.
+The wait happens after the chunk has been logged, so the log shows when
+data arrived, not when it left.
+*/
+
+package main
+
+import (
+	"flag"
+	"math/rand"
+	"time"
+)
+
+var (
+	latency_client_ms *int = flag.Int("latency-client-ms", 0, "delay data from the client by this many milliseconds")
+	latency_server_ms *int = flag.Int("latency-server-ms", 0, "delay data from the server by this many milliseconds")
+	latency_jitter_ms *int = flag.Int("latency-jitter-ms", 0, "add a random delay of up to this many milliseconds per chunk")
+)
+
+// Delay configured for data read in the given direction
+func direction_latency(direction string) time.Duration {
+	ms := *latency_server_ms
+	if direction == client_to_server {
+		ms = *latency_client_ms
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// Waits out the delay of one chunk, plus jitter
+func inject_latency(base time.Duration) {
+	d := base
+	if *latency_jitter_ms > 0 {
+		d += time.Duration(rand.Int63n(int64(*latency_jitter_ms)*int64(time.Millisecond) + 1))
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Connection limits.
+
+-max-conns caps the number of simultaneous connections: the accept loop
+waits for a free slot before handing a connection to process_connection.
+-rate-limit-per-ip closes connections from clients that connect faster
+than the given rate.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	max_conns         *int           = flag.Int("max-conns", 0, "maximum simultaneous connections (0 means unlimited)")
+	rate_limit_per_ip *float64       = flag.Float64("rate-limit-per-ip", 0, "connections per second allowed per client IP (0 means unlimited)")
+	rate_limit_ttl    *time.Duration = flag.Duration("rate-limit-ttl", 10*time.Minute, "forget the rate of an IP after this long without connections")
+)
+
+var (
+	conn_slots  chan bool // buffered to -max-conns, nil when unlimited
+	ip_limiters sync.Map  // client IP -> *ip_limiter
+)
+
+type ip_limiter struct {
+	bucket    *TokenBucket
+	last_seen int64 // unix nanoseconds, updated atomically
+}
+
+// Sets up the limits selected on the command line
+func init_limits() {
+	if *max_conns > 0 {
+		conn_slots = make(chan bool, *max_conns)
+	}
+	if *rate_limit_per_ip > 0 {
+		go evict_ip_limiters(*rate_limit_ttl)
+	}
+}
+
+// Blocks until another connection may be processed; false if the
+// proxy shuts down in the meantime
+func acquire_slot(shutdown chan bool) bool {
+	if conn_slots == nil {
+		return true
+	}
+	select {
+	case conn_slots <- true:
+		return true
+	case <-shutdown:
+		return false
+	}
+}
+
+func release_slot() {
+	if conn_slots != nil {
+		<-conn_slots
+	}
+}
+
+// The address of a client without its port
+func client_ip(addr net.Addr) string {
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return ip
+}
+
+// Reports whether the client is within its rate, closing the connection if not
+func allow_connection(conn net.Conn) bool {
+	if *rate_limit_per_ip <= 0 {
+		return true
+	}
+	ip := client_ip(conn.RemoteAddr())
+	v, ok := ip_limiters.Load(ip)
+	if !ok {
+		burst := int(math.Max(1, math.Ceil(*rate_limit_per_ip)))
+		v, _ = ip_limiters.LoadOrStore(ip, &ip_limiter{bucket: NewTokenBucket(*rate_limit_per_ip, burst)})
+	}
+	l := v.(*ip_limiter)
+	atomic.StoreInt64(&l.last_seen, time.Now().UnixNano())
+	if l.bucket.Allow() {
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "Rate limit exceeded by %s, closing connection\n", ip)
+	conn.Close()
+	return false
+}
+
+// Drops the limiters of IPs that have not connected for ttl
+func evict_ip_limiters(ttl time.Duration) {
+	for range time.Tick(ttl / 2) {
+		cutoff := time.Now().Add(-ttl).UnixNano()
+		ip_limiters.Range(func(k, v interface{}) bool {
+			if atomic.LoadInt64(&v.(*ip_limiter).last_seen) < cutoff {
+				ip_limiters.Delete(k)
+			}
+			return true
+		})
+	}
+}
@@ -0,0 +1,340 @@
+/*
+Connection log events and their formatters.
+
+pass_through and process_connection describe what happened as LogEvents;
+the connection logger goroutine hands each one to a Logger, which decides
+how it looks in the log file. The copiers don't hex dump the chunks
+themselves, they attach a copy and a FormattingLogger in front of the
+other loggers does the dump while the chunk is being forwarded.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	log_format *string = flag.String("format", "text", "connection log format: text (hex dumps), json or logfmt")
+	output_dir *string = flag.String("output-dir", "", "directory for the log files, created if needed (default current directory)")
+	log_prefix *string = flag.String("log-prefix", "log", "log file names start with this, binary logs with <prefix>-binary")
+)
+
+const (
+	client_to_server = "client→server"
+	server_to_client = "server→client"
+)
+
+type LogEvent struct {
+	Timestamp  time.Time         `json:"timestamp"` // marshalled as RFC3339Nano
+	ConnID     int               `json:"conn_id"`
+	Event      string            `json:"event"` // connected, received, datagram, sent, dropped, write_error, disconnected, network_error, finished, ...
+	Direction  string            `json:"direction,omitempty"`
+	Peer       string            `json:"peer,omitempty"`
+	PacketSeq  int               `json:"packet_seq"`
+	ByteOffset int               `json:"byte_offset"`
+	Length     int               `json:"length"`
+	HexPayload string            `json:"hex_payload,omitempty"`
+	HTTP       *HTTPRecord       `json:"http,omitempty"`
+	WebSocket  *WebSocketRecord  `json:"websocket,omitempty"`
+	GRPC       *GRPCRecord       `json:"grpc,omitempty"`
+	HTTP2      *HTTP2FrameRecord `json:"h2,omitempty"`
+	MQTT       *MQTTPacket       `json:"mqtt,omitempty"`
+	Redis      *RedisRecord      `json:"redis,omitempty"`
+	Postgres   *PostgresRecord   `json:"postgres,omitempty"`
+	MySQL      *MySQLRecord      `json:"mysql,omitempty"`
+	FTP        *FTPRecord        `json:"ftp,omitempty"`
+	SMTP       *SMTPRecord       `json:"smtp,omitempty"`
+	DNS        *DNSRecord        `json:"dns,omitempty"`
+	Modbus     *ModbusRecord     `json:"modbus,omitempty"`
+	LatencyMS  float64           `json:"request_latency_ms,omitempty"` // -measure-latency, on responses
+	Message    string            `json:"message,omitempty"`
+	Raw        []byte            `json:"-"` // only filled in for log backends
+	dump       []byte            // for the FormattingLogger to turn into HexPayload, then kept for payload()
+}
+
+// Builds an event about data moving in one direction
+func new_event(conn_n int, direction, kind, peer string) *LogEvent {
+	return &LogEvent{
+		Timestamp: time.Now(),
+		ConnID:    conn_n,
+		Event:     kind,
+		Direction: direction,
+		Peer:      peer,
+	}
+}
+
+// Leaves the hex dump of b to the FormattingLogger; b may be reused as
+// soon as this returns
+func (e *LogEvent) dump_later(b []byte) {
+	e.dump = bytes.Clone(b)
+}
+
+// The bytes of a received event, if they were kept; the events of
+// parsers that decoded their chunks have none
+func (e *LogEvent) payload() []byte {
+	if e.dump != nil {
+		return e.dump
+	}
+	return e.Raw
+}
+
+// Builds an event that only carries a human readable message
+func log_message(conn_n int, event, format string, v ...interface{}) *LogEvent {
+	return &LogEvent{
+		Timestamp: time.Now(),
+		ConnID:    conn_n,
+		Event:     event,
+		Message:   fmt.Sprintf(format, v...),
+	}
+}
+
+// Writes log events to the connection log
+type Logger interface {
+	Log(e *LogEvent) error
+}
+
+// Fills in the hex dumps of the events going through it, in a goroutine
+// of its own, and passes them on in the order they came
+type FormattingLogger struct {
+	in, out chan *LogEvent
+}
+
+func NewFormattingLogger(out chan *LogEvent) *FormattingLogger {
+	f := &FormattingLogger{in: make(chan *LogEvent), out: out}
+	go f.run()
+	return f
+}
+
+// Where the events go in. The nil one that stops the loggers stops this
+// too, after passing it on.
+func (f *FormattingLogger) Events() chan *LogEvent {
+	return f.in
+}
+
+func (f *FormattingLogger) run() {
+	for e := range f.in {
+		if e != nil && e.dump != nil {
+			e.HexPayload = hex.Dump(e.dump)
+		}
+		f.out <- e
+		if e == nil {
+			return
+		}
+	}
+}
+
+// The original free-form format
+type TextLogger struct {
+	w io.Writer
+}
+
+func (l *TextLogger) Log(e *LogEvent) error {
+	var s string
+	switch e.Event {
+	case "received":
+		s = fmt.Sprintf("Received (#%d, %08X)%d bytes from %s\n",
+			e.PacketSeq, e.ByteOffset, e.Length, e.Peer) + e.HexPayload
+	case "fanout_received":
+		s = fmt.Sprintf("Received (#%d, %08X) %d bytes from shadow %s, not forwarded\n",
+			e.PacketSeq, e.ByteOffset, e.Length, e.Peer) + e.HexPayload
+	case "datagram":
+		s = fmt.Sprintf("--- Datagram (#%d, %08X) %d bytes from %s ---\n",
+			e.PacketSeq, e.ByteOffset, e.Length, e.Peer) + e.HexPayload +
+			fmt.Sprintf("--- End of datagram (#%d) ---\n", e.PacketSeq)
+	case "sent":
+		s = fmt.Sprintf("Sent (#%d) to %s\n", e.PacketSeq, e.Peer)
+	case "injected":
+		s = fmt.Sprintf("Injected (#%d) %d synthetic bytes (%s at %08X) for %s\n",
+			e.PacketSeq, e.Length, e.Message, e.ByteOffset, e.Peer) + e.HexPayload
+	case "dropped":
+		s = fmt.Sprintf("Dropped (#%d) %d bytes instead of sending to %s\n", e.PacketSeq, e.Length, e.Peer)
+	case "http_request", "http_response":
+		s = format_http(e)
+	case "websocket_frame":
+		s = format_websocket(e)
+	case "grpc_headers", "grpc_message":
+		s = format_grpc(e)
+	case "h2_frame":
+		s = format_h2(e)
+	case "mqtt_packet":
+		s = format_mqtt(e)
+	case "redis_command", "redis_reply":
+		s = format_redis(e)
+	case "postgres_message":
+		s = format_postgres(e)
+	case "mysql_packet":
+		s = format_mysql(e)
+	case "ftp_command", "ftp_reply":
+		s = format_ftp(e)
+	case "smtp_command", "smtp_reply":
+		s = format_smtp(e)
+	case "dns_message":
+		s = format_dns(e)
+	case "modbus_request", "modbus_response":
+		s = format_modbus(e)
+	default:
+		s = e.Message + "\n"
+	}
+	if e.LatencyMS > 0 {
+		s += fmt.Sprintf("Server latency %.3f ms\n", e.LatencyMS)
+	}
+	_, err := io.WriteString(l.w, s)
+	return err
+}
+
+func format_http(e *LogEvent) string {
+	h := e.HTTP
+	var b strings.Builder
+	if e.Event == "http_request" {
+		fmt.Fprintf(&b, "HTTP request from %s: %s %s %s\n", e.Peer, h.Method, h.URL, h.Proto)
+		if h.Host != "" {
+			fmt.Fprintf(&b, "Host: %s\n", h.Host)
+		}
+	} else {
+		fmt.Fprintf(&b, "HTTP response from %s: %s %s\n", e.Peer, h.Proto, h.Status)
+	}
+	var headers strings.Builder
+	h.Headers.Write(&headers)
+	b.WriteString(strings.ReplaceAll(headers.String(), "\r\n", "\n"))
+	if h.Body != "" {
+		b.WriteString("\n" + h.Body + "\n")
+	}
+	if h.BodyTruncated {
+		b.WriteString("[body truncated]\n")
+	}
+	return b.String()
+}
+
+func format_websocket(e *LogEvent) string {
+	w := e.WebSocket
+	kind := w.Type
+	if w.Message != "" {
+		kind += " (" + w.Message + ")"
+	}
+	s := fmt.Sprintf("WebSocket %s frame from %s: fin=%t, %d bytes", kind, e.Peer, w.Fin, w.Length)
+	if w.Masked {
+		s += ", mask " + w.MaskKey
+	}
+	s += "\n"
+	if w.Text != "" {
+		s += w.Text + "\n"
+	}
+	s += w.HexPayload
+	if w.Truncated {
+		s += "[payload truncated]\n"
+	}
+	return s
+}
+
+func format_grpc(e *LogEvent) string {
+	g := e.GRPC
+	var b strings.Builder
+	if e.Event == "grpc_headers" {
+		kind := "headers"
+		if g.EndStream {
+			kind = "trailers"
+		}
+		fmt.Fprintf(&b, "gRPC %s from %s, stream %d %s\n", kind, e.Peer, g.StreamID, g.Method)
+		for _, h := range g.Headers {
+			b.WriteString(h + "\n")
+		}
+		return b.String()
+	}
+	fmt.Fprintf(&b, "gRPC message from %s, stream %d %s, %d bytes", e.Peer, g.StreamID, g.Method, g.Length)
+	if g.Compressed {
+		b.WriteString(", compressed")
+	}
+	b.WriteString("\n")
+	if g.Message != nil {
+		b.Write(g.Message)
+		b.WriteString("\n")
+	}
+	b.WriteString(g.HexPayload)
+	return b.String()
+}
+
+// Picks the Logger selected with -format, slog records for json and logfmt
+func new_logger(w io.Writer) Logger {
+	if *log_format == "text" {
+		return &TextLogger{w}
+	}
+	return NewSlogLogger(w, *log_format)
+}
+
+// -format takes text, json or logfmt
+func init_log_format() {
+	switch *log_format {
+	case "text", "json", "logfmt":
+	default:
+		die("Unknown -format %q, use text, json or logfmt", *log_format)
+	}
+}
+
+// Creates -output-dir if it doesn't exist yet
+func init_output_dir() {
+	if *output_dir == "" {
+		return
+	}
+	if err := os.MkdirAll(*output_dir, 0755); err != nil {
+		die("Unable to create output directory, %v", err)
+	}
+}
+
+// Creates a log file, reports on opened whether that worked, and then
+// blocks for events until a nil one arrives. grep, if not nil, picks the
+// events that are written.
+func event_logger_loop(ctx context.Context, events chan *LogEvent, log_name string, opened chan error, grep *StreamingGrepFilter) error {
+	f, err := OpenFileBackend(log_name)
+	if err != nil {
+		err = fmt.Errorf("unable to create file %s: %w", log_name, err)
+		opened <- err
+		return err
+	}
+	opened <- nil
+	defer grep.finish(log_name) // after the file is closed
+	defer f.Close()
+	separator := *append_log
+	done := ctx.Done()
+	for {
+		select {
+		case e := <-events:
+			if e == nil {
+				return nil
+			}
+			if separator {
+				start := log_message(e.ConnID, "session_started", "=== Session started at %s ===", format_time(e.Timestamp))
+				start.Timestamp = e.Timestamp
+				f.WriteEvent(start)
+				separator = false
+			}
+			for _, e := range grep.Filter(e) {
+				f.WriteEvent(e)
+			}
+		case <-rotation.wait():
+			f.Rotate()
+		case <-done:
+			// the disconnect events are still to come, keep going
+			// until the nil one
+			f.Sync()
+			done = nil
+		}
+	}
+}
+
+// Stands in for a connection logger whose file couldn't be created
+func discard_events(events chan *LogEvent) {
+	for e := range events {
+		if e == nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Log file names (-log-name-template).
+
+The template is text/template syntax and is executed once for the
+connection log and once for each binary log of a connection. It can use
+
+	{{.Prefix}}     -log-prefix, plus "-<listen port>" with several mappings
+	{{.Time}}       when the connection started, as in the log messages
+	{{.ConnID}}     the connection number, zero padded to 4 digits
+	{{.LocalAddr}}  the client, e.g. 127.0.0.1-51234
+	{{.RemoteAddr}} the target
+	{{.ListenPort}} the port the connection came in on
+	{{.Tag}}        -tag, or the client's own with -accept-tags (tag.go)
+	{{.Kind}}       "log" for the connection log, "binary" for binary logs
+	{{.Peer}}       whose data a binary log holds, empty for the connection log
+
+The result is relative to -output-dir and may contain subdirectories,
+which are created as needed. The default gives the original names:
+log-<time>-<conn>-<local>-<remote>.log and
+log-binary-<time>-<conn>-<peer>.log.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const default_log_name_template = `{{.Prefix}}{{if eq .Kind "binary"}}-binary{{end}}-{{.Time}}-{{.ConnID}}-` +
+	`{{if eq .Kind "binary"}}{{.Peer}}{{else}}{{.LocalAddr}}-{{.RemoteAddr}}{{end}}.log`
+
+var (
+	log_name_template *string = flag.String("log-name-template", default_log_name_template, "text/template for log file names, see logname.go")
+	log_tag           *string = flag.String("tag", "", "free text for {{.Tag}} in -log-name-template")
+)
+
+var log_name_tmpl *template.Template
+
+type log_name_vars struct {
+	Prefix     string
+	Time       string
+	ConnID     string
+	LocalAddr  string
+	RemoteAddr string
+	ListenPort string
+	Tag        string
+	Kind       string
+	Peer       string
+}
+
+// Parses -log-name-template, and makes sure the three log files of a
+// connection can't end up with the same name
+func init_log_names() {
+	t, err := template.New("log-name-template").Parse(*log_name_template)
+	if err != nil {
+		die("Invalid -log-name-template, %v", err)
+	}
+	log_name_tmpl = t
+
+	v := log_name_vars{Prefix: "log", Time: format_time(time.Now()), ConnID: "0001",
+		LocalAddr: "127.0.0.1-50000", RemoteAddr: "127.0.0.1-80", ListenPort: "8080", Tag: *log_tag, Kind: "log"}
+	names := make(map[string]bool)
+	for _, peer := range []string{"", v.LocalAddr, v.RemoteAddr} {
+		if peer != "" {
+			v.Kind, v.Peer = "binary", peer
+		}
+		name, err := execute_log_name(v)
+		if err != nil {
+			die("Invalid -log-name-template, %v", err)
+		}
+		if name == "" || strings.HasSuffix(name, "/") {
+			die("-log-name-template gives an empty file name")
+		}
+		if names[name] {
+			die("-log-name-template gives the same name to a connection log and its binary logs, use {{.Kind}} and {{.Peer}}")
+		}
+		names[name] = true
+	}
+}
+
+func execute_log_name(v log_name_vars) (string, error) {
+	var b strings.Builder
+	if err := log_name_tmpl.Execute(&b, v); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// The file name of one log of a connection, with its directory created.
+// peer is empty for the connection log.
+func log_file_name(m *mapping, conn_n int, local_info, remote_info, tag, peer string) string {
+	v := log_name_vars{
+		Prefix:     filepath.Base(m.log_prefix),
+		Time:       format_time(time.Now()),
+		ConnID:     fmt.Sprintf("%04d", conn_n),
+		LocalAddr:  local_info,
+		RemoteAddr: remote_info,
+		ListenPort: m.listen_port,
+		Tag:        tag,
+		Kind:       "log",
+	}
+	if peer != "" {
+		v.Kind, v.Peer = "binary", peer
+	}
+	name := log_path(m, v)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create directory for %s, %v\n", name, err)
+	}
+	return compressed_name(name)
+}
+
+// The template's name for v, next to m's -log-prefix
+func log_path(m *mapping, v log_name_vars) string {
+	name, err := execute_log_name(v)
+	if err != nil { // checked in init_log_names, so only on odd input
+		name = fmt.Sprintf("%s-%s-%s-%s.log", v.Prefix, v.Time, v.ConnID, v.Kind)
+	}
+	return filepath.Join(filepath.Dir(m.log_prefix), name)
+}
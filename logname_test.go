@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestLogFileName(t *testing.T) {
+	saved := *log_name_template
+	t.Cleanup(func() {
+		*log_name_template = saved
+		init_log_names()
+	})
+	time_re := `[0-9]{4}\.[0-9]{2}\.[0-9]{2}-[0-9]{2}\.[0-9]{2}\.[0-9]{2}`
+	tests := []struct {
+		name     string
+		template string
+		log      string // patterns, relative to the -log-prefix directory
+		binary   string
+	}{
+		{"default", default_log_name_template,
+			`log-` + time_re + `-0007-127\.0\.0\.1-50000-10\.0\.0\.1-80\.log`,
+			`log-binary-` + time_re + `-0007-127\.0\.0\.1-50000\.log`},
+		{"flat", `{{.Prefix}}-{{.ListenPort}}-{{.ConnID}}-{{.Kind}}{{.Peer}}.txt`,
+			`log-8080-0007-log\.txt`,
+			`log-8080-0007-binary127\.0\.0\.1-50000\.txt`},
+		{"subdirectories", `{{.ListenPort}}/{{.Tag}}/{{.ConnID}}/{{.Kind}}{{if .Peer}}-{{.Peer}}{{end}}.log`,
+			`8080/staging/0007/log\.log`,
+			`8080/staging/0007/binary-127\.0\.0\.1-50000\.log`},
+		{"a directory per day", `{{slice .Time 0 10}}/{{.Prefix}}-{{.ConnID}}-{{.Kind}}{{.Peer}}.log`,
+			`[0-9]{4}\.[0-9]{2}\.[0-9]{2}/log-0007-log\.log`,
+			`[0-9]{4}\.[0-9]{2}\.[0-9]{2}/log-0007-binary127\.0\.0\.1-50000\.log`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*log_name_template = tt.template
+			init_log_names()
+			dir := t.TempDir()
+			m := &mapping{listen_port: "8080", log_prefix: filepath.Join(dir, "log")}
+			for _, f := range []struct{ peer, want string }{{"", tt.log}, {"127.0.0.1-50000", tt.binary}} {
+				name := log_file_name(m, 7, "127.0.0.1-50000", "10.0.0.1-80", "staging", f.peer)
+				rel, err := filepath.Rel(dir, name)
+				if err != nil || !regexp.MustCompile("^"+f.want+"$").MatchString(filepath.ToSlash(rel)) {
+					t.Errorf("log name %s, want %s", rel, f.want)
+				}
+				if info, err := os.Stat(filepath.Dir(name)); err != nil || !info.IsDir() {
+					t.Errorf("the directory of %s wasn't created, %v", rel, err)
+				}
+			}
+		})
+	}
+}
+
+// Names are relative to the directory of -log-prefix, which {{.Prefix}}
+// leaves out
+func TestLogFileNamePrefixDir(t *testing.T) {
+	saved := *log_name_template
+	t.Cleanup(func() {
+		*log_name_template = saved
+		init_log_names()
+	})
+	*log_name_template = `{{.Prefix}}/{{.ConnID}}-{{.Kind}}{{.Peer}}.log`
+	init_log_names()
+	dir := t.TempDir()
+	m := &mapping{listen_port: "8080", log_prefix: filepath.Join(dir, "logs", "spy")}
+	if got, want := log_file_name(m, 12, "a", "b", "", ""), filepath.Join(dir, "logs", "spy", "0012-log.log"); got != want {
+		t.Errorf("log name %s, want %s", got, want)
+	}
+}
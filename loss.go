@@ -0,0 +1,45 @@
+/*
+Packet loss simulation for chaos testing.
+
+Each chunk read in pass_through is dropped with probability -loss-rate:
+it is still logged, but never written to the other side. TCP is reliable,
+so nothing retransmits a dropped chunk; the peer simply never sees those
+bytes and the protocol on top will usually stall or fail. That is the
+point of the exercise, but expect it.
+*/
+
+package main
+
+import (
+	"flag"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	loss_rate *float64 = flag.Float64("loss-rate", 0, "probability (0.0-1.0) of dropping each forwarded chunk")
+	loss_seed *int64   = flag.Int64("loss-seed", 0, "seed for the loss decisions, for reproducible runs (0 picks one)")
+)
+
+var loss = struct {
+	sync.Mutex
+	rnd *rand.Rand
+}{}
+
+// Decides whether the next chunk is dropped
+func drop_chunk() bool {
+	if *loss_rate <= 0 {
+		return false
+	}
+	loss.Lock()
+	defer loss.Unlock()
+	if loss.rnd == nil {
+		seed := *loss_seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		loss.rnd = rand.New(rand.NewSource(seed))
+	}
+	return loss.rnd.Float64() < *loss_rate
+}
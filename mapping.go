@@ -0,0 +1,183 @@
+/*
+Listen port to target mappings.
+
+One process can tap several services at once: every mapping has its own
+listener, accept loop and connection numbers. Mappings come from the
+-config targets and from repeated -map flags, e.g.
+
+	-map 8080:example.com:80 -map 8443:example.com:443
+
+Without either, -listen_port, -host and -port make the only mapping,
+or -listen_port and the -upstream pool.
+Once there are several, log file names carry the listen port after
+-log-prefix so that
+connections with the same number don't collide. With -proto unix the
+listen port and port are socket paths.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	bind_addr *string = flag.String("bind-addr", "", "address to listen on, e.g. 127.0.0.1 or :: (default all interfaces, IPv4 and IPv6)")
+	ipv6_only *bool   = flag.Bool("ipv6-only", false, "only accept IPv6 connections")
+)
+
+type mapping struct {
+	index       int
+	listen_port string
+	host, port  string           // unused in the dynamic modes
+	namespace   string           // the listen port once there are several mappings
+	log_prefix  string           // -output-dir/-log-prefix, plus "-<namespace>"
+	pool        *UpstreamPool    // nil unless -upstream
+	hooks       []func(*Session) // Proxy.OnConnection
+}
+
+func (m *mapping) target() string {
+	if unix_mode() && *mode == "forward" {
+		return m.port
+	}
+	return net.JoinHostPort(m.host, m.port)
+}
+
+// The target of a new connection from client, and how it was chosen
+func (m *mapping) next_target(client net.Addr) (string, string) {
+	if m.pool == nil {
+		return m.target(), ""
+	}
+	return m.pool.Next(client_ip(client)), " (upstream, " + m.pool.strategy + ")"
+}
+
+// What the startup message says connections are forwarded to
+func (m *mapping) target_description() string {
+	if m.pool == nil {
+		return m.target()
+	}
+	return m.pool.String()
+}
+
+func (m *mapping) listen_addr() string {
+	if unix_mode() {
+		return m.listen_port
+	}
+	return net.JoinHostPort(*bind_addr, m.listen_port)
+}
+
+// Network of the connections to the target
+func (m *mapping) target_network() string {
+	if unix_mode() && *mode == "forward" {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// Whether there is enough to listen and forward; replays don't listen
+func (m *mapping) complete(dynamic_target bool) bool {
+	if unix_mode() {
+		return (dynamic_target || m.port != "0") && (m.listen_port != "" || *replay_file != "")
+	}
+	return (dynamic_target || (m.host != "" && m.port != "0")) &&
+		(m.listen_port != "0" || *replay_file != "")
+}
+
+func (m *mapping) String() string {
+	if unix_mode() {
+		return "socket " + m.listen_port
+	}
+	return "port " + m.listen_port
+}
+
+// tcp or udp listen dual-stack on the wildcard address; tcp6 and udp6
+// set IPV6_V6ONLY
+func listen_network(base string) string {
+	if *ipv6_only {
+		return base + "6"
+	}
+	return base
+}
+
+// Repeated -map flags
+type map_flags []*mapping
+
+func (f *map_flags) String() string {
+	var s []string
+	for _, m := range *f {
+		s = append(s, m.listen_port+":"+m.target())
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *map_flags) Set(value string) error {
+	m, err := parse_mapping(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, m)
+	return nil
+}
+
+var maps map_flags
+
+func init() {
+	flag.Var(&maps, "map", "listen_port:host:port to forward, may be repeated")
+}
+
+// Parses listen_port:host:port; IPv6 hosts go in brackets
+func parse_mapping(s string) (*mapping, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("%q is not listen_port:host:port", s)
+	}
+	host, port, err := net.SplitHostPort(s[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("%q is not listen_port:host:port, %v", s, err)
+	}
+	return &mapping{listen_port: s[:i], host: host, port: port}, nil
+}
+
+// All mappings of this run, numbered and with their log prefixes set
+func configured_mappings() []*mapping {
+	var all []*mapping
+	for _, t := range configured_targets() {
+		all = append(all, &mapping{listen_port: t.ListenPort, host: t.Host, port: t.Port})
+	}
+	all = append(all, maps...)
+	if len(all) == 0 {
+		m := &mapping{listen_port: *listen_port, host: *host, port: *port}
+		if unix_mode() {
+			m.listen_port = *listen_socket
+		}
+		if m.pool = upstream_pool(); m.pool != nil {
+			// the first upstream stands in wherever a single target is needed
+			m.host, m.port, _ = net.SplitHostPort(upstreams[0])
+		}
+		if len(fanout) > 0 {
+			if m.pool != nil {
+				die("-fanout can't be combined with -upstream")
+			}
+			m.host, m.port, _ = net.SplitHostPort(fanout[0])
+		}
+		all = append(all, m)
+	} else if len(upstreams) > 0 {
+		die("-upstream can't be combined with -map or -config targets")
+	} else if len(fanout) > 0 {
+		die("-fanout can't be combined with -map or -config targets")
+	}
+	for i, m := range all {
+		m.index = i
+		m.log_prefix = *log_prefix
+		if len(all) > 1 {
+			m.namespace = sanitize_name(m.listen_port)
+			m.log_prefix += "-" + m.namespace
+		}
+		m.log_prefix = filepath.Join(*output_dir, m.log_prefix)
+	}
+	return all
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestParseMapping(t *testing.T) {
+	tests := []struct {
+		value                   string
+		listen_port, host, port string
+		err                     bool
+	}{
+		{"8080:example.com:80", "8080", "example.com", "80", false},
+		{"8443:10.0.0.5:443", "8443", "10.0.0.5", "443", false},
+		{"5432:[::1]:5432", "5432", "::1", "5432", false},
+		{"5432:[2001:db8::7]:6432", "5432", "2001:db8::7", "6432", false},
+		{"8080", "", "", "", true},
+		{"8080:example.com", "", "", "", true},
+		{"8080:::1:80", "", "", "", true}, // IPv6 without brackets
+	}
+	for _, tt := range tests {
+		m, err := parse_mapping(tt.value)
+		if (err != nil) != tt.err {
+			t.Errorf("parse_mapping(%q) error %v, want error %v", tt.value, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if m.listen_port != tt.listen_port || m.host != tt.host || m.port != tt.port {
+			t.Errorf("parse_mapping(%q) = %s %s %s, want %s %s %s", tt.value,
+				m.listen_port, m.host, m.port, tt.listen_port, tt.host, tt.port)
+		}
+	}
+}
+
+func TestMapFlags(t *testing.T) {
+	var f map_flags
+	for _, v := range []string{"8080:example.com:80", "5432:[::1]:5432"} {
+		if err := f.Set(v); err != nil {
+			t.Fatalf("Set(%q): %v", v, err)
+		}
+	}
+	if got, want := f.String(), "8080:example.com:80,5432:[::1]:5432"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if err := f.Set("nonsense"); err == nil || len(f) != 2 {
+		t.Errorf("Set(nonsense) = %v with %d mappings, want an error and 2", err, len(f))
+	}
+}
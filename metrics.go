@@ -0,0 +1,151 @@
+/*
+Prometheus metrics (-metrics-addr).
+
+Counters are plain atomics and /metrics renders them in the text
+exposition format, so no client library is needed.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var metrics_addr *string = flag.String("metrics-addr", "", "serve Prometheus metrics on this address, e.g. :9090")
+
+var duration_buckets = []float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 1800, 3600}
+
+type Metrics struct {
+	active_connections int64
+	total_connections  int64
+	bytes_c2s          int64
+	bytes_s2c          int64
+	dial_errors        int64
+	read_errors        int64
+	write_errors       int64
+	auth_failures      int64
+	webhook_dropped    int64
+	webhook_failures   int64
+	hook_dropped       int64
+	hook_failures      int64
+
+	mu             sync.Mutex // guards the histogram
+	duration_count []int64    // per bucket, not cumulative
+	duration_sum   float64
+	duration_n     int64
+}
+
+var metrics = &Metrics{duration_count: make([]int64, len(duration_buckets))}
+
+var metrics_server *http.Server
+
+func (m *Metrics) connection_opened() {
+	atomic.AddInt64(&m.active_connections, 1)
+	atomic.AddInt64(&m.total_connections, 1)
+}
+
+func (m *Metrics) connection_closed(d time.Duration) {
+	atomic.AddInt64(&m.active_connections, -1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := d.Seconds()
+	for i, le := range duration_buckets {
+		if s <= le {
+			m.duration_count[i] += 1
+			break
+		}
+	}
+	m.duration_sum += s
+	m.duration_n += 1
+}
+
+func (m *Metrics) forwarded(direction string, n int) {
+	if direction == client_to_server {
+		atomic.AddInt64(&m.bytes_c2s, int64(n))
+	} else {
+		atomic.AddInt64(&m.bytes_s2c, int64(n))
+	}
+}
+
+func (m *Metrics) error(counter *int64) {
+	atomic.AddInt64(counter, 1)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("gotcpspy_active_connections", "gauge", "Connections currently being proxied.")
+	fmt.Fprintf(&b, "gotcpspy_active_connections %d\n", atomic.LoadInt64(&m.active_connections))
+
+	metric("gotcpspy_total_connections_total", "counter", "Connections accepted since start.")
+	fmt.Fprintf(&b, "gotcpspy_total_connections_total %d\n", atomic.LoadInt64(&m.total_connections))
+
+	metric("gotcpspy_bytes_forwarded_total", "counter", "Bytes forwarded per direction.")
+	fmt.Fprintf(&b, "gotcpspy_bytes_forwarded_total{direction=\"client_to_server\"} %d\n", atomic.LoadInt64(&m.bytes_c2s))
+	fmt.Fprintf(&b, "gotcpspy_bytes_forwarded_total{direction=\"server_to_client\"} %d\n", atomic.LoadInt64(&m.bytes_s2c))
+
+	metric("gotcpspy_connection_duration_seconds", "histogram", "Duration of finished connections.")
+	m.mu.Lock()
+	cumulative := int64(0)
+	for i, le := range duration_buckets {
+		cumulative += m.duration_count[i]
+		fmt.Fprintf(&b, "gotcpspy_connection_duration_seconds_bucket{le=\"%g\"} %d\n", le, cumulative)
+	}
+	fmt.Fprintf(&b, "gotcpspy_connection_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.duration_n)
+	fmt.Fprintf(&b, "gotcpspy_connection_duration_seconds_sum %g\n", m.duration_sum)
+	fmt.Fprintf(&b, "gotcpspy_connection_duration_seconds_count %d\n", m.duration_n)
+	m.mu.Unlock()
+
+	metric("gotcpspy_errors_total", "counter", "Errors by type.")
+	fmt.Fprintf(&b, "gotcpspy_errors_total{type=\"dial\"} %d\n", atomic.LoadInt64(&m.dial_errors))
+	fmt.Fprintf(&b, "gotcpspy_errors_total{type=\"read\"} %d\n", atomic.LoadInt64(&m.read_errors))
+	fmt.Fprintf(&b, "gotcpspy_errors_total{type=\"write\"} %d\n", atomic.LoadInt64(&m.write_errors))
+
+	metric("gotcpspy_auth_failures_total", "counter", "Clients turned away by -auth-token.")
+	fmt.Fprintf(&b, "gotcpspy_auth_failures_total %d\n", atomic.LoadInt64(&m.auth_failures))
+
+	metric("gotcpspy_webhook_errors_total", "counter", "-webhook-url events not delivered, by reason.")
+	fmt.Fprintf(&b, "gotcpspy_webhook_errors_total{type=\"dropped\"} %d\n", atomic.LoadInt64(&m.webhook_dropped))
+	fmt.Fprintf(&b, "gotcpspy_webhook_errors_total{type=\"failed\"} %d\n", atomic.LoadInt64(&m.webhook_failures))
+
+	metric("gotcpspy_hook_errors_total", "counter", "-hook-cmd events not run or failed, by reason.")
+	fmt.Fprintf(&b, "gotcpspy_hook_errors_total{type=\"dropped\"} %d\n", atomic.LoadInt64(&m.hook_dropped))
+	fmt.Fprintf(&b, "gotcpspy_hook_errors_total{type=\"failed\"} %d\n", atomic.LoadInt64(&m.hook_failures))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
+
+// Serves /metrics in the background when -metrics-addr is set
+func start_metrics_server() {
+	if *metrics_addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	metrics_server = &http.Server{Addr: *metrics_addr, Handler: mux}
+	go func() {
+		if err := metrics_server.ListenAndServe(); err != http.ErrServerClosed {
+			die("Unable to start metrics server, %v", err)
+		}
+	}()
+}
+
+func stop_metrics_server() {
+	if metrics_server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	metrics_server.Shutdown(ctx)
+}
@@ -0,0 +1,113 @@
+/*
+Traffic mirroring (-mirror-host, -mirror-port).
+
+Every direction of every connection gets its own connection to the
+mirror, so an IDS or analysis tool there sees the same two byte streams
+as the peers did: what was actually forwarded, after injection and loss.
+The mirror is dialed on the first data and redialed after an error, but
+it never slows the proxy down. Chunks are queued without blocking and
+dropped while the mirror is slow or unreachable.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	mirror_host *string = flag.String("mirror-host", "", "also send a copy of the forwarded bytes to this host")
+	mirror_port *int    = flag.Int("mirror-port", 0, "port of the -mirror-host endpoint")
+)
+
+const (
+	mirror_queue_size    = 256
+	mirror_dial_timeout  = 2 * time.Second
+	mirror_write_timeout = time.Second
+	mirror_retry_after   = time.Second // chunks are dropped, not dialed for, until then
+)
+
+func mirror_enabled() bool {
+	return *mirror_host != "" && *mirror_port != 0
+}
+
+// A fire-and-forget connection to the mirror
+type MirrorConn struct {
+	addr    string
+	queue   chan []byte
+	done    chan bool
+	dropped int64
+}
+
+func NewMirrorConn(addr string) *MirrorConn {
+	m := &MirrorConn{addr: addr, queue: make(chan []byte, mirror_queue_size), done: make(chan bool)}
+	go m.send_loop()
+	return m
+}
+
+// The mirror of one direction, nil unless mirroring is on
+func new_mirror() *MirrorConn {
+	if !mirror_enabled() {
+		return nil
+	}
+	return NewMirrorConn(net.JoinHostPort(*mirror_host, strconv.Itoa(*mirror_port)))
+}
+
+// Queues a copy of b; never blocks and never fails
+func (m *MirrorConn) Write(b []byte) (int, error) {
+	d := make([]byte, len(b))
+	copy(d, b)
+	select {
+	case m.queue <- d:
+	default:
+		atomic.AddInt64(&m.dropped, int64(len(b)))
+	}
+	return len(b), nil
+}
+
+// Sends what is still queued, if the mirror is up, and hangs up
+func (m *MirrorConn) Close() error {
+	close(m.queue)
+	<-m.done
+	if n := atomic.LoadInt64(&m.dropped); n > 0 {
+		fmt.Fprintf(os.Stderr, "Mirror %s missed %d bytes\n", m.addr, n)
+	}
+	return nil
+}
+
+func (m *MirrorConn) send_loop() {
+	defer close(m.done)
+	var conn net.Conn
+	var retry_at time.Time
+	for b := range m.queue {
+		if conn == nil {
+			if time.Now().Before(retry_at) {
+				atomic.AddInt64(&m.dropped, int64(len(b)))
+				continue
+			}
+			var err error
+			if conn, err = net.DialTimeout("tcp", m.addr, mirror_dial_timeout); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to connect to mirror %s, %v\n", m.addr, err)
+				retry_at = time.Now().Add(mirror_retry_after)
+				atomic.AddInt64(&m.dropped, int64(len(b)))
+				continue
+			}
+		}
+		conn.SetWriteDeadline(time.Now().Add(mirror_write_timeout))
+		if _, err := conn.Write(b); err != nil {
+			fmt.Fprintf(os.Stderr, "Mirror %s failed, %v\n", m.addr, err)
+			conn.Close()
+			conn = nil
+			atomic.AddInt64(&m.dropped, int64(len(b)))
+		}
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
@@ -0,0 +1,311 @@
+/*
+Modbus TCP decoding for the connection log (-proto modbus).
+
+Every frame starts with the 7 byte MBAP header: transaction ID, protocol
+ID (0 for Modbus), the length of what follows and the unit ID. The
+function code and its data come after. The reading and writing of coils
+and registers is decoded, with the registers as big-endian 16 bit
+values; other functions are logged with their data as hex. A function
+code with the high bit set is an error response carrying an exception
+code.
+
+The read responses don't repeat the address and quantity asked for, so
+the requests are kept by transaction ID until their response comes.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+const (
+	modbus_max_length = 254 // unit ID and PDU
+	modbus_max_queue  = 1024
+)
+
+type ModbusRecord struct {
+	TransactionID uint16   `json:"transaction_id"`
+	UnitID        uint8    `json:"unit_id"`
+	Length        int      `json:"length"`
+	Function      uint8    `json:"function"`
+	FunctionName  string   `json:"function_name"`
+	Address       int      `json:"address"`
+	Quantity      int      `json:"quantity,omitempty"`
+	Registers     []uint16 `json:"registers,omitempty"`
+	Coils         []bool   `json:"coils,omitempty"`
+	Exception     string   `json:"exception,omitempty"`
+	Data          string   `json:"data,omitempty"` // hex, of the functions not decoded
+	NoRequest     bool     `json:"no_request,omitempty"`
+}
+
+var modbus_functions = map[uint8]string{
+	0x01: "Read Coils",
+	0x02: "Read Discrete Inputs",
+	0x03: "Read Holding Registers",
+	0x04: "Read Input Registers",
+	0x05: "Write Single Coil",
+	0x06: "Write Single Register",
+	0x07: "Read Exception Status",
+	0x08: "Diagnostics",
+	0x0b: "Get Comm Event Counter",
+	0x0c: "Get Comm Event Log",
+	0x0f: "Write Multiple Coils",
+	0x10: "Write Multiple Registers",
+	0x11: "Report Server ID",
+	0x14: "Read File Record",
+	0x15: "Write File Record",
+	0x16: "Mask Write Register",
+	0x17: "Read/Write Multiple Registers",
+	0x18: "Read FIFO Queue",
+	0x2b: "Encapsulated Interface Transport",
+}
+
+var modbus_exceptions = map[uint8]string{
+	0x01: "Illegal Function",
+	0x02: "Illegal Data Address",
+	0x03: "Illegal Data Value",
+	0x04: "Server Device Failure",
+	0x05: "Acknowledge",
+	0x06: "Server Device Busy",
+	0x08: "Memory Parity Error",
+	0x0a: "Gateway Path Unavailable",
+	0x0b: "Gateway Target Device Failed to Respond",
+}
+
+type modbus_request struct {
+	function uint8
+	address  int
+	quantity int
+}
+
+// Decodes both directions of a Modbus TCP connection. The client side
+// leaves its requests for the server side.
+type ModbusParser struct {
+	mu      sync.Mutex
+	pending map[uint16]modbus_request
+}
+
+func NewModbusParser() *ModbusParser {
+	return &ModbusParser{pending: make(map[uint16]modbus_request)}
+}
+
+// Reads one frame: the MBAP header and the PDU
+func read_modbus_frame(r *bufio.Reader) (*ModbusRecord, []byte, error) {
+	var header [7]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, nil, err
+	}
+	if protocol := binary.BigEndian.Uint16(header[2:]); protocol != 0 {
+		return nil, nil, fmt.Errorf("Modbus protocol ID %d", protocol)
+	}
+	length := int(binary.BigEndian.Uint16(header[4:]))
+	if length < 2 || length > modbus_max_length {
+		return nil, nil, fmt.Errorf("Modbus frame length %d", length)
+	}
+	pdu := make([]byte, length-1)
+	if _, err := io.ReadFull(r, pdu); err != nil {
+		return nil, nil, err
+	}
+	rec := &ModbusRecord{
+		TransactionID: binary.BigEndian.Uint16(header[0:]),
+		UnitID:        header[6],
+		Length:        len(header) + len(pdu),
+		Function:      pdu[0],
+	}
+	rec.FunctionName = modbus_function_name(rec.Function &^ 0x80)
+	return rec, pdu[1:], nil
+}
+
+func modbus_function_name(f uint8) string {
+	if s, ok := modbus_functions[f]; ok {
+		return s
+	}
+	return "Function"
+}
+
+// The functions on coils and registers, their requests start with an address
+func modbus_addressed(f uint8) bool {
+	return f >= 0x01 && f <= 0x06 || f == 0x0f || f == 0x10
+}
+
+func modbus_registers(b []byte) []uint16 {
+	v := make([]uint16, len(b)/2)
+	for i := range v {
+		v[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+	return v
+}
+
+func modbus_coils(b []byte, n int) []bool {
+	if n <= 0 || n > len(b)*8 {
+		n = len(b) * 8
+	}
+	v := make([]bool, n)
+	for i := range v {
+		v[i] = b[i/8]&(1<<(i%8)) != 0
+	}
+	return v
+}
+
+// The data after a byte count, as long as the count says or what's there
+func modbus_counted(data []byte, at int) []byte {
+	if len(data) <= at {
+		return nil
+	}
+	n := int(data[at])
+	if n > len(data)-at-1 {
+		n = len(data) - at - 1
+	}
+	return data[at+1 : at+1+n]
+}
+
+func (p *ModbusParser) ParseRequest(r *bufio.Reader) (*ModbusRecord, error) {
+	rec, data, err := read_modbus_frame(r)
+	if err != nil {
+		return nil, err
+	}
+	if !modbus_addressed(rec.Function) || len(data) < 4 {
+		rec.Data = hex.EncodeToString(data)
+	} else {
+		rec.Address = int(binary.BigEndian.Uint16(data))
+		value := binary.BigEndian.Uint16(data[2:])
+		switch rec.Function {
+		case 0x05:
+			rec.Coils = []bool{value == 0xff00}
+		case 0x06:
+			rec.Registers = []uint16{value}
+		case 0x0f:
+			rec.Quantity = int(value)
+			rec.Coils = modbus_coils(modbus_counted(data, 4), rec.Quantity)
+		case 0x10:
+			rec.Quantity = int(value)
+			rec.Registers = modbus_registers(modbus_counted(data, 4))
+		default:
+			rec.Quantity = int(value)
+		}
+	}
+	p.mu.Lock()
+	if len(p.pending) < modbus_max_queue {
+		p.pending[rec.TransactionID] = modbus_request{rec.Function, rec.Address, rec.Quantity}
+	}
+	p.mu.Unlock()
+	return rec, nil
+}
+
+func (p *ModbusParser) ParseResponse(r *bufio.Reader) (*ModbusRecord, error) {
+	rec, data, err := read_modbus_frame(r)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	req, ok := p.pending[rec.TransactionID]
+	delete(p.pending, rec.TransactionID)
+	p.mu.Unlock()
+	rec.NoRequest = !ok || req.function != rec.Function&^0x80
+	if rec.Function&0x80 != 0 {
+		code := uint8(0)
+		if len(data) > 0 {
+			code = data[0]
+		}
+		name, known := modbus_exceptions[code]
+		if !known {
+			name = "Exception"
+		}
+		rec.Exception = fmt.Sprintf("%s (0x%02x)", name, code)
+		rec.Address = req.address
+		return rec, nil
+	}
+	switch rec.Function {
+	case 0x01, 0x02:
+		rec.Address, rec.Quantity = req.address, req.quantity
+		rec.Coils = modbus_coils(modbus_counted(data, 0), req.quantity)
+	case 0x03, 0x04:
+		rec.Address = req.address
+		rec.Registers = modbus_registers(modbus_counted(data, 0))
+		rec.Quantity = len(rec.Registers)
+	case 0x05, 0x06, 0x0f, 0x10: // the address and the value or quantity, echoed back
+		if len(data) < 4 {
+			rec.Data = hex.EncodeToString(data)
+			break
+		}
+		rec.Address = int(binary.BigEndian.Uint16(data))
+		value := binary.BigEndian.Uint16(data[2:])
+		switch rec.Function {
+		case 0x05:
+			rec.Coils = []bool{value == 0xff00}
+		case 0x06:
+			rec.Registers = []uint16{value}
+		default:
+			rec.Quantity = int(value)
+		}
+	default:
+		rec.Data = hex.EncodeToString(data)
+	}
+	return rec, nil
+}
+
+func new_modbus_parsers(conn_n int, logger chan *LogEvent, client_peer, server_peer string) (request, response *StreamParser) {
+	p := NewModbusParser()
+	request = NewStreamParser(conn_n, client_to_server, client_peer, logger, decode_modbus("modbus_request", p.ParseRequest))
+	response = NewStreamParser(conn_n, server_to_client, server_peer, logger, decode_modbus("modbus_response", p.ParseResponse))
+	return
+}
+
+func decode_modbus(event string, parse func(r *bufio.Reader) (*ModbusRecord, error)) decode_func {
+	return func(r *bufio.Reader) (*LogEvent, error) {
+		rec, err := parse(r)
+		if err != nil {
+			return nil, err
+		}
+		return &LogEvent{Event: event, Length: rec.Length, Modbus: rec}, nil
+	}
+}
+
+func format_modbus(e *LogEvent) string {
+	rec := e.Modbus
+	var b strings.Builder
+	kind := "request"
+	if e.Event == "modbus_response" {
+		kind = "response"
+	}
+	fmt.Fprintf(&b, "Modbus %s from %s, transaction %d, unit %d, %s (0x%02x)",
+		kind, e.Peer, rec.TransactionID, rec.UnitID, rec.FunctionName, rec.Function)
+	switch {
+	case rec.Exception != "":
+		b.WriteString(", exception " + rec.Exception)
+	case rec.Data != "":
+		b.WriteString(", data " + rec.Data)
+	default:
+		fmt.Fprintf(&b, ", address %d", rec.Address)
+		if rec.Quantity != 0 {
+			fmt.Fprintf(&b, ", quantity %d", rec.Quantity)
+		}
+	}
+	if rec.NoRequest && e.Event == "modbus_response" {
+		b.WriteString(", no matching request")
+	}
+	if len(rec.Registers) > 0 {
+		b.WriteString(":")
+		for _, v := range rec.Registers {
+			fmt.Fprintf(&b, " %d", v)
+		}
+	}
+	if len(rec.Coils) > 0 {
+		b.WriteString(": ")
+		for _, on := range rec.Coils {
+			if on {
+				b.WriteByte('1')
+			} else {
+				b.WriteByte('0')
+			}
+		}
+	}
+	return b.String() + "\n"
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// An MBAP header for unit 0x11 in front of pdu
+func modbus_frame(transaction uint16, pdu ...byte) []byte {
+	n := len(pdu) + 1
+	return append([]byte{byte(transaction >> 8), byte(transaction), 0, 0, byte(n >> 8), byte(n), 0x11}, pdu...)
+}
+
+// The request and response examples of the Modbus Application Protocol
+// Specification V1.1b3, section 6, then an exception, functions that
+// aren't decoded and a response without its request
+var modbus_tests = []struct {
+	request, response   []byte
+	want_req, want_resp string
+}{
+	{modbus_frame(1, 0x01, 0x00, 0x13, 0x00, 0x13), modbus_frame(1, 0x01, 0x03, 0xcd, 0x6b, 0x05),
+		"Read Coils (0x01), address 19, quantity 19",
+		"Read Coils (0x01), address 19, quantity 19: 1011001111010110101"},
+	{modbus_frame(2, 0x02, 0x00, 0xc4, 0x00, 0x16), modbus_frame(2, 0x02, 0x03, 0xac, 0xdb, 0x35),
+		"Read Discrete Inputs (0x02), address 196, quantity 22",
+		"Read Discrete Inputs (0x02), address 196, quantity 22: 0011010111011011101011"},
+	{modbus_frame(3, 0x03, 0x00, 0x6b, 0x00, 0x03), modbus_frame(3, 0x03, 0x06, 0x02, 0x2b, 0x00, 0x00, 0x00, 0x64),
+		"Read Holding Registers (0x03), address 107, quantity 3",
+		"Read Holding Registers (0x03), address 107, quantity 3: 555 0 100"},
+	{modbus_frame(4, 0x04, 0x00, 0x08, 0x00, 0x01), modbus_frame(4, 0x04, 0x02, 0x00, 0x0a),
+		"Read Input Registers (0x04), address 8, quantity 1",
+		"Read Input Registers (0x04), address 8, quantity 1: 10"},
+	{modbus_frame(5, 0x05, 0x00, 0xac, 0xff, 0x00), modbus_frame(5, 0x05, 0x00, 0xac, 0xff, 0x00),
+		"Write Single Coil (0x05), address 172: 1",
+		"Write Single Coil (0x05), address 172: 1"},
+	{modbus_frame(6, 0x06, 0x00, 0x01, 0x00, 0x03), modbus_frame(6, 0x06, 0x00, 0x01, 0x00, 0x03),
+		"Write Single Register (0x06), address 1: 3",
+		"Write Single Register (0x06), address 1: 3"},
+	{modbus_frame(7, 0x0f, 0x00, 0x13, 0x00, 0x0a, 0x02, 0xcd, 0x01), modbus_frame(7, 0x0f, 0x00, 0x13, 0x00, 0x0a),
+		"Write Multiple Coils (0x0f), address 19, quantity 10: 1011001110",
+		"Write Multiple Coils (0x0f), address 19, quantity 10"},
+	{modbus_frame(8, 0x10, 0x00, 0x01, 0x00, 0x02, 0x04, 0x00, 0x0a, 0x01, 0x02), modbus_frame(8, 0x10, 0x00, 0x01, 0x00, 0x02),
+		"Write Multiple Registers (0x10), address 1, quantity 2: 10 258",
+		"Write Multiple Registers (0x10), address 1, quantity 2"},
+	{modbus_frame(9, 0x01, 0x04, 0xa1, 0x00, 0x01), modbus_frame(9, 0x81, 0x02),
+		"Read Coils (0x01), address 1185, quantity 1",
+		"Read Coils (0x81), exception Illegal Data Address (0x02)"},
+	{modbus_frame(10, 0x11), modbus_frame(10, 0x11, 0x02, 0x00, 0xff),
+		"Report Server ID (0x11), address 0",
+		"Report Server ID (0x11), data 0200ff"},
+	{modbus_frame(11, 0x41, 0x12, 0x34), modbus_frame(11, 0xc1, 0x01),
+		"Function (0x41), data 1234",
+		"Function (0xc1), exception Illegal Function (0x01)"},
+	{nil, modbus_frame(12, 0x03, 0x02, 0x00, 0x01),
+		"", "Read Holding Registers (0x03), address 0, quantity 1, no matching request: 1"},
+}
+
+func TestDecodeModbusStream(t *testing.T) {
+	var requests, responses []byte
+	var want, want_responses []string
+	for i, tt := range modbus_tests {
+		if tt.request != nil {
+			requests = append(requests, tt.request...)
+			want = append(want, fmt.Sprintf("Modbus request from 127.0.0.1-50000, transaction %d, unit 17, %s", i+1, tt.want_req))
+		}
+		responses = append(responses, tt.response...)
+		want_responses = append(want_responses, fmt.Sprintf("Modbus response from 127.0.0.1-502, transaction %d, unit 17, %s", i+1, tt.want_resp))
+	}
+	want = append(want, want_responses...)
+	for _, chunk := range []int{1, 4, 1 << 20} {
+		logger := make(chan *LogEvent)
+		request, response := new_modbus_parsers(1, logger, "127.0.0.1-50000", "127.0.0.1-502")
+		events := feed_parsers(t, logger, []*StreamParser{request, response}, [][]byte{requests, responses}, chunk)
+		var got []string
+		for _, e := range events {
+			if e.Modbus == nil {
+				t.Fatalf("chunks of %d: a %s event, the decoder gave up", chunk, e.Event)
+			}
+			got = append(got, strings.TrimSuffix(format_modbus(e), "\n"))
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("chunks of %d logged\n%s\nwant\n%s", chunk, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+func TestModbusParserErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		frame []byte
+	}{
+		{"protocol 1", []byte{0, 1, 0, 1, 0, 6, 0x11, 0x03, 0x00, 0x6b, 0x00, 0x03}},
+		{"length 1", []byte{0, 1, 0, 0, 0, 1, 0x11}},
+		{"length 300", append([]byte{0, 1, 0, 0, 0x01, 0x2c, 0x11}, make([]byte, 299)...)},
+		{"cut off", modbus_frame(1, 0x03, 0x00, 0x6b, 0x00, 0x03)[:10]},
+	} {
+		if rec, err := NewModbusParser().ParseRequest(bufio.NewReader(bytes.NewReader(tt.frame))); err == nil {
+			t.Errorf("%s: accepted as %+v", tt.name, rec)
+		}
+	}
+}
+
+// A response whose function doesn't match the request of its transaction
+func TestModbusParserMismatch(t *testing.T) {
+	p := NewModbusParser()
+	if _, err := p.ParseRequest(bufio.NewReader(bytes.NewReader(modbus_frame(1, 0x03, 0x00, 0x6b, 0x00, 0x01)))); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := p.ParseResponse(bufio.NewReader(bytes.NewReader(modbus_frame(1, 0x04, 0x02, 0x00, 0x0a))))
+	if err != nil || !rec.NoRequest {
+		t.Errorf("%+v, %v, want no matching request", rec, err)
+	}
+	if len(p.pending) != 0 {
+		t.Errorf("%d requests still pending", len(p.pending))
+	}
+}
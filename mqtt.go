@@ -0,0 +1,361 @@
+/*
+MQTT 3.1.1 decoding for the connection log (-proto mqtt).
+
+Both directions are read packet by packet: the fixed header gives the
+packet type and the remaining length, which is enough to cut the stream
+into packets however the reads were split. Each packet is logged with
+its type, topic, QoS, message ID and payload, the payload as text if it
+is valid UTF-8 and as a hex dump otherwise. MQTT 5 properties are not
+understood; such a connection falls back to the hex dump, and so does one
+with a packet over mqtt_max_packet.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	mqtt_connect     = 1
+	mqtt_connack     = 2
+	mqtt_publish     = 3
+	mqtt_puback      = 4
+	mqtt_pubrec      = 5
+	mqtt_pubrel      = 6
+	mqtt_pubcomp     = 7
+	mqtt_subscribe   = 8
+	mqtt_suback      = 9
+	mqtt_unsubscribe = 10
+	mqtt_unsuback    = 11
+	mqtt_pingreq     = 12
+	mqtt_pingresp    = 13
+	mqtt_disconnect  = 14
+
+	mqtt_max_remaining = 268435455 // four length bytes
+	mqtt_max_packet    = 64 << 20  // what the log decoder will hold in memory
+)
+
+var mqtt_packet_types = map[byte]string{
+	mqtt_connect:     "CONNECT",
+	mqtt_connack:     "CONNACK",
+	mqtt_publish:     "PUBLISH",
+	mqtt_puback:      "PUBACK",
+	mqtt_pubrec:      "PUBREC",
+	mqtt_pubrel:      "PUBREL",
+	mqtt_pubcomp:     "PUBCOMP",
+	mqtt_subscribe:   "SUBSCRIBE",
+	mqtt_suback:      "SUBACK",
+	mqtt_unsubscribe: "UNSUBSCRIBE",
+	mqtt_unsuback:    "UNSUBACK",
+	mqtt_pingreq:     "PINGREQ",
+	mqtt_pingresp:    "PINGRESP",
+	mqtt_disconnect:  "DISCONNECT",
+}
+
+var mqtt_connack_codes = []string{
+	"accepted",
+	"unacceptable protocol version",
+	"identifier rejected",
+	"server unavailable",
+	"bad user name or password",
+	"not authorized",
+}
+
+type MQTTSubscription struct {
+	Topic string `json:"topic"`
+	QoS   byte   `json:"qos"`
+}
+
+type MQTTPacket struct {
+	Type          string             `json:"type"`
+	Length        int                `json:"length"` // remaining length
+	Dup           bool               `json:"dup,omitempty"`
+	QoS           byte               `json:"qos"`
+	Retain        bool               `json:"retain,omitempty"`
+	MessageID     uint16             `json:"message_id,omitempty"`
+	Topic         string             `json:"topic,omitempty"`
+	Subscriptions []MQTTSubscription `json:"subscriptions,omitempty"` // SUBSCRIBE, UNSUBSCRIBE (no QoS)
+	ReturnCodes   []byte             `json:"return_codes,omitempty"`  // SUBACK
+	// CONNECT
+	Protocol     string `json:"protocol,omitempty"`
+	Level        byte   `json:"level,omitempty"`
+	ClientID     string `json:"client_id,omitempty"`
+	KeepAlive    uint16 `json:"keep_alive,omitempty"`
+	CleanSession bool   `json:"clean_session,omitempty"`
+	WillTopic    string `json:"will_topic,omitempty"`
+	Username     string `json:"username,omitempty"`
+	HasPassword  bool   `json:"has_password,omitempty"`
+	// CONNACK
+	SessionPresent bool   `json:"session_present,omitempty"`
+	ReturnCode     string `json:"return_code,omitempty"`
+
+	Payload    string `json:"payload,omitempty"` // PUBLISH, and the will message
+	HexPayload string `json:"hex_payload,omitempty"`
+	Truncated  bool   `json:"truncated,omitempty"`
+}
+
+var errMQTTShort = errors.New("MQTT packet too short")
+
+// Walks the variable header and payload of one packet
+type mqtt_reader struct {
+	b   []byte
+	err error
+}
+
+func (r *mqtt_reader) bytes(n int) []byte {
+	if r.err != nil || len(r.b) < n {
+		r.err = errMQTTShort
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *mqtt_reader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *mqtt_reader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// Length prefixed UTF-8 string, or binary data
+func (r *mqtt_reader) string() string {
+	return string(r.bytes(int(r.uint16())))
+}
+
+// Decodes one complete packet, fixed header included
+func ParseMQTTPacket(data []byte) (MQTTPacket, error) {
+	var p MQTTPacket
+	if len(data) < 2 {
+		return p, errMQTTShort
+	}
+	kind, flags := data[0]>>4, data[0]&0x0f
+	p.Type = mqtt_packet_types[kind]
+	if p.Type == "" {
+		return p, fmt.Errorf("reserved MQTT packet type %d", kind)
+	}
+	length, n, err := mqtt_remaining_length(data[1:])
+	if err != nil {
+		return p, err
+	}
+	if len(data) != 1+n+length {
+		return p, fmt.Errorf("MQTT %s with remaining length %d in %d bytes", p.Type, length, len(data))
+	}
+	p.Length = length
+	r := &mqtt_reader{b: data[1+n:]}
+
+	switch kind {
+	case mqtt_connect:
+		p.Protocol = r.string()
+		p.Level = r.byte()
+		connect_flags := r.byte()
+		p.KeepAlive = r.uint16()
+		p.CleanSession = connect_flags&0x02 != 0
+		p.ClientID = r.string()
+		if connect_flags&0x04 != 0 {
+			p.WillTopic = r.string()
+			mqtt_payload(&p, r.bytes(int(r.uint16())))
+			p.QoS = (connect_flags >> 3) & 3
+			p.Retain = connect_flags&0x20 != 0
+		}
+		if connect_flags&0x80 != 0 {
+			p.Username = r.string()
+		}
+		if connect_flags&0x40 != 0 {
+			r.string()
+			p.HasPassword = true
+		}
+	case mqtt_connack:
+		p.SessionPresent = r.byte()&0x01 != 0
+		code := r.byte()
+		if int(code) < len(mqtt_connack_codes) {
+			p.ReturnCode = mqtt_connack_codes[code]
+		} else {
+			p.ReturnCode = fmt.Sprintf("unknown (%d)", code)
+		}
+	case mqtt_publish:
+		p.Dup, p.QoS, p.Retain = flags&0x08 != 0, (flags>>1)&3, flags&0x01 != 0
+		if p.QoS == 3 {
+			return p, errors.New("MQTT PUBLISH with QoS 3")
+		}
+		p.Topic = r.string()
+		if p.QoS > 0 {
+			p.MessageID = r.uint16()
+		}
+		if r.err == nil {
+			mqtt_payload(&p, r.b)
+			r.b = nil
+		}
+	case mqtt_puback, mqtt_pubrec, mqtt_pubrel, mqtt_pubcomp, mqtt_unsuback:
+		p.MessageID = r.uint16()
+	case mqtt_subscribe, mqtt_unsubscribe:
+		p.MessageID = r.uint16()
+		for r.err == nil && len(r.b) > 0 {
+			s := MQTTSubscription{Topic: r.string()}
+			if kind == mqtt_subscribe {
+				s.QoS = r.byte()
+			}
+			p.Subscriptions = append(p.Subscriptions, s)
+		}
+	case mqtt_suback:
+		p.MessageID = r.uint16()
+		if r.err == nil {
+			p.ReturnCodes, r.b = r.b, nil
+		}
+	case mqtt_pingreq, mqtt_pingresp, mqtt_disconnect:
+	}
+	if r.err != nil {
+		return p, fmt.Errorf("MQTT %s: %v", p.Type, r.err)
+	}
+	if len(r.b) > 0 {
+		return p, fmt.Errorf("MQTT %s: %d bytes left over", p.Type, len(r.b))
+	}
+	return p, nil
+}
+
+// The variable length integer after the first byte, and how many bytes it took
+func mqtt_remaining_length(b []byte) (int, int, error) {
+	length, shift := 0, 0
+	for i := 0; i < 4; i++ {
+		if i >= len(b) {
+			return 0, 0, errMQTTShort
+		}
+		length |= int(b[i]&0x7f) << shift
+		if b[i]&0x80 == 0 {
+			return length, i + 1, nil
+		}
+		shift += 7
+	}
+	return 0, 0, errors.New("MQTT remaining length longer than 4 bytes")
+}
+
+func mqtt_payload(p *MQTTPacket, b []byte) {
+	if len(b) > *max_body {
+		b, p.Truncated = b[:*max_body], true
+	}
+	if utf8.Valid(b) {
+		p.Payload = string(b)
+	} else {
+		p.HexPayload = hex.Dump(b)
+	}
+}
+
+// Parsers for both directions of one MQTT connection
+func new_mqtt_parsers(conn_n int, logger chan *LogEvent, client_peer, server_peer string) (request, response *StreamParser) {
+	request = NewStreamParser(conn_n, client_to_server, client_peer, logger, decode_mqtt)
+	response = NewStreamParser(conn_n, server_to_client, server_peer, logger, decode_mqtt)
+	return
+}
+
+// Reads exactly one packet off the stream and decodes it
+func decode_mqtt(r *bufio.Reader) (*LogEvent, error) {
+	data := make([]byte, 1, 5)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, c)
+		if c&0x80 == 0 {
+			break
+		}
+		if len(data) == 5 {
+			return nil, errors.New("MQTT remaining length longer than 4 bytes")
+		}
+	}
+	length, _, _ := mqtt_remaining_length(data[1:])
+	if length > mqtt_max_packet {
+		return nil, fmt.Errorf("MQTT remaining length %d is too large to decode", length)
+	}
+	header := len(data)
+	data = append(data, make([]byte, length)...)
+	if _, err := io.ReadFull(r, data[header:]); err != nil {
+		return nil, err
+	}
+	p, err := ParseMQTTPacket(data)
+	if err != nil {
+		return nil, err
+	}
+	return &LogEvent{Event: "mqtt_packet", Length: len(data), MQTT: &p}, nil
+}
+
+func format_mqtt(e *LogEvent) string {
+	p := e.MQTT
+	var b strings.Builder
+	fmt.Fprintf(&b, "MQTT %s from %s", p.Type, e.Peer)
+	switch p.Type {
+	case "CONNECT":
+		fmt.Fprintf(&b, ": %s level %d, client %q, keep alive %ds", p.Protocol, p.Level, p.ClientID, p.KeepAlive)
+		if p.CleanSession {
+			b.WriteString(", clean session")
+		}
+		if p.Username != "" {
+			fmt.Fprintf(&b, ", user %q", p.Username)
+		}
+		if p.HasPassword {
+			b.WriteString(", with password")
+		}
+		if p.WillTopic != "" {
+			fmt.Fprintf(&b, ", will on %s QoS %d", p.WillTopic, p.QoS)
+		}
+	case "CONNACK":
+		fmt.Fprintf(&b, ": %s", p.ReturnCode)
+		if p.SessionPresent {
+			b.WriteString(", session present")
+		}
+	case "PUBLISH":
+		fmt.Fprintf(&b, ": %s QoS %d", p.Topic, p.QoS)
+		if p.QoS > 0 {
+			fmt.Fprintf(&b, ", id %d", p.MessageID)
+		}
+		if p.Dup {
+			b.WriteString(", dup")
+		}
+		if p.Retain {
+			b.WriteString(", retain")
+		}
+	case "SUBSCRIBE", "UNSUBSCRIBE":
+		fmt.Fprintf(&b, ": id %d", p.MessageID)
+		for _, s := range p.Subscriptions {
+			if p.Type == "SUBSCRIBE" {
+				fmt.Fprintf(&b, ", %s QoS %d", s.Topic, s.QoS)
+			} else {
+				fmt.Fprintf(&b, ", %s", s.Topic)
+			}
+		}
+	case "SUBACK":
+		fmt.Fprintf(&b, ": id %d, return codes %v", p.MessageID, p.ReturnCodes)
+	default:
+		if p.MessageID != 0 {
+			fmt.Fprintf(&b, ": id %d", p.MessageID)
+		}
+	}
+	b.WriteString("\n")
+	if p.Payload != "" {
+		b.WriteString(p.Payload + "\n")
+	}
+	b.WriteString(p.HexPayload)
+	if p.Truncated {
+		b.WriteString("[payload truncated]\n")
+	}
+	return b.String()
+}
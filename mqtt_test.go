@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// The packets of an MQTT 3.1.1 session, as the specification lays them out
+var mqtt_tests = []struct {
+	name   string
+	packet []byte
+	want   MQTTPacket
+}{
+	{"CONNECT", []byte{
+		0x10, 0x10, // CONNECT, remaining length 16
+		0x00, 0x04, 'M', 'Q', 'T', 'T', // protocol name
+		0x04,       // level 4, 3.1.1
+		0x02,       // clean session
+		0x00, 0x3c, // keep alive 60s
+		0x00, 0x04, 'c', 'l', 'i', '1', // client id
+	}, MQTTPacket{Type: "CONNECT", Length: 16, Protocol: "MQTT", Level: 4, CleanSession: true, KeepAlive: 60, ClientID: "cli1"}},
+	{"CONNECT with will, user and password", []byte{
+		0x10, 0x1f,
+		0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04,
+		0xee, // user, password, will retain, will QoS 1, will, clean session
+		0x00, 0x0a,
+		0x00, 0x02, 'c', '1',
+		0x00, 0x03, 'w', '/', 't', // will topic
+		0x00, 0x03, 'b', 'y', 'e', // will message
+		0x00, 0x01, 'u',
+		0x00, 0x02, 'p', 'w',
+	}, MQTTPacket{Type: "CONNECT", Length: 31, Protocol: "MQTT", Level: 4, CleanSession: true, KeepAlive: 10, ClientID: "c1",
+		WillTopic: "w/t", Payload: "bye", QoS: 1, Retain: true, Username: "u", HasPassword: true}},
+	{"CONNACK accepted", []byte{0x20, 0x02, 0x00, 0x00}, MQTTPacket{Type: "CONNACK", Length: 2, ReturnCode: "accepted"}},
+	{"CONNACK session present, not authorized", []byte{0x20, 0x02, 0x01, 0x05},
+		MQTTPacket{Type: "CONNACK", Length: 2, SessionPresent: true, ReturnCode: "not authorized"}},
+	{"PUBLISH QoS 0", []byte{0x30, 0x0a, 0x00, 0x03, 'a', '/', 'b', 'h', 'e', 'l', 'l', 'o'},
+		MQTTPacket{Type: "PUBLISH", Length: 10, Topic: "a/b", Payload: "hello"}},
+	{"PUBLISH QoS 1 retained", []byte{0x33, 0x09, 0x00, 0x03, 'a', '/', 'b', 0x00, 0x0a, 'o', 'n'},
+		MQTTPacket{Type: "PUBLISH", Length: 9, QoS: 1, Retain: true, Topic: "a/b", MessageID: 10, Payload: "on"}},
+	{"PUBLISH QoS 2 duplicate, binary payload", []byte{0x3c, 0x09, 0x00, 0x01, 't', 0x12, 0x34, 0xff, 0x00, 0xfe, 0x01},
+		MQTTPacket{Type: "PUBLISH", Length: 9, Dup: true, QoS: 2, Topic: "t", MessageID: 0x1234,
+			HexPayload: "00000000  ff 00 fe 01                                       |....|\n"}},
+	{"PUBACK", []byte{0x40, 0x02, 0x00, 0x0a}, MQTTPacket{Type: "PUBACK", Length: 2, MessageID: 10}},
+	{"PUBREC", []byte{0x50, 0x02, 0x12, 0x34}, MQTTPacket{Type: "PUBREC", Length: 2, MessageID: 0x1234}},
+	{"PUBREL", []byte{0x62, 0x02, 0x12, 0x34}, MQTTPacket{Type: "PUBREL", Length: 2, MessageID: 0x1234}},
+	{"PUBCOMP", []byte{0x70, 0x02, 0x12, 0x34}, MQTTPacket{Type: "PUBCOMP", Length: 2, MessageID: 0x1234}},
+	{"SUBSCRIBE", []byte{0x82, 0x0e, 0x00, 0x01, 0x00, 0x03, 'a', '/', 'b', 0x01, 0x00, 0x03, 'c', '/', '#', 0x02},
+		MQTTPacket{Type: "SUBSCRIBE", Length: 14, MessageID: 1, Subscriptions: []MQTTSubscription{{"a/b", 1}, {"c/#", 2}}}},
+	{"SUBACK", []byte{0x90, 0x05, 0x00, 0x01, 0x01, 0x02, 0x80},
+		MQTTPacket{Type: "SUBACK", Length: 5, MessageID: 1, ReturnCodes: []byte{1, 2, 0x80}}},
+	{"UNSUBSCRIBE", []byte{0xa2, 0x07, 0x00, 0x02, 0x00, 0x03, 'a', '/', 'b'},
+		MQTTPacket{Type: "UNSUBSCRIBE", Length: 7, MessageID: 2, Subscriptions: []MQTTSubscription{{"a/b", 0}}}},
+	{"UNSUBACK", []byte{0xb0, 0x02, 0x00, 0x02}, MQTTPacket{Type: "UNSUBACK", Length: 2, MessageID: 2}},
+	{"PINGREQ", []byte{0xc0, 0x00}, MQTTPacket{Type: "PINGREQ"}},
+	{"PINGRESP", []byte{0xd0, 0x00}, MQTTPacket{Type: "PINGRESP"}},
+	{"DISCONNECT", []byte{0xe0, 0x00}, MQTTPacket{Type: "DISCONNECT"}},
+}
+
+func TestParseMQTTPacket(t *testing.T) {
+	for _, tt := range mqtt_tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMQTTPacket(tt.packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMQTTPacketErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		packet []byte
+	}{
+		{"empty", nil},
+		{"reserved type 0", []byte{0x00, 0x00}},
+		{"reserved type 15", []byte{0xf0, 0x00}},
+		{"remaining length past the end", []byte{0x40, 0x03, 0x00, 0x01}},
+		{"bytes after the packet", []byte{0x40, 0x02, 0x00, 0x01, 0x00}},
+		{"PUBLISH QoS 3", []byte{0x36, 0x05, 0x00, 0x01, 't', 0x00, 0x01}},
+		{"topic past the end", []byte{0x30, 0x03, 0x00, 0x05, 't'}},
+		{"PINGREQ with a body", []byte{0xc0, 0x01, 0x00}},
+		{"five length bytes", []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x7f}},
+	} {
+		if _, err := ParseMQTTPacket(tt.packet); err == nil {
+			t.Errorf("%s: % x was accepted", tt.name, tt.packet)
+		}
+	}
+}
+
+// The remaining length examples of the specification, section 2.2.3
+func TestMQTTRemainingLength(t *testing.T) {
+	for _, tt := range []struct {
+		b      []byte
+		length int
+	}{
+		{[]byte{0x00}, 0},
+		{[]byte{0x7f}, 127},
+		{[]byte{0x80, 0x01}, 128},
+		{[]byte{0xff, 0x7f}, 16383},
+		{[]byte{0x80, 0x80, 0x01}, 16384},
+		{[]byte{0xff, 0xff, 0x7f}, 2097151},
+		{[]byte{0x80, 0x80, 0x80, 0x01}, 2097152},
+		{[]byte{0xff, 0xff, 0xff, 0x7f}, mqtt_max_remaining},
+	} {
+		length, n, err := mqtt_remaining_length(tt.b)
+		if err != nil || length != tt.length || n != len(tt.b) {
+			t.Errorf("% x: %d in %d bytes, %v, want %d in %d", tt.b, length, n, err, tt.length, len(tt.b))
+		}
+	}
+}
+
+// The whole session through the stream decoder, a byte at a time and all
+// at once, with a PUBLISH big enough for a two byte remaining length
+func TestDecodeMQTTStream(t *testing.T) {
+	big := append([]byte{0x30, 0xc8, 0x01, 0x00, 0x01, 't'}, bytes.Repeat([]byte("x"), 197)...)
+	var stream []byte
+	for _, tt := range mqtt_tests {
+		stream = append(stream, tt.packet...)
+	}
+	stream = append(stream, big...)
+	for _, chunk := range []int{1, 7, len(stream)} {
+		events := parse_stream(t, decode_mqtt, stream, chunk)
+		if len(events) != len(mqtt_tests)+1 {
+			t.Fatalf("%d events in chunks of %d, want %d", len(events), chunk, len(mqtt_tests)+1)
+		}
+		for i, tt := range mqtt_tests {
+			if e := events[i]; e.Event != "mqtt_packet" || e.Length != len(tt.packet) || !reflect.DeepEqual(*e.MQTT, tt.want) {
+				t.Errorf("chunks of %d, event %d: %s %d bytes %+v, want %s", chunk, i, e.Event, e.Length, e.MQTT, tt.name)
+			}
+		}
+		if p := events[len(events)-1].MQTT; p == nil || p.Length != 200 || len(p.Payload) != 197 {
+			t.Errorf("chunks of %d: the large PUBLISH decoded as %+v", chunk, p)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Mutual TLS for both sides of -tls.
+
+	-client-ca-cert clients.pem
+
+makes the proxy ask every client for a certificate and only go on with
+those that present one signed by a CA in clients.pem; the others fail
+the handshake. The subject and SHA-256 fingerprint of the certificate
+are logged when the connection starts.
+
+	-upstream-cert proxy.pem -upstream-key proxy-key.pem
+
+is the certificate the proxy presents to targets that ask for one. The
+client's own certificate can't be passed on, its key stays with the
+client.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var (
+	client_ca_cert *string = flag.String("client-ca-cert", "", "with -tls, require client certificates signed by a CA in this PEM file")
+	upstream_cert  *string = flag.String("upstream-cert", "", "with -tls, certificate (PEM) presented to the target")
+	upstream_key   *string = flag.String("upstream-key", "", "private key (PEM) of -upstream-cert")
+)
+
+var (
+	client_cas     *x509.CertPool    // nil without -client-ca-cert
+	upstream_certs []tls.Certificate // empty without -upstream-cert
+)
+
+// Loads the files of -client-ca-cert and -upstream-cert
+func init_mtls() {
+	if *client_ca_cert != "" {
+		pem, err := os.ReadFile(*client_ca_cert)
+		if err != nil {
+			die("Unable to read -client-ca-cert, %v", err)
+		}
+		client_cas = x509.NewCertPool()
+		if !client_cas.AppendCertsFromPEM(pem) {
+			die("No certificates in %s", *client_ca_cert)
+		}
+	}
+	if (*upstream_cert == "") != (*upstream_key == "") {
+		die("-upstream-cert and -upstream-key go together")
+	}
+	if *upstream_cert != "" {
+		cert, err := tls.LoadX509KeyPair(*upstream_cert, *upstream_key)
+		if err != nil {
+			die("Unable to load the upstream certificate, %v", err)
+		}
+		upstream_certs = []tls.Certificate{cert}
+	}
+}
+
+// Makes the clients of cfg present a certificate, with -client-ca-cert
+func require_client_certs(cfg *tls.Config) *tls.Config {
+	if client_cas != nil {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = client_cas
+	}
+	return cfg
+}
+
+// Subject and fingerprint of the client's certificate, "" without one
+func client_cert_description(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := state.PeerCertificates[0]
+	return fmt.Sprintf("%s, SHA-256 %s", cert.Subject, fingerprint(cert))
+}
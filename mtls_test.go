@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A client certificate for name signed by the CA that generate_cert_files
+// wrote to ca_dir, as files in dir
+func sign_client_cert(t *testing.T, dir, ca_dir, name string) (crt, key string) {
+	t.Helper()
+	ca, err := tls.LoadX509KeyPair(filepath.Join(ca_dir, "ca.crt"), filepath.Join(ca_dir, "ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca_x509, _ := x509.ParseCertificate(ca.Certificate[0])
+	k, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca_x509, k.Public(), ca.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, key = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := write_pem(crt, 0644, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+		t.Fatal(err)
+	}
+	if err := write_key(key, k); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func load_cert_pool(t *testing.T, path string) *x509.CertPool {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(b)
+	return pool
+}
+
+// -client-ca-cert lets a client with a certificate of that CA through and
+// turns away one with a certificate of another CA or none; the target,
+// which wants a client certificate too, gets -upstream-cert
+func TestProxyMutualTLS(t *testing.T) {
+	saved_tls, saved_ca, saved_client_ca, saved_cert, saved_key, saved_dir :=
+		*tls_mode, cert_authority, *client_ca_cert, *upstream_cert, *upstream_key, *output_dir
+	saved_cas, saved_certs, saved_skip := client_cas, upstream_certs, *tls_skip_verify
+	t.Cleanup(func() {
+		*tls_mode, cert_authority, *client_ca_cert, *upstream_cert, *upstream_key, *output_dir =
+			saved_tls, saved_ca, saved_client_ca, saved_cert, saved_key, saved_dir
+		client_cas, upstream_certs, *tls_skip_verify = saved_cas, saved_certs, saved_skip
+	})
+	dir := t.TempDir()
+	ca_dir, other_dir := filepath.Join(dir, "ca"), filepath.Join(dir, "other")
+	for _, d := range []string{ca_dir, other_dir} {
+		if err := generate_cert_files(d, "ecdsa", "test CA", "127.0.0.1", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice_crt, alice_key := sign_client_cert(t, dir, ca_dir, "alice")
+	mallory_crt, mallory_key := sign_client_cert(t, dir, other_dir, "mallory")
+	*upstream_cert, *upstream_key = sign_client_cert(t, dir, ca_dir, "proxy")
+
+	var err error
+	if cert_authority, err = load_cert_authority(filepath.Join(ca_dir, "ca.crt"), filepath.Join(ca_dir, "ca.key")); err != nil {
+		t.Fatal(err)
+	}
+	*tls_mode, *client_ca_cert = true, filepath.Join(ca_dir, "ca.crt")
+	init_mtls()
+	*output_dir = filepath.Join(dir, "logs")
+	init_output_dir()
+	init_log_names()
+	buffer_pool = NewBufferPool(*buf_size)
+
+	// the target: the leaf of generate_cert_files, and only clients of the CA
+	leaf, err := tls.LoadX509KeyPair(filepath.Join(ca_dir, "leaf.crt"), filepath.Join(ca_dir, "leaf.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cas := load_cert_pool(t, filepath.Join(ca_dir, "ca.crt"))
+	target, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{leaf},
+		ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: cas})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	proxy_client := make(chan string, 1)
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				if err := c.(*tls.Conn).Handshake(); err != nil {
+					return
+				}
+				proxy_client <- c.(*tls.Conn).ConnectionState().PeerCertificates[0].Subject.CommonName
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	*tls_skip_verify = true // the proxy doesn't know the target's CA
+
+	host, port, _ := net.SplitHostPort(target.Addr().String())
+	m := &mapping{listen_port: free_port(t), host: host, port: port, log_prefix: filepath.Join(*output_dir, "log")}
+	p := NewProxy(m)
+	sessions := make(chan *Session, 1)
+	p.OnConnection(func(s *Session) { sessions <- s })
+	run_proxy(t, p)
+
+	// ends the handshake through the proxy and sends hello; TLS 1.3
+	// servers only turn a client certificate down after the handshake
+	hello := func(certs ...tls.Certificate) (string, error) {
+		conn := tls.Client(dial_proxy(t, m.listen_port), &tls.Config{ServerName: "127.0.0.1", RootCAs: cas, Certificates: certs})
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			return "", err
+		}
+		b := make([]byte, 5)
+		_, err := io.ReadFull(conn, b)
+		return string(b), err
+	}
+	mallory, err := tls.LoadX509KeyPair(mallory_crt, mallory_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := hello(mallory); err == nil {
+		t.Errorf("a certificate of another CA got %q back", got)
+	}
+	if got, err := hello(); err == nil {
+		t.Errorf("no certificate got %q back", got)
+	}
+	alice, err := tls.LoadX509KeyPair(alice_crt, alice_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := hello(alice); err != nil || got != "hello" {
+		t.Errorf("alice got %q, %v", got, err)
+	}
+	<-sessions
+	active_connections.Wait()
+	if name := <-proxy_client; name != "proxy" {
+		t.Errorf("the target got the certificate of %q", name)
+	}
+
+	alice_x509, _ := x509.ParseCertificate(alice.Certificate[0])
+	want := "Client certificate CN=alice, SHA-256 " + fingerprint(alice_x509)
+	names, _ := filepath.Glob(filepath.Join(*output_dir, "log-*-0003-*.log"))
+	for _, name := range names {
+		if b, _ := os.ReadFile(name); !strings.Contains(name, "binary") && !strings.Contains(string(b), want) {
+			t.Errorf("%q not in %s:\n%s", want, name, b)
+		}
+	}
+	if len(names) == 0 {
+		t.Error("no log of the third connection")
+	}
+}
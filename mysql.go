@@ -0,0 +1,657 @@
+/*
+MySQL protocol decoding for the connection log (-proto mysql).
+
+Every packet is a 3 byte length and a sequence number. The server speaks
+first with its greeting, the client answers with its handshake, and
+after the server's OK the client sends commands, each answered with an
+OK, an error or a result set: a column count, the column definitions
+and the rows. What a server packet means depends on the command it
+answers, so the client side queues the commands for the server side.
+
+With the compression capability both sides wrap their packets in zlib
+frames once authentication is done; the frames are inflated before the
+packets are read. A client asking for TLS (SSLRequest) ends the
+decoding, the rest is a hex dump (use -tls to see inside). Column
+values are shortened to mysql_max_value bytes.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	mysql_max_packet = 0xffffff
+	mysql_max_value  = 64
+
+	mysql_client_connect_with_db = 0x00000008
+	mysql_client_compress        = 0x00000020
+	mysql_client_protocol_41     = 0x00000200
+	mysql_client_ssl             = 0x00000800
+	mysql_client_secure_conn     = 0x00008000
+	mysql_client_plugin_auth     = 0x00080000
+	mysql_client_auth_lenenc     = 0x00200000
+	mysql_client_deprecate_eof   = 0x01000000
+
+	mysql_more_results = 0x0008 // server status flag
+
+	mysql_com_quit         = 0x01
+	mysql_com_init_db      = 0x02
+	mysql_com_query        = 0x03
+	mysql_com_stmt_prepare = 0x16
+	mysql_com_stmt_execute = 0x17
+	mysql_com_stmt_send    = 0x18
+	mysql_com_stmt_close   = 0x19
+)
+
+var mysql_commands = map[byte]string{
+	0x00: "COM_SLEEP", mysql_com_quit: "COM_QUIT", mysql_com_init_db: "COM_INIT_DB",
+	mysql_com_query: "COM_QUERY", 0x04: "COM_FIELD_LIST", 0x08: "COM_STATISTICS",
+	0x0d: "COM_DEBUG", 0x0e: "COM_PING", 0x11: "COM_CHANGE_USER", 0x1f: "COM_RESET_CONNECTION",
+	mysql_com_stmt_prepare: "COM_STMT_PREPARE", mysql_com_stmt_execute: "COM_STMT_EXECUTE",
+	mysql_com_stmt_send: "COM_STMT_SEND_LONG_DATA", mysql_com_stmt_close: "COM_STMT_CLOSE",
+	0x1a: "COM_STMT_RESET", 0x1b: "COM_SET_OPTION", 0x1c: "COM_STMT_FETCH",
+}
+
+type MySQLRecord struct {
+	Seq          byte     `json:"seq"`
+	Type         string   `json:"type"`
+	Length       int      `json:"length"`
+	Compressed   bool     `json:"compressed,omitempty"`
+	Command      string   `json:"command,omitempty"` // that a server packet answers
+	Query        string   `json:"query,omitempty"`
+	StatementID  uint32   `json:"statement_id,omitempty"`
+	Version      string   `json:"version,omitempty"`
+	ConnectionID uint32   `json:"connection_id,omitempty"`
+	AuthPlugin   string   `json:"auth_plugin,omitempty"`
+	Capabilities uint32   `json:"capabilities,omitempty"`
+	User         string   `json:"user,omitempty"`
+	Database     string   `json:"database,omitempty"`
+	Column       string   `json:"column,omitempty"`
+	Values       []string `json:"values,omitempty"`
+	ErrorCode    uint16   `json:"error_code,omitempty"`
+	SQLState     string   `json:"sql_state,omitempty"`
+	Message      string   `json:"message,omitempty"`
+	Detail       string   `json:"detail,omitempty"`
+}
+
+// Reads packets, inflating the compressed frames once they start
+type mysql_packets struct {
+	r          *bufio.Reader
+	compressed bool
+	inflated   []byte
+}
+
+func (m *mysql_packets) read(n int) ([]byte, error) {
+	if !m.compressed {
+		b := make([]byte, n)
+		_, err := io.ReadFull(m.r, b)
+		return b, err
+	}
+	for len(m.inflated) < n {
+		if err := m.inflate(); err != nil {
+			if err == io.EOF && len(m.inflated) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	b := m.inflated[:n:n]
+	m.inflated = m.inflated[n:]
+	return b, nil
+}
+
+// Reads one compressed frame: 3 bytes length, sequence, 3 bytes length
+// before compression (0 if the frame wasn't worth compressing)
+func (m *mysql_packets) inflate() error {
+	var h [7]byte
+	if _, err := io.ReadFull(m.r, h[:]); err != nil {
+		return err
+	}
+	n := int(h[0]) | int(h[1])<<8 | int(h[2])<<16
+	plain := int(h[4]) | int(h[5])<<8 | int(h[6])<<16
+	data := make([]byte, n)
+	if _, err := io.ReadFull(m.r, data); err != nil {
+		return err
+	}
+	if plain == 0 {
+		m.inflated = append(m.inflated, data...)
+		return nil
+	}
+	z, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	data, err = io.ReadAll(io.LimitReader(z, int64(plain)))
+	if err != nil {
+		return err
+	}
+	m.inflated = append(m.inflated, data...)
+	return nil
+}
+
+// The next packet; payloads of 16MB and more continue in the following packets
+func (m *mysql_packets) next() (byte, []byte, error) {
+	var payload []byte
+	for {
+		h, err := m.read(4)
+		if err != nil {
+			return 0, nil, err
+		}
+		n := int(h[0]) | int(h[1])<<8 | int(h[2])<<16
+		b, err := m.read(n)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, nil, err
+		}
+		payload = append(payload, b...)
+		if n < mysql_max_packet {
+			return h[3], payload, nil
+		}
+	}
+}
+
+// Walks a packet payload
+type mysql_reader struct {
+	b   []byte
+	err error
+}
+
+func (r *mysql_reader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || len(r.b) < n {
+		r.err = errors.New("MySQL packet too short")
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *mysql_reader) uint(n int) uint64 {
+	b := r.bytes(n)
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v
+}
+
+// Length encoded integer; null is true for 0xfb, the NULL column value
+func (r *mysql_reader) lenenc() (v uint64, null bool) {
+	switch c := r.uint(1); {
+	case c < 0xfb:
+		return c, false
+	case c == 0xfb:
+		return 0, true
+	case c == 0xfc:
+		return r.uint(2), false
+	case c == 0xfd:
+		return r.uint(3), false
+	default:
+		return r.uint(8), false
+	}
+}
+
+func (r *mysql_reader) lenenc_string() string {
+	n, _ := r.lenenc()
+	return string(r.bytes(int(n)))
+}
+
+func (r *mysql_reader) cstring() string {
+	if r.err != nil {
+		return ""
+	}
+	i := bytes.IndexByte(r.b, 0)
+	if i < 0 {
+		s := string(r.b) // the last field may go without NUL
+		r.b = nil
+		return s
+	}
+	s := string(r.b[:i])
+	r.b = r.b[i+1:]
+	return s
+}
+
+// A text protocol column value as it should appear in the log
+func (r *mysql_reader) value() string {
+	n, null := r.lenenc()
+	if null {
+		return "NULL"
+	}
+	return mysql_printable(r.bytes(int(n)))
+}
+
+func mysql_printable(b []byte) string {
+	n := len(b)
+	if n > mysql_max_value {
+		b = b[:mysql_max_value]
+	}
+	var s string
+	if utf8.Valid(b) {
+		s = string(b)
+	} else {
+		s = "0x" + hex.EncodeToString(b)
+	}
+	if n > mysql_max_value {
+		s += fmt.Sprintf("...(%d bytes)", n)
+	}
+	return s
+}
+
+// ERR packets look the same in every phase
+func mysql_error(rec *MySQLRecord, r *mysql_reader) {
+	rec.Type = "ERR"
+	r.uint(1)
+	rec.ErrorCode = uint16(r.uint(2))
+	if len(r.b) > 0 && r.b[0] == '#' {
+		rec.SQLState = string(r.bytes(6)[1:])
+	}
+	rec.Message = string(r.b)
+	r.b = nil
+}
+
+// Decodes both directions of one connection. The client side pushes the
+// commands that expect an answer, the server side takes them in order.
+type MySQLParser struct {
+	commands chan byte
+	caps     chan uint32 // the client's capabilities, once
+
+	// client side
+	client       mysql_packets
+	client_phase int // 0 handshake, 1 authentication, 2 commands
+	client_caps  uint32
+
+	// server side
+	server       mysql_packets
+	server_phase int // 0 greeting, 1 authentication, 2 commands
+	server_caps  uint32
+	answering    byte     // the command of the current response
+	responding   bool     // in the middle of a response
+	expect       []string // packets still due before the rows, or the end
+	rows         bool
+	binary_rows  bool
+}
+
+func NewMySQLParser() *MySQLParser {
+	return &MySQLParser{commands: make(chan byte, 1024), caps: make(chan uint32, 1)}
+}
+
+func (p *MySQLParser) ParseClient(r *bufio.Reader) (*MySQLRecord, error) {
+	p.client.r = r
+	if p.client_phase == 1 {
+		// Commands start a new sequence, authentication continues one
+		h, err := r.Peek(4)
+		if err != nil {
+			return nil, err
+		}
+		if h[3] == 0 {
+			p.client_phase = 2
+			p.client.compressed = p.client_caps&mysql_client_compress != 0
+		}
+	}
+	seq, b, err := p.client.next()
+	if err != nil {
+		return nil, err
+	}
+	rec := &MySQLRecord{Seq: seq, Length: len(b), Compressed: p.client.compressed}
+	m := &mysql_reader{b: b}
+	switch p.client_phase {
+	case 0:
+		caps := uint32(m.uint(4))
+		m.bytes(4 + 1 + 23) // max packet size, character set, filler
+		rec.Capabilities = caps
+		if len(m.b) == 0 && caps&mysql_client_ssl != 0 {
+			rec.Type = "SSLRequest"
+			return rec, m.err // TLS follows, the next packet won't make sense
+		}
+		rec.Type = "HandshakeResponse"
+		rec.User = m.cstring()
+		switch {
+		case caps&mysql_client_auth_lenenc != 0:
+			m.lenenc_string()
+		case caps&mysql_client_secure_conn != 0:
+			m.bytes(int(m.uint(1)))
+		default:
+			m.cstring()
+		}
+		if caps&mysql_client_connect_with_db != 0 {
+			rec.Database = m.cstring()
+		}
+		if caps&mysql_client_plugin_auth != 0 {
+			rec.AuthPlugin = m.cstring()
+		}
+		m.b = nil // connection attributes
+		p.client_caps = caps
+		p.client_phase = 1
+		select {
+		case p.caps <- caps:
+		default:
+		}
+	case 1:
+		rec.Type = "AuthData"
+		m.b = nil
+	case 2:
+		cmd := byte(m.uint(1))
+		rec.Type = mysql_commands[cmd]
+		if rec.Type == "" {
+			rec.Type = fmt.Sprintf("COM_0x%02x", cmd)
+		}
+		switch cmd {
+		case mysql_com_query, mysql_com_stmt_prepare:
+			rec.Query = string(m.b)
+		case mysql_com_init_db:
+			rec.Database = string(m.b)
+		case mysql_com_stmt_execute, mysql_com_stmt_close, mysql_com_stmt_send:
+			rec.StatementID = uint32(m.uint(4))
+			if cmd == mysql_com_stmt_execute && len(m.b) > 5 {
+				rec.Detail = fmt.Sprintf("%d parameter bytes", len(m.b)-5)
+			}
+		}
+		m.b = nil
+		switch cmd {
+		case mysql_com_quit, mysql_com_stmt_close, mysql_com_stmt_send: // no answer
+		default:
+			select {
+			case p.commands <- cmd:
+			default:
+			}
+		}
+	}
+	return rec, m.err
+}
+
+func (p *MySQLParser) ParseServer(r *bufio.Reader) (*MySQLRecord, error) {
+	p.server.r = r
+	seq, b, err := p.server.next()
+	if err != nil {
+		return nil, err
+	}
+	rec := &MySQLRecord{Seq: seq, Length: len(b), Compressed: p.server.compressed}
+	m := &mysql_reader{b: b}
+	if len(b) == 0 {
+		return nil, errors.New("empty MySQL packet")
+	}
+	switch p.server_phase {
+	case 0:
+		if b[0] == 0xff {
+			mysql_error(rec, m)
+			return rec, nil
+		}
+		rec.Type = "Greeting"
+		if v := m.uint(1); v != 10 {
+			return nil, fmt.Errorf("MySQL protocol version %d", v)
+		}
+		rec.Version = m.cstring()
+		rec.ConnectionID = uint32(m.uint(4))
+		m.bytes(8 + 1) // first part of the auth data, filler
+		caps := uint32(m.uint(2))
+		m.bytes(1 + 2) // character set, status
+		if len(m.b) > 0 {
+			caps |= uint32(m.uint(2)) << 16
+			auth_len := int(m.uint(1))
+			m.bytes(10)
+			if caps&mysql_client_secure_conn != 0 {
+				m.bytes(max(13, auth_len-8))
+			}
+			if caps&mysql_client_plugin_auth != 0 {
+				rec.AuthPlugin = m.cstring()
+			}
+		}
+		rec.Capabilities = caps
+		p.server_caps = caps
+		p.server_phase = 1
+		return rec, m.err
+	case 1:
+		switch b[0] {
+		case 0x00:
+			p.mysql_ok(rec, m)
+			p.server_phase = 2
+			// The request parser runs on its own and may lag behind
+			select {
+			case caps := <-p.caps:
+				p.server_caps &= caps
+			case <-time.After(5 * time.Second):
+			}
+			p.server.compressed = p.server_caps&mysql_client_compress != 0
+		case 0xff:
+			mysql_error(rec, m)
+		case 0xfe:
+			rec.Type = "AuthSwitchRequest"
+			m.uint(1)
+			rec.AuthPlugin = m.cstring()
+			m.b = nil
+		default:
+			rec.Type = "AuthMoreData"
+			m.b = nil
+		}
+		return rec, m.err
+	}
+
+	if !p.responding {
+		select {
+		case p.answering = <-p.commands:
+		case <-time.After(100 * time.Millisecond):
+			p.answering = 0xff
+		}
+		p.responding = true
+	}
+	rec.Command = mysql_commands[p.answering]
+	p.response(rec, m, b)
+	return rec, m.err
+}
+
+// One packet of an answer to a command
+func (p *MySQLParser) response(rec *MySQLRecord, m *mysql_reader, b []byte) {
+	deprecate_eof := p.server_caps&mysql_client_deprecate_eof != 0
+	is_eof := b[0] == 0xfe && len(b) < 9
+
+	if len(p.expect) > 0 {
+		kind := p.expect[0]
+		p.expect = p.expect[1:]
+		if kind == "EOF" && is_eof {
+			rec.Type = "EOF"
+			m.b = nil
+		} else {
+			rec.Type = "ColumnDefinition"
+			catalog_schema_table := []string{m.lenenc_string(), m.lenenc_string(), m.lenenc_string()}
+			m.lenenc_string() // original table
+			rec.Column = m.lenenc_string()
+			if t := catalog_schema_table[2]; t != "" {
+				rec.Column = catalog_schema_table[1] + "." + t + "." + rec.Column
+			}
+			m.b = nil
+		}
+		if len(p.expect) == 0 && !p.rows {
+			p.responding = false
+		}
+		return
+	}
+
+	if p.rows {
+		switch {
+		case b[0] == 0xff:
+			mysql_error(rec, m)
+			p.end_response(0)
+		case b[0] == 0xfe && len(b) < mysql_max_packet:
+			status := uint16(0)
+			if deprecate_eof {
+				m.uint(1)
+				m.lenenc()
+				m.lenenc()
+				status = uint16(m.uint(2))
+				rec.Type = "OK"
+			} else {
+				rec.Type = "EOF"
+				m.uint(1)
+				m.uint(2)
+				status = uint16(m.uint(2))
+			}
+			m.b = nil
+			p.end_response(status)
+		case p.binary_rows:
+			rec.Type = "BinaryRow"
+			rec.Values = []string{mysql_printable(b[1:])}
+			m.b = nil
+		default:
+			rec.Type = "Row"
+			for m.err == nil && len(m.b) > 0 {
+				rec.Values = append(rec.Values, m.value())
+			}
+		}
+		return
+	}
+
+	switch {
+	case b[0] == 0x00 && p.answering == mysql_com_stmt_prepare:
+		rec.Type = "PrepareOK"
+		m.uint(1)
+		rec.StatementID = uint32(m.uint(4))
+		columns, params := int(m.uint(2)), int(m.uint(2))
+		rec.Detail = fmt.Sprintf("%d columns, %d parameters", columns, params)
+		m.b = nil
+		for _, n := range []int{params, columns} {
+			for i := 0; i < n; i++ {
+				p.expect = append(p.expect, "column")
+			}
+			if n > 0 && !deprecate_eof {
+				p.expect = append(p.expect, "EOF")
+			}
+		}
+		p.responding = len(p.expect) > 0
+	case b[0] == 0x00:
+		p.end_response(p.mysql_ok(rec, m))
+	case b[0] == 0xff:
+		mysql_error(rec, m)
+		p.end_response(0)
+	case b[0] == 0xfb:
+		rec.Type = "LocalInfileRequest"
+		m.uint(1)
+		rec.Message = string(m.b)
+		m.b = nil
+		p.end_response(0)
+	case is_eof: // the answer to COM_FIELD_LIST and friends, or a stray EOF
+		rec.Type = "EOF"
+		m.b = nil
+		p.end_response(0)
+	default:
+		rec.Type = "ResultSet"
+		n, _ := m.lenenc()
+		rec.Detail = fmt.Sprintf("%d columns", n)
+		for i := uint64(0); i < n && i < 4096; i++ {
+			p.expect = append(p.expect, "column")
+		}
+		if !deprecate_eof {
+			p.expect = append(p.expect, "EOF")
+		}
+		p.rows, p.binary_rows = true, p.answering == mysql_com_stmt_execute
+	}
+}
+
+// Decodes an OK packet and returns the server status
+func (p *MySQLParser) mysql_ok(rec *MySQLRecord, m *mysql_reader) uint16 {
+	rec.Type = "OK"
+	m.uint(1)
+	affected, _ := m.lenenc()
+	insert_id, _ := m.lenenc()
+	status := uint16(m.uint(2))
+	m.uint(2) // warnings
+	rec.Detail = fmt.Sprintf("%d rows affected", affected)
+	if insert_id != 0 {
+		rec.Detail += fmt.Sprintf(", last insert ID %d", insert_id)
+	}
+	if m.err == nil && len(m.b) > 0 {
+		rec.Message = string(m.b)
+	}
+	m.err, m.b = nil, nil // old servers end it early
+	return status
+}
+
+// Another result set may follow for the same command
+func (p *MySQLParser) end_response(status uint16) {
+	p.rows, p.binary_rows, p.expect = false, false, nil
+	p.responding = status&mysql_more_results != 0
+}
+
+// Parsers for both directions of one MySQL connection
+func new_mysql_parsers(conn_n int, logger chan *LogEvent, client_peer, server_peer string) (request, response *StreamParser) {
+	p := NewMySQLParser()
+	request = NewStreamParser(conn_n, client_to_server, client_peer, logger, decode_mysql(p.ParseClient))
+	response = NewStreamParser(conn_n, server_to_client, server_peer, logger, decode_mysql(p.ParseServer))
+	return
+}
+
+func decode_mysql(parse func(r *bufio.Reader) (*MySQLRecord, error)) decode_func {
+	return func(r *bufio.Reader) (*LogEvent, error) {
+		rec, err := parse(r)
+		if err != nil {
+			return nil, err
+		}
+		return &LogEvent{Event: "mysql_packet", Length: rec.Length, MySQL: rec}, nil
+	}
+}
+
+func format_mysql(e *LogEvent) string {
+	rec := e.MySQL
+	var b strings.Builder
+	fmt.Fprintf(&b, "MySQL %s from %s, seq %d, %d bytes", rec.Type, e.Peer, rec.Seq, rec.Length)
+	if rec.Compressed {
+		b.WriteString(", compressed")
+	}
+	if rec.Command != "" {
+		fmt.Fprintf(&b, " (%s)", rec.Command)
+	}
+	var details []string
+	if rec.Version != "" {
+		details = append(details, "version "+rec.Version, fmt.Sprintf("connection %d", rec.ConnectionID))
+	}
+	if rec.Capabilities != 0 {
+		details = append(details, fmt.Sprintf("capabilities %08x", rec.Capabilities))
+	}
+	if rec.User != "" {
+		details = append(details, fmt.Sprintf("user %q", rec.User))
+	}
+	if rec.Database != "" {
+		details = append(details, fmt.Sprintf("database %q", rec.Database))
+	}
+	if rec.AuthPlugin != "" {
+		details = append(details, "auth "+rec.AuthPlugin)
+	}
+	if rec.StatementID != 0 {
+		details = append(details, fmt.Sprintf("statement %d", rec.StatementID))
+	}
+	if rec.Column != "" {
+		details = append(details, rec.Column)
+	}
+	if rec.ErrorCode != 0 {
+		details = append(details, fmt.Sprintf("error %d (%s)", rec.ErrorCode, rec.SQLState))
+	}
+	if rec.Detail != "" {
+		details = append(details, rec.Detail)
+	}
+	if len(details) > 0 {
+		b.WriteString(": " + strings.Join(details, ", "))
+	}
+	b.WriteString("\n")
+	if rec.Query != "" {
+		b.WriteString(rec.Query + "\n")
+	}
+	if rec.Message != "" {
+		b.WriteString(rec.Message + "\n")
+	}
+	if rec.Values != nil {
+		b.WriteString(strings.Join(rec.Values, " | ") + "\n")
+	}
+	return b.String()
+}
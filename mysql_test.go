@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"strings"
+	"testing"
+)
+
+// A packet: 3 byte length, sequence number, payload
+func mysql_packet(seq byte, payload ...[]byte) []byte {
+	b := bytes.Join(payload, nil)
+	return append([]byte{byte(len(b)), byte(len(b) >> 8), byte(len(b) >> 16), seq}, b...)
+}
+
+// A length encoded string, all shorter than 251 bytes
+func mysql_lenenc(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func mysql_column(schema, table, name string) []byte {
+	return bytes.Join([][]byte{
+		mysql_lenenc("def"), mysql_lenenc(schema), mysql_lenenc(table), mysql_lenenc(table),
+		mysql_lenenc(name), mysql_lenenc(name),
+		{0x0c, 0x21, 0x00, 0x00, 0x01, 0x00, 0x00, 0xfd, 0x00, 0x00, 0x00, 0x00, 0x00},
+	}, nil)
+}
+
+const mysql_test_caps = mysql_client_protocol_41 | mysql_client_secure_conn | mysql_client_plugin_auth |
+	mysql_client_connect_with_db | mysql_client_deprecate_eof
+
+// The server's protocol 10 greeting offering caps
+func mysql_greeting(caps uint32) []byte {
+	return mysql_packet(0,
+		[]byte{10}, []byte("8.0.36\x00"),
+		[]byte{0x2a, 0x00, 0x00, 0x00}, // connection 42
+		[]byte("abcdefgh\x00"),         // first part of the scramble, filler
+		[]byte{byte(caps), byte(caps >> 8), 0xff, 0x02, 0x00, byte(caps >> 16), byte(caps >> 24)},
+		[]byte{21}, make([]byte, 10),
+		[]byte("ijklmnopqrst\x00"),
+		[]byte("caching_sha2_password\x00"))
+}
+
+// The client's handshake response with caps, logging in as root to test
+func mysql_handshake(caps uint32) []byte {
+	return mysql_packet(1,
+		[]byte{byte(caps), byte(caps >> 8), byte(caps >> 16), byte(caps >> 24)},
+		[]byte{0x00, 0x00, 0x00, 0x01, 0xff}, make([]byte, 23), // max packet, character set, filler
+		[]byte("root\x00"),
+		append([]byte{20}, bytes.Repeat([]byte{0x5a}, 20)...),
+		[]byte("test\x00"),
+		[]byte("caching_sha2_password\x00"))
+}
+
+var mysql_ok_packet = []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}
+
+// A session with a text query, a prepared statement, a failing query and
+// COM_QUIT, with the packets each side sends
+func mysql_session() (client, server [][]byte) {
+	client = [][]byte{
+		mysql_handshake(mysql_test_caps),
+		mysql_packet(0, []byte{mysql_com_query}, []byte("SELECT id, name FROM users")),
+		mysql_packet(0, []byte{mysql_com_stmt_prepare}, []byte("SELECT name FROM users WHERE id = ?")),
+		mysql_packet(0, []byte{mysql_com_stmt_execute, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00},
+			[]byte{0x00, 0x01, 0x08, 0x00, 0x01, 0, 0, 0, 0, 0, 0, 0}), // one LONGLONG parameter, 1
+		mysql_packet(0, []byte{mysql_com_query}, []byte("SELECT * FROM nope")),
+		mysql_packet(0, []byte{mysql_com_quit}),
+	}
+	server = [][]byte{
+		mysql_greeting(mysql_test_caps | mysql_client_compress),
+		mysql_packet(2, mysql_ok_packet),
+
+		mysql_packet(1, []byte{0x02}),
+		mysql_packet(2, mysql_column("test", "users", "id")),
+		mysql_packet(3, mysql_column("test", "users", "name")),
+		mysql_packet(4, mysql_lenenc("1"), mysql_lenenc("alice")),
+		mysql_packet(5, mysql_lenenc("2"), []byte{0xfb}),
+		mysql_packet(6, []byte{0xfe, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}),
+
+		mysql_packet(1, []byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}),
+		mysql_packet(2, mysql_column("", "", "?")),
+		mysql_packet(3, mysql_column("test", "users", "name")),
+
+		mysql_packet(1, []byte{0x01}),
+		mysql_packet(2, mysql_column("test", "users", "name")),
+		mysql_packet(3, []byte{0x00, 0x00}, mysql_lenenc("alice")),
+		mysql_packet(4, []byte{0xfe, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}),
+
+		mysql_packet(1, []byte{0xff, 0x7a, 0x04}, []byte("#42S02Table 'test.nope' doesn't exist")),
+	}
+	return
+}
+
+func TestDecodeMySQLStream(t *testing.T) {
+	client, server := mysql_session()
+	want := []string{
+		`MySQL HandshakeResponse from 127.0.0.1-50000, seq 1, 85 bytes: capabilities 01088208, user "root", database "test", auth caching_sha2_password`,
+		`MySQL COM_QUERY from 127.0.0.1-50000, seq 0, 27 bytes`,
+		`SELECT id, name FROM users`,
+		`MySQL COM_STMT_PREPARE from 127.0.0.1-50000, seq 0, 36 bytes`,
+		`SELECT name FROM users WHERE id = ?`,
+		`MySQL COM_STMT_EXECUTE from 127.0.0.1-50000, seq 0, 22 bytes: statement 1, 12 parameter bytes`,
+		`MySQL COM_QUERY from 127.0.0.1-50000, seq 0, 19 bytes`,
+		`SELECT * FROM nope`,
+		`MySQL COM_QUIT from 127.0.0.1-50000, seq 0, 1 bytes`,
+
+		`MySQL Greeting from 127.0.0.1-3306, seq 0, 74 bytes: version 8.0.36, connection 42, capabilities 01088228, auth caching_sha2_password`,
+		`MySQL OK from 127.0.0.1-3306, seq 2, 7 bytes: 0 rows affected`,
+		`MySQL ResultSet from 127.0.0.1-3306, seq 1, 1 bytes (COM_QUERY): 2 columns`,
+		`MySQL ColumnDefinition from 127.0.0.1-3306, seq 2, 40 bytes (COM_QUERY): test.users.id`,
+		`MySQL ColumnDefinition from 127.0.0.1-3306, seq 3, 44 bytes (COM_QUERY): test.users.name`,
+		`MySQL Row from 127.0.0.1-3306, seq 4, 8 bytes (COM_QUERY)`,
+		`1 | alice`,
+		`MySQL Row from 127.0.0.1-3306, seq 5, 3 bytes (COM_QUERY)`,
+		`2 | NULL`,
+		`MySQL OK from 127.0.0.1-3306, seq 6, 7 bytes (COM_QUERY)`,
+		`MySQL PrepareOK from 127.0.0.1-3306, seq 1, 12 bytes (COM_STMT_PREPARE): statement 1, 1 columns, 1 parameters`,
+		`MySQL ColumnDefinition from 127.0.0.1-3306, seq 2, 24 bytes (COM_STMT_PREPARE): ?`,
+		`MySQL ColumnDefinition from 127.0.0.1-3306, seq 3, 44 bytes (COM_STMT_PREPARE): test.users.name`,
+		`MySQL ResultSet from 127.0.0.1-3306, seq 1, 1 bytes (COM_STMT_EXECUTE): 1 columns`,
+		`MySQL ColumnDefinition from 127.0.0.1-3306, seq 2, 44 bytes (COM_STMT_EXECUTE): test.users.name`,
+		`MySQL BinaryRow from 127.0.0.1-3306, seq 3, 8 bytes (COM_STMT_EXECUTE)`,
+		"\x00\x05alice",
+		`MySQL OK from 127.0.0.1-3306, seq 4, 7 bytes (COM_STMT_EXECUTE)`,
+		`MySQL ERR from 127.0.0.1-3306, seq 1, 40 bytes (COM_QUERY): error 1146 (42S02)`,
+		`Table 'test.nope' doesn't exist`,
+	}
+	for _, chunk := range []int{1, 5, 1 << 20} {
+		logger := make(chan *LogEvent)
+		request, response := new_mysql_parsers(1, logger, "127.0.0.1-50000", "127.0.0.1-3306")
+		events := feed_parsers(t, logger, []*StreamParser{request, response},
+			[][]byte{bytes.Join(client, nil), bytes.Join(server, nil)}, chunk)
+		var got []string
+		for _, e := range events {
+			if e.MySQL == nil {
+				t.Fatalf("chunks of %d: a %s event, the decoder gave up", chunk, e.Event)
+			}
+			got = append(got, strings.TrimSuffix(format_mysql(e), "\n"))
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("chunks of %d logged\n%s\nwant\n%s", chunk, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+// Compressed frames: one zlib frame with two commands in it, and one the
+// sender didn't compress
+func TestDecodeMySQLCompressed(t *testing.T) {
+	caps := uint32(mysql_test_caps | mysql_client_compress)
+	var z bytes.Buffer
+	w := zlib.NewWriter(&z)
+	commands := bytes.Join([][]byte{
+		mysql_packet(0, []byte{mysql_com_query}, []byte("SELECT 1")),
+		mysql_packet(0, []byte{0x0e}), // COM_PING
+	}, nil)
+	w.Write(commands)
+	w.Close()
+	frame := func(seq byte, plain int, data []byte) []byte {
+		n := len(data)
+		return append([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq, byte(plain), byte(plain >> 8), byte(plain >> 16)}, data...)
+	}
+	client := bytes.Join([][]byte{mysql_handshake(caps), frame(0, len(commands), z.Bytes())}, nil)
+	replies := bytes.Join([][]byte{
+		mysql_packet(1, []byte{0x01}),
+		mysql_packet(2, mysql_column("", "", "1")),
+		mysql_packet(3, mysql_lenenc("1")),
+		mysql_packet(4, []byte{0xfe, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}),
+		mysql_packet(1, mysql_ok_packet),
+	}, nil)
+	server := bytes.Join([][]byte{mysql_greeting(caps), mysql_packet(2, mysql_ok_packet), frame(0, 0, replies)}, nil)
+
+	logger := make(chan *LogEvent)
+	request, response := new_mysql_parsers(1, logger, "127.0.0.1-50000", "127.0.0.1-3306")
+	events := feed_parsers(t, logger, []*StreamParser{request, response}, [][]byte{client, server}, 3)
+	var got []string
+	for _, e := range events {
+		if e.MySQL == nil {
+			t.Fatalf("a %s event, the decoder gave up", e.Event)
+		}
+		line := []string{e.MySQL.Type, e.MySQL.Command}
+		line = append(line, e.MySQL.Values...)
+		if e.MySQL.Compressed {
+			line = append(line, "compressed")
+		}
+		got = append(got, strings.Join(strings.Fields(strings.Join(line, " ")), " "))
+	}
+	want := []string{
+		"HandshakeResponse", "COM_QUERY compressed", "COM_PING compressed",
+		"Greeting", "OK",
+		"ResultSet COM_QUERY compressed", "ColumnDefinition COM_QUERY compressed", "Row COM_QUERY 1 compressed",
+		"OK COM_QUERY compressed", "OK COM_PING compressed",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("logged\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// Servers without CLIENT_DEPRECATE_EOF end the column definitions and the
+// rows with EOF packets
+func TestMySQLParserEOF(t *testing.T) {
+	caps := uint32(mysql_test_caps &^ mysql_client_deprecate_eof)
+	p := NewMySQLParser()
+	client := bufio.NewReader(bytes.NewReader(bytes.Join([][]byte{
+		mysql_handshake(caps),
+		mysql_packet(0, []byte{mysql_com_query}, []byte("SELECT 1")),
+	}, nil)))
+	server := bufio.NewReader(bytes.NewReader(bytes.Join([][]byte{
+		mysql_greeting(caps),
+		mysql_packet(2, mysql_ok_packet),
+		mysql_packet(1, []byte{0x01}),
+		mysql_packet(2, mysql_column("", "", "1")),
+		mysql_packet(3, []byte{0xfe, 0x00, 0x00, 0x02, 0x00}),
+		mysql_packet(4, mysql_lenenc(strings.Repeat("y", 100))),
+		mysql_packet(5, mysql_lenenc("\xff\xfe")),
+		mysql_packet(6, []byte{0xfe, 0x00, 0x00, 0x02, 0x00}),
+	}, nil)))
+	for i := 0; i < 2; i++ {
+		if _, err := p.ParseClient(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	for i := 0; i < 8; i++ {
+		rec, err := p.ParseServer(server)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		got = append(got, rec.Type+" "+strings.Join(rec.Values, ","))
+	}
+	want := []string{"Greeting ", "OK ", "ResultSet ", "ColumnDefinition ", "EOF ",
+		"Row " + strings.Repeat("y", mysql_max_value) + "...(100 bytes)", "Row 0xfffe", "EOF "}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("decoded\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if p.responding {
+		t.Error("still in a response after the last EOF")
+	}
+}
+
+func TestMySQLParserSSLRequest(t *testing.T) {
+	p := NewMySQLParser()
+	caps := uint32(mysql_test_caps | mysql_client_ssl)
+	ssl := mysql_packet(1, []byte{byte(caps), byte(caps >> 8), byte(caps >> 16), byte(caps >> 24)}, make([]byte, 28))
+	rec, err := p.ParseClient(bufio.NewReader(bytes.NewReader(ssl)))
+	if err != nil || rec.Type != "SSLRequest" || rec.Capabilities != caps {
+		t.Errorf("%+v, %v, want an SSLRequest", rec, err)
+	}
+}
+
+func TestMySQLParserErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		packet []byte
+	}{
+		{"protocol 9", mysql_packet(0, []byte{9}, []byte("5.0\x00"))},
+		{"empty packet", mysql_packet(0)},
+		{"short greeting", mysql_packet(0, []byte{10}, []byte("8.0.36\x00"), []byte{0x2a})},
+		{"truncated packet", mysql_packet(0, []byte{10}, []byte("8.0.36\x00"))[:8]},
+	} {
+		if rec, err := NewMySQLParser().ParseServer(bufio.NewReader(bytes.NewReader(tt.packet))); err == nil {
+			t.Errorf("%s: accepted as %+v", tt.name, rec)
+		}
+	}
+	rec, err := NewMySQLParser().ParseServer(bufio.NewReader(bytes.NewReader(
+		mysql_packet(0, []byte{0xff, 0x6a, 0x04}, []byte("Host '10.0.0.1' is not allowed to connect")))))
+	if err != nil || rec.Type != "ERR" || rec.ErrorCode != 1130 || rec.SQLState != "" {
+		t.Errorf("an error instead of the greeting decoded as %+v, %v", rec, err)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Protocol aware logging.
+
+A StreamParser sits in the logging path of one direction of a connection.
+pass_through hands it a copy of every chunk it forwards; the parser turns
+the byte stream into protocol records in its own goroutine. As soon as
+the stream stops making sense it falls back to the plain hex dump, so
+nothing that was forwarded is ever missing from the log.
+*/
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"time"
+)
+
+// Largest amount of undecoded data kept around for the hex fallback
+const parser_max_pending = 4 << 20
+
+// Decodes one protocol message from the stream. A nil event without an
+// error means the bytes were understood but aren't worth a log entry.
+type decode_func func(r *bufio.Reader) (*LogEvent, error)
+
+type StreamParser struct {
+	conn_n    int
+	direction string
+	peer      string
+	logger    chan *LogEvent
+	decode    decode_func
+	in        chan []byte
+	done      chan bool
+	offset    int // bytes logged so far, for the fallback events
+	packet_n  int
+}
+
+func NewStreamParser(conn_n int, direction, peer string, logger chan *LogEvent, decode decode_func) *StreamParser {
+	p := &StreamParser{
+		conn_n:    conn_n,
+		direction: direction,
+		peer:      peer,
+		logger:    logger,
+		decode:    decode,
+		in:        make(chan []byte, 64),
+		done:      make(chan bool),
+	}
+	go p.run()
+	return p
+}
+
+// The decoders of protocol for both directions of a connection, nil for
+// the plain hex dump. log_name is the connection log, -proto smtp saves
+// the messages next to it.
+func new_protocol_parsers(protocol Protocol, conn_n int, logger chan *LogEvent, client_peer, server_peer, log_name string) (request, response *StreamParser) {
+	switch protocol {
+	case "http":
+		request, response = new_http_parsers(conn_n, logger, client_peer, server_peer)
+	case "grpc":
+		request, response = new_grpc_parsers(conn_n, logger, client_peer, server_peer)
+	case "h2":
+		request, response = new_h2_parsers(conn_n, logger, client_peer, server_peer)
+	case "mqtt":
+		request, response = new_mqtt_parsers(conn_n, logger, client_peer, server_peer)
+	case "redis":
+		request, response = new_redis_parsers(conn_n, logger, client_peer, server_peer)
+	case "postgres":
+		request, response = new_postgres_parsers(conn_n, logger, client_peer, server_peer)
+	case "mysql":
+		request, response = new_mysql_parsers(conn_n, logger, client_peer, server_peer)
+	case "ftp":
+		request, response = new_ftp_parsers(conn_n, logger, client_peer, server_peer)
+	case "smtp":
+		request, response = new_smtp_parsers(conn_n, logger, client_peer, server_peer, smtp_eml_prefix(log_name))
+	case "dns":
+		request, response = new_dns_parsers(conn_n, logger, client_peer, server_peer)
+	case "modbus":
+		request, response = new_modbus_parsers(conn_n, logger, client_peer, server_peer)
+	}
+	return
+}
+
+// Queues a copy of data; b is reused by the caller
+func (p *StreamParser) Feed(b []byte) {
+	d := make([]byte, len(b))
+	copy(d, b)
+	p.in <- d
+}
+
+// Ends the stream and waits until everything has been logged
+func (p *StreamParser) Close() {
+	close(p.in)
+	<-p.done
+}
+
+// Turns the chunk channel back into a stream, remembering what was read
+// since the last complete message
+type recording_reader struct {
+	in      chan []byte
+	chunk   []byte
+	pending []byte
+}
+
+func (r *recording_reader) Read(b []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		c, ok := <-r.in
+		if !ok {
+			return 0, io.EOF
+		}
+		r.chunk = c
+	}
+	n := copy(b, r.chunk)
+	r.chunk = r.chunk[n:]
+	if len(r.pending) < parser_max_pending {
+		r.pending = append(r.pending, b[:n]...)
+	}
+	return n, nil
+}
+
+func (p *StreamParser) run() {
+	defer close(p.done)
+
+	rec := &recording_reader{in: p.in}
+	br := bufio.NewReader(rec)
+	for {
+		e, err := p.decode(br)
+		if err != nil {
+			if err != io.EOF || len(rec.pending) > 0 {
+				p.fallback(rec)
+			}
+			return
+		}
+		if e != nil {
+			e.Timestamp = time.Now()
+			e.ConnID, e.Direction, e.Peer = p.conn_n, p.direction, p.peer
+			p.logger <- e
+		}
+
+		// Only the read-ahead of the next message is still undecoded
+		consumed := len(rec.pending) - br.Buffered()
+		if consumed < 0 { // pending overflowed, give up on the read-ahead
+			rec.pending = nil
+			continue
+		}
+		p.offset += consumed
+		rec.pending = rec.pending[consumed:]
+	}
+}
+
+// Logs the undecoded bytes and the rest of the stream as hex dumps
+func (p *StreamParser) fallback(rec *recording_reader) {
+	p.dump(rec.pending)
+	p.dump(rec.chunk)
+	for c := range p.in {
+		p.dump(c)
+	}
+}
+
+func (p *StreamParser) dump(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	e := new_event(p.conn_n, p.direction, "received", p.peer)
+	e.PacketSeq, e.ByteOffset, e.Length = p.packet_n, p.offset, len(b)
+	e.dump_later(b)
+	e.Raw = raw_payload(b)
+	p.logger <- e
+	p.offset += len(b)
+	p.packet_n += 1
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Runs stream through a StreamParser with decode, fed chunk bytes at a
+// time, and returns what it logged
+func parse_stream(t *testing.T, decode decode_func, stream []byte, chunk int) []*LogEvent {
+	t.Helper()
+	logger := make(chan *LogEvent)
+	p := NewStreamParser(1, client_to_server, "127.0.0.1-50000", logger, decode)
+	return feed_parsers(t, logger, []*StreamParser{p}, [][]byte{stream}, chunk)
+}
+
+// Feeds each stream to its parser in turn, the next one once the
+// previous is closed, and returns what they logged
+func feed_parsers(t *testing.T, logger chan *LogEvent, parsers []*StreamParser, streams [][]byte, chunk int) []*LogEvent {
+	t.Helper()
+	var events []*LogEvent
+	done := make(chan bool)
+	go func() {
+		for e := range logger {
+			if e == nil {
+				break
+			}
+			events = append(events, e)
+		}
+		done <- true
+	}()
+	for i, p := range parsers {
+		for b := streams[i]; len(b) > 0; b = b[min(chunk, len(b)):] {
+			p.Feed(b[:min(chunk, len(b))])
+		}
+		p.Close()
+	}
+	logger <- nil
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the parsers didn't finish")
+	}
+	return events
+}
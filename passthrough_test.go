@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// What the loggers of a test Channel were sent
+type channel_sink struct {
+	events []*LogEvent
+	binary []byte
+	done   chan bool
+}
+
+// A client to server Channel from from to to, with loggers that collect
+// into the returned sink. The binary logger takes slow for every chunk,
+// as one writing to a busy disk would.
+func new_test_channel(ctx context.Context, from, to net.Conn, slow time.Duration) (*Channel, *channel_sink) {
+	if buffer_pool == nil {
+		buffer_pool = NewBufferPool(*buf_size)
+	}
+	events := make(chan *LogEvent)
+	c := &Channel{from: from, to: to, conn_n: 1, direction: client_to_server,
+		logger: NewFormattingLogger(events).Events(), binary_logger: make(chan []byte),
+		timeouts: new_conn_timeouts(ctx), session: &SessionStats{}, ack: make(chan bool, 1), ctx: ctx}
+	s := &channel_sink{done: make(chan bool, 2)}
+	go func() {
+		for e := range events {
+			if e == nil {
+				break
+			}
+			s.events = append(s.events, e)
+		}
+		s.done <- true
+	}()
+	go func() {
+		for b := range c.binary_logger {
+			if len(b) == 0 {
+				break
+			}
+			time.Sleep(slow)
+			s.binary = append(s.binary, b...)
+		}
+		s.done <- true
+	}()
+	return c, s
+}
+
+// Stops the loggers once pass_through is done and waits for them
+func (s *channel_sink) stop(c *Channel) {
+	c.logger <- nil
+	c.binary_logger <- []byte{}
+	<-s.done
+	<-s.done
+}
+
+// The events of one kind
+func (s *channel_sink) count(kind string) int {
+	n := 0
+	for _, e := range s.events {
+		if e.Event == kind {
+			n += 1
+		}
+	}
+	return n
+}
+
+func random_bytes(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+// The binary log has to hold what was sent even when the binary logger
+// is slower than the copy, which reuses its buffer right away
+func TestPassThroughBinaryLog(t *testing.T) {
+	data := random_bytes(1 << 20)
+	client, from := net.Pipe()
+	to, server := net.Pipe()
+	c, sink := new_test_channel(context.Background(), from, to, 50*time.Microsecond)
+	go pass_through(c)
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	forwarded, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-c.ack
+	sink.stop(c)
+	if !bytes.Equal(forwarded, data) {
+		t.Errorf("forwarded %d bytes that differ from the %d sent", len(forwarded), len(data))
+	}
+	if !bytes.Equal(sink.binary, data) {
+		t.Errorf("the binary log holds %d bytes that differ from the %d sent", len(sink.binary), len(data))
+	}
+	var dumped []byte
+	for _, e := range sink.events {
+		if e.Event == "received" {
+			dumped = append(dumped, e.dump...)
+		}
+	}
+	if !bytes.Equal(dumped, data) {
+		t.Errorf("the hex dumps hold %d bytes that differ from the %d sent", len(dumped), len(data))
+	}
+}
+
+// pass_through as it was before LoggingWriter: a read loop that formats
+// the hex dump itself, kept to compare the two
+func read_loop_pass_through(c *Channel) {
+	b := make([]byte, 10240)
+	offset, packet_n := 0, 0
+	for {
+		n, err := c.from.Read(b)
+		if err != nil {
+			break
+		}
+		e := c.event("received", "")
+		e.PacketSeq, e.ByteOffset, e.Length = packet_n, offset, n
+		e.HexPayload = hex.Dump(b[:n])
+		c.logger <- e
+		c.binary_logger <- append([]byte(nil), b[:n]...)
+		c.to.Write(b[:n])
+		c.logger <- c.event("sent", "")
+		offset += n
+		packet_n += 1
+	}
+	c.from.Close()
+	c.to.Close()
+	c.ack <- true
+}
+
+// Throughput of the copy loops with connections running in parallel,
+// each chunk written by the client and read back on the server side
+func BenchmarkCopyLoops(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		copy func(*Channel)
+	}{
+		{"read loop", read_loop_pass_through},
+		{"LoggingWriter", pass_through},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			chunk := random_bytes(10240)
+			b.SetBytes(int64(len(chunk)))
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				client, from := net.Pipe()
+				to, server := net.Pipe()
+				c, sink := new_test_channel(context.Background(), from, to, 0)
+				go bench.copy(c)
+				got := make([]byte, len(chunk))
+				for pb.Next() {
+					go client.Write(chunk)
+					io.ReadFull(server, got)
+				}
+				client.Close()
+				<-c.ack
+				sink.stop(c)
+			})
+		})
+	}
+}
+
+// How long a 10 KB chunk takes from the client to the server, with the
+// hex dump made before the chunk is forwarded and with the
+// FormattingLogger making it on the side. Each chunk waits for the
+// loggers to finish with the one before, as chunks that don't come back
+// to back would, and only its way to the server is counted in
+// forward-ns/op.
+func BenchmarkForwardLatency(b *testing.B) {
+	if buffer_pool == nil {
+		buffer_pool = NewBufferPool(*buf_size)
+	}
+	for _, bench := range []struct {
+		name string
+		copy func(*Channel)
+	}{
+		{"hex dump first", read_loop_pass_through},
+		{"FormattingLogger", pass_through},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			chunk := random_bytes(10240)
+			client, from := net.Pipe()
+			to, server := net.Pipe()
+			ctx := context.Background()
+			events := make(chan *LogEvent)
+			c := &Channel{from: from, to: to, conn_n: 1, direction: client_to_server,
+				logger: NewFormattingLogger(events).Events(), binary_logger: make(chan []byte),
+				timeouts: new_conn_timeouts(ctx), session: &SessionStats{}, ack: make(chan bool, 1), ctx: ctx}
+			logged := make(chan bool)
+			go func() {
+				for e := range events {
+					if e == nil {
+						return
+					}
+					if e.Event == "sent" {
+						logged <- true
+					}
+				}
+			}()
+			go discard_logger(c.binary_logger)
+			go bench.copy(c)
+			got := make([]byte, len(chunk))
+			var forwarding time.Duration
+			b.SetBytes(int64(len(chunk)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				go client.Write(chunk)
+				io.ReadFull(server, got)
+				forwarding += time.Since(start)
+				<-logged
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(forwarding.Nanoseconds())/float64(b.N), "forward-ns/op")
+			client.Close()
+			<-c.ack
+			c.logger <- nil
+			c.binary_logger <- []byte{}
+		})
+	}
+}
+
+// Whole short connections through pass_through, in parallel, with the
+// buffers from the pool and with a new one for every connection
+func BenchmarkPassThrough(b *testing.B) {
+	saved := buffer_pool
+	b.Cleanup(func() { buffer_pool = saved })
+	unpooled := NewBufferPool(*buf_size)
+	unpooled.size = -1 // takes no buffer back, so Get always allocates
+	request := random_bytes(4096)
+	for _, bench := range []struct {
+		name string
+		pool *BufferPool
+	}{
+		{"new buffers", unpooled},
+		{"BufferPool", NewBufferPool(*buf_size)},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			buffer_pool = bench.pool
+			b.SetBytes(int64(len(request)))
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					client, from := net.Pipe()
+					to, server := net.Pipe()
+					c, sink := new_test_channel(context.Background(), from, to, 0)
+					go pass_through(c)
+					go func() {
+						client.Write(request)
+						client.Close()
+					}()
+					io.Copy(io.Discard, server)
+					<-c.ack
+					sink.stop(c)
+				}
+			})
+		})
+	}
+}
+
+// Cancelling the connection's context in the middle of a transfer ends
+// pass_through at once, and leaves no goroutine of it behind
+func TestPassThroughCancel(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	client, from := net.Pipe()
+	to, server := net.Pipe()
+	c, sink := new_test_channel(ctx, from, to, 0)
+	go pass_through(c)
+	chunk := random_bytes(4096)
+	go func() {
+		for {
+			if _, err := client.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+	go io.Copy(io.Discard, server)
+	for atomic.LoadInt64(&c.session.BytesToServer) < 1<<20 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-c.ack:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("pass_through still running 100ms after the cancel")
+	}
+	sink.stop(c)
+	e := sink.events[len(sink.events)-1]
+	if e.Event != "disconnected" || !strings.Contains(e.Message, "cancel") {
+		t.Errorf("pass_through ended with %s %q", e.Event, e.Message)
+	}
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines left 100ms after the cancel, %d before the transfer", n, before)
+	}
+}
+
+// Runs pass_through from from to to and returns what it logged
+func run_pass_through(t *testing.T, from, to *RecordingConn) *channel_sink {
+	c, sink := new_test_channel(context.Background(), from, to, 0)
+	go pass_through(c)
+	select {
+	case <-c.ack:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pass_through didn't finish")
+	}
+	sink.stop(c)
+	return sink
+}
+
+func TestPassThroughRecordingConn(t *testing.T) {
+	request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	tests := []struct {
+		name       string
+		setup      func(from, to *RecordingConn)
+		forwarded  int    // bytes of request the server got
+		last       string // event
+		message    string // in the last event
+		half_close bool
+	}{
+		{"normal", func(from, to *RecordingConn) {},
+			len(request), "disconnected", "half-closed the connection", true},
+		{"read error", func(from, to *RecordingConn) {
+			from.ReadErr, from.ReadErrAfter = errors.New("connection reset by peer"), 2
+		},
+			16, "network_error", "connection reset by peer", false},
+		{"write error", func(from, to *RecordingConn) { to.WriteErr, to.WriteErrAfter = errors.New("broken pipe"), 1 },
+			8, "disconnected", "half-closed the connection", true}, // the write_error is logged, the copy goes on
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to := NewRecordingConn(request), NewRecordingConn(nil)
+			from.ReadSize = 8
+			tt.setup(from, to)
+			sink := run_pass_through(t, from, to)
+			if got := to.Written(); !bytes.Equal(got, request[:tt.forwarded]) {
+				t.Errorf("forwarded %q, want %q", got, request[:tt.forwarded])
+			}
+			if n := sink.count("received"); n != from.Reads() {
+				t.Errorf("%d received events for %d reads", n, from.Reads())
+			}
+			e := sink.events[len(sink.events)-1]
+			if e.Event != tt.last || !strings.Contains(e.Message, tt.message) {
+				t.Errorf("ended with %s %q, want %s with %q", e.Event, e.Message, tt.last, tt.message)
+			}
+			if to.WriteClosed() != tt.half_close || from.Closed() == tt.half_close || to.Closed() == tt.half_close {
+				t.Errorf("half-closed %v, closed %v and %v, want a half-close %v", to.WriteClosed(), from.Closed(), to.Closed(), tt.half_close)
+			}
+			if to.WriteErr != nil && sink.count("write_error") == 0 {
+				t.Error("no write_error event")
+			}
+		})
+	}
+}
+
+// Both sides finish sending at the same time: each direction passes its
+// end on as a half-close and nothing is closed under the other
+func TestPassThroughSimultaneousHalfClose(t *testing.T) {
+	request, response := random_bytes(10000), random_bytes(20000)
+	client, server := NewRecordingConn(request), NewRecordingConn(response)
+	client.ReadSize, server.ReadSize = 1000, 1000
+	client.ReadDelay, server.ReadDelay = time.Millisecond, time.Millisecond
+	to_server, to_server_sink := new_test_channel(context.Background(), client, server, 0)
+	to_client, to_client_sink := new_test_channel(context.Background(), server, client, 0)
+	to_client.direction = server_to_client
+	go pass_through(to_server)
+	go pass_through(to_client)
+	for _, c := range []*Channel{to_server, to_client} {
+		select {
+		case <-c.ack:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the %s pass_through didn't finish", c.direction)
+		}
+	}
+	to_server_sink.stop(to_server)
+	to_client_sink.stop(to_client)
+	if !bytes.Equal(server.Written(), request) || !bytes.Equal(client.Written(), response) {
+		t.Errorf("the server got %d bytes of %d, the client %d of %d", len(server.Written()), len(request), len(client.Written()), len(response))
+	}
+	if !client.WriteClosed() || !server.WriteClosed() || client.Closed() || server.Closed() {
+		t.Errorf("half-closed %v and %v, closed %v and %v, want both half-closed only",
+			client.WriteClosed(), server.WriteClosed(), client.Closed(), server.Closed())
+	}
+	for _, sink := range []*channel_sink{to_server_sink, to_client_sink} {
+		if e := sink.events[len(sink.events)-1]; e.Event != "disconnected" {
+			t.Errorf("ended with %s %q", e.Event, e.Message)
+		}
+	}
+}
+
+// A net.Pipe in each direction, so that the writing side can be shut
+// down on its own the way CloseWrite does on a TCP connection
+type duplex_pipe struct {
+	net.Conn // reads
+	w        net.Conn
+}
+
+func new_duplex_pipe() (a, b *duplex_pipe) {
+	r1, w1 := net.Pipe()
+	r2, w2 := net.Pipe()
+	return &duplex_pipe{r1, w2}, &duplex_pipe{r2, w1}
+}
+
+func (p *duplex_pipe) Write(b []byte) (int, error) { return p.w.Write(b) }
+func (p *duplex_pipe) CloseWrite() error           { return p.w.Close() }
+
+func (p *duplex_pipe) Close() error {
+	p.w.Close()
+	return p.Conn.Close()
+}
+
+// The client sends its request and half-closes; the server sees the end
+// of it and only then answers, which still reaches the client in full
+func TestPassThroughHalfClosePipe(t *testing.T) {
+	request, response := random_bytes(5000), random_bytes(50000)
+	client, from := new_duplex_pipe()
+	to, server := new_duplex_pipe()
+	to_server, to_server_sink := new_test_channel(context.Background(), from, to, 0)
+	to_client, to_client_sink := new_test_channel(context.Background(), to, from, 0)
+	to_client.direction = server_to_client
+	go pass_through(to_server)
+	go pass_through(to_client)
+
+	go func() {
+		client.Write(request)
+		client.CloseWrite()
+	}()
+	got, err := io.ReadAll(server)
+	if err != nil || !bytes.Equal(got, request) {
+		t.Fatalf("the server got %d bytes of %d, %v", len(got), len(request), err)
+	}
+	select {
+	case <-to_server.ack:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client to server pass_through didn't finish")
+	}
+	go func() {
+		server.Write(response)
+		server.CloseWrite()
+	}()
+	if got, err = io.ReadAll(client); err != nil || !bytes.Equal(got, response) {
+		t.Errorf("the client got %d bytes of %d after its half-close, %v", len(got), len(response), err)
+	}
+	select {
+	case <-to_client.ack:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server to client pass_through didn't finish")
+	}
+	to_server_sink.stop(to_server)
+	to_client_sink.stop(to_client)
+	for _, sink := range []*channel_sink{to_server_sink, to_client_sink} {
+		if e := sink.events[len(sink.events)-1]; e.Event != "disconnected" || !strings.Contains(e.Message, "half-closed") {
+			t.Errorf("ended with %s %q, want a half-close", e.Event, e.Message)
+		}
+	}
+	client.Close()
+	server.Close()
+}
@@ -0,0 +1,169 @@
+/*
+pcap capture output.
+
+Each connection can additionally be written as a classic libpcap file
+that Wireshark and tshark open directly. The link type is LINKTYPE_RAW,
+so every record is a synthesised IP header, a TCP header whose sequence
+numbers follow the bytes seen so far, and the payload.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var pcap_output *bool = flag.Bool("pcap", false, "also write each connection as a pcap file")
+
+const (
+	pcap_magic      = 0xa1b2c3d4
+	pcap_snaplen    = 65535
+	linktype_raw    = 101
+	tcp_flags_ack   = 0x10
+	tcp_flags_psh   = 0x08
+	tcp_header_size = 20
+)
+
+type tcp_endpoint struct {
+	ip   net.IP
+	port uint16
+	seq  uint32
+}
+
+// Writes one connection as a pcap stream
+type PCAPWriter struct {
+	w              io.Writer
+	mu             sync.Mutex // both pass_through goroutines write
+	client, server tcp_endpoint
+}
+
+func NewPCAPWriter(w io.Writer, client, server net.Addr) *PCAPWriter {
+	return &PCAPWriter{
+		w:      w,
+		client: new_tcp_endpoint(client),
+		server: new_tcp_endpoint(server),
+	}
+}
+
+func new_tcp_endpoint(a net.Addr) tcp_endpoint {
+	e := tcp_endpoint{ip: net.IPv4zero}
+	if t, ok := a.(*net.TCPAddr); ok {
+		e.ip, e.port = t.IP, uint16(t.Port)
+	}
+	if ip4 := e.ip.To4(); ip4 != nil {
+		e.ip = ip4
+	}
+	return e
+}
+
+func (p *PCAPWriter) WriteGlobalHeader() error {
+	h := make([]byte, 24)
+	binary.LittleEndian.PutUint32(h[0:], pcap_magic)
+	binary.LittleEndian.PutUint16(h[4:], 2) // version 2.4
+	binary.LittleEndian.PutUint16(h[6:], 4)
+	binary.LittleEndian.PutUint32(h[16:], pcap_snaplen)
+	binary.LittleEndian.PutUint32(h[20:], linktype_raw)
+	_, err := p.w.Write(h)
+	return err
+}
+
+// Appends one packet. Each record goes out in a single Write so the file
+// stays readable even if the process dies mid-session.
+func (p *PCAPWriter) WritePacket(direction string, data []byte, ts time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	src, dst := &p.client, &p.server
+	if direction == server_to_client {
+		src, dst = dst, src
+	}
+	if len(data) > pcap_snaplen-60 {
+		data = data[:pcap_snaplen-60]
+	}
+
+	tcp := make([]byte, tcp_header_size+len(data))
+	binary.BigEndian.PutUint16(tcp[0:], src.port)
+	binary.BigEndian.PutUint16(tcp[2:], dst.port)
+	binary.BigEndian.PutUint32(tcp[4:], src.seq)
+	binary.BigEndian.PutUint32(tcp[8:], dst.seq)
+	tcp[12] = (tcp_header_size / 4) << 4
+	tcp[13] = tcp_flags_psh | tcp_flags_ack
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[tcp_header_size:], data)
+	src.seq += uint32(len(data))
+
+	var ip []byte
+	if src.ip.To4() != nil && dst.ip.To4() != nil {
+		ip = ipv4_header(src.ip.To4(), dst.ip.To4(), len(tcp))
+		binary.BigEndian.PutUint16(tcp[16:], tcp_checksum(checksum_ipv4_pseudo(ip), tcp))
+	} else {
+		ip = ipv6_header(src.ip.To16(), dst.ip.To16(), len(tcp))
+		binary.BigEndian.PutUint16(tcp[16:], tcp_checksum(checksum_ipv6_pseudo(ip), tcp))
+	}
+
+	rec := make([]byte, 16, 16+len(ip)+len(tcp))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(ip)+len(tcp)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(ip)+len(tcp)))
+	rec = append(append(rec, ip...), tcp...)
+	_, err := p.w.Write(rec)
+	return err
+}
+
+func ipv4_header(src, dst net.IP, payload int) []byte {
+	h := make([]byte, 20)
+	h[0] = 0x45 // version 4, 5 words
+	binary.BigEndian.PutUint16(h[2:], uint16(20+payload))
+	h[6] = 0x40 // don't fragment
+	h[8] = 64   // TTL
+	h[9] = 6    // TCP
+	copy(h[12:], src)
+	copy(h[16:], dst)
+	binary.BigEndian.PutUint16(h[10:], ^checksum_add(0, h))
+	return h
+}
+
+func ipv6_header(src, dst net.IP, payload int) []byte {
+	h := make([]byte, 40)
+	h[0] = 0x60
+	binary.BigEndian.PutUint16(h[4:], uint16(payload))
+	h[6] = 6 // next header TCP
+	h[7] = 64
+	copy(h[8:], src)
+	copy(h[24:], dst)
+	return h
+}
+
+func checksum_ipv4_pseudo(ip []byte) uint32 {
+	sum := uint32(checksum_add(0, ip[12:20]))
+	return sum + 6 + uint32(binary.BigEndian.Uint16(ip[2:])) - 20
+}
+
+func checksum_ipv6_pseudo(ip []byte) uint32 {
+	sum := uint32(checksum_add(0, ip[8:40]))
+	return sum + 6 + uint32(binary.BigEndian.Uint16(ip[4:]))
+}
+
+func tcp_checksum(pseudo uint32, tcp []byte) uint16 {
+	return ^checksum_add(pseudo, tcp)
+}
+
+// One's complement sum over 16 bit words, folded to 16 bits
+func checksum_add(sum uint32, b []byte) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Packets written by PCAPWriter read back through the reader and TCP
+// decoding of -capture-file, checksums included
+func TestPCAPRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name           string
+		client, server *net.TCPAddr
+	}{
+		{"IPv4", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}, &net.TCPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 80}},
+		{"IPv6", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 50000}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			packets := []struct {
+				direction string
+				data      []byte
+			}{
+				{client_to_server, []byte("GET / HTTP/1.1\r\n\r\n")},
+				{server_to_client, []byte("HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\n")},
+				{server_to_client, []byte("odd")}, // an odd length for the checksum
+				{client_to_server, random_bytes(1400)},
+			}
+			var buf bytes.Buffer
+			w := NewPCAPWriter(&buf, tt.client, tt.server)
+			if err := w.WriteGlobalHeader(); err != nil {
+				t.Fatal(err)
+			}
+			start := time.Date(2026, 1, 2, 3, 4, 5, 678000, time.UTC)
+			for i, p := range packets {
+				w.WritePacket(p.direction, p.data, start.Add(time.Duration(i)*time.Millisecond))
+			}
+
+			src, err := open_pcap_file(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if src.LinkType() != linktype_raw {
+				t.Errorf("link type %d, want %d", src.LinkType(), linktype_raw)
+			}
+			seq := map[string]uint32{}
+			for i, p := range packets {
+				frame, ts, err := src.ReadPacket()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := start.Add(time.Duration(i) * time.Millisecond); !ts.Equal(want) {
+					t.Errorf("packet %d at %s, want %s", i, ts, want)
+				}
+				s, ok := decode_tcp_segment(src.LinkType(), frame)
+				if !ok {
+					t.Fatalf("packet %d is not a TCP segment", i)
+				}
+				from, to := tt.client, tt.server
+				if p.direction == server_to_client {
+					from, to = to, from
+				}
+				if s.src.String() != from.String() || s.dst.String() != to.String() {
+					t.Errorf("packet %d from %s to %s, want %s to %s", i, s.src, s.dst, from, to)
+				}
+				if s.seq != seq[p.direction] || !bytes.Equal(s.payload, p.data) {
+					t.Errorf("packet %d: seq %d and %d bytes, want seq %d and %d bytes", i, s.seq, len(s.payload), seq[p.direction], len(p.data))
+				}
+				seq[p.direction] += uint32(len(p.data))
+				check_pcap_checksums(t, frame)
+			}
+			if _, _, err := src.ReadPacket(); err != io.EOF {
+				t.Errorf("after the last packet: %v, want EOF", err)
+			}
+		})
+	}
+}
+
+// A correct one's complement checksum sums to 0xffff with itself included
+func check_pcap_checksums(t *testing.T, frame []byte) {
+	var pseudo uint32
+	tcp := frame[40:]
+	if frame[0]>>4 == 4 {
+		if sum := checksum_add(0, frame[:20]); sum != 0xffff {
+			t.Errorf("IPv4 header checksum off, sums to %#x", sum)
+		}
+		pseudo, tcp = checksum_ipv4_pseudo(frame), frame[20:]
+	} else {
+		pseudo = checksum_ipv6_pseudo(frame)
+	}
+	if sum := checksum_add(pseudo, tcp); sum != 0xffff {
+		t.Errorf("TCP checksum off, sums to %#x", sum)
+	}
+}
+
+// Keeps each Write of a PCAPWriter, one record per packet
+type pcap_records [][]byte
+
+func (r *pcap_records) Write(b []byte) (int, error) {
+	*r = append(*r, bytes.Clone(b))
+	return len(b), nil
+}
+
+// A capture with a segment that came early and one sent twice is logged
+// as the two streams the connection carried, in order
+func TestCapturerPlayback(t *testing.T) {
+	saved_dir, saved_store := *output_dir, log_store
+	t.Cleanup(func() { *output_dir, log_store = saved_dir, saved_store })
+	*output_dir = t.TempDir()
+	store := NewMemoryBackend()
+	log_store = store
+	init_log_names()
+
+	client, server := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}, &net.TCPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 80}
+	var records pcap_records
+	w := NewPCAPWriter(&records, client, server)
+	w.WriteGlobalHeader()
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i, p := range []struct {
+		direction, data string
+	}{
+		{client_to_server, "GET / HTTP/1.1\r\n\r\n"},
+		{server_to_client, "HTTP/1.1 200 OK\r\n"},
+		{server_to_client, "Content-Length: 3\r\n\r\n"},
+		{server_to_client, "odd"},
+		{client_to_server, "GET /again HTTP/1.1\r\n\r\n"},
+	} {
+		w.WritePacket(p.direction, []byte(p.data), start.Add(time.Duration(i)*time.Millisecond))
+	}
+	// the body before the headers, and the first request again
+	file := bytes.Join([][]byte{records[0], records[1], records[2], records[4], records[3], records[1], records[5]}, nil)
+	src, err := open_pcap_file(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCapturer(context.Background(), &mapping{log_prefix: filepath.Join(*output_dir, "log")})
+	if err := c.Run(src); err != nil {
+		t.Fatal(err)
+	}
+	backend_loggers.Wait()
+
+	var kinds []string
+	var from_client, from_server string
+	for _, e := range store.Events() {
+		if len(kinds) == 0 || kinds[len(kinds)-1] != e.Event {
+			kinds = append(kinds, e.Event)
+		}
+		switch {
+		case e.Event == "connected" && e.Message != "Captured connection from 192.0.2.1:50000 to 198.51.100.7:80, already open, at "+format_time(start):
+			t.Errorf("connected as %q", e.Message)
+		case e.Event == "received" && e.Direction == client_to_server:
+			from_client += string(e.Raw)
+		case e.Event == "received":
+			from_server += string(e.Raw)
+		case e.Event == "finished" && !strings.Contains(e.Message, "still open when the capture ended"):
+			t.Errorf("finished as %q", e.Message)
+		}
+	}
+	if c.conn_n != 1 || len(kinds) == 0 || kinds[0] != "connected" || kinds[len(kinds)-1] != "finished" {
+		t.Errorf("%d connections, events %v", c.conn_n, kinds)
+	}
+	if want := "GET / HTTP/1.1\r\n\r\nGET /again HTTP/1.1\r\n\r\n"; from_client != want {
+		t.Errorf("the client sent %q, want %q", from_client, want)
+	}
+	if want := "HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\nodd"; from_server != want {
+		t.Errorf("the server sent %q, want %q", from_server, want)
+	}
+}
@@ -0,0 +1,75 @@
+/*
+PID file (-pid-file).
+
+The process ID is written to the file as a decimal line when gotcpspy
+starts, and the file is removed again when it shuts down cleanly. A file
+left behind by a gotcpspy that is still running stops a second one from
+starting; one whose process is gone is simply replaced.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var pid_file *string = flag.String("pid-file", "", "write the process ID to this file, removed on shutdown")
+
+// Reads the PID in path, 0 if there is no file or no number in it
+func read_pid_file(path string) int {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	return pid
+}
+
+// Signal 0 checks that the process exists without disturbing it;
+// EPERM means it runs as somebody else
+func process_running(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Writes this process's PID to path, unless it names one still running
+func WritePIDFile(path string) error {
+	if pid := read_pid_file(path); pid != 0 && pid != os.Getpid() && process_running(pid) {
+		return fmt.Errorf("%s belongs to PID %d, which is still running", path, pid)
+	}
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// Removes path if it still holds this process's PID
+func RemovePIDFile(path string) {
+	if read_pid_file(path) != os.Getpid() {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to remove the PID file, %v\n", err)
+	}
+}
+
+func write_pid_file() {
+	if *pid_file == "" {
+		return
+	}
+	if err := WritePIDFile(*pid_file); err != nil {
+		die("Refusing to start, %v", err)
+	}
+}
+
+func remove_pid_file() {
+	if *pid_file != "" {
+		RemovePIDFile(*pid_file)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gotcpspy.pid")
+	if err := WritePIDFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != strconv.Itoa(os.Getpid())+"\n" {
+		t.Errorf("the file holds %q, want PID %d", b, os.Getpid())
+	}
+	if err := WritePIDFile(path); err != nil { // our own PID is no reason to stop
+		t.Errorf("writing it again: %v", err)
+	}
+	RemovePIDFile(path)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("still there after RemovePIDFile, %v", err)
+	}
+}
+
+// A PID of a process that still runs stops the start and is left alone;
+// one of a process that is gone is replaced
+func TestPIDFileOtherProcess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gotcpspy.pid")
+	running := strconv.Itoa(os.Getppid()) + "\n"
+	os.WriteFile(path, []byte(running), 0644)
+	if err := WritePIDFile(path); err == nil || !strings.Contains(err.Error(), "still running") {
+		t.Errorf("started next to PID %s: %v", strings.TrimSpace(running), err)
+	}
+	RemovePIDFile(path)
+	if b, _ := os.ReadFile(path); string(b) != running {
+		t.Errorf("the file of the running process now holds %q", b)
+	}
+
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip(err)
+	}
+	os.WriteFile(path, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0644)
+	if err := WritePIDFile(path); err != nil {
+		t.Errorf("the file of a process that exited: %v", err)
+	}
+	if read_pid_file(path) != os.Getpid() {
+		t.Errorf("the file of a process that exited wasn't replaced")
+	}
+}
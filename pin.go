@@ -0,0 +1,98 @@
+/*
+Certificate pinning for the target (-pin-sha256, -pin-ca).
+
+In TLS mode the target's certificate can be pinned by the SHA-256
+fingerprint of its DER encoding, the same value as
+
+	openssl x509 -in cert.pem -noout -fingerprint -sha256
+
+-pin-sha256 pins the leaf certificate, -pin-ca any certificate above it
+in the chain the target presents. Both may be repeated or comma
+separated, and colons in the fingerprints are optional. A target that
+matches none of the pins is disconnected, even with -tls-skip-verify.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Repeated fingerprint flags, normalized to lower case hex
+type pin_flags []string
+
+func (f *pin_flags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *pin_flags) Set(value string) error {
+	for _, pin := range strings.Split(value, ",") {
+		pin = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(pin), ":", ""))
+		if b, err := hex.DecodeString(pin); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("%q is not a hex SHA-256 fingerprint", pin)
+		}
+		*f = append(*f, pin)
+	}
+	return nil
+}
+
+var leaf_pins, ca_pins pin_flags
+
+func init() {
+	flag.Var(&leaf_pins, "pin-sha256", "SHA-256 fingerprint the target's certificate must have with -tls, may be repeated")
+	flag.Var(&ca_pins, "pin-ca", "SHA-256 fingerprint of a CA that must be in the target's chain with -tls, may be repeated")
+}
+
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func (f pin_flags) match(certs []*x509.Certificate) bool {
+	for _, cert := range certs {
+		fp := fingerprint(cert)
+		for _, pin := range f {
+			if fp == pin {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Checks the target's certificates against the pins, if there are any
+func check_pins(state tls.ConnectionState, server_name string) error {
+	if len(leaf_pins) == 0 && len(ca_pins) == 0 {
+		return nil
+	}
+	certs := state.PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("target sent no certificate to check the pins against")
+	}
+	if len(leaf_pins) > 0 && !leaf_pins.match(certs[:1]) {
+		fmt.Fprintf(os.Stderr, "Certificate of %s is not pinned, its SHA-256 fingerprint is %s\n",
+			server_name, fingerprint(certs[0]))
+		return errors.New("target certificate does not match -pin-sha256")
+	}
+	if len(ca_pins) > 0 && !ca_pins.match(certs[1:]) {
+		var fps []string
+		for _, cert := range certs[1:] {
+			fps = append(fps, fingerprint(cert)+" ("+cert.Subject.CommonName+")")
+		}
+		if fps == nil {
+			fps = []string{"none, only the leaf was sent"}
+		}
+		fmt.Fprintf(os.Stderr, "No pinned CA in the chain of %s, its CA fingerprints are %s\n",
+			server_name, strings.Join(fps, ", "))
+		return errors.New("target certificate chain does not match -pin-ca")
+	}
+	return nil
+}
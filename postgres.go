@@ -0,0 +1,445 @@
+/*
+PostgreSQL wire protocol decoding for the connection log (-proto postgres).
+
+Every message after the first is a type byte and a 4 byte length. The
+client's first message has no type byte: it is the startup message, or
+an SSLRequest/GSSENCRequest that the server answers with the single byte
+'S' or 'N' before the real startup follows. After an 'S' the connection
+is TLS and the log falls back to the hex dump (use -tls to see inside).
+
+Queries, the extended protocol (Parse/Bind/Execute), row descriptions,
+data rows, command completions and errors are decoded; other messages
+are logged with their type and length only. Column values are shortened
+to pg_max_value bytes.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	pg_max_message = 64 << 20
+	pg_max_value   = 64
+
+	pg_ssl_request  = 80877103
+	pg_gss_request  = 80877104
+	pg_cancel       = 80877102
+	pg_auth_ok      = 0
+	pg_auth_sasl    = 10
+	pg_auth_md5     = 5
+	pg_auth_clear   = 3
+	pg_auth_sasl_ok = 12
+)
+
+var pg_frontend_messages = map[byte]string{
+	'Q': "Query", 'P': "Parse", 'B': "Bind", 'E': "Execute", 'D': "Describe",
+	'S': "Sync", 'H': "Flush", 'C': "Close", 'X': "Terminate", 'p': "Password",
+	'F': "FunctionCall", 'd': "CopyData", 'c': "CopyDone", 'f': "CopyFail",
+}
+
+var pg_backend_messages = map[byte]string{
+	'R': "Authentication", 'S': "ParameterStatus", 'K': "BackendKeyData",
+	'Z': "ReadyForQuery", 'T': "RowDescription", 'D': "DataRow",
+	'C': "CommandComplete", 'E': "ErrorResponse", 'N': "NoticeResponse",
+	'1': "ParseComplete", '2': "BindComplete", '3': "CloseComplete",
+	'n': "NoData", 't': "ParameterDescription", 's': "PortalSuspended",
+	'I': "EmptyQueryResponse", 'A': "NotificationResponse", 'V': "FunctionCallResponse",
+	'G': "CopyInResponse", 'H': "CopyOutResponse", 'W': "CopyBothResponse",
+	'd': "CopyData", 'c': "CopyDone", 'v': "NegotiateProtocolVersion",
+}
+
+// Field codes of ErrorResponse and NoticeResponse
+var pg_error_fields = map[byte]string{
+	'S': "severity", 'V': "severity", 'C': "code", 'M': "message", 'D': "detail",
+	'H': "hint", 'P': "position", 'W': "where", 's': "schema", 't': "table",
+	'c': "column", 'n': "constraint", 'F': "file", 'L': "line", 'R': "routine",
+}
+
+type PostgresRecord struct {
+	Type      string            `json:"type"` // the type byte, empty for untyped messages
+	Name      string            `json:"name"`
+	Length    int               `json:"length"`
+	Query     string            `json:"query,omitempty"`
+	Statement string            `json:"statement,omitempty"`
+	Portal    string            `json:"portal,omitempty"`
+	Params    map[string]string `json:"params,omitempty"` // startup, ParameterStatus
+	Values    []string          `json:"values,omitempty"` // Bind parameters, DataRow columns
+	Columns   []string          `json:"columns,omitempty"`
+	Tag       string            `json:"tag,omitempty"`    // CommandComplete
+	Fields    map[string]string `json:"fields,omitempty"` // ErrorResponse, NoticeResponse
+	Detail    string            `json:"detail,omitempty"` // anything else worth a word
+}
+
+// Decodes one direction of a connection; the first message of each side
+// is special, so the parser remembers whether it has been seen
+type PostgreSQLParser struct {
+	started bool
+}
+
+// Reads the type byte (if any), the length and the body of a message
+func pg_read(r *bufio.Reader, typed bool) (byte, []byte, error) {
+	var kind byte
+	if typed {
+		var err error
+		if kind, err = r.ReadByte(); err != nil {
+			return 0, nil, err
+		}
+	}
+	var h [4]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(binary.BigEndian.Uint32(h[:]))
+	if n < 4 || n > pg_max_message {
+		return 0, nil, fmt.Errorf("PostgreSQL message length %d", n)
+	}
+	body := make([]byte, n-4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return kind, body, nil
+}
+
+// Walks a message body
+type pg_reader struct {
+	b   []byte
+	err error
+}
+
+func (r *pg_reader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || len(r.b) < n {
+		r.err = errors.New("PostgreSQL message too short")
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *pg_reader) int16() int {
+	if b := r.bytes(2); b != nil {
+		return int(int16(binary.BigEndian.Uint16(b)))
+	}
+	return 0
+}
+
+func (r *pg_reader) int32() int {
+	if b := r.bytes(4); b != nil {
+		return int(int32(binary.BigEndian.Uint32(b)))
+	}
+	return 0
+}
+
+// NUL terminated string
+func (r *pg_reader) cstring() string {
+	if r.err != nil {
+		return ""
+	}
+	i := strings.IndexByte(string(r.b), 0)
+	if i < 0 {
+		r.err = errors.New("PostgreSQL string without terminator")
+		return ""
+	}
+	s := string(r.b[:i])
+	r.b = r.b[i+1:]
+	return s
+}
+
+// A length prefixed value as it should appear in the log
+func (r *pg_reader) value() string {
+	n := r.int32()
+	if n == -1 {
+		return "NULL"
+	}
+	b := r.bytes(n)
+	if r.err != nil {
+		return ""
+	}
+	short := len(b) > pg_max_value
+	if short {
+		b = b[:pg_max_value]
+	}
+	var s string
+	if utf8.Valid(b) {
+		s = string(b)
+	} else {
+		s = `\x` + hex.EncodeToString(b)
+	}
+	if short {
+		s += fmt.Sprintf("...(%d bytes)", n)
+	}
+	return s
+}
+
+func (p *PostgreSQLParser) ParseFrontend(r *bufio.Reader) (*PostgresRecord, error) {
+	if !p.started {
+		_, body, err := pg_read(r, false)
+		if err != nil {
+			return nil, err
+		}
+		return p.startup(body)
+	}
+	kind, body, err := pg_read(r, true)
+	if err != nil {
+		return nil, err
+	}
+	rec := &PostgresRecord{Type: string(kind), Name: pg_frontend_messages[kind], Length: len(body) + 4}
+	if rec.Name == "" {
+		return nil, fmt.Errorf("unknown PostgreSQL frontend message %q", kind)
+	}
+	m := &pg_reader{b: body}
+	switch kind {
+	case 'Q':
+		rec.Query = m.cstring()
+	case 'P':
+		rec.Statement = m.cstring()
+		rec.Query = m.cstring()
+		if types := m.int16(); types > 0 {
+			rec.Detail = fmt.Sprintf("%d parameter types", types)
+		}
+	case 'B':
+		rec.Portal = m.cstring()
+		rec.Statement = m.cstring()
+		m.bytes(2 * m.int16()) // parameter formats
+		for i, n := 0, m.int16(); i < n && m.err == nil; i++ {
+			rec.Values = append(rec.Values, m.value())
+		}
+	case 'E':
+		rec.Portal = m.cstring()
+		if rows := m.int32(); rows > 0 {
+			rec.Detail = fmt.Sprintf("at most %d rows", rows)
+		}
+	case 'D', 'C':
+		what := m.bytes(1)
+		if m.err == nil && what[0] == 'S' {
+			rec.Statement = m.cstring()
+		} else {
+			rec.Portal = m.cstring()
+		}
+	}
+	return rec, m.err
+}
+
+// The untyped first message(s) of the client
+func (p *PostgreSQLParser) startup(body []byte) (*PostgresRecord, error) {
+	rec := &PostgresRecord{Length: len(body) + 4}
+	m := &pg_reader{b: body}
+	switch code := m.int32(); code {
+	case pg_ssl_request:
+		rec.Name = "SSLRequest" // another startup message may follow
+	case pg_gss_request:
+		rec.Name = "GSSENCRequest"
+	case pg_cancel:
+		rec.Name = "CancelRequest"
+		rec.Detail = fmt.Sprintf("backend %d", m.int32())
+		p.started = true
+	default:
+		if code>>16 != 3 {
+			return nil, fmt.Errorf("unsupported PostgreSQL protocol %d.%d", code>>16, code&0xffff)
+		}
+		rec.Name = "StartupMessage"
+		rec.Params = make(map[string]string)
+		for m.err == nil && len(m.b) > 1 {
+			k := m.cstring()
+			rec.Params[k] = m.cstring()
+		}
+		p.started = true
+	}
+	return rec, m.err
+}
+
+func (p *PostgreSQLParser) ParseBackend(r *bufio.Reader) (*PostgresRecord, error) {
+	if !p.started {
+		// Only the answer to SSLRequest/GSSENCRequest can come first
+		// with one of these, a real first message is Authentication
+		b, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == 'S' || b[0] == 'N' {
+			r.ReadByte()
+			rec := &PostgresRecord{Name: "EncryptionResponse", Length: 1, Detail: "accepted"}
+			if b[0] == 'N' {
+				rec.Detail = "refused"
+			}
+			return rec, nil
+		}
+		p.started = true
+	}
+	kind, body, err := pg_read(r, true)
+	if err != nil {
+		return nil, err
+	}
+	rec := &PostgresRecord{Type: string(kind), Name: pg_backend_messages[kind], Length: len(body) + 4}
+	if rec.Name == "" {
+		return nil, fmt.Errorf("unknown PostgreSQL backend message %q", kind)
+	}
+	m := &pg_reader{b: body}
+	switch kind {
+	case 'R':
+		switch auth := m.int32(); auth {
+		case pg_auth_ok:
+			rec.Detail = "ok"
+		case pg_auth_clear:
+			rec.Detail = "cleartext password"
+		case pg_auth_md5:
+			rec.Detail = "MD5 password"
+		case pg_auth_sasl:
+			var mechanisms []string
+			for m.err == nil && len(m.b) > 1 {
+				mechanisms = append(mechanisms, m.cstring())
+			}
+			rec.Detail = "SASL " + strings.Join(mechanisms, ", ")
+		case pg_auth_sasl_ok:
+			rec.Detail = "SASL final"
+		default:
+			rec.Detail = fmt.Sprintf("method %d", auth)
+		}
+		m.b = nil
+	case 'S':
+		k := m.cstring()
+		rec.Params = map[string]string{k: m.cstring()}
+	case 'Z':
+		rec.Detail = string(m.bytes(1)) // I idle, T in transaction, E failed transaction
+	case 'T':
+		for i, n := 0, m.int16(); i < n && m.err == nil; i++ {
+			rec.Columns = append(rec.Columns, m.cstring())
+			m.bytes(18) // table OID, column, type OID, size, modifier, format
+		}
+	case 'D':
+		for i, n := 0, m.int16(); i < n && m.err == nil; i++ {
+			rec.Values = append(rec.Values, m.value())
+		}
+	case 'C':
+		rec.Tag = m.cstring()
+	case 'E', 'N':
+		rec.Fields = make(map[string]string)
+		for m.err == nil && len(m.b) > 1 {
+			code := m.bytes(1)[0]
+			name := pg_error_fields[code]
+			if name == "" {
+				name = string(code)
+			}
+			rec.Fields[name] = m.cstring()
+		}
+	}
+	return rec, m.err
+}
+
+// Parsers for both directions of one PostgreSQL connection
+func new_postgres_parsers(conn_n int, logger chan *LogEvent, client_peer, server_peer string) (request, response *StreamParser) {
+	frontend, backend := &PostgreSQLParser{}, &PostgreSQLParser{}
+	latency := NewLatencyTracker()
+	request = NewStreamParser(conn_n, client_to_server, client_peer, logger, decode_postgres(frontend.ParseFrontend, pg_request_latency(latency)))
+	response = NewStreamParser(conn_n, server_to_client, server_peer, logger, decode_postgres(backend.ParseBackend, pg_response_latency(latency)))
+	return
+}
+
+// Sees every message of one direction when it started, returns the
+// latency for the event
+type pg_latency_func func(rec *PostgresRecord, start time.Time) float64
+
+func decode_postgres(parse func(r *bufio.Reader) (*PostgresRecord, error), measure pg_latency_func) decode_func {
+	return func(r *bufio.Reader) (*LogEvent, error) {
+		if _, err := r.Peek(1); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		rec, err := parse(r)
+		if err != nil {
+			return nil, err
+		}
+		return &LogEvent{Event: "postgres_message", Length: rec.Length, Postgres: rec, LatencyMS: measure(rec, start)}, nil
+	}
+}
+
+// A Query or a Sync each gets one run of backend messages ending with
+// ReadyForQuery
+func pg_request_latency(latency *LatencyTracker) pg_latency_func {
+	seq := 0
+	return func(rec *PostgresRecord, start time.Time) float64 {
+		if rec.Type == "Q" || rec.Type == "S" {
+			latency.Request(seq, time.Now())
+			seq++
+		}
+		return 0
+	}
+}
+
+// The first ReadyForQuery ends the startup, after that each run starts
+// with its first message other than the asynchronous ParameterStatus,
+// NoticeResponse and NotificationResponse
+func pg_response_latency(latency *LatencyTracker) pg_latency_func {
+	ready, answering := false, false
+	seq := 0
+	return func(rec *PostgresRecord, start time.Time) float64 {
+		if !ready {
+			ready = rec.Type == "Z"
+			return 0
+		}
+		var ms float64
+		if !answering && rec.Type != "S" && rec.Type != "N" && rec.Type != "A" {
+			ms = latency.Response(seq, start)
+			seq++
+			answering = true
+		}
+		if rec.Type == "Z" {
+			answering = false
+		}
+		return ms
+	}
+}
+
+func format_postgres(e *LogEvent) string {
+	rec := e.Postgres
+	var b strings.Builder
+	fmt.Fprintf(&b, "PostgreSQL %s", rec.Name)
+	if rec.Type != "" {
+		fmt.Fprintf(&b, " (%s)", rec.Type)
+	}
+	fmt.Fprintf(&b, " from %s, %d bytes", e.Peer, rec.Length)
+	if rec.Statement != "" {
+		fmt.Fprintf(&b, ", statement %q", rec.Statement)
+	}
+	if rec.Portal != "" {
+		fmt.Fprintf(&b, ", portal %q", rec.Portal)
+	}
+	if rec.Tag != "" {
+		fmt.Fprintf(&b, ": %s", rec.Tag)
+	}
+	if rec.Detail != "" {
+		fmt.Fprintf(&b, ": %s", rec.Detail)
+	}
+	b.WriteString("\n")
+	if rec.Query != "" {
+		b.WriteString(rec.Query + "\n")
+	}
+	for _, m := range []map[string]string{rec.Params, rec.Fields} {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&b, "%s: %s\n", k, m[k])
+		}
+	}
+	if rec.Columns != nil {
+		b.WriteString("columns: " + strings.Join(rec.Columns, ", ") + "\n")
+	}
+	if rec.Values != nil {
+		fmt.Fprintf(&b, "%d values: %s\n", len(rec.Values), strings.Join(rec.Values, ", "))
+	}
+	return b.String()
+}
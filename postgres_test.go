@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A psql session that is refused TLS, runs a simple query, a prepared
+// one through the extended protocol and a query that fails, message by
+// message as captured off the wire
+var pg_frontend_capture = []struct {
+	hex  string
+	want PostgresRecord
+}{
+	{"0000000804d2162f", PostgresRecord{Name: "SSLRequest", Length: 8}},
+	{"0000003b000300007573657200706f7374677265730064617461626173650074657374006170706c69636174696f6e5f6e616d65007073716c0000",
+		PostgresRecord{Name: "StartupMessage", Length: 59, Params: map[string]string{"user": "postgres", "database": "test", "application_name": "psql"}}},
+	{"510000002253454c4543542031204153206f6e652c204e554c4c2041532074776f3b00",
+		PostgresRecord{Type: "Q", Name: "Query", Length: 34, Query: "SELECT 1 AS one, NULL AS two;"}},
+	{"500000001c73310053454c4543542024313a3a696e7400000100000017",
+		PostgresRecord{Type: "P", Name: "Parse", Length: 28, Statement: "s1", Query: "SELECT $1::int", Detail: "1 parameter types"}},
+	{"420000001400733100000100000001000000023432",
+		PostgresRecord{Type: "B", Name: "Bind", Length: 20, Statement: "s1", Values: []string{"42"}}},
+	{"44000000065000", PostgresRecord{Type: "D", Name: "Describe", Length: 6}},
+	{"45000000090000000000", PostgresRecord{Type: "E", Name: "Execute", Length: 9}},
+	{"5300000004", PostgresRecord{Type: "S", Name: "Sync", Length: 4}},
+	{"5800000004", PostgresRecord{Type: "X", Name: "Terminate", Length: 4}},
+}
+
+var pg_backend_capture = []struct {
+	hex  string
+	want PostgresRecord
+}{
+	{"4e", PostgresRecord{Name: "EncryptionResponse", Length: 1, Detail: "refused"}},
+	{"520000000800000000", PostgresRecord{Type: "R", Name: "Authentication", Length: 8, Detail: "ok"}},
+	{"53000000187365727665725f76657273696f6e0031362e3200",
+		PostgresRecord{Type: "S", Name: "ParameterStatus", Length: 24, Params: map[string]string{"server_version": "16.2"}}},
+	{"4b0000000c0000109200003039", PostgresRecord{Type: "K", Name: "BackendKeyData", Length: 12}},
+	{"5a0000000549", PostgresRecord{Type: "Z", Name: "ReadyForQuery", Length: 5, Detail: "I"}},
+	{"540000003200026f6e6500000000000000000000170004ffffffff000074776f00000000000000000000190004ffffffff0000",
+		PostgresRecord{Type: "T", Name: "RowDescription", Length: 50, Columns: []string{"one", "two"}}},
+	{"440000000f00020000000131ffffffff", PostgresRecord{Type: "D", Name: "DataRow", Length: 15, Values: []string{"1", "NULL"}}},
+	{"430000000d53454c454354203100", PostgresRecord{Type: "C", Name: "CommandComplete", Length: 13, Tag: "SELECT 1"}},
+	{"5a0000000549", PostgresRecord{Type: "Z", Name: "ReadyForQuery", Length: 5, Detail: "I"}},
+	{"3100000004", PostgresRecord{Type: "1", Name: "ParseComplete", Length: 4}},
+	{"3200000004", PostgresRecord{Type: "2", Name: "BindComplete", Length: 4}},
+	{"540000001d0001696e743400000000000000000000170004ffffffff0000",
+		PostgresRecord{Type: "T", Name: "RowDescription", Length: 29, Columns: []string{"int4"}}},
+	{"440000000c0001000000023432", PostgresRecord{Type: "D", Name: "DataRow", Length: 12, Values: []string{"42"}}},
+	{"430000000d53454c454354203100", PostgresRecord{Type: "C", Name: "CommandComplete", Length: 13, Tag: "SELECT 1"}},
+	{"5a0000000549", PostgresRecord{Type: "Z", Name: "ReadyForQuery", Length: 5, Detail: "I"}},
+	{"450000003e534552524f5200564552524f5200433432503031004d72656c6174696f6e20226e6f70652220646f6573206e6f74206578697374005031350000",
+		PostgresRecord{Type: "E", Name: "ErrorResponse", Length: 62, Fields: map[string]string{
+			"severity": "ERROR", "code": "42P01", "message": `relation "nope" does not exist`, "position": "15"}}},
+}
+
+func pg_hex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestPostgreSQLParser(t *testing.T) {
+	var frontend, backend []byte
+	for _, m := range pg_frontend_capture {
+		frontend = append(frontend, pg_hex(t, m.hex)...)
+	}
+	for _, m := range pg_backend_capture {
+		backend = append(backend, pg_hex(t, m.hex)...)
+	}
+	for _, side := range []struct {
+		name   string
+		stream []byte
+		parse  func(*bufio.Reader) (*PostgresRecord, error)
+		want   int
+	}{
+		{"frontend", frontend, (&PostgreSQLParser{}).ParseFrontend, len(pg_frontend_capture)},
+		{"backend", backend, (&PostgreSQLParser{}).ParseBackend, len(pg_backend_capture)},
+	} {
+		r := bufio.NewReader(bytes.NewReader(side.stream))
+		for i := 0; i < side.want; i++ {
+			rec, err := side.parse(r)
+			if err != nil {
+				t.Fatalf("%s message %d: %v", side.name, i, err)
+			}
+			want := pg_frontend_capture
+			if side.name == "backend" {
+				want = pg_backend_capture
+			}
+			if !reflect.DeepEqual(*rec, want[i].want) {
+				t.Errorf("%s message %d\ngot  %+v\nwant %+v", side.name, i, *rec, want[i].want)
+			}
+		}
+		if _, err := side.parse(r); err != io.EOF {
+			t.Errorf("%s: %v after the last message, want EOF", side.name, err)
+		}
+	}
+}
+
+func TestPostgreSQLParserValues(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	row := []byte{'D', 0, 0, 0, 0, 0, 3}
+	for _, v := range [][]byte{[]byte(long), {0xde, 0xad, 0xbe, 0xef}, {}} {
+		row = append(row, byte(len(v)>>24), byte(len(v)>>16), byte(len(v)>>8), byte(len(v)))
+		row = append(row, v...)
+	}
+	row[4] = byte(len(row) - 1)
+	p := &PostgreSQLParser{started: true}
+	rec, err := p.ParseBackend(bufio.NewReader(bytes.NewReader(row)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{long[:pg_max_value] + "...(100 bytes)", `\xdeadbeef`, ""}
+	if !reflect.DeepEqual(rec.Values, want) {
+		t.Errorf("values %q, want %q", rec.Values, want)
+	}
+}
+
+func TestPostgreSQLParserErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		hex      string
+		frontend bool
+		started  bool
+	}{
+		{"protocol 2", "0000000800020000", true, false},
+		{"length below 4", "5100000003", true, true},
+		{"unknown frontend type", "7a00000004", true, true},
+		{"unknown backend type", "7a00000004", false, true},
+		{"unterminated query", "5100000006414200", true, false},
+		{"query without its NUL", "510000000641424344", true, true},
+		{"DataRow past the end", "440000000a00010000000531", false, true},
+	} {
+		p := &PostgreSQLParser{started: tt.started}
+		parse := p.ParseBackend
+		if tt.frontend {
+			parse = p.ParseFrontend
+		}
+		if rec, err := parse(bufio.NewReader(bytes.NewReader(pg_hex(t, tt.hex)))); err == nil {
+			t.Errorf("%s: %s was accepted as %+v", tt.name, tt.hex, rec)
+		}
+	}
+}
+
+// The whole session through the connection's parsers, a few bytes at a
+// time; the first reply to the Query and to the Sync get a latency, the
+// startup and the unanswered error don't
+func TestDecodePostgresStream(t *testing.T) {
+	saved := *measure_latency
+	t.Cleanup(func() { *measure_latency = saved })
+	*measure_latency = true
+	var frontend, backend []byte
+	for _, m := range pg_frontend_capture {
+		frontend = append(frontend, pg_hex(t, m.hex)...)
+	}
+	for _, m := range pg_backend_capture {
+		backend = append(backend, pg_hex(t, m.hex)...)
+	}
+	for _, chunk := range []int{1, 5, 1 << 20} {
+		logger := make(chan *LogEvent)
+		request, response := new_postgres_parsers(1, logger, "127.0.0.1-50000", "127.0.0.1-5432")
+		events := feed_parsers(t, logger, []*StreamParser{request, response}, [][]byte{frontend, backend}, chunk)
+		if len(events) != len(pg_frontend_capture)+len(pg_backend_capture) {
+			t.Fatalf("chunks of %d: %d events", chunk, len(events))
+		}
+		var timed []string
+		for i, e := range events {
+			if e.Postgres == nil {
+				t.Fatalf("chunks of %d: event %d is %s, the decoder gave up", chunk, i, e.Event)
+			}
+			if e.LatencyMS > 0 {
+				timed = append(timed, e.Postgres.Name)
+			}
+		}
+		if strings.Join(timed, " ") != "RowDescription ParseComplete" {
+			t.Errorf("chunks of %d: latency on %v", chunk, timed)
+		}
+		if line := format_postgres(events[2]); line != "PostgreSQL Query (Q) from 127.0.0.1-50000, 34 bytes\nSELECT 1 AS one, NULL AS two;\n" {
+			t.Errorf("chunks of %d: Query formatted as %q", chunk, line)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Profiling connections (-profile-dir).
+
+	-profile-dir profiles -profile-sample-rate 100
+
+writes, for one connection in 100, profile-<conn>-cpu.pprof with a CPU
+profile for as long as the connection lasts and, when it closes,
+profile-<conn>-heap.pprof with a heap snapshot. Look at them with
+
+	go tool pprof -tagfocus 'conn_id=^42$' gotcpspy profiles/profile-42-cpu.pprof
+
+Go has only one CPU profiler and it sees the whole process, so the
+goroutines of every connection carry a conn_id profiler label and
+-tagfocus picks out the one the file is named after (as a regexp, pprof
+takes a bare number for a range). The others come with it for
+comparison. While one connection is being profiled, the
+sampled connections that start in the meantime only get their heap
+snapshot. The heap snapshot is as of the last garbage collection, no
+collection is forced for it.
+
+The profile is streamed to the file through a pipe by a goroutine of
+its own, and stopped and written after the connection is gone, so
+profiling doesn't hold up the connection.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strconv"
+	"sync/atomic"
+)
+
+var (
+	profile_dir         *string = flag.String("profile-dir", "", "write CPU and heap profiles of connections to this directory")
+	profile_sample_rate *int    = flag.Int("profile-sample-rate", 1, "with -profile-dir, profile one connection in this many")
+)
+
+var profiled_connections atomic.Int64
+
+func init_profiling() {
+	if *profile_dir == "" {
+		return
+	}
+	if *profile_sample_rate < 1 {
+		die("-profile-sample-rate has to be at least 1")
+	}
+	if err := os.MkdirAll(*profile_dir, 0755); err != nil {
+		die("Unable to create profile directory, %v", err)
+	}
+}
+
+func profile_path(conn_n int, kind string) string {
+	return filepath.Join(*profile_dir, fmt.Sprintf("profile-%d-%s.pprof", conn_n, kind))
+}
+
+// Labels the calling goroutine, and those it starts, with conn_n and
+// starts profiling if the connection is sampled. The function returned
+// ends it once the connection is done.
+func profile_connection(conn_n int) func() {
+	if *profile_dir == "" {
+		return func() {}
+	}
+	pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), pprof.Labels("conn_id", strconv.Itoa(conn_n))))
+	if (profiled_connections.Add(1)-1)%int64(*profile_sample_rate) != 0 {
+		return func() {}
+	}
+	stop_cpu := start_cpu_profile(profile_path(conn_n, "cpu"))
+	return func() {
+		go func() {
+			stop_cpu()
+			write_heap_profile(profile_path(conn_n, "heap"))
+		}()
+	}
+}
+
+// Starts the CPU profile into path; the function returned stops it and
+// waits for the file to be written. Does nothing if another connection
+// is being profiled.
+func start_cpu_profile(path string) func() {
+	pr, pw := io.Pipe()
+	if err := pprof.StartCPUProfile(pw); err != nil {
+		return func() {}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		pprof.StopCPUProfile()
+		fmt.Fprintf(os.Stderr, "Unable to create CPU profile, %v\n", err)
+		return func() {}
+	}
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		if _, err := io.Copy(f, pr); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to write CPU profile %s, %v\n", path, err)
+		}
+		if err := f.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to write CPU profile %s, %v\n", path, err)
+		}
+	}()
+	return func() {
+		pprof.StopCPUProfile()
+		pw.Close()
+		<-written
+	}
+}
+
+func write_heap_profile(path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create heap profile, %v\n", err)
+		return
+	}
+	err = pprof.WriteHeapProfile(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write heap profile %s, %v\n", path, err)
+	}
+}
@@ -0,0 +1,138 @@
+/*
+Schema-less protobuf rendering.
+
+Without the .proto files only the wire format is known, so messages are
+shown as JSON objects keyed by field number and what the value looks
+like: "1:varint", "2:fixed64", "3:fixed32", "4:string", "5:message" or
+"6:bytes" (hex). A length-delimited field is taken for a string when it
+is printable UTF-8, else for a nested message when it parses as one.
+Repeated fields become arrays.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+const protobuf_max_depth = 16
+
+// Keeps the fields in wire order, which a map would lose
+type protobuf_object struct {
+	keys   []string
+	values map[string][]interface{}
+}
+
+func (o *protobuf_object) add(key string, v interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = append(o.values[key], v)
+}
+
+func (o *protobuf_object) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range o.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		b.Write(key)
+		b.WriteByte(':')
+		var v interface{} = o.values[k]
+		if len(o.values[k]) == 1 {
+			v = o.values[k][0]
+		}
+		value, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// Renders a serialized message as JSON
+func protobuf_json(b []byte) ([]byte, error) {
+	o, err := decode_protobuf(b, 0)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(o)
+}
+
+func decode_protobuf(b []byte, depth int) (*protobuf_object, error) {
+	if depth > protobuf_max_depth {
+		return nil, fmt.Errorf("protobuf nested too deep")
+	}
+	o := &protobuf_object{values: make(map[string][]interface{})}
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("bad protobuf tag")
+		}
+		b = b[n:]
+		field, wire := tag>>3, tag&7
+		if field == 0 {
+			return nil, fmt.Errorf("protobuf field number 0")
+		}
+		switch wire {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return nil, fmt.Errorf("bad protobuf varint")
+			}
+			o.add(fmt.Sprintf("%d:varint", field), v)
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return nil, fmt.Errorf("short protobuf fixed64")
+			}
+			o.add(fmt.Sprintf("%d:fixed64", field), binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		case 5:
+			if len(b) < 4 {
+				return nil, fmt.Errorf("short protobuf fixed32")
+			}
+			o.add(fmt.Sprintf("%d:fixed32", field), binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, fmt.Errorf("bad protobuf length")
+			}
+			v := b[n : n+int(l)]
+			b = b[n+int(l):]
+			if is_printable_utf8(v) {
+				o.add(fmt.Sprintf("%d:string", field), string(v))
+			} else if m, err := decode_protobuf(v, depth+1); err == nil && len(v) > 0 {
+				o.add(fmt.Sprintf("%d:message", field), m)
+			} else {
+				o.add(fmt.Sprintf("%d:bytes", field), hex.EncodeToString(v))
+			}
+		default: // groups are long deprecated
+			return nil, fmt.Errorf("unsupported protobuf wire type %d", wire)
+		}
+	}
+	return o, nil
+}
+
+func is_printable_utf8(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+/*
+Embedding API.
+
+A Proxy runs one mapping: it listens, accepts and handles connections
+until its context is cancelled. Hooks registered with OnConnection see
+every connection before any data moves, and can attach Loggers of their
+own that get each of its events. main runs its listeners through Proxy
+too.
+
+This is still package main, which other programs can't import: without
+a module there is no path to import a package from. Proxy is the seam
+along which the library will be split off once there is one.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+)
+
+// One proxied connection, as hooks see it
+type Session struct {
+	ID      int // connection number within the mapping
+	Client  net.Addr
+	Target  string
+	Info    *ConnectionInfo // counters and, with the API, the events
+	loggers []Logger
+}
+
+// Adds a Logger that gets every event of the session. Only takes effect
+// from within an OnConnection hook.
+func (s *Session) AddLogger(l Logger) {
+	s.loggers = append(s.loggers, l)
+}
+
+// Puts the session's loggers in front of the connection logger
+func (s *Session) tee(logger chan *LogEvent) chan *LogEvent {
+	if len(s.loggers) == 0 {
+		return logger
+	}
+	in := make(chan *LogEvent)
+	go func() {
+		for e := range in {
+			if e != nil {
+				for _, l := range s.loggers {
+					l.Log(e)
+				}
+			}
+			logger <- e
+			if e == nil {
+				return
+			}
+		}
+	}()
+	return in
+}
+
+type Proxy struct {
+	m *mapping
+}
+
+func NewProxy(m *mapping) *Proxy {
+	return &Proxy{m}
+}
+
+// Registers f to be called for every new connection, before Listen
+func (p *Proxy) OnConnection(f func(*Session)) {
+	p.m.hooks = append(p.m.hooks, f)
+}
+
+// Accepts connections until ctx is cancelled. Connections still open by
+// then go on; drain waits for them.
+func (p *Proxy) Listen(ctx context.Context) error {
+	var ln net.Listener
+	var err error
+	if unix_mode() {
+		ln, err = listen_unix(p.m.listen_addr())
+	} else {
+		ln, err = listen_config.Listen(ctx, listen_network("tcp"), p.m.listen_addr())
+	}
+	if err != nil {
+		return err
+	}
+	shutdown := make(chan bool)
+	go func() {
+		<-ctx.Done()
+		close(shutdown)
+		ln.Close()
+	}()
+	accept_loop(ln, p.m, shutdown)
+	return nil
+}
+
+// Runs the OnConnection hooks for a connection
+func (m *mapping) new_session(conn_n int, client net.Addr, target string, info *ConnectionInfo) *Session {
+	s := &Session{ID: conn_n, Client: client, Target: target, Info: info}
+	for _, hook := range m.hooks {
+		hook(s)
+	}
+	return s
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Collects the events of a session for the test
+type recording_logger struct {
+	events chan *LogEvent
+}
+
+func (l *recording_logger) Log(e *LogEvent) error {
+	l.events <- e
+	return nil
+}
+
+// Echoes every connection back until it closes
+func start_echo_server(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+func free_port(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+// Runs p until the end of the test, which waits for it to stop before
+// the flags it reads are restored
+func run_proxy(t *testing.T, p *Proxy) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		p.Listen(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// Connects to a proxy once its listener is up
+func dial_proxy(t *testing.T, port string) net.Conn {
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", port)); err == nil {
+			return conn
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal(err)
+	return nil
+}
+
+func TestProxyOnConnection(t *testing.T) {
+	init_log_names()
+	buffer_pool = NewBufferPool(*buf_size)
+	saved := *output_dir
+	t.Cleanup(func() { *output_dir = saved })
+	*output_dir = t.TempDir() // the session summary goes here
+	echo := start_echo_server(t)
+	host, port, _ := net.SplitHostPort(echo.Addr().String())
+	m := &mapping{listen_port: free_port(t), host: host, port: port, log_prefix: filepath.Join(t.TempDir(), "log")}
+
+	p := NewProxy(m)
+	rec := &recording_logger{events: make(chan *LogEvent, 64)}
+	sessions := make(chan *Session, 1)
+	p.OnConnection(func(s *Session) {
+		s.AddLogger(rec)
+		sessions <- s
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Listen(ctx)
+
+	conn := dial_proxy(t, m.listen_port)
+	conn.Write([]byte("ping"))
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("reply %q, %v", reply, err)
+	}
+	conn.Close()
+
+	s := <-sessions
+	if s.ID != 1 || s.Target != echo.Addr().String() {
+		t.Errorf("session %d to %s, want 1 to %s", s.ID, s.Target, echo.Addr())
+	}
+	seen := map[string]bool{}
+	timeout := time.After(5 * time.Second)
+	for !seen["finished"] {
+		select {
+		case e := <-rec.events:
+			seen[e.Event] = true
+			if e.Event == "received" && e.Direction == client_to_server && e.Length != 4 {
+				t.Errorf("received %d bytes from the client, want 4", e.Length)
+			}
+		case <-timeout:
+			t.Fatalf("no finished event, got %v", seen)
+		}
+	}
+	for _, name := range []string{"connected", "received", "sent", "disconnected"} {
+		if !seen[name] {
+			t.Errorf("no %s event, got %v", name, seen)
+		}
+	}
+	active_connections.Wait() // the summary is written after the finished event
+	if names, _ := filepath.Glob(filepath.Join(*output_dir, "summary-*.json")); len(names) != 1 {
+		t.Errorf("summaries %v in -output-dir, want one", names)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Token bucket rate limiter.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Refills at rate tokens per second, holding at most burst tokens
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (t *TokenBucket) refill(now time.Time) {
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.burst {
+		t.tokens = t.burst
+	}
+	t.last = now
+}
+
+// Changes the refill rate from now on
+func (t *TokenBucket) SetRate(rate float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if rate != t.rate {
+		t.refill(time.Now())
+		t.rate = rate
+	}
+}
+
+// Takes a token if one is available
+func (t *TokenBucket) Allow() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refill(time.Now())
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens -= 1
+	return true
+}
+
+// Blocks until n tokens have been taken. Requests above the burst are
+// taken in burst sized steps; tokens may go negative, which makes later
+// callers wait for the debt to be paid off.
+func (t *TokenBucket) WaitN(n int) {
+	for n > 0 {
+		take := n
+		if float64(take) > t.burst {
+			take = int(t.burst)
+		}
+		t.mu.Lock()
+		t.refill(time.Now())
+		t.tokens -= float64(take)
+		deficit := -t.tokens
+		t.mu.Unlock()
+		if deficit > 0 {
+			time.Sleep(time.Duration(deficit / t.rate * float64(time.Second)))
+		}
+		n -= take
+	}
+}
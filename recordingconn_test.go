@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// A net.Conn that reads from a script and records what is written to it,
+// to drive pass_through and the parsers without sockets. Once the script
+// is used up reads return io.EOF, or, with HoldOpen, block until the
+// connection is closed or its read deadline passes. ReadDelay slows every
+// read down, ReadSize splits the script into smaller reads, and ReadErr
+// and WriteErr make a read or write fail after a number of good ones.
+type RecordingConn struct {
+	ReadDelay     time.Duration // before each read returns
+	ReadSize      int           // at most this much per read, 0 for all that fits
+	ReadErr       error         // returned by read number ReadErrAfter+1 and after
+	ReadErrAfter  int
+	WriteErr      error // returned by write number WriteErrAfter+1 and after
+	WriteErrAfter int
+	HoldOpen      bool // block at the end of the script instead of io.EOF
+	LocalAddress  net.Addr
+	RemoteAddress net.Addr
+
+	mu            sync.Mutex
+	script        []byte
+	written       bytes.Buffer
+	reads         int
+	writes        int
+	closed        bool
+	write_closed  bool
+	read_deadline time.Time
+	wake          chan struct{} // closed and replaced to wake a blocked Read
+}
+
+// A connection whose reads return script
+func NewRecordingConn(script []byte) *RecordingConn {
+	return &RecordingConn{
+		LocalAddress:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000},
+		RemoteAddress: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80},
+		script:        script,
+		wake:          make(chan struct{}),
+	}
+}
+
+func (c *RecordingConn) Read(b []byte) (int, error) {
+	if c.ReadDelay > 0 {
+		if err := c.wait(time.After(c.ReadDelay)); err != nil {
+			return 0, err
+		}
+	}
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if c.ReadErr != nil && c.reads >= c.ReadErrAfter {
+			c.mu.Unlock()
+			return 0, c.ReadErr
+		}
+		if len(c.script) > 0 {
+			n := len(b)
+			if c.ReadSize > 0 && n > c.ReadSize {
+				n = c.ReadSize
+			}
+			n = copy(b, c.script[:min(n, len(c.script))])
+			c.script = c.script[n:]
+			c.reads += 1
+			c.mu.Unlock()
+			return n, nil
+		}
+		if !c.HoldOpen {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		c.mu.Unlock()
+		if err := c.wait(nil); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Blocks until done fires, the read deadline passes or the connection is
+// closed; only done is not an error. Feed and SetReadDeadline wake it up
+// too, to look again.
+func (c *RecordingConn) wait(done <-chan time.Time) error {
+	c.mu.Lock()
+	wake, deadline, closed := c.wake, c.read_deadline, c.closed
+	c.mu.Unlock()
+	if closed {
+		return net.ErrClosed
+	}
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		if time.Until(deadline) <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-done:
+		return nil
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	case <-wake:
+		if done != nil {
+			return c.wait(done)
+		}
+		return nil
+	}
+}
+
+// Wakes up whatever waits in Read
+func (c *RecordingConn) notify() {
+	close(c.wake)
+	c.wake = make(chan struct{})
+}
+
+// Adds to the script, for a HoldOpen connection that should get more
+func (c *RecordingConn) Feed(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.script = append(c.script, b...)
+	c.notify()
+}
+
+func (c *RecordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.write_closed {
+		return 0, net.ErrClosed
+	}
+	if c.WriteErr != nil && c.writes >= c.WriteErrAfter {
+		return 0, c.WriteErr
+	}
+	c.writes += 1
+	return c.written.Write(b)
+}
+
+func (c *RecordingConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.notify()
+	return nil
+}
+
+// The half-close of a *net.TCPConn: no more writes, reads go on
+func (c *RecordingConn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.write_closed = true
+	return nil
+}
+
+func (c *RecordingConn) LocalAddr() net.Addr  { return c.LocalAddress }
+func (c *RecordingConn) RemoteAddr() net.Addr { return c.RemoteAddress }
+
+func (c *RecordingConn) SetDeadline(t time.Time) error {
+	c.SetWriteDeadline(t)
+	return c.SetReadDeadline(t)
+}
+
+func (c *RecordingConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.read_deadline = t
+	c.notify()
+	return nil
+}
+
+// Writes never block, so there is nothing to time out
+func (c *RecordingConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Everything written so far
+func (c *RecordingConn) Written() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Clone(c.written.Bytes())
+}
+
+// How many reads returned data
+func (c *RecordingConn) Reads() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reads
+}
+
+func (c *RecordingConn) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// Whether CloseWrite was called
+func (c *RecordingConn) WriteClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.write_closed
+}
+
+var _ net.Conn = (*RecordingConn)(nil)
@@ -0,0 +1,293 @@
+/*
+Redis decoding for the connection log (-proto redis).
+
+Commands and replies are read as RESP2 values: simple strings, errors,
+integers, bulk strings and arrays, plus the inline commands redis-cli
+and telnet users type. Each one is logged as a single line, like
+
+	C→S: SET key value
+	S→C: +OK (SET)
+
+Clients may pipeline many commands before reading any reply, so the
+request side queues the command names and the response side takes them
+in order to say which command a reply belongs to. Bulk strings longer
+than -max-body are shortened in the log; a line longer than
+resp_max_line is not RESP and falls back to the hex dump.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	resp_max_depth = 32       // nested arrays
+	resp_max_line  = 64 << 10 // like Redis' proto-inline-max-size
+	resp_queue     = 1024     // pipelined commands waiting for their reply
+)
+
+type RedisRecord struct {
+	Command   []string `json:"command,omitempty"`
+	Inline    bool     `json:"inline,omitempty"`
+	Reply     string   `json:"reply,omitempty"`
+	InReplyTo string   `json:"in_reply_to,omitempty"`
+}
+
+type RESPValue struct {
+	Type      byte // '+', '-', ':', '$' or '*'
+	Str       string
+	Int       int64
+	Array     []RESPValue
+	Null      bool
+	Length    int // of a bulk string, which may be longer than Str
+	Truncated bool
+}
+
+// Reads RESP values off a buffered stream, partial reads just block
+type RESPParser struct {
+	r      *bufio.Reader
+	inline bool // the client may type commands
+}
+
+func NewRESPParser(r *bufio.Reader, inline bool) *RESPParser {
+	return &RESPParser{r: r, inline: inline}
+}
+
+// One line without its CRLF, at most resp_max_line long
+func (p *RESPParser) line() (string, error) {
+	var line []byte
+	for {
+		b, err := p.r.ReadSlice('\n')
+		line = append(line, b...)
+		if len(line) > resp_max_line {
+			return "", fmt.Errorf("RESP line longer than %d bytes", resp_max_line)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		break
+	}
+	s := string(line)
+	return strings.TrimSuffix(strings.TrimSuffix(s, "\n"), "\r"), nil
+}
+
+// The next value; inline commands come back as arrays of bulk strings
+func (p *RESPParser) Next() (RESPValue, bool, error) {
+	b, err := p.r.Peek(1)
+	if err != nil {
+		return RESPValue{}, false, err
+	}
+	switch b[0] {
+	case '+', '-', ':', '$', '*':
+		v, err := p.value(0)
+		return v, false, err
+	}
+	if !p.inline {
+		return RESPValue{}, false, fmt.Errorf("unexpected RESP type byte %q", b[0])
+	}
+	s, err := p.line()
+	if err != nil {
+		return RESPValue{}, true, err
+	}
+	v := RESPValue{Type: '*'}
+	for _, arg := range strings.Fields(s) {
+		v.Array = append(v.Array, RESPValue{Type: '$', Str: arg, Length: len(arg)})
+	}
+	return v, true, nil
+}
+
+func (p *RESPParser) value(depth int) (RESPValue, error) {
+	if depth > resp_max_depth {
+		return RESPValue{}, errors.New("RESP arrays nested too deep")
+	}
+	s, err := p.line()
+	if err != nil {
+		return RESPValue{}, err
+	}
+	if s == "" {
+		return RESPValue{}, errors.New("empty RESP line")
+	}
+	v := RESPValue{Type: s[0]}
+	switch v.Type {
+	case '+', '-':
+		v.Str = s[1:]
+		return v, nil
+	case ':':
+		v.Int, err = strconv.ParseInt(s[1:], 10, 64)
+		return v, err
+	}
+	n, err := strconv.Atoi(s[1:])
+	if err != nil {
+		return v, fmt.Errorf("bad RESP length %q", s)
+	}
+	if n < 0 {
+		v.Null = true
+		return v, nil
+	}
+	if v.Type == '*' {
+		for i := 0; i < n; i++ {
+			e, err := p.value(depth + 1)
+			if err != nil {
+				return v, err
+			}
+			v.Array = append(v.Array, e)
+		}
+		return v, nil
+	}
+	if v.Type != '$' {
+		return v, fmt.Errorf("unknown RESP type %q", v.Type)
+	}
+	v.Length = n
+	keep := n
+	if keep > *max_body {
+		keep, v.Truncated = *max_body, true
+	}
+	b := make([]byte, keep)
+	if _, err := io.ReadFull(p.r, b); err != nil {
+		return v, err
+	}
+	if _, err := io.CopyN(io.Discard, p.r, int64(n-keep)); err != nil {
+		return v, err
+	}
+	v.Str = string(b)
+	if end, err := p.line(); err != nil {
+		return v, err
+	} else if end != "" {
+		return v, errors.New("RESP bulk string longer than its length")
+	}
+	return v, nil
+}
+
+// A bulk string for the log, quoted unless it is a plain word
+func resp_word(v RESPValue) string {
+	s := v.Str
+	if s == "" || strings.ContainsAny(s, " \"'\\") || strconv.Quote(s) != `"`+s+`"` {
+		s = strconv.Quote(s)
+	}
+	if v.Truncated {
+		s += fmt.Sprintf("...(%d bytes)", v.Length)
+	}
+	return s
+}
+
+// Renders a reply the way redis-cli would, on one line
+func (v RESPValue) String() string {
+	switch v.Type {
+	case '+', '-':
+		return string(v.Type) + v.Str
+	case ':':
+		return ":" + strconv.FormatInt(v.Int, 10)
+	case '$':
+		if v.Null {
+			return "(nil)"
+		}
+		return resp_word(v)
+	}
+	if v.Null {
+		return "*(nil)"
+	}
+	parts := make([]string, len(v.Array))
+	for i, e := range v.Array {
+		parts[i] = e.String()
+	}
+	return fmt.Sprintf("*%d [%s]", len(v.Array), strings.Join(parts, ", "))
+}
+
+// Parsers for both directions of one Redis connection
+func new_redis_parsers(conn_n int, logger chan *LogEvent, client_peer, server_peer string) (request, response *StreamParser) {
+	commands := make(chan redis_pending, resp_queue)
+	latency := NewLatencyTracker()
+	request = NewStreamParser(conn_n, client_to_server, client_peer, logger, decode_redis_command(commands, latency))
+	response = NewStreamParser(conn_n, server_to_client, server_peer, logger, decode_redis_reply(commands, latency))
+	return
+}
+
+// A command waiting for its reply
+type redis_pending struct {
+	name string
+	seq  int // pipeline position, for the LatencyTracker
+}
+
+func decode_redis_command(commands chan redis_pending, latency *LatencyTracker) decode_func {
+	var p *RESPParser
+	seq := 0
+	return func(r *bufio.Reader) (*LogEvent, error) {
+		if p == nil {
+			p = NewRESPParser(r, true)
+		}
+		v, inline, err := p.Next()
+		if err != nil {
+			return nil, err
+		}
+		if v.Type != '*' {
+			return nil, fmt.Errorf("Redis command is a RESP %q, not an array", v.Type)
+		}
+		if len(v.Array) == 0 {
+			return nil, nil // empty line
+		}
+		rec := &RedisRecord{Inline: inline}
+		for _, arg := range v.Array {
+			rec.Command = append(rec.Command, resp_word(arg))
+		}
+		latency.Request(seq, time.Now())
+		select {
+		case commands <- redis_pending{strings.ToUpper(v.Array[0].Str), seq}:
+		default:
+		}
+		seq++
+		return &LogEvent{Event: "redis_command", Redis: rec}, nil
+	}
+}
+
+func decode_redis_reply(commands chan redis_pending, latency *LatencyTracker) decode_func {
+	var p *RESPParser
+	return func(r *bufio.Reader) (*LogEvent, error) {
+		if p == nil {
+			p = NewRESPParser(r, false)
+		}
+		if _, err := r.Peek(1); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		v, _, err := p.Next()
+		if err != nil {
+			return nil, err
+		}
+		rec := &RedisRecord{Reply: v.String()}
+		// The request parser runs on its own and may lag behind; pushed
+		// pub/sub messages have no command at all
+		var ms float64
+		select {
+		case c := <-commands:
+			rec.InReplyTo = c.name
+			ms = latency.Response(c.seq, start)
+		case <-time.After(100 * time.Millisecond):
+		}
+		return &LogEvent{Event: "redis_reply", Redis: rec, LatencyMS: ms}, nil
+	}
+}
+
+func format_redis(e *LogEvent) string {
+	rec := e.Redis
+	if e.Event == "redis_command" {
+		return "C→S: " + strings.Join(rec.Command, " ") + "\n"
+	}
+	s := "S→C: " + rec.Reply
+	if rec.InReplyTo != "" {
+		s += " (" + rec.InReplyTo + ")"
+	}
+	return s + "\n"
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// A pipelined session as redis-cli and the server send it: the client
+// writes all its commands before reading any reply
+func TestRedisPipelining(t *testing.T) {
+	large := strings.Repeat("v", 100000)
+	requests := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n" +
+		"PING\r\n" + // inline, as typed in telnet
+		"\r\n" + // an empty line, ignored
+		"set  spaced   words\r\n" +
+		fmt.Sprintf("*3\r\n$3\r\nSET\r\n$5\r\nlarge\r\n$%d\r\n%s\r\n", len(large), large) +
+		"*2\r\n$4\r\nLLEN\r\n$4\r\nlist\r\n" +
+		"*2\r\n$3\r\nGET\r\n$7\r\nmissing\r\n" +
+		"*3\r\n$6\r\nLRANGE\r\n$4\r\nlist\r\n$2\r\n10\r\n" +
+		"*2\r\n$3\r\nGET\r\n$10\r\nwith\"quote\r\n"
+	replies := "+OK\r\n" +
+		"$5\r\nvalue\r\n" +
+		"+PONG\r\n" +
+		"-ERR unknown command 'set', with args beginning with: 'spaced' 'words'\r\n" +
+		"+OK\r\n" +
+		":3\r\n" +
+		"$-1\r\n" +
+		"*3\r\n$1\r\na\r\n*2\r\n:1\r\n$-1\r\n*-1\r\n" +
+		fmt.Sprintf("$%d\r\n%s\r\n", len(large), large)
+	want := []string{
+		"C→S: SET key value",
+		"C→S: GET key",
+		"C→S: PING",
+		"C→S: set spaced words",
+		fmt.Sprintf("C→S: SET large %s...(%d bytes)", large[:*max_body], len(large)),
+		"C→S: LLEN list",
+		"C→S: GET missing",
+		"C→S: LRANGE list 10",
+		`C→S: GET "with\"quote"`,
+		"S→C: +OK (SET)",
+		"S→C: value (GET)",
+		"S→C: +PONG (PING)",
+		"S→C: -ERR unknown command 'set', with args beginning with: 'spaced' 'words' (SET)",
+		"S→C: +OK (SET)",
+		"S→C: :3 (LLEN)",
+		"S→C: (nil) (GET)",
+		"S→C: *3 [a, *2 [:1, (nil)], *(nil)] (LRANGE)",
+		fmt.Sprintf("S→C: %s...(%d bytes) (GET)", large[:*max_body], len(large)),
+	}
+	for _, chunk := range []int{1, 3, 1 << 20} {
+		logger := make(chan *LogEvent)
+		request, response := new_redis_parsers(1, logger, "127.0.0.1-50000", "127.0.0.1-6379")
+		events := feed_parsers(t, logger, []*StreamParser{request, response}, [][]byte{[]byte(requests), []byte(replies)}, chunk)
+		var got []string
+		for _, e := range events {
+			if e.Redis == nil {
+				t.Fatalf("chunks of %d: a %s event, the decoder gave up at %q", chunk, e.Event, e.dump[:min(40, len(e.dump))])
+			}
+			got = append(got, strings.TrimSuffix(format_redis(e), "\n"))
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("chunks of %d logged\n%s\nwant\n%s", chunk, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+		if !events[2].Redis.Inline || events[0].Redis.Inline {
+			t.Errorf("chunks of %d: PING inline %v, SET inline %v", chunk, events[2].Redis.Inline, events[0].Redis.Inline)
+		}
+	}
+}
+
+func TestRESPParser(t *testing.T) {
+	tests := []struct {
+		resp string
+		want string // String() of the value
+	}{
+		{"+OK\r\n", "+OK"},
+		{"-WRONGTYPE Operation against a key\r\n", "-WRONGTYPE Operation against a key"},
+		{":-42\r\n", ":-42"},
+		{"$0\r\n\r\n", `""`},
+		{"$-1\r\n", "(nil)"},
+		{"$11\r\nhello world\r\n", `"hello world"`},
+		{"$4\r\na\r\nb\r\n", `"a\r\nb"`}, // CRLF inside a bulk string
+		{"*0\r\n", "*0 []"},
+		{"*-1\r\n", "*(nil)"},
+		{"*2\r\n*1\r\n+x\r\n:2\r\n", "*2 [*1 [+x], :2]"},
+		{"+no CR\n", "+no CR"},
+	}
+	for _, tt := range tests {
+		v, inline, err := NewRESPParser(bufio.NewReader(strings.NewReader(tt.resp)), false).Next()
+		if err != nil || inline || v.String() != tt.want {
+			t.Errorf("%q parsed as %s, %v, want %s", tt.resp, v, err, tt.want)
+		}
+	}
+	for _, bad := range []string{
+		"PING\r\n", // inline, but not from a client
+		":x\r\n",
+		"$5\r\nab\r\n",
+		"$2\r\nabc\r\n",
+		"*2\r\n+a\r\n",
+		"$x\r\n",
+		"\r\n",
+		"!3\r\n",
+		strings.Repeat("*1\r\n", resp_max_depth+2) + "+x\r\n",
+		"+" + strings.Repeat("x", resp_max_line) + "\r\n",
+	} {
+		if _, _, err := NewRESPParser(bufio.NewReader(strings.NewReader(bad)), false).Next(); err == nil {
+			t.Errorf("%.40q was accepted", bad)
+		}
+	}
+}
+
+// Something that isn't RESP ends up in the hex dump, whole
+func TestRedisFallback(t *testing.T) {
+	stream := []byte("*1\r\n$4\r\nPING\r\n\x16\x03\x01\x00\x05hello")
+	events := parse_stream(t, decode_redis_command(make(chan redis_pending, 1), NewLatencyTracker()), stream, 4)
+	if len(events) < 2 || events[0].Event != "redis_command" {
+		t.Fatalf("%d events", len(events))
+	}
+	var dumped []byte
+	for _, e := range events[1:] {
+		dumped = append(dumped, e.dump...)
+	}
+	if !bytes.Equal(dumped, stream[14:]) {
+		t.Errorf("hex dumps of %q, want %q", dumped, stream[14:])
+	}
+}
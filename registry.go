@@ -0,0 +1,276 @@
+/*
+Registry of the active connections.
+
+process_connection registers each connection once it is established and
+pass_through counts what it forwards, so the dashboard and the API can
+show what is going on right now. Every change is reported to the
+registry's listener, if one is set. Finished connections are kept in a
+ring buffer of the last history_size, with their events if those are
+recorded.
+
+Recorded events are bounded by their size, not their number. A
+connection keeps hex dumps for its first history_dump_bytes, then its
+events without them up to history_conn_bytes. All connections together,
+active and in the history, hold at most history_total_bytes; what
+doesn't fit is counted as dropped.
+*/
+
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ConnectionInfo struct {
+	ID            int64      `json:"id"` // unique in this process, unlike conn
+	Conn          int        `json:"conn"`
+	ListenPort    string     `json:"listen_port"`
+	Client        string     `json:"client"`
+	Server        string     `json:"server"`
+	Started       time.Time  `json:"started"`
+	BytesToServer int64      `json:"bytes_to_server"`
+	BytesToClient int64      `json:"bytes_to_client"`
+	Finished      *time.Time `json:"finished,omitempty"`
+	DurationMS    int64      `json:"duration_ms,omitempty"`
+
+	registry    *ConnectionRegistry
+	mu          sync.Mutex
+	events      []*LogEvent
+	kept        int               // about the bytes events holds
+	dropped     int               // events that didn't fit
+	binary_logs map[string]string // "client" and "server" to file names
+}
+
+const (
+	history_dump_bytes  = 512 << 10
+	history_conn_bytes  = 1 << 20
+	history_total_bytes = 128 << 20
+	history_event_bytes = 256 // about what an event takes without its texts
+)
+
+// Keeps e for the history, without the payload copies and, once the
+// connection has used its share, without the hex dump
+func (c *ConnectionInfo) record(e *LogEvent) {
+	kept := *e
+	kept.dump, kept.Raw = nil, nil
+	size := history_event_bytes + len(kept.Message) + len(kept.HexPayload)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.kept+size > history_dump_bytes {
+		size -= len(kept.HexPayload)
+		kept.HexPayload = ""
+	}
+	if c.kept+size > history_conn_bytes || !c.registry.keep(size) {
+		c.dropped += 1
+		return
+	}
+	c.events = append(c.events, &kept)
+	c.kept += size
+}
+
+// How many events were not recorded for lack of room
+func (c *ConnectionInfo) Dropped() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dropped
+}
+
+// A page of the recorded events and how many there are in total
+func (c *ConnectionInfo) Events(offset, limit int) ([]*LogEvent, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	total := len(c.events)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return c.events[offset:end], total
+}
+
+func (c *ConnectionInfo) BinaryLog(side string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.binary_logs[side]
+}
+
+func (c *ConnectionInfo) set_binary_log(side, name string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	if c.binary_logs == nil {
+		c.binary_logs = make(map[string]string)
+	}
+	c.binary_logs[side] = name
+	c.mu.Unlock()
+}
+
+func (c *ConnectionInfo) copy() ConnectionInfo {
+	return ConnectionInfo{
+		ID:            c.ID,
+		Conn:          c.Conn,
+		ListenPort:    c.ListenPort,
+		Client:        c.Client,
+		Server:        c.Server,
+		Started:       c.Started,
+		BytesToServer: atomic.LoadInt64(&c.BytesToServer),
+		BytesToClient: atomic.LoadInt64(&c.BytesToClient),
+		Finished:      c.Finished,
+		DurationMS:    c.DurationMS,
+	}
+}
+
+// Counts bytes forwarded in one direction; nil safe for the UDP path
+func (c *ConnectionInfo) forwarded(direction string, n int) {
+	if c == nil {
+		return
+	}
+	if direction == client_to_server {
+		atomic.AddInt64(&c.BytesToServer, int64(n))
+	} else {
+		atomic.AddInt64(&c.BytesToClient, int64(n))
+	}
+	c.registry.changed()
+}
+
+type ConnectionRegistry struct {
+	mu           sync.RWMutex
+	conns        map[int64]*ConnectionInfo
+	last_id      int64
+	listener     func() // called after every change, must not block
+	history      []*ConnectionInfo
+	history_next int   // slot the next finished connection goes to
+	kept         int64 // bytes of recorded events, see history_total_bytes
+}
+
+func NewConnectionRegistry() *ConnectionRegistry {
+	return &ConnectionRegistry{conns: make(map[int64]*ConnectionInfo)}
+}
+
+var connections = NewConnectionRegistry()
+
+func (r *ConnectionRegistry) Add(conn_n int, listen_port string, client, server net.Addr) *ConnectionInfo {
+	r.mu.Lock()
+	r.last_id += 1
+	c := &ConnectionInfo{
+		ID:         r.last_id,
+		Conn:       conn_n,
+		ListenPort: listen_port,
+		Client:     client.String(),
+		Server:     server.String(),
+		Started:    time.Now(),
+		registry:   r,
+	}
+	r.conns[c.ID] = c
+	r.mu.Unlock()
+	r.changed()
+	return c
+}
+
+func (r *ConnectionRegistry) Remove(c *ConnectionInfo) {
+	finished := time.Now()
+	r.mu.Lock()
+	delete(r.conns, c.ID)
+	c.Finished, c.DurationMS = &finished, finished.Sub(c.Started).Milliseconds()
+	if len(r.history) > 0 {
+		r.release(r.history[r.history_next])
+		r.history[r.history_next] = c
+		r.history_next = (r.history_next + 1) % len(r.history)
+	} else {
+		r.release(c)
+	}
+	r.mu.Unlock()
+	r.changed()
+}
+
+// Takes size bytes of the total for recorded events, if they are left
+func (r *ConnectionRegistry) keep(size int) bool {
+	if atomic.AddInt64(&r.kept, int64(size)) > history_total_bytes {
+		atomic.AddInt64(&r.kept, -int64(size))
+		return false
+	}
+	return true
+}
+
+// Gives back what the events of a connection leaving the history took
+func (r *ConnectionRegistry) release(c *ConnectionInfo) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	atomic.AddInt64(&r.kept, -int64(c.kept))
+	c.events, c.kept = nil, 0
+	c.mu.Unlock()
+}
+
+// Starts keeping the last n finished connections
+func (r *ConnectionRegistry) SetHistorySize(n int) {
+	r.mu.Lock()
+	for _, c := range r.history {
+		r.release(c)
+	}
+	r.history, r.history_next = make([]*ConnectionInfo, n), 0
+	r.mu.Unlock()
+}
+
+// Copies of the finished connections in the history, oldest first
+func (r *ConnectionRegistry) History() []ConnectionInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var list []ConnectionInfo
+	for i := range r.history {
+		if c := r.history[(r.history_next+i)%len(r.history)]; c != nil {
+			list = append(list, c.copy())
+		}
+	}
+	return list
+}
+
+// Finds an active or finished connection
+func (r *ConnectionRegistry) Lookup(id int64) *ConnectionInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if c, ok := r.conns[id]; ok {
+		return c
+	}
+	for _, c := range r.history {
+		if c != nil && c.ID == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// Copies of the active connections, oldest first
+func (r *ConnectionRegistry) Snapshot() []ConnectionInfo {
+	r.mu.RLock()
+	list := make([]ConnectionInfo, 0, len(r.conns))
+	for _, c := range r.conns {
+		list = append(list, c.copy())
+	}
+	r.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (r *ConnectionRegistry) SetListener(f func()) {
+	r.mu.Lock()
+	r.listener = f
+	r.mu.Unlock()
+}
+
+func (r *ConnectionRegistry) changed() {
+	r.mu.RLock()
+	f := r.listener
+	r.mu.RUnlock()
+	if f != nil {
+		f()
+	}
+}
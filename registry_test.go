@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+var test_addr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+
+// A received event with a hex dump of n bytes, as the FormattingLogger
+// leaves it
+func dumped_event(n int) *LogEvent {
+	e := new_event(1, client_to_server, "received", "127.0.0.1-50000")
+	e.Length = n
+	e.dump = make([]byte, n)
+	e.Raw = make([]byte, n)
+	e.HexPayload = strings.Repeat("x", 4*n)
+	return e
+}
+
+func TestConnectionInfoRecord(t *testing.T) {
+	r := NewConnectionRegistry()
+	r.SetHistorySize(2)
+	c := r.Add(1, "8080", test_addr, test_addr)
+	const n = 10240 // a 40 KB hex dump
+	total := 5000
+	for i := 0; i < total; i++ {
+		c.record(dumped_event(n))
+	}
+	events, recorded := c.Events(0, total)
+	if recorded+c.Dropped() != total {
+		t.Errorf("%d recorded and %d dropped of %d", recorded, c.Dropped(), total)
+	}
+	if c.kept > history_conn_bytes {
+		t.Errorf("the connection holds %d bytes, more than %d", c.kept, history_conn_bytes)
+	}
+	dumps := 0
+	for i, e := range events {
+		if e.dump != nil || e.Raw != nil {
+			t.Fatal("a recorded event kept its payload copies")
+		}
+		if e.HexPayload != "" {
+			if i != dumps {
+				t.Fatal("an event with a hex dump came after one without")
+			}
+			dumps += 1
+		}
+	}
+	if dumps == 0 || dumps == len(events) {
+		t.Errorf("%d of %d events kept their hex dump, want the first ones only", dumps, len(events))
+	}
+	if c.Dropped() == 0 {
+		t.Error("nothing was dropped")
+	}
+
+	// the registry gives the room back as connections leave the history
+	r.Remove(c)
+	for id := 2; id <= 3; id++ {
+		c := r.Add(id, "8080", test_addr, test_addr)
+		c.record(dumped_event(16))
+		r.Remove(c)
+	}
+	if got, want := r.kept, int64(2*(history_event_bytes+64)); got != want {
+		t.Errorf("the registry counts %d bytes, want %d for the two connections left", got, want)
+	}
+}
+
+func TestConnectionRegistryTotal(t *testing.T) {
+	r := NewConnectionRegistry()
+	r.SetHistorySize(1000)
+	conns := history_total_bytes/history_conn_bytes + 10
+	events := 0
+	for id := 1; id <= conns; id++ {
+		c := r.Add(id, "8080", test_addr, test_addr)
+		for c.Dropped() == 0 {
+			c.record(dumped_event(1024))
+		}
+		_, n := c.Events(0, 0)
+		events += n
+		r.Remove(c)
+	}
+	if r.kept > history_total_bytes {
+		t.Errorf("the registry holds %d bytes, more than %d", r.kept, history_total_bytes)
+	}
+	if events == 0 {
+		t.Error("nothing was recorded")
+	}
+	last := r.Lookup(int64(conns))
+	if _, n := last.Events(0, 0); n != 0 {
+		t.Errorf("the last connection recorded %d events with the total used up", n)
+	}
+}
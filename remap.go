@@ -0,0 +1,201 @@
+/*
+Address translation in the forwarded bytes (-remap-port).
+
+	-listen_port 8080 -host app.internal -port 80 -remap-port localhost:8080=app.internal:80
+
+Protocols that carry the address they were reached at, an HTTP Host
+header, an absolute URL in a redirect, break when that address is the
+proxy's. With -remap-port src=dst every src in what the client sends is
+replaced by dst before it goes to the target, and every dst in what the
+target sends by src on the way back. src and dst are plain text, usually
+host:port as the client and the target write them; -remap-port may be
+repeated or given a comma separated list. FTP's passive mode replies
+write the address differently, -ftp-data-proxy takes care of those.
+
+The logs show the bytes as they were received, the sent events count the
+bytes after the replacement. A replacement of a different length shifts
+everything after it, so lengths carried by the protocol (Content-Length)
+no longer match; keep src and dst the same length where that matters.
+
+An occurrence may be split over two reads. A ByteRewriter holds back the
+end of a chunk that could be the start of a pattern until the next chunk
+shows whether it is one, or for remap_hold at most when nothing more
+comes, and before the connection is closed.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type port_remap struct {
+	src, dst string
+}
+
+type remap_flags []port_remap
+
+func (f *remap_flags) String() string {
+	var s []string
+	for _, r := range *f {
+		s = append(s, r.src+"="+r.dst)
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *remap_flags) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		src, dst, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || src == "" || dst == "" {
+			return fmt.Errorf("%q is not src=dst", pair)
+		}
+		*f = append(*f, port_remap{src, dst})
+	}
+	return nil
+}
+
+var port_remaps remap_flags
+
+func init() {
+	flag.Var(&port_remaps, "remap-port", "src=dst: replace src with dst in what the client sends and dst with src in what the target sends (repeatable)")
+}
+
+const remap_hold = 50 * time.Millisecond
+
+// Replaces patterns in a byte stream, also where they are split over two
+// chunks
+type ByteRewriter struct {
+	from, to [][]byte
+	pending  []byte // end of the last chunk that may start a pattern
+}
+
+func NewByteRewriter(from, to [][]byte) *ByteRewriter {
+	return &ByteRewriter{from: from, to: to}
+}
+
+// The bytes to forward for b, after the ones held back from before. The
+// end of b that may start a pattern is held back for the next call.
+func (r *ByteRewriter) Rewrite(b []byte) []byte {
+	data := b
+	if len(r.pending) > 0 {
+		data = append(r.pending, b...)
+		r.pending = nil
+	}
+	var out []byte
+	start := 0 // of the bytes not copied to out yet
+	for i := 0; i < len(data); {
+		k, partial := r.match(data[i:])
+		if k < 0 && !partial {
+			i++
+			continue
+		}
+		if out == nil {
+			out = make([]byte, 0, len(data))
+		}
+		out = append(out, data[start:i]...)
+		if partial {
+			r.pending = bytes.Clone(data[i:])
+			return out
+		}
+		out = append(out, r.to[k]...)
+		i += len(r.from[k])
+		start = i
+	}
+	if out == nil {
+		return data // nothing replaced
+	}
+	return append(out, data[start:]...)
+}
+
+// Which pattern b starts with, or whether b is the start of one
+func (r *ByteRewriter) match(b []byte) (int, bool) {
+	partial := false
+	for k, p := range r.from {
+		if b[0] != p[0] {
+			continue
+		}
+		if bytes.HasPrefix(b, p) {
+			return k, false
+		}
+		if len(b) < len(p) && bytes.HasPrefix(p, b) {
+			partial = true
+		}
+	}
+	return -1, partial
+}
+
+// Hands out what is held back
+func (r *ByteRewriter) Flush() []byte {
+	b := r.pending
+	r.pending = nil
+	return b
+}
+
+// Writes through a ByteRewriter, sending what it holds back once the
+// stream stays idle for remap_hold
+type remap_conn struct {
+	net.Conn
+	mu    sync.Mutex
+	r     *ByteRewriter
+	timer *time.Timer
+}
+
+// The connection c of a Channel writes the data of direction to, with
+// -remap-port
+func remap(c net.Conn, direction string) net.Conn {
+	if len(port_remaps) == 0 {
+		return c
+	}
+	var from, to [][]byte
+	for _, m := range port_remaps {
+		src, dst := []byte(m.src), []byte(m.dst)
+		if direction == server_to_client {
+			src, dst = dst, src
+		}
+		from, to = append(from, src), append(to, dst)
+	}
+	rc := &remap_conn{Conn: c, r: NewByteRewriter(from, to)}
+	rc.timer = time.AfterFunc(remap_hold, rc.flush)
+	rc.timer.Stop()
+	return rc
+}
+
+func (c *remap_conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timer.Stop()
+	out := c.r.Rewrite(b)
+	if len(c.r.pending) > 0 {
+		c.timer.Reset(remap_hold)
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *remap_conn) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b := c.r.Flush(); len(b) > 0 {
+		c.Conn.Write(b)
+	}
+}
+
+func (c *remap_conn) Close() error {
+	c.timer.Stop()
+	c.flush()
+	return c.Conn.Close()
+}
+
+func init_remap() {
+	if len(port_remaps) > 0 && *proto == "udp" {
+		die("-remap-port only works for TCP and Unix socket streams")
+	}
+}
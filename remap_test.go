@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestByteRewriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to []string
+		chunks   []string
+		want     []string // forwarded after each chunk, then what Flush gives
+	}{
+		{"no match", []string{"localhost:8080"}, []string{"app:80"},
+			[]string{"GET / HTTP/1.1\r\n"}, []string{"GET / HTTP/1.1\r\n", ""}},
+		{"in one chunk", []string{"localhost:8080"}, []string{"app:80"},
+			[]string{"Host: localhost:8080\r\n"}, []string{"Host: app:80\r\n", ""}},
+		{"every occurrence", []string{"a"}, []string{"bb"},
+			[]string{"aXaXa"}, []string{"bbXbbXbb", ""}},
+		{"split over two chunks", []string{"localhost:8080"}, []string{"app:80"},
+			[]string{"Host: local", "host:8080\r\n"}, []string{"Host: ", "app:80\r\n", ""}},
+		{"split over three chunks", []string{"localhost:8080"}, []string{"app:80"},
+			[]string{"local", "host:", "8080"}, []string{"", "", "app:80", ""}},
+		{"start that isn't one", []string{"localhost:8080"}, []string{"app:80"},
+			[]string{"x local", "ness"}, []string{"x ", "localness", ""}},
+		{"held at the end", []string{"localhost:8080"}, []string{"app:80"},
+			[]string{"to localhost:80"}, []string{"to ", "localhost:80"}},
+		{"several patterns", []string{"one", "two"}, []string{"1", "2"},
+			[]string{"one two three"}, []string{"1 2 three", ""}},
+		{"first pattern wins", []string{"ab", "abc"}, []string{"X", "Y"},
+			[]string{"abc"}, []string{"Xc", ""}},
+		{"longer replacement", []string{"127.0.0.1:1"}, []string{"backend.internal:10001"},
+			[]string{"http://127.0.0.1:1/x"}, []string{"http://backend.internal:10001/x", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var from, to [][]byte
+			for i := range tt.from {
+				from, to = append(from, []byte(tt.from[i])), append(to, []byte(tt.to[i]))
+			}
+			r := NewByteRewriter(from, to)
+			var got []string
+			for _, c := range tt.chunks {
+				got = append(got, string(r.Rewrite([]byte(c))))
+			}
+			got = append(got, string(r.Flush()))
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemapFlags(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		err   bool
+	}{
+		{"localhost:8080=app:80", "localhost:8080=app:80", false},
+		{"a=b, c=d", "a=b,c=d", false},
+		{"a", "", true},
+		{"=b", "", true},
+		{"a=", "", true},
+	}
+	for _, tt := range tests {
+		var f remap_flags
+		err := f.Set(tt.value)
+		if (err != nil) != tt.err {
+			t.Errorf("Set(%q) error %v, want error %v", tt.value, err, tt.err)
+			continue
+		}
+		if err == nil && f.String() != tt.want {
+			t.Errorf("Set(%q) gives %q, want %q", tt.value, f.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+/*
+Traffic replay.
+
+With -record-timing every binary log gets a "<name>.timing" sidecar, one
+"offset unix-nanoseconds length" line per write. -replay-file sends a
+recorded client->server binary log to -host/-port again, paced by the
+sidecar (if there is one) and sped up by -replay-speed. When
+-replay-expect names the recorded server->client log, the new responses
+are compared with it. Framed binary logs (-binary-format framed, see
+binlog.go) need no sidecar, their records carry the timestamps.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+var (
+	record_timing    *bool    = flag.Bool("record-timing", false, "write a .timing sidecar next to each binary log")
+	replay_file      *string  = flag.String("replay-file", "", "replay this client->server binary log against -host/-port and exit")
+	replay_speed     *float64 = flag.Float64("replay-speed", 1.0, "replay speed multiplier")
+	replay_expect    *string  = flag.String("replay-expect", "", "server->client binary log the replayed responses should match")
+	replay_tolerance *float64 = flag.Float64("replay-tolerance", 0, "fraction of response bytes allowed to differ")
+)
+
+// How long the replayer waits for more response bytes once it is done sending
+const replay_response_timeout = 5 * time.Second
+
+type replay_chunk struct {
+	data []byte
+	at   time.Duration // since the first chunk
+}
+
+type Replayer struct {
+	chunks    []replay_chunk
+	expected  []byte // nil if responses are not checked
+	tolerance float64
+}
+
+// Writes the sidecar entries for one binary log
+type timing_writer struct {
+	w      *bufio.Writer
+	f      *os.File
+	offset int64
+}
+
+func create_timing_file(log_name string) (*timing_writer, error) {
+	f, err := os.Create(log_name + ".timing")
+	if err != nil {
+		return nil, err
+	}
+	return &timing_writer{w: bufio.NewWriter(f), f: f}, nil
+}
+
+func (t *timing_writer) record(n int, ts time.Time) {
+	fmt.Fprintf(t.w, "%d %d %d\n", t.offset, ts.UnixNano(), n)
+	t.w.Flush()
+	t.offset += int64(n)
+}
+
+func (t *timing_writer) Close() error {
+	t.w.Flush()
+	return t.f.Close()
+}
+
+// Reads a binary log and, if present, its timing sidecar
+func (r *Replayer) Load(path string) error {
+	data, err := read_log(path)
+	if err != nil {
+		return err
+	}
+	if framed_binary_logs() {
+		return r.load_records(path, data)
+	}
+	r.chunks = []replay_chunk{{data: data}}
+
+	f, err := os.Open(path + ".timing")
+	if os.IsNotExist(err) {
+		return nil // no pacing, send everything at once
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var chunks []replay_chunk
+	var first int64
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var offset, ts, n int64
+		if _, err := fmt.Sscan(s.Text(), &offset, &ts, &n); err != nil {
+			return fmt.Errorf("%s.timing: %v", path, err)
+		}
+		if offset+n > int64(len(data)) {
+			return fmt.Errorf("%s.timing: entry at %d past the end of the log", path, offset)
+		}
+		if len(chunks) == 0 {
+			first = ts
+		}
+		chunks = append(chunks, replay_chunk{data[offset : offset+n], time.Duration(ts - first)})
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	r.chunks = chunks
+	return nil
+}
+
+// A framed log carries its own timing, one chunk per record
+func (r *Replayer) load_records(path string, data []byte) error {
+	records, err := read_records(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	r.chunks = nil
+	for _, rec := range records {
+		r.chunks = append(r.chunks, replay_chunk{rec.Data, rec.Time.Sub(records[0].Time)})
+	}
+	return nil
+}
+
+// Loads the responses the replay is compared with
+func (r *Replayer) Expect(path string, tolerance float64) error {
+	data, err := read_log(path)
+	if err != nil {
+		return err
+	}
+	if framed_binary_logs() {
+		records, err := read_records(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		data = nil
+		for _, rec := range records {
+			data = append(data, rec.Data...)
+		}
+	}
+	r.expected, r.tolerance = data, tolerance
+	return nil
+}
+
+func (r *Replayer) Run(target string, speedMultiplier float64) error {
+	if speedMultiplier <= 0 {
+		return fmt.Errorf("invalid replay speed %g", speedMultiplier)
+	}
+	conn, err := net.Dial("tcp", target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	received := make(chan []byte)
+	go func() {
+		var buf []byte
+		b := make([]byte, 32768)
+		for {
+			n, err := conn.Read(b)
+			buf = append(buf, b[:n]...)
+			if err != nil {
+				break
+			}
+		}
+		received <- buf
+	}()
+
+	started := time.Now()
+	sent := 0
+	for _, c := range r.chunks {
+		due := started.Add(time.Duration(float64(c.at) / speedMultiplier))
+		time.Sleep(time.Until(due))
+		if _, err := conn.Write(c.data); err != nil {
+			return err
+		}
+		sent += len(c.data)
+	}
+	fmt.Printf("Replayed %d bytes in %d writes to %s\n", sent, len(r.chunks), target)
+
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(replay_response_timeout))
+	response := <-received
+	fmt.Printf("Received %d bytes in response\n", len(response))
+	if r.expected == nil {
+		return nil
+	}
+	return compare_responses(r.expected, response, r.tolerance)
+}
+
+// Counts differing and missing/extra bytes against the recorded responses
+func compare_responses(expected, actual []byte, tolerance float64) error {
+	diff := 0
+	for i := 0; i < len(expected) || i < len(actual); i++ {
+		if i >= len(expected) || i >= len(actual) || expected[i] != actual[i] {
+			diff += 1
+		}
+	}
+	total := len(expected)
+	if total == 0 {
+		total = 1
+	}
+	ratio := float64(diff) / float64(total)
+	if ratio > tolerance {
+		return fmt.Errorf("responses differ in %d bytes (%.2f%%), tolerance is %.2f%%",
+			diff, ratio*100, tolerance*100)
+	}
+	fmt.Printf("Responses match (%d bytes differ)\n", diff)
+	return nil
+}
+
+// Implements -replay-file
+func replay(target string) {
+	r := &Replayer{}
+	if err := r.Load(*replay_file); err != nil {
+		die("Unable to load %s, %v", *replay_file, err)
+	}
+	if *replay_expect != "" {
+		if err := r.Expect(*replay_expect, *replay_tolerance); err != nil {
+			die("Unable to load %s, %v", *replay_expect, err)
+		}
+	}
+	if err := r.Run(target, *replay_speed); err != nil {
+		die("Replay failed, %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Server latency per request (-measure-latency).
+
+	-proto redis -measure-latency
+
+With -proto http, redis or postgres (or auto, once one of them is
+detected) every response is matched with its request and the time from
+the end of the request to the start of the response goes into the
+response event, as request_latency_ms in the JSON log and "Server
+latency" in the text log. The protocols answer in order on a connection,
+so requests are keyed by their position: the nth HTTP request with the
+nth final response, the nth Redis command with the nth reply (pushed
+pub/sub messages count for none), the nth PostgreSQL Query or Sync with
+the nth run of backend messages up to ReadyForQuery.
+
+Both ends are taken when the protocol parsers see the bytes, which is
+when they are forwarded, so the latency is that of the target plus the
+network between gotcpspy and it, including any -latency-client-ms.
+*/
+
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+var measure_latency *bool = flag.Bool("measure-latency", false, "log the time between each HTTP, Redis or PostgreSQL request and the start of its response")
+
+const latency_max_pending = 1024 // requests without a response yet
+
+// The end times of the requests of one connection that are still waiting
+// for their response, shared by the two parsers
+type LatencyTracker struct {
+	mu   sync.Mutex
+	sent map[int]time.Time // request position -> end of the request
+}
+
+// nil without -measure-latency; the methods do nothing then
+func NewLatencyTracker() *LatencyTracker {
+	if !*measure_latency {
+		return nil
+	}
+	return &LatencyTracker{sent: make(map[int]time.Time)}
+}
+
+// Records that request key was complete at the given time
+func (t *LatencyTracker) Request(key int, at time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.sent) < latency_max_pending {
+		t.sent[key] = at
+	}
+}
+
+// Milliseconds from the end of request key to a response starting at
+// the given time, 0 if the request isn't known. Requests up to key are
+// forgotten, their responses won't come any more.
+func (t *LatencyTracker) Response(key int, at time.Time) float64 {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sent, ok := t.sent[key]
+	for k := range t.sent {
+		if k <= key {
+			delete(t.sent, k)
+		}
+	}
+	if !ok {
+		return 0
+	}
+	return max(float64(at.Sub(sent))/float64(time.Millisecond), 0.001) // 0 means unmatched
+}
+
+func init_measure_latency() {
+	if !*measure_latency {
+		return
+	}
+	switch *proto {
+	case "http", "redis", "postgres", "auto":
+	default:
+		die("-measure-latency works with -proto http, redis, postgres or auto")
+	}
+}
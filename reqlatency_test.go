@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyTracker(t *testing.T) {
+	saved := *measure_latency
+	t.Cleanup(func() { *measure_latency = saved })
+	*measure_latency = false
+	if l := NewLatencyTracker(); l != nil || l.Response(0, time.Now()) != 0 {
+		t.Error("a tracker without -measure-latency")
+	}
+	*measure_latency = true
+	l := NewLatencyTracker()
+	start := time.Now()
+	l.Request(0, start)
+	l.Request(1, start.Add(time.Millisecond))
+	l.Request(2, start.Add(2*time.Millisecond))
+	if ms := l.Response(1, start.Add(11*time.Millisecond)); ms != 10 {
+		t.Errorf("latency %v ms, want 10", ms)
+	}
+	if ms := l.Response(0, start.Add(20*time.Millisecond)); ms != 0 {
+		t.Errorf("latency %v ms for a request answered out of turn", ms)
+	}
+	if ms := l.Response(2, start.Add(2*time.Millisecond)); ms != 0.001 {
+		t.Errorf("latency %v ms for an immediate response, want the smallest", ms)
+	}
+	if len(l.sent) != 0 {
+		t.Errorf("%d requests still waiting", len(l.sent))
+	}
+}
+
+// A Redis client pipelines two GETs; the server answers the first after
+// about 30 ms and the second 30 ms later
+func TestRedisLatency(t *testing.T) {
+	saved := *measure_latency
+	t.Cleanup(func() { *measure_latency = saved })
+	*measure_latency = true
+	logger := make(chan *LogEvent)
+	request, response := new_redis_parsers(1, logger, "127.0.0.1-50000", "127.0.0.1-6379")
+	next := func(want string) *LogEvent {
+		select {
+		case e := <-logger:
+			if e.Event != want {
+				t.Fatalf("a %s event, want %s", e.Event, want)
+			}
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s event", want)
+		}
+		return nil
+	}
+	request.Feed([]byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n*2\r\n$3\r\nGET\r\n$1\r\nb\r\n"))
+	next("redis_command")
+	next("redis_command")
+	var latency []float64
+	for _, reply := range []string{"$1\r\n1\r\n", "$-1\r\n"} {
+		time.Sleep(30 * time.Millisecond)
+		response.Feed([]byte(reply))
+		e := next("redis_reply")
+		if e.Redis.InReplyTo != "GET" {
+			t.Errorf("%q in reply to %q", reply, e.Redis.InReplyTo)
+		}
+		latency = append(latency, e.LatencyMS)
+	}
+	go func() {
+		for range logger {
+		}
+	}()
+	request.Close()
+	response.Close()
+	close(logger)
+	if latency[0] < 30 || latency[1] < latency[0]+30 || latency[1] > 5000 {
+		t.Errorf("latencies %v ms, want about 30 and 60", latency)
+	}
+}
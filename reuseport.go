@@ -0,0 +1,60 @@
+/*
+Sharing the listen port between processes (-reuseport).
+
+With -reuseport the TCP and UDP listeners set SO_REUSEPORT, so several
+gotcpspy processes started with it can listen on the same port and the
+kernel spreads new connections over them. That allows restarts without
+downtime: start the new process, then stop the old one with SIGTERM;
+it stops accepting and drains its connections while the new one takes
+all new clients. All processes sharing the port must be started with
+-reuseport, by the same user.
+
+The OS has to support SO_REUSEPORT: Linux 3.9 or later balances between
+the listeners, the BSDs and macOS accept the option too. Elsewhere the
+listener fails to start. Each process writes its own logs, so give them
+their own -output-dir (or -log-prefix) with connection numbers starting
+at 1 in each.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"runtime"
+	"syscall"
+)
+
+var reuseport *bool = flag.Bool("reuseport", false, "set SO_REUSEPORT on the listeners, so that several gotcpspy processes can share the port")
+
+// The syscall package only has SO_REUSEPORT for some systems
+var so_reuseport = map[string]int{
+	"linux":   0xf,
+	"android": 0xf,
+	"darwin":  0x200,
+	"freebsd": 0x200,
+	"netbsd":  0x200,
+	"openbsd": 0x200,
+}
+
+// Sets the socket options the listeners need, before they bind
+func listen_control(network, address string, c syscall.RawConn) error {
+	if !*reuseport {
+		return nil
+	}
+	opt, ok := so_reuseport[runtime.GOOS]
+	if !ok {
+		return errors.New("SO_REUSEPORT is not supported on " + runtime.GOOS)
+	}
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, opt, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// How the TCP and UDP listeners of the mappings are opened
+var listen_config = &net.ListenConfig{Control: listen_control}
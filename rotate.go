@@ -0,0 +1,269 @@
+/*
+Log rotation.
+
+A log file is rotated when it would grow past -max-log-size, or for all
+open logs at once on SIGHUP. Rotated parts get a numeric suffix:
+log-....log, log-....log.1, log-....log.2, ... With -compress the size
+is counted before compression. -log-rotate-count N keeps only the N
+latest parts of each log: after a rotation the oldest ones are deleted,
+in a goroutine of their own so the logger doesn't wait for it.
+
+With -append-log a log file that already exists, e.g. from before a
+restart with a -log-name-template that gives the same names again, is
+added to instead of replaced, and its size counts towards -max-log-size.
+Each connection starts its part of a connection log with a
+"=== Session started at ... ===" line (a session_started event in the
+json and logfmt formats). Connections that log to the same file at the
+same time get their events interleaved.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var (
+	max_log_size     *int64 = flag.Int64("max-log-size", 0, "rotate log files at this many bytes (0 means never)")
+	append_log       *bool  = flag.Bool("append-log", false, "append to existing log files instead of replacing them")
+	log_rotate_count *int   = flag.Int("log-rotate-count", 0, "keep only this many parts of each rotated log file, the current one included (0 keeps all)")
+)
+
+var rotation = &broadcast{ch: make(chan struct{})}
+
+// Wakes up every goroutine waiting on it, any number of times
+type broadcast struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func (b *broadcast) wait() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ch
+}
+
+func (b *broadcast) notify() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	close(b.ch)
+	b.ch = make(chan struct{})
+}
+
+// Asks all loggers to rotate whenever SIGHUP arrives
+func rotate_on_sighup() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			rotation.notify()
+		}
+	}()
+}
+
+// A log file that moves on to the next numbered part when rotated
+type RotatingFile struct {
+	mu       sync.Mutex
+	name     string
+	max_size int64
+	f        *os.File
+	z        log_compression // nil without -compress
+	written  int64
+	part     int
+}
+
+func CreateRotatingFile(name string, max_size int64) (*RotatingFile, error) {
+	r := &RotatingFile{name: name, max_size: max_size}
+	if err := r.open(name); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Makes name the current part, compressing it if asked to
+func (r *RotatingFile) open(name string) error {
+	var f *os.File
+	var err error
+	if *append_log {
+		f, err = os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	} else {
+		f, err = os.Create(name)
+	}
+	if err != nil {
+		return err
+	}
+	written := int64(0)
+	if *append_log {
+		if info, err := f.Stat(); err == nil {
+			written = info.Size()
+		}
+	}
+	var z log_compression
+	if c := selected_compressor(); c != nil {
+		if z, err = c.new_writer(f); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	r.close()
+	r.f, r.z, r.written = f, z, written
+	return nil
+}
+
+func (r *RotatingFile) close() error {
+	if r.f == nil {
+		return nil
+	}
+	if r.z != nil {
+		r.z.Close() // writes the trailer
+	}
+	return r.f.Close()
+}
+
+func (r *RotatingFile) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.max_size > 0 && r.written > 0 && r.written+int64(len(b)) > r.max_size {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if r.z != nil {
+		n, err = r.z.Write(b)
+	} else {
+		n, err = r.f.Write(b)
+	}
+	r.written += int64(n)
+	return n, err
+}
+
+// Flushes the compressor too, so the file can be read up to here
+func (r *RotatingFile) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.z != nil {
+		if err := r.z.Flush(); err != nil {
+			return err
+		}
+	}
+	return r.f.Sync()
+}
+
+func (r *RotatingFile) Rotate() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.written == 0 {
+		return nil // nothing to rotate away
+	}
+	return r.rotate()
+}
+
+// Opens the next part first, so a failure leaves the current one in use
+func (r *RotatingFile) rotate() error {
+	if err := r.open(log_part_name(r.name, r.part+1)); err != nil {
+		return err
+	}
+	r.part += 1
+	if *log_rotate_count > 0 {
+		go func(name string) {
+			if err := rotations.Prune(name, *log_rotate_count); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to delete old parts of %s, %v\n", name, err)
+			}
+		}(r.name)
+	}
+	return nil
+}
+
+// Deletes the parts of rotated logs beyond -log-rotate-count
+type RotationManager struct {
+	mu sync.Mutex // one pruning at a time, two could pick the same files
+}
+
+var rotations = &RotationManager{}
+
+// Keeps the max_count latest parts of the log prefix, the name of its
+// first part, and deletes the older ones. The latest are those written
+// last, or with the higher part number when that is the same.
+func (m *RotationManager) Prune(prefix string, max_count int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ext := ""
+	if c := compressor_for(prefix); c != nil {
+		ext = c.ext
+	}
+	dir, base := filepath.Split(prefix)
+	parts := regexp.MustCompile("^" + regexp.QuoteMeta(strings.TrimSuffix(base, ext)) + `(?:\.([0-9]+))?` + regexp.QuoteMeta(ext) + "$")
+	entries, err := os.ReadDir(filepath.Join(dir, "."))
+	if err != nil {
+		return err
+	}
+	type part struct {
+		name string
+		n    int
+		info os.FileInfo
+	}
+	var found []part
+	for _, e := range entries {
+		match := parts.FindStringSubmatch(e.Name())
+		if match == nil || !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue // deleted meanwhile
+		}
+		n, _ := strconv.Atoi(match[1]) // 0 for the first part
+		found = append(found, part{filepath.Join(dir, e.Name()), n, info})
+	}
+	if len(found) <= max_count {
+		return nil
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if t, u := found[i].info.ModTime(), found[j].info.ModTime(); !t.Equal(u) {
+			return t.After(u)
+		}
+		return found[i].n > found[j].n
+	})
+	var first error
+	for _, p := range found[max_count:] {
+		if err := os.Remove(p.name); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// The name of a rotated part of the log name, numbered from 1
+func log_part_name(name string, part int) string {
+	if c := compressor_for(name); c != nil {
+		return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(name, c.ext), part, c.ext)
+	}
+	return fmt.Sprintf("%s.%d", name, part)
+}
+
+func init_append_log() {
+	if *append_log && *record_timing {
+		die("-append-log can't be combined with -record-timing, the .timing offsets would no longer match")
+	}
+	if *log_rotate_count < 0 {
+		die("-log-rotate-count can't be negative")
+	}
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.close()
+}
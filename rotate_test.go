@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotationManagerPrune(t *testing.T) {
+	saved := *compress
+	t.Cleanup(func() { *compress = saved })
+	tests := []struct {
+		name      string
+		compress  string
+		same_time bool // all parts with the same modification time
+	}{
+		{"plain", "", false},
+		{"gzip", "gzip", false},
+		{"same modification time", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*compress = tt.compress
+			dir := t.TempDir()
+			first := compressed_name(filepath.Join(dir, "log-0001.log"))
+			others := []string{"log-0002.log", "log-0001.log.timing", "log-0001.log.x"}
+			for _, name := range others {
+				os.WriteFile(filepath.Join(dir, name), nil, 0644)
+			}
+			var parts []string
+			written := time.Now().Add(-time.Hour)
+			for part := 0; part < 5; part++ {
+				name := first
+				if part > 0 {
+					name = log_part_name(first, part)
+				}
+				os.WriteFile(name, []byte("x"), 0644)
+				if !tt.same_time {
+					written = written.Add(time.Minute)
+				}
+				os.Chtimes(name, written, written)
+				parts = append(parts, filepath.Base(name))
+			}
+
+			if err := rotations.Prune(first, 3); err != nil {
+				t.Fatal(err)
+			}
+			entries, _ := os.ReadDir(dir)
+			var left []string
+			for _, e := range entries {
+				left = append(left, e.Name())
+			}
+			want := append(append([]string(nil), others...), parts[2:]...)
+			sort.Strings(want)
+			if len(left) != len(want) {
+				t.Fatalf("left %v, want %v", left, want)
+			}
+			for i := range want {
+				if left[i] != want[i] {
+					t.Fatalf("left %v, want %v", left, want)
+				}
+			}
+
+			// fewer parts than the limit is left alone
+			if err := rotations.Prune(first, 3); err != nil {
+				t.Fatal(err)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != len(want) {
+				t.Errorf("a second Prune left %d files, want %d", len(entries), len(want))
+			}
+		})
+	}
+}
+
+// Two connections one after the other log to the same file with
+// -append-log, after what was in it before, each behind its own
+// separator
+func TestAppendLogSessions(t *testing.T) {
+	saved_append, saved_template, saved_dir := *append_log, *log_name_template, *output_dir
+	t.Cleanup(func() {
+		*append_log, *log_name_template, *output_dir = saved_append, saved_template, saved_dir
+		init_log_names()
+	})
+	*append_log = true
+	*log_name_template = `{{.Prefix}}-{{.ListenPort}}-{{.Kind}}{{if .Peer}}-{{.Peer}}{{end}}.log`
+	*output_dir = t.TempDir()
+	init_log_names()
+	buffer_pool = NewBufferPool(*buf_size)
+
+	echo := start_echo_server(t)
+	host, port, _ := net.SplitHostPort(echo.Addr().String())
+	m := &mapping{listen_port: free_port(t), host: host, port: port, log_prefix: filepath.Join(*output_dir, "log")}
+	log_name := filepath.Join(*output_dir, "log-"+m.listen_port+"-log.log")
+	const before = "from before the restart\n"
+	os.WriteFile(log_name, []byte(before), 0644)
+	p := NewProxy(m)
+	sessions := make(chan *Session, 2)
+	p.OnConnection(func(s *Session) { sessions <- s })
+	run_proxy(t, p)
+
+	read_log := func() string {
+		b, _ := os.ReadFile(log_name)
+		return string(b)
+	}
+	for i, msg := range []string{"first", "second"} {
+		conn := dial_proxy(t, m.listen_port)
+		conn.Write([]byte(msg))
+		if _, err := io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		<-sessions
+		// the next connection starts once this one's log is complete
+		wait_for(t, "the end of the session's log", func() bool { return strings.Count(read_log(), "Finished at ") == i+1 })
+	}
+	active_connections.Wait()
+
+	log := read_log()
+	rest := log
+	for _, part := range []string{before, "=== Session started at ", "|first|", "Finished at ",
+		"=== Session started at ", "|second|", "Finished at "} {
+		i := strings.Index(rest, part)
+		if i < 0 {
+			t.Fatalf("no %q in order in\n%s", part, log)
+		}
+		rest = rest[i+len(part):]
+	}
+	if !strings.HasPrefix(log, before) || strings.Count(log, "=== Session started at ") != 2 {
+		t.Errorf("logged\n%s\nwant what was there and two sessions after it", log)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Rules that can change while the proxy runs (-rules-file).
+
+The rules file is a JSON object such as
+
+	{
+	  "filter_regex": "(?i)password=(?P<password>[^&]*)",
+	  "inject": [{"direction":"client","offset":0,"bytes":"0d0a","mode":"prepend"}],
+	  "throttle": {"client_bps": 2048, "server_bps": 0}
+	}
+
+filter_regex replaces -filter-regex ("" turns the filter off), inject is
+a list of -inject-file rules and replaces that file, and the throttle
+values replace -throttle-client-bps and -throttle-server-bps (0 means
+unlimited). Anything left out keeps its command line value.
+
+The file is checked for changes every second and reloaded; a file that
+doesn't load leaves the previous rules in place. Open connections pick
+up new rules at their next chunk. Injection rules start over with the
+new set, but offsets that a connection has already passed never fire.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var rules_file *string = flag.String("rules-file", "", "JSON file with filter, injection and throttle rules, reloaded when it changes")
+
+const rules_poll = time.Second
+
+type RulesFile struct {
+	FilterRegex *string          `json:"filter_regex"`
+	Inject      []*InjectionRule `json:"inject"`
+	Throttle    struct {
+		ClientBPS *int `json:"client_bps"`
+		ServerBPS *int `json:"server_bps"`
+	} `json:"throttle"`
+}
+
+// The rules in effect, merged with the command line
+type rule_set struct {
+	version                int
+	filter                 *regexp.Regexp // nil when not filtering
+	inject                 []*InjectionRule
+	client_bps, server_bps int
+}
+
+type RuleEngine struct {
+	mu    sync.RWMutex
+	rules *rule_set
+}
+
+var rule_engine *RuleEngine // nil without -rules-file
+
+// Loads path and makes it the current rule set. On error the current
+// rules stay as they are.
+func (re *RuleEngine) Reload(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var f RulesFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	r := &rule_set{
+		inject:     injection_rules,
+		client_bps: *throttle_client_bps,
+		server_bps: *throttle_server_bps,
+	}
+	expr := *filter_regex
+	if f.FilterRegex != nil {
+		expr = *f.FilterRegex
+	}
+	if expr != "" {
+		if r.filter, err = regexp.Compile(expr); err != nil {
+			return fmt.Errorf("%s: filter_regex: %v", path, err)
+		}
+	}
+	if f.Inject != nil {
+		if err := check_injection_rules(f.Inject, path); err != nil {
+			return err
+		}
+		r.inject = f.Inject
+	}
+	if f.Throttle.ClientBPS != nil {
+		r.client_bps = *f.Throttle.ClientBPS
+	}
+	if f.Throttle.ServerBPS != nil {
+		r.server_bps = *f.Throttle.ServerBPS
+	}
+
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	if re.rules != nil {
+		r.version = re.rules.version
+	}
+	r.version += 1
+	re.rules = r
+	return nil
+}
+
+// The current rule set; callers must not modify it
+func (re *RuleEngine) Rules() *rule_set {
+	re.mu.RLock()
+	defer re.mu.RUnlock()
+	return re.rules
+}
+
+// Polls path and reloads it whenever its size or modification time changes
+func (re *RuleEngine) Watch(path string) {
+	last, _ := os.Stat(path)
+	for range time.Tick(rules_poll) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue // being replaced, or gone until it comes back
+		}
+		if last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+			continue
+		}
+		last = fi
+		if err := re.Reload(path); err != nil {
+			fmt.Printf("Unable to reload rules, keeping the previous ones, %v\n", err)
+		} else {
+			fmt.Printf("Reloaded rules from %s\n", path)
+		}
+	}
+}
+
+// Picks up reloaded injection rules at a chunk boundary
+func (c *Channel) refresh_injector() {
+	if rule_engine == nil {
+		return
+	}
+	r := rule_engine.Rules()
+	if r.version != c.rules_version {
+		c.injector = NewInjector(r.inject, c.direction)
+		c.rules_version = r.version
+	}
+}
+
+// Current throttle limits; without -rules-file only the flags count
+func client_bps() int {
+	if rule_engine == nil {
+		return *throttle_client_bps
+	}
+	return rule_engine.Rules().client_bps
+}
+
+func server_bps() int {
+	if rule_engine == nil {
+		return *throttle_server_bps
+	}
+	return rule_engine.Rules().server_bps
+}
+
+// Loads -rules-file, if given, and starts watching it
+func init_rules() {
+	if *rules_file == "" {
+		return
+	}
+	rule_engine = &RuleEngine{}
+	if err := rule_engine.Reload(*rules_file); err != nil {
+		die("Unable to load rules, %v", err)
+	}
+	go rule_engine.Watch(*rules_file)
+}
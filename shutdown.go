@@ -0,0 +1,104 @@
+/*
+Graceful shutdown.
+
+On SIGINT or SIGTERM the listeners are closed and the active connections
+get -drain-timeout to finish on their own before they are closed, so
+every log file is completed either way. A second signal exits right
+away, leaving the logs of the connections still open unfinished.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var drain_timeout *time.Duration = flag.Duration("drain-timeout", 30*time.Second,
+	"time active connections get to finish on shutdown")
+
+var (
+	active_connections sync.WaitGroup // one per process_connection
+	open_conns         = &conn_set{conns: make(map[net.Conn]bool)}
+
+	// Parent of every connection's context, cancelled when the drain
+	// timeout runs out
+	connections_ctx, cancel_connections = context.WithCancel(context.Background())
+)
+
+// Sockets of the active connections, closed on a forced shutdown
+type conn_set struct {
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+func (s *conn_set) add(c net.Conn) {
+	s.mu.Lock()
+	s.conns[c] = true
+	s.mu.Unlock()
+}
+
+func (s *conn_set) remove(c net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+}
+
+func (s *conn_set) close_all() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// A context that is cancelled on the first SIGINT/SIGTERM, which makes
+// the proxies close their listeners; the second one exits
+func cancel_on_signal() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		fmt.Printf("Received %s, no longer accepting connections\n", s)
+		cancel()
+		s = <-sig
+		stop_tui()
+		fmt.Printf("Received %s again, exiting without waiting for the connections\n", s)
+		remove_pid_file()
+		os.Exit(1)
+	}()
+	return ctx
+}
+
+// Waits for the active connections and returns the exit code: 0 if they
+// all finished in time, 1 if they had to be closed
+func drain(timeout time.Duration) int {
+	stop_tui() // the shutdown messages go to the terminal again
+	done := make(chan bool)
+	go func() {
+		active_connections.Wait()
+		close(done)
+	}()
+	defer stop_metrics_server()
+	defer close_log_store()
+	defer remove_pid_file()
+	select {
+	case <-done:
+		fmt.Printf("All connections finished\n")
+		return 0
+	case <-time.After(timeout):
+	}
+	fmt.Printf("Drain timeout after %s, closing active connections\n", timeout)
+	cancel_connections()
+	open_conns.close_all() // the ones still dialing or in a handshake
+	<-done                 // pass_through notices the closed sockets and stops the loggers
+	return 1
+}
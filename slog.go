@@ -0,0 +1,124 @@
+/*
+Connection logs as log/slog records (-format json and -format logfmt).
+
+Apart from the hex dumps of -format text, connection logs are written
+through log/slog: every LogEvent becomes a record named after the event,
+and the connection, direction, peer, packet number, offset and length
+become attributes, followed by the message text, the hex dump and the
+decoded protocol record if there is one. The keys are the JSON names of
+the LogEvent fields, with the record's time as timestamp and its message
+as event, so -format json can still be read back by analyze:
+
+	timestamp=... level=INFO event=received conn_id=1 direction=client→server peer=127.0.0.1-8080 packet_seq=0 byte_offset=0 length=18
+
+json gives one JSON object per line and logfmt the key=value lines of
+slog's text handler. Errors are logged at level WARN.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Picks slog's JSON handler for json and its text handler for logfmt,
+// both with the LogEvent names for time and message
+func NewSlogHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{ReplaceAttr: event_keys}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+func event_keys(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 {
+		switch a.Key {
+		case slog.TimeKey:
+			a.Key = "timestamp"
+		case slog.MessageKey:
+			a.Key = "event"
+		}
+	}
+	return a
+}
+
+type SlogLogger struct {
+	h      slog.Handler
+	logfmt bool // the decoded records as JSON values, not Go structs
+}
+
+func NewSlogLogger(w io.Writer, format string) *SlogLogger {
+	return &SlogLogger{NewSlogHandler(w, format), format != "json"}
+}
+
+func (l *SlogLogger) Log(e *LogEvent) error {
+	level := slog.LevelInfo
+	switch e.Event {
+	case "network_error", "write_error", "dropped":
+		level = slog.LevelWarn
+	}
+	r := slog.NewRecord(e.Timestamp, level, e.Event, 0)
+	r.AddAttrs(slog.Int("conn_id", e.ConnID))
+	if e.Direction != "" {
+		r.AddAttrs(slog.String("direction", e.Direction))
+	}
+	if e.Peer != "" {
+		r.AddAttrs(slog.String("peer", e.Peer))
+	}
+	r.AddAttrs(slog.Int("packet_seq", e.PacketSeq), slog.Int("byte_offset", e.ByteOffset), slog.Int("length", e.Length))
+	if e.Message != "" {
+		r.AddAttrs(slog.String("message", e.Message))
+	}
+	if e.HexPayload != "" {
+		r.AddAttrs(slog.String("hex_payload", e.HexPayload))
+	}
+	if e.LatencyMS > 0 {
+		r.AddAttrs(slog.Float64("request_latency_ms", e.LatencyMS))
+	}
+	if name, rec := event_record(e); rec != nil && l.logfmt {
+		var b strings.Builder
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false) // keep <addresses> of SMTP readable
+		enc.Encode(rec)
+		r.AddAttrs(slog.String(name, strings.TrimSuffix(b.String(), "\n")))
+	} else if rec != nil {
+		r.AddAttrs(slog.Any(name, rec))
+	}
+	return l.h.Handle(context.Background(), r)
+}
+
+// The decoded protocol record an event carries, under its JSON name
+func event_record(e *LogEvent) (string, any) {
+	switch {
+	case e.HTTP != nil:
+		return "http", e.HTTP
+	case e.WebSocket != nil:
+		return "websocket", e.WebSocket
+	case e.GRPC != nil:
+		return "grpc", e.GRPC
+	case e.HTTP2 != nil:
+		return "h2", e.HTTP2
+	case e.MQTT != nil:
+		return "mqtt", e.MQTT
+	case e.Redis != nil:
+		return "redis", e.Redis
+	case e.Postgres != nil:
+		return "postgres", e.Postgres
+	case e.MySQL != nil:
+		return "mysql", e.MySQL
+	case e.FTP != nil:
+		return "ftp", e.FTP
+	case e.SMTP != nil:
+		return "smtp", e.SMTP
+	case e.DNS != nil:
+		return "dns", e.DNS
+	case e.Modbus != nil:
+		return "modbus", e.Modbus
+	}
+	return "", nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func slog_test_events() []*LogEvent {
+	at := time.Date(2026, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	return []*LogEvent{
+		{Timestamp: at, ConnID: 1, Event: "connected", Message: "Connected to 127.0.0.1:6379"},
+		{Timestamp: at, ConnID: 1, Event: "received", Direction: client_to_server, Peer: "127.0.0.1-50000",
+			PacketSeq: 2, ByteOffset: 14, Length: 14, HexPayload: "00000000  2a 31 0d 0a 24 34 0d 0a  50 49 4e 47 0d 0a        |*1..$4..PING..|"},
+		{Timestamp: at, ConnID: 1, Event: "received", Direction: server_to_client, Peer: "127.0.0.1-6379",
+			Length: 7, Redis: &RedisRecord{Reply: "PONG", InReplyTo: "PING"}, LatencyMS: 1.5},
+		{Timestamp: at, ConnID: 1, Event: "network_error", Message: "read: connection reset by peer"},
+	}
+}
+
+func TestSlogLoggerLogfmt(t *testing.T) {
+	var b bytes.Buffer
+	l := NewSlogLogger(&b, "logfmt")
+	for _, e := range slog_test_events() {
+		if err := l.Log(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{
+		`timestamp=2026-01-02T03:04:05.123Z level=INFO event=connected conn_id=1 packet_seq=0 byte_offset=0 length=0 message="Connected to 127.0.0.1:6379"`,
+		`timestamp=2026-01-02T03:04:05.123Z level=INFO event=received conn_id=1 direction=client→server peer=127.0.0.1-50000 packet_seq=2 byte_offset=14 length=14 hex_payload="00000000  2a 31 0d 0a 24 34 0d 0a  50 49 4e 47 0d 0a        |*1..$4..PING..|"`,
+		`timestamp=2026-01-02T03:04:05.123Z level=INFO event=received conn_id=1 direction=server→client peer=127.0.0.1-6379 packet_seq=0 byte_offset=0 length=7 request_latency_ms=1.5 redis="{\"reply\":\"PONG\",\"in_reply_to\":\"PING\"}"`,
+		`timestamp=2026-01-02T03:04:05.123Z level=WARN event=network_error conn_id=1 packet_seq=0 byte_offset=0 length=0 message="read: connection reset by peer"`,
+	}
+	if got := strings.TrimSuffix(b.String(), "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("logged\n%s\nwant\n%s", got, strings.Join(want, "\n"))
+	}
+}
+
+// The JSON lines read back as the events they were made from
+func TestSlogLoggerJSON(t *testing.T) {
+	var b bytes.Buffer
+	l := NewSlogLogger(&b, "json")
+	events := slog_test_events()
+	for _, e := range events {
+		if err := l.Log(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != len(events) {
+		t.Fatalf("%d lines for %d events:\n%s", len(lines), len(events), b.String())
+	}
+	if want := `{"timestamp":"2026-01-02T03:04:05.123456789Z","level":"INFO","event":"connected","conn_id":1,`; !strings.HasPrefix(lines[0], want) {
+		t.Errorf("%s\ndoesn't start with\n%s", lines[0], want)
+	}
+	for i, line := range lines {
+		var e LogEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		if !reflect.DeepEqual(&e, events[i]) {
+			t.Errorf("%s\nread back as %+v, want %+v", line, e, *events[i])
+		}
+	}
+}
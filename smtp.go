@@ -0,0 +1,468 @@
+/*
+SMTP decoding for the connection log (-proto smtp).
+
+Commands and replies are logged one per entry, like the FTP ones:
+
+	C→S: MAIL FROM:<alice@example.com>
+	S→C: 250 2.1.0 Ok (MAIL)
+
+The client side is a state machine: after DATA is accepted the lines up
+to the lone "." are the message, which is un-dot-stuffed and saved next
+to the connection log as <log name>-<n>.eml; after AUTH PLAIN and AUTH
+LOGIN the base64 credentials are decoded and the password redacted
+unless -show-passwords is given.
+
+When the client asks for STARTTLS and -ca-cert/-ca-key are given, the
+plaintext start of the session is relayed line by line so that the TLS
+handshakes can be taken over right after the server's 220: the rest of
+the session is intercepted like in -tls mode and logged decrypted.
+Without a CA the session is passed on untouched and what follows
+STARTTLS is logged as hex dumps.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	smtp_max_line  = 64 * 1024
+	smtp_queue     = 256                     // pipelined commands waiting for their reply
+	smtp_data_wait = 1000 * time.Millisecond // for the reply to DATA, before the body is assumed
+)
+
+type SMTPRecord struct {
+	Command     string `json:"command,omitempty"`
+	Argument    string `json:"argument,omitempty"`
+	Code        int    `json:"code,omitempty"`
+	Text        string `json:"text,omitempty"` // of a reply, the lines joined with \n
+	InReplyTo   string `json:"in_reply_to,omitempty"`
+	Mechanism   string `json:"mechanism,omitempty"` // of AUTH
+	User        string `json:"user,omitempty"`
+	Password    string `json:"password,omitempty"`
+	MessageFile string `json:"message_file,omitempty"`
+	MessageSize int    `json:"message_size,omitempty"`
+	Lines       int    `json:"lines,omitempty"`
+}
+
+// Where the client side of the dialogue is
+type smtp_state int
+
+const (
+	smtp_command    smtp_state = iota
+	smtp_data_reply            // DATA sent, the server's 354 decides
+	smtp_body
+	smtp_auth_user // AUTH LOGIN, the base64 user name comes next
+	smtp_auth_pass
+	smtp_auth_plain // AUTH PLAIN without an initial response
+	smtp_starttls_reply
+	smtp_encrypted // STARTTLS without -ca-cert, nothing more to decode
+)
+
+// Decodes the client's lines. accepted learns from the reply side whether
+// DATA or STARTTLS went ahead.
+type SMTPParser struct {
+	state     smtp_state
+	accepted  chan bool
+	intercept bool        // STARTTLS leads to TLS interception
+	expects   string      // the command a reply to the last line answers
+	auth      *SMTPRecord // being collected
+	message   *os.File
+	eml       string // name prefix for the saved messages
+	messages  int
+	body_size int
+	body_n    int
+}
+
+func NewSMTPParser(eml_prefix string, accepted chan bool, intercept bool) *SMTPParser {
+	return &SMTPParser{eml: eml_prefix, accepted: accepted, intercept: intercept}
+}
+
+// Waits for the verdict on DATA or STARTTLS, the line at hand says the
+// client didn't
+func (p *SMTPParser) was_accepted() bool {
+	select {
+	case ok := <-p.accepted:
+		return ok
+	case <-time.After(smtp_data_wait):
+		return true
+	}
+}
+
+// Returns the record a client line completes, nil while inside a message
+// or an exchange of AUTH lines
+func (p *SMTPParser) ParseCommand(line string) *SMTPRecord {
+	p.expects = ""
+	switch p.state {
+	case smtp_data_reply:
+		p.state = smtp_command
+		if p.was_accepted() {
+			p.start_message()
+		}
+	case smtp_starttls_reply:
+		p.state = smtp_command
+		if p.was_accepted() && !p.intercept {
+			p.state = smtp_encrypted
+		}
+	}
+	if p.state == smtp_encrypted {
+		return nil
+	}
+	text := strings.TrimRight(line, "\r\n")
+	switch p.state {
+	case smtp_body:
+		return p.body_line(line, text)
+	case smtp_auth_user, smtp_auth_pass, smtp_auth_plain:
+		p.expects = "AUTH"
+		return p.auth_line(text)
+	}
+	cmd, arg, _ := strings.Cut(text, " ")
+	rec := &SMTPRecord{Command: strings.ToUpper(cmd), Argument: arg}
+	p.expects = rec.Command
+	switch rec.Command {
+	case "DATA":
+		p.state = smtp_data_reply
+	case "STARTTLS":
+		p.state = smtp_starttls_reply
+	case "AUTH":
+		mech, initial, _ := strings.Cut(arg, " ")
+		rec.Mechanism = strings.ToUpper(mech)
+		rec.Argument = rec.Mechanism
+		switch rec.Mechanism {
+		case "PLAIN":
+			if initial == "" {
+				p.auth, p.state = rec, smtp_auth_plain
+				return nil
+			}
+			smtp_plain_credentials(rec, initial)
+		case "LOGIN":
+			p.auth, p.state = rec, smtp_auth_user
+			if initial != "" {
+				rec.User = smtp_base64(initial)
+				p.state = smtp_auth_pass
+			}
+			return nil
+		}
+	}
+	return rec
+}
+
+func (p *SMTPParser) auth_line(text string) *SMTPRecord {
+	rec := p.auth
+	if text == "*" { // the client gave up
+		p.auth, p.state = nil, smtp_command
+		rec.Argument += " (cancelled)"
+		return rec
+	}
+	switch p.state {
+	case smtp_auth_user:
+		rec.User = smtp_base64(text)
+		p.state = smtp_auth_pass
+		return nil
+	case smtp_auth_pass:
+		rec.Password = smtp_password(smtp_base64(text))
+	case smtp_auth_plain:
+		smtp_plain_credentials(rec, text)
+	}
+	p.auth, p.state = nil, smtp_command
+	return rec
+}
+
+// authzid NUL authcid NUL passwd
+func smtp_plain_credentials(rec *SMTPRecord, b64 string) {
+	f := strings.Split(smtp_base64(b64), "\x00")
+	if len(f) == 3 {
+		rec.User, rec.Password = f[1], smtp_password(f[2])
+	}
+}
+
+func smtp_base64(s string) string {
+	d, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return "[not base64] " + s
+	}
+	return string(d)
+}
+
+func smtp_password(s string) string {
+	if *show_passwords || s == "" {
+		return s
+	}
+	return "[REDACTED]"
+}
+
+func (p *SMTPParser) start_message() {
+	p.state, p.body_size, p.body_n = smtp_body, 0, 0
+	p.messages += 1
+	name := fmt.Sprintf("%s-%d.eml", p.eml, p.messages)
+	f, err := os.Create(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create file %s, %v\n", name, err)
+		return
+	}
+	p.message = f
+}
+
+func (p *SMTPParser) body_line(line, text string) *SMTPRecord {
+	if text == "." {
+		p.expects = "message"
+		rec := &SMTPRecord{Command: "message", MessageSize: p.body_size, Lines: p.body_n}
+		if p.message != nil {
+			rec.MessageFile = p.message.Name()
+			p.message.Close()
+			p.message = nil
+		}
+		p.state = smtp_command
+		return rec
+	}
+	if strings.HasPrefix(line, ".") { // dot-stuffed
+		line = line[1:]
+	}
+	p.body_size += len(line)
+	p.body_n += 1
+	if p.message != nil {
+		p.message.WriteString(line)
+	}
+	return nil
+}
+
+// A message cut off by the end of the connection is kept as far as it got
+func (p *SMTPParser) Close() {
+	if p.message != nil {
+		p.message.Close()
+	}
+}
+
+// Collects reply lines until the last one of a reply
+type smtp_reply_parser struct {
+	code  int
+	lines []string
+}
+
+func (p *smtp_reply_parser) ParseReply(line string) (*SMTPRecord, error) {
+	code, sep, text := ftp_reply_code(strings.TrimRight(line, "\r\n")) // same format as FTP
+	if code == 0 || (p.code != 0 && code != p.code) {
+		return nil, fmt.Errorf("SMTP reply %q has no reply code", strings.TrimRight(line, "\r\n"))
+	}
+	p.code = code
+	p.lines = append(p.lines, text)
+	if sep == '-' {
+		return nil, nil
+	}
+	rec := &SMTPRecord{Code: code, Text: strings.Join(p.lines, "\n")}
+	p.code, p.lines = 0, nil
+	return rec, nil
+}
+
+// eml_prefix is the connection log name without its extension
+func new_smtp_parsers(conn_n int, logger chan *LogEvent, client_peer, server_peer, eml_prefix string) (request, response *StreamParser) {
+	commands := make(chan string, smtp_queue)
+	accepted := make(chan bool, 1)
+	request = NewStreamParser(conn_n, client_to_server, client_peer, logger, decode_smtp_command(eml_prefix, commands, accepted))
+	response = NewStreamParser(conn_n, server_to_client, server_peer, logger, decode_smtp_reply(commands, accepted))
+	return
+}
+
+// The connection log name without .log (and .gz), for the .eml files
+func smtp_eml_prefix(log_name string) string {
+	for _, ext := range []string{".gz", ".log"} {
+		log_name = strings.TrimSuffix(log_name, ext)
+	}
+	return log_name
+}
+
+func read_smtp_line(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > smtp_max_line {
+		return "", fmt.Errorf("SMTP line longer than %d bytes", smtp_max_line)
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(line), nil
+}
+
+var errSMTPEncrypted = errors.New("encrypted after STARTTLS")
+
+func decode_smtp_command(eml_prefix string, commands chan string, accepted chan bool) decode_func {
+	p := NewSMTPParser(eml_prefix, accepted, cert_authority != nil)
+	return func(r *bufio.Reader) (*LogEvent, error) {
+		line, err := read_smtp_line(r)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		rec := p.ParseCommand(line)
+		if p.state == smtp_encrypted {
+			return nil, errSMTPEncrypted // the rest goes to the hex dump
+		}
+		if p.expects != "" {
+			select {
+			case commands <- p.expects:
+			default:
+			}
+		}
+		if rec == nil || rec.Command == "" {
+			return nil, nil
+		}
+		return &LogEvent{Event: "smtp_command", SMTP: rec}, nil
+	}
+}
+
+func decode_smtp_reply(commands chan string, accepted chan bool) decode_func {
+	p := &smtp_reply_parser{}
+	greeted := false
+	return func(r *bufio.Reader) (*LogEvent, error) {
+		line, err := read_smtp_line(r)
+		if err != nil {
+			return nil, err
+		}
+		rec, err := p.ParseReply(line)
+		if rec == nil {
+			return nil, err
+		}
+		if greeted { // the greeting answers no command
+			select {
+			case rec.InReplyTo = <-commands:
+			case <-time.After(ftp_reply_wait):
+			}
+		}
+		greeted = true
+		if rec.InReplyTo == "DATA" || rec.InReplyTo == "STARTTLS" {
+			select {
+			case accepted <- rec.Code == 354 || rec.Code == 220:
+			default:
+			}
+		}
+		return &LogEvent{Event: "smtp_reply", SMTP: rec}, nil
+	}
+}
+
+func format_smtp(e *LogEvent) string {
+	rec := e.SMTP
+	if e.Event == "smtp_reply" {
+		s := fmt.Sprintf("S→C: %d %s", rec.Code, rec.Text)
+		if rec.InReplyTo != "" {
+			s += " (" + rec.InReplyTo + ")"
+		}
+		return s + "\n"
+	}
+	switch {
+	case rec.Command == "message":
+		s := fmt.Sprintf("C→S: message, %d bytes in %d lines", rec.MessageSize, rec.Lines)
+		if rec.MessageFile != "" {
+			s += ", saved as " + rec.MessageFile
+		}
+		return s + "\n"
+	case rec.Command == "AUTH" && (rec.User != "" || rec.Password != ""):
+		return fmt.Sprintf("C→S: AUTH %s, user %q, password %s\n", rec.Argument, rec.User, rec.Password)
+	}
+	s := "C→S: " + rec.Command
+	if rec.Argument != "" {
+		s += " " + rec.Argument
+	}
+	return s + "\n"
+}
+
+// Gives back what a bufio.Reader read ahead of conn
+func unread_conn(conn net.Conn, r *bufio.Reader) net.Conn {
+	if r.Buffered() == 0 {
+		return conn
+	}
+	b, _ := r.Peek(r.Buffered())
+	return &preamble_conn{conn, io.MultiReader(bytes.NewReader(append([]byte(nil), b...)), conn)}
+}
+
+// Relays the plaintext start of the session through the channels'
+// LoggingWriters, in lockstep, until the client sends anything but EHLO,
+// HELO, NOOP or RSET. If that is a STARTTLS the server accepts, both
+// sides are switched to TLS interception before the copiers start.
+func smtp_starttls(conn_n int, logger chan *LogEvent, request, response *Channel, server_name string) {
+	client := bufio.NewReader(&channel_reader{c: request})
+	server := bufio.NewReader(&channel_reader{c: response})
+	stop_request, stop_response := request.close_on_cancel(), response.close_on_cancel()
+	defer func() {
+		stop_request()
+		stop_response()
+		request.to, response.to = response.from, request.from
+		request.from = unread_conn(request.from, client)
+		response.from = unread_conn(response.from, server)
+	}()
+	to_client, to_server := response.logging_writer(), request.logging_writer()
+	starttls := false
+	for {
+		code, err := relay_smtp_reply(server, to_client)
+		if err != nil {
+			return
+		}
+		if starttls {
+			if code == 220 {
+				smtp_intercept_tls(conn_n, logger, request, response, client, server, server_name)
+			}
+			return
+		}
+		line, err := client.ReadSlice('\n')
+		if len(line) > 0 {
+			to_server.Write(line)
+		}
+		if err != nil {
+			return
+		}
+		verb, _, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO", "NOOP", "RSET":
+		case "STARTTLS":
+			if cert_authority == nil {
+				return
+			}
+			starttls = true
+		default:
+			return
+		}
+	}
+}
+
+// Forwards one complete reply and returns its code
+func relay_smtp_reply(server *bufio.Reader, to_client *LoggingWriter) (int, error) {
+	for {
+		line, err := server.ReadSlice('\n')
+		if len(line) > 0 {
+			to_client.Write(line)
+		}
+		if err != nil {
+			return 0, err
+		}
+		code, sep, _ := ftp_reply_code(strings.TrimRight(string(line), "\r\n"))
+		if code == 0 || sep == ' ' {
+			return code, nil
+		}
+	}
+}
+
+func smtp_intercept_tls(conn_n int, logger chan *LogEvent, request, response *Channel, client, server *bufio.Reader, server_name string) {
+	local, sni, err := tls_accept(unread_conn(request.from, client), cert_authority, server_name)
+	if err == nil {
+		if sni != "" {
+			server_name = sni
+		}
+		var remote net.Conn
+		if remote, err = tls_connect(unread_conn(response.from, server), server_name); err == nil {
+			request.from, response.from = local, remote
+			logger <- log_message(conn_n, "starttls", "STARTTLS, intercepting TLS for %s", server_name)
+			return
+		}
+	}
+	logger <- log_message(conn_n, "network_error", "STARTTLS interception failed, %v", err)
+	request.from.Close()
+	response.from.Close()
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Feeds an SMTP dialogue through new_smtp_parsers one exchange at a time,
+// the client's lines and then the server's answer, as they would arrive.
+// Returns what each side logged, the hex dumps as a ? for each byte.
+func run_smtp_dialogue(t *testing.T, eml_prefix string, exchanges [][2]string) (client, server []string) {
+	t.Helper()
+	logger := make(chan *LogEvent)
+	request, response := new_smtp_parsers(1, logger, "127.0.0.1-50000", "127.0.0.1-25", eml_prefix)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for e := range logger {
+			if e == nil {
+				return
+			}
+			line := strings.TrimSuffix(format_smtp_or_dump(e), "\n")
+			if e.Direction == client_to_server {
+				client = append(client, line)
+			} else {
+				server = append(server, line)
+			}
+		}
+	}()
+	for _, x := range exchanges {
+		if x[0] != "" {
+			request.Feed([]byte(x[0]))
+		}
+		if x[1] != "" {
+			response.Feed([]byte(x[1]))
+		}
+	}
+	request.Close()
+	response.Close()
+	logger <- nil
+	done := make(chan bool)
+	go func() { wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the parsers didn't finish")
+	}
+	return
+}
+
+func format_smtp_or_dump(e *LogEvent) string {
+	if e.SMTP == nil {
+		return strings.Repeat("?", e.Length)
+	}
+	return format_smtp(e)
+}
+
+// RFC 5321 D.1 with EHLO, AUTH LOGIN, a dot-stuffed message and then
+// STARTTLS, which without -ca-cert leaves the rest to the hex dump
+func TestDecodeSMTPDialogue(t *testing.T) {
+	saved := cert_authority
+	t.Cleanup(func() { cert_authority = saved })
+	cert_authority = nil
+
+	prefix := filepath.Join(t.TempDir(), "log-0001")
+	client_hello, server_hello := "\x16\x03\x01\x00\x05hello\n", "\x16\x03\x03\x00\x02\x02\x00"
+	client, server := run_smtp_dialogue(t, prefix, [][2]string{
+		{"", "220 foo.com Simple Mail Transfer Service Ready\r\n"},
+		{"EHLO bar.com\r\n", "250-foo.com greets bar.com\r\n250-8BITMIME\r\n250-AUTH LOGIN PLAIN\r\n250 STARTTLS\r\n"},
+		{"AUTH LOGIN\r\n", "334 VXNlcm5hbWU6\r\n"},
+		{"YWxpY2U=\r\n", "334 UGFzc3dvcmQ6\r\n"},
+		{"czNjcjN0\r\n", "235 2.7.0 Authentication successful\r\n"},
+		{"MAIL FROM:<Smith@bar.com>\r\n", "250 OK\r\n"},
+		{"RCPT TO:<Jones@foo.com>\r\n", "250 OK\r\n"},
+		{"RCPT TO:<Green@foo.com>\r\n", "550 No such user here\r\n"},
+		{"DATA\r\n", "354 Start mail input; end with <CRLF>.<CRLF>\r\n"},
+		{"Subject: dots\r\n\r\nBlah blah blah...\r\n..a line that starts with a dot\r\n.\r\n", "250 OK\r\n"},
+		{"STARTTLS\r\n", "220 Go ahead\r\n"},
+		{client_hello, server_hello},
+	})
+	eml := prefix + "-1.eml"
+	want_client := []string{
+		"C→S: EHLO bar.com",
+		`C→S: AUTH LOGIN, user "alice", password [REDACTED]`,
+		"C→S: MAIL FROM:<Smith@bar.com>",
+		"C→S: RCPT TO:<Jones@foo.com>",
+		"C→S: RCPT TO:<Green@foo.com>",
+		"C→S: DATA",
+		"C→S: message, 68 bytes in 4 lines, saved as " + eml,
+		"C→S: STARTTLS",
+		strings.Repeat("?", len(client_hello)),
+	}
+	want_server := []string{
+		"S→C: 220 foo.com Simple Mail Transfer Service Ready",
+		"S→C: 250 foo.com greets bar.com\n8BITMIME\nAUTH LOGIN PLAIN\nSTARTTLS (EHLO)",
+		"S→C: 334 VXNlcm5hbWU6 (AUTH)",
+		"S→C: 334 UGFzc3dvcmQ6 (AUTH)",
+		"S→C: 235 2.7.0 Authentication successful (AUTH)",
+		"S→C: 250 OK (MAIL)",
+		"S→C: 250 OK (RCPT)",
+		"S→C: 550 No such user here (RCPT)",
+		"S→C: 354 Start mail input; end with <CRLF>.<CRLF> (DATA)",
+		"S→C: 250 OK (message)",
+		"S→C: 220 Go ahead (STARTTLS)",
+		strings.Repeat("?", len(server_hello)),
+	}
+	if strings.Join(client, "\n") != strings.Join(want_client, "\n") {
+		t.Errorf("the client side logged\n%s\nwant\n%s", strings.Join(client, "\n"), strings.Join(want_client, "\n"))
+	}
+	if strings.Join(server, "\n") != strings.Join(want_server, "\n") {
+		t.Errorf("the server side logged\n%s\nwant\n%s", strings.Join(server, "\n"), strings.Join(want_server, "\n"))
+	}
+	b, err := os.ReadFile(eml)
+	if want := "Subject: dots\r\n\r\nBlah blah blah...\r\n.a line that starts with a dot\r\n"; err != nil || string(b) != want {
+		t.Errorf("saved message %q, %v, want %q", b, err, want)
+	}
+}
+
+// A DATA the server refuses is followed by commands, not a message
+func TestDecodeSMTPDataRefused(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), "log-0001")
+	client, _ := run_smtp_dialogue(t, prefix, [][2]string{
+		{"", "220 foo.com ready\r\n"},
+		{"DATA\r\n", "554 No valid recipients\r\n"},
+		{"QUIT\r\n", "221 Bye\r\n"},
+	})
+	if want := "C→S: DATA\nC→S: QUIT"; strings.Join(client, "\n") != want {
+		t.Errorf("the client side logged\n%s\nwant\n%s", strings.Join(client, "\n"), want)
+	}
+	if _, err := os.Stat(prefix + "-1.eml"); err == nil {
+		t.Error("a message was saved for a refused DATA")
+	}
+}
+
+func TestSMTPParserAuth(t *testing.T) {
+	saved := *show_passwords
+	t.Cleanup(func() { *show_passwords = saved })
+	for _, tt := range []struct {
+		name  string
+		show  bool
+		lines []string
+		want  SMTPRecord
+	}{
+		{"PLAIN with initial response", false, []string{"AUTH PLAIN AGFsaWNlAHMzY3IzdA==\r\n"},
+			SMTPRecord{Command: "AUTH", Argument: "PLAIN", Mechanism: "PLAIN", User: "alice", Password: "[REDACTED]"}},
+		{"PLAIN after 334", false, []string{"auth plain\r\n", "AGFsaWNlAHMzY3IzdA==\r\n"},
+			SMTPRecord{Command: "AUTH", Argument: "PLAIN", Mechanism: "PLAIN", User: "alice", Password: "[REDACTED]"}},
+		{"PLAIN with -show-passwords", true, []string{"AUTH PLAIN AGFsaWNlAHMzY3IzdA==\r\n"},
+			SMTPRecord{Command: "AUTH", Argument: "PLAIN", Mechanism: "PLAIN", User: "alice", Password: "s3cr3t"}},
+		{"LOGIN", false, []string{"AUTH LOGIN\r\n", "YWxpY2U=\r\n", "czNjcjN0\r\n"},
+			SMTPRecord{Command: "AUTH", Argument: "LOGIN", Mechanism: "LOGIN", User: "alice", Password: "[REDACTED]"}},
+		{"LOGIN with initial response", false, []string{"AUTH LOGIN YWxpY2U=\r\n", "czNjcjN0\r\n"},
+			SMTPRecord{Command: "AUTH", Argument: "LOGIN", Mechanism: "LOGIN", User: "alice", Password: "[REDACTED]"}},
+		{"LOGIN cancelled", false, []string{"AUTH LOGIN\r\n", "YWxpY2U=\r\n", "*\r\n"},
+			SMTPRecord{Command: "AUTH", Argument: "LOGIN (cancelled)", Mechanism: "LOGIN", User: "alice"}},
+		{"not base64", false, []string{"AUTH LOGIN\r\n", "alice\r\n", "czNjcjN0\r\n"},
+			SMTPRecord{Command: "AUTH", Argument: "LOGIN", Mechanism: "LOGIN", User: "[not base64] alice", Password: "[REDACTED]"}},
+		{"CRAM-MD5 is not decoded", false, []string{"AUTH CRAM-MD5\r\n"},
+			SMTPRecord{Command: "AUTH", Argument: "CRAM-MD5", Mechanism: "CRAM-MD5"}},
+	} {
+		*show_passwords = tt.show
+		p := NewSMTPParser("", make(chan bool), false)
+		var rec *SMTPRecord
+		for i, line := range tt.lines {
+			rec = p.ParseCommand(line)
+			if (rec != nil) != (i == len(tt.lines)-1) {
+				t.Errorf("%s: %q ended the exchange early or not at all", tt.name, line)
+			}
+			if p.expects != "AUTH" {
+				t.Errorf("%s: the reply to %q would answer %q", tt.name, line, p.expects)
+			}
+		}
+		if rec == nil || *rec != tt.want {
+			t.Errorf("%s: %+v, want %+v", tt.name, rec, tt.want)
+		}
+		if p.state != smtp_command {
+			t.Errorf("%s: still in state %d", tt.name, p.state)
+		}
+	}
+}
+
+func TestSMTPReplyParser(t *testing.T) {
+	p := &smtp_reply_parser{}
+	for _, line := range []string{"250-first\r\n", "250-second\r\n"} {
+		if rec, err := p.ParseReply(line); rec != nil || err != nil {
+			t.Fatalf("%q gave %+v, %v", line, rec, err)
+		}
+	}
+	if rec, err := p.ParseReply("250 last\r\n"); err != nil || rec.Code != 250 || rec.Text != "first\nsecond\nlast" {
+		t.Errorf("reply %+v, %v", rec, err)
+	}
+	for _, lines := range [][]string{{"hello\r\n"}, {"250-first\r\n", "251 other code\r\n"}} {
+		p := &smtp_reply_parser{}
+		var err error
+		for _, line := range lines {
+			_, err = p.ParseReply(line)
+		}
+		if err == nil {
+			t.Errorf("%q accepted", lines)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+SOCKS5 server mode (RFC 1928).
+
+The client picks the target per connection with a CONNECT request; only
+the "no authentication" method is offered.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socks5_version       = 5
+	socks5_no_auth       = 0
+	socks5_no_acceptable = 0xff
+	socks5_connect       = 1
+	socks5_ipv4          = 1
+	socks5_domain        = 3
+	socks5_ipv6          = 4
+
+	socks5_succeeded         = 0
+	socks5_general_failure   = 1
+	socks5_cmd_not_supported = 7
+)
+
+// Performs the greeting and reads the CONNECT request, returning the
+// requested target as host:port. Reads exactly the handshake bytes, so
+// nothing the client tunnels afterwards is consumed.
+func ReadSOCKS5Request(conn net.Conn) (addr string, err error) {
+	hdr := make([]byte, 2)
+	if _, err = io.ReadFull(conn, hdr); err != nil {
+		return "", err
+	}
+	if hdr[0] != socks5_version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	method := byte(socks5_no_acceptable)
+	for _, m := range methods {
+		if m == socks5_no_auth {
+			method = socks5_no_auth
+		}
+	}
+	if _, err = conn.Write([]byte{socks5_version, method}); err != nil {
+		return "", err
+	}
+	if method == socks5_no_acceptable {
+		return "", errors.New("client offers no acceptable authentication method")
+	}
+
+	req := make([]byte, 4)
+	if _, err = io.ReadFull(conn, req); err != nil {
+		return "", err
+	}
+	if req[0] != socks5_version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", req[0])
+	}
+
+	var host string
+	switch req[3] {
+	case socks5_ipv4, socks5_ipv6:
+		ip := make(net.IP, 4)
+		if req[3] == socks5_ipv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err = io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5_domain:
+		n := make([]byte, 1)
+		if _, err = io.ReadFull(conn, n); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err = io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unsupported SOCKS address type %d", req[3])
+	}
+	port := make([]byte, 2)
+	if _, err = io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+
+	if req[1] != socks5_connect {
+		write_socks5_reply(conn, socks5_cmd_not_supported)
+		return "", fmt.Errorf("unsupported SOCKS command %d", req[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// Tells the client whether the target could be reached
+func WriteSOCKS5Response(conn net.Conn, success bool) error {
+	if success {
+		return write_socks5_reply(conn, socks5_succeeded)
+	}
+	return write_socks5_reply(conn, socks5_general_failure)
+}
+
+// The bound address is not meaningful for a proxy, it is sent as 0.0.0.0:0
+func write_socks5_reply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{socks5_version, rep, 0, socks5_ipv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
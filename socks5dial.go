@@ -0,0 +1,185 @@
+/*
+Reaching targets through a SOCKS5 proxy (-upstream-socks5).
+
+	-upstream-socks5 proxy.corp:1080
+	-upstream-socks5 user:secret@proxy.corp:1080
+
+sends every TCP connection to a target (and to -fanout shadows, the
+-diff-reference and -watch retries) through the proxy with a CONNECT
+request. Host names are passed to the proxy as they are, so it resolves
+them and the DNS cache is not used. With a user and password the proxy
+may ask for RFC 1929 authentication, without it only "no authentication"
+is offered.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var upstream_socks5 *string = flag.String("upstream-socks5", "", "connect to targets through this SOCKS5 proxy, [user:password@]host:port")
+
+const (
+	socks5_user_pass    = 2
+	socks5_auth_version = 1
+	socks5_dial_timeout = 30 * time.Second
+)
+
+var socks5_replies = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// Connects to targetAddr (host:port) through the SOCKS5 proxy at
+// proxyAddr, which may start with user:password@. The handshake is done
+// when ctx expires or is cancelled.
+func DialViaSocks5(ctx context.Context, proxyAddr, targetAddr string) (net.Conn, error) {
+	var user, password string
+	if i := strings.LastIndex(proxyAddr, "@"); i >= 0 {
+		user, password, _ = strings.Cut(proxyAddr[:i], ":")
+		proxyAddr = proxyAddr[i+1:]
+	}
+	host, port_s, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(port_s, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad port in %s", targetAddr)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	err = socks5_handshake(conn, user, password, host, uint16(port))
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy %s: %v", proxyAddr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func socks5_handshake(conn net.Conn, user, password, host string, port uint16) error {
+	methods := []byte{socks5_no_auth}
+	if user != "" {
+		methods = append(methods, socks5_user_pass)
+	}
+	if _, err := conn.Write(append([]byte{socks5_version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5_version {
+		return fmt.Errorf("unsupported SOCKS version %d", reply[0])
+	}
+	switch reply[1] {
+	case socks5_no_auth:
+	case socks5_user_pass:
+		if user == "" {
+			return errors.New("asked for a user and password")
+		}
+		if err := socks5_authenticate(conn, user, password); err != nil {
+			return err
+		}
+	default:
+		return errors.New("no acceptable authentication method")
+	}
+
+	req := []byte{socks5_version, socks5_connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %s is too long", host)
+		}
+		req = append(req, socks5_domain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, socks5_ipv4), ip4...)
+	} else {
+		req = append(append(req, socks5_ipv6), ip...)
+	}
+	req = binary.BigEndian.AppendUint16(req, port)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// version, reply, reserved, then the bound address, which is skipped
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return err
+	}
+	if hdr[1] != socks5_succeeded {
+		if msg, ok := socks5_replies[hdr[1]]; ok {
+			return errors.New(msg)
+		}
+		return fmt.Errorf("CONNECT failed with reply %d", hdr[1])
+	}
+	var addr_len int
+	switch hdr[3] {
+	case socks5_ipv4:
+		addr_len = 4
+	case socks5_ipv6:
+		addr_len = 16
+	case socks5_domain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return err
+		}
+		addr_len = int(n[0])
+	default:
+		return fmt.Errorf("unsupported SOCKS address type %d", hdr[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, addr_len+2))
+	return err
+}
+
+// RFC 1929 username/password subnegotiation
+func socks5_authenticate(conn net.Conn, user, password string) error {
+	if len(user) > 255 || len(password) > 255 {
+		return errors.New("user or password longer than 255 bytes")
+	}
+	req := []byte{socks5_auth_version, byte(len(user))}
+	req = append(req, user...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("user or password rejected")
+	}
+	return nil
+}
+
+func init_upstream_socks5() {
+	if *upstream_socks5 != "" && (*proto == "udp" || unix_mode()) {
+		die("-upstream-socks5 only works with TCP targets")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// What a socks5_stub was sent, as it came
+type socks5_exchange struct {
+	greeting, auth, connect []byte
+}
+
+// A SOCKS5 proxy for one connection: it picks method, answers the
+// CONNECT with reply and, if that is a success, sends "hello" as the
+// target
+func socks5_stub(t *testing.T, method, reply byte) (string, chan *socks5_exchange) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	got := make(chan *socks5_exchange, 1)
+	go func() {
+		x := &socks5_exchange{}
+		defer func() { got <- x }()
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		// reads n bytes onto b, and if counted as many more as the last says
+		var read func(b *[]byte, n int, counted bool) bool
+		read = func(b *[]byte, n int, counted bool) bool {
+			p := make([]byte, n)
+			if _, err := io.ReadFull(c, p); err != nil {
+				return false
+			}
+			*b = append(*b, p...)
+			if counted {
+				return read(b, int(p[n-1]), false)
+			}
+			return true
+		}
+		if !read(&x.greeting, 2, true) {
+			return
+		}
+		c.Write([]byte{5, method})
+		if method == socks5_user_pass {
+			if !read(&x.auth, 2, true) || !read(&x.auth, 1, true) {
+				return
+			}
+			c.Write([]byte{1, 0})
+		} else if method != socks5_no_auth {
+			return
+		}
+		if !read(&x.connect, 4, false) {
+			return
+		}
+		switch x.connect[3] {
+		case socks5_ipv4:
+			read(&x.connect, 4+2, false)
+		case socks5_ipv6:
+			read(&x.connect, 16+2, false)
+		case socks5_domain:
+			read(&x.connect, 1, true)
+			read(&x.connect, 2, false)
+		}
+		// bound to a name, which the client has to skip
+		c.Write([]byte{5, reply, 0, socks5_domain, 5, 'p', 'r', 'o', 'x', 'y', 0x04, 0x38})
+		if reply == socks5_succeeded {
+			c.Write([]byte("hello"))
+		}
+	}()
+	return ln.Addr().String(), got
+}
+
+func TestDialViaSocks5(t *testing.T) {
+	for _, tt := range []struct {
+		name, user, target string
+		method             byte
+		greeting, auth     string // hex
+		connect            string
+	}{
+		{"host name", "", "example.com:443", socks5_no_auth,
+			"050100", "", "05010003" + "0b" + hex.EncodeToString([]byte("example.com")) + "01bb"},
+		{"IPv4", "", "192.0.2.1:80", socks5_no_auth,
+			"050100", "", "05010001" + "c0000201" + "0050"},
+		{"IPv6", "", "[2001:db8::1]:8080", socks5_no_auth,
+			"050100", "", "05010004" + "20010db8000000000000000000000001" + "1f90"},
+		{"user and password", "alice:s3cret@", "example.com:25", socks5_user_pass,
+			"05020002", "01" + "05" + hex.EncodeToString([]byte("alice")) + "06" + hex.EncodeToString([]byte("s3cret")),
+			"05010003" + "0b" + hex.EncodeToString([]byte("example.com")) + "0019"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, got := socks5_stub(t, tt.method, socks5_succeeded)
+			conn, err := DialViaSocks5(context.Background(), tt.user+addr, tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(conn)
+			conn.Close()
+			if string(b) != "hello" {
+				t.Errorf("read %q from the target", b)
+			}
+			x := <-got
+			for _, part := range []struct {
+				name      string
+				got, want []byte
+			}{{"greeting", x.greeting, must_hex(t, tt.greeting)}, {"authentication", x.auth, must_hex(t, tt.auth)}, {"CONNECT", x.connect, must_hex(t, tt.connect)}} {
+				if !bytes.Equal(part.got, part.want) {
+					t.Errorf("%s %x, want %x", part.name, part.got, part.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDialViaSocks5Errors(t *testing.T) {
+	for _, tt := range []struct {
+		name, user    string
+		method, reply byte
+		want          string
+	}{
+		{"refused", "", socks5_no_auth, 5, "connection refused"},
+		{"unknown reply", "", socks5_no_auth, 42, "CONNECT failed with reply 42"},
+		{"no acceptable method", "", 0xff, 0, "no acceptable authentication method"},
+		{"password wanted", "", socks5_user_pass, 0, "asked for a user and password"},
+	} {
+		addr, _ := socks5_stub(t, tt.method, tt.reply)
+		conn, err := DialViaSocks5(context.Background(), tt.user+addr, "example.com:80")
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s: connected", tt.name)
+		} else if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v, want %q", tt.name, err, tt.want)
+		}
+	}
+	if _, err := DialViaSocks5(context.Background(), "127.0.0.1:1", "example.com:http"); err == nil {
+		t.Error("a port name accepted")
+	}
+}
+
+func must_hex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,98 @@
+/*
+Connections without logs (-no-log), spliced on Linux.
+
+With -no-log no connection logs are written, neither the text or JSON
+log nor the binary ones, and no -log-backend gets the events. The
+counters (metrics, -stats, the API) and the summaries go on as before.
+
+If in addition nothing else has to see or change the bytes (no -proto
+decoder, -pcap, -inject-file, -rules-file, -mirror, -fanout,
+-diff-reference, -filter, -dry-run, -loss, -latency, -remap-port,
+-idle-timeout, hooks, TLS or throttling), each direction is a plain
+io.Copy from one socket to the other. Between TCP sockets on Linux
+net.TCPConn's ReadFrom does that with splice(2), without the data being
+copied into gotcpspy; elsewhere it is an ordinary copy, still without
+the LoggingWriter. The counters are brought up to date every
+copy_unlogged_chunk bytes. -max-duration and shutdown close the source
+as they do for the logged copy.
+
+io.Copy doesn't say which side failed. A write error is told by its
+net.OpError ("write") or, where the kernel moved the bytes itself, by
+EPIPE; it is logged as a write_error like LoggingWriter logs one, and
+the direction ends without a network_error for the source.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+var no_log *bool = flag.Bool("no-log", false, "write no connection logs; on Linux data that nothing else looks at is spliced between the sockets")
+
+const copy_unlogged_chunk = 1 << 18
+
+// Ends a direction of copy_unlogged whose write failed, for disconnect_event
+var errWriteFailed = errors.New("write to the other side failed")
+
+// Whether c's bytes may bypass its LoggingWriter
+func can_splice(c *Channel) bool {
+	return c.splice && c.parser == nil && c.pcap == nil && c.injector == nil && rule_engine == nil &&
+		c.rewrite == nil && len(port_remaps) == 0 && c.mirror == nil && c.fanout == nil && c.diff == nil && content_filter == nil &&
+		!*dry_run && *loss_rate <= 0 && direction_latency(c.direction) == 0 && *latency_jitter_ms <= 0 &&
+		*idle_timeout <= 0 // a splice only returns once its chunk is through, too late to tell idle from busy
+}
+
+// Forwards c without its LoggingWriter w if can_splice allows it,
+// reporting whether it did. A read error is left in r as the logged copy
+// leaves it.
+func copy_unlogged(c *Channel, w *LoggingWriter, r *channel_reader) bool {
+	if !can_splice(c) {
+		return false
+	}
+	for {
+		n, err := io.CopyN(c.to, c.from, copy_unlogged_chunk)
+		if n > 0 {
+			c.spliced(int(n))
+		}
+		if err == nil {
+			continue
+		}
+		if err != io.EOF && !errors.Is(err, net.ErrClosed) && write_failed(err) {
+			metrics.error(&metrics.write_errors)
+			e := c.event("write_error", w.to_peer)
+			e.Message = fmt.Sprintf("Write to %s failed: %v", w.to_peer, err)
+			c.logger <- e
+			err = errWriteFailed
+		} else if c.ctx.Err() != nil {
+			err = c.ctx.Err()
+		}
+		r.err = err
+		return true
+	}
+}
+
+// Whether an error of io.Copy came from writing rather than reading; a
+// socket closed by the other direction is neither
+func write_failed(err error) bool {
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if op, ok := e.(*net.OpError); ok && op.Op == "write" {
+			return true
+		}
+	}
+	return errors.Is(err, syscall.EPIPE)
+}
+
+// Counts n spliced bytes like LoggingWriter.Write counts a chunk
+func (c *Channel) spliced(n int) {
+	c.timeouts.touch()
+	c.session.add(c.direction, n)
+	metrics.forwarded(c.direction, n)
+	global_stats.forwarded(c.direction, n)
+	c.stats.forwarded(c.direction, n)
+}
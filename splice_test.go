@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Both ends of a loopback TCP connection
+func tcp_pair(tb testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s := <-accepted
+	if s == nil {
+		tb.Fatal("accept failed")
+	}
+	return c, s
+}
+
+// Sends data from client through c to server, half-closing, and copies
+// what server got to out
+func transfer(tb testing.TB, c *Channel, client, server net.Conn, data []byte, out io.Writer) int64 {
+	go func() {
+		client.Write(data)
+		client.(*net.TCPConn).CloseWrite()
+	}()
+	n, err := io.Copy(out, server)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	select {
+	case <-c.ack:
+	case <-time.After(10 * time.Second):
+		tb.Fatal("pass_through didn't finish")
+	}
+	return n
+}
+
+// With -no-log a TCP connection goes around the LoggingWriter: the bytes
+// arrive and are counted, but no received events are logged
+func TestCopyUnlogged(t *testing.T) {
+	data := random_bytes(3*copy_unlogged_chunk + 1000)
+	client, from := tcp_pair(t)
+	to, server := tcp_pair(t)
+	defer func() {
+		for _, conn := range []net.Conn{client, from, to, server} {
+			conn.Close()
+		}
+	}()
+	c, sink := new_test_channel(context.Background(), from, to, 0)
+	c.splice = true
+	go pass_through(c)
+	var got bytes.Buffer
+	transfer(t, c, client, server, data, &got)
+	sink.stop(c)
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Errorf("forwarded %d bytes that differ from the %d sent", got.Len(), len(data))
+	}
+	if n := atomic.LoadInt64(&c.session.BytesToServer); n != int64(len(data)) {
+		t.Errorf("counted %d bytes of %d", n, len(data))
+	}
+	if n := sink.count("received"); n != 0 || len(sink.binary) != 0 {
+		t.Errorf("%d received events and %d bytes of binary log", n, len(sink.binary))
+	}
+	if e := sink.events[len(sink.events)-1]; e.Event != "disconnected" {
+		t.Errorf("ended with %s %q", e.Event, e.Message)
+	}
+}
+
+// 100 MB between two TCP connections: through a buffer in user space, as
+// the LoggingWriter's copy has to, and with -no-log's copy_unlogged,
+// which splices the sockets together on Linux
+func BenchmarkSplice(b *testing.B) {
+	data := random_bytes(100 << 20)
+	for _, bench := range []struct {
+		name  string
+		setup func(c *Channel)
+	}{
+		{"io.Copy through user space", func(c *Channel) {
+			go func() {
+				buf := make([]byte, *buf_size)
+				io.CopyBuffer(struct{ io.Writer }{c.to}, struct{ io.Reader }{c.from}, buf) // hides ReadFrom and WriteTo
+				c.to.(*net.TCPConn).CloseWrite()
+				c.ack <- true
+			}()
+		}},
+		{"copy_unlogged", func(c *Channel) {
+			c.splice = true
+			go pass_through(c)
+		}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				client, from := tcp_pair(b)
+				to, server := tcp_pair(b)
+				c, sink := new_test_channel(context.Background(), from, to, 0)
+				bench.setup(c)
+				if n := transfer(b, c, client, server, data, io.Discard); n != int64(len(data)) {
+					b.Fatalf("forwarded %d bytes of %d", n, len(data))
+				}
+				sink.stop(c)
+				for _, conn := range []net.Conn{client, from, to, server} {
+					conn.Close()
+				}
+			}
+		})
+	}
+}
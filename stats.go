@@ -0,0 +1,108 @@
+/*
+Periodic throughput statistics on stdout (-stats-interval).
+
+Every interval one line says how many connections are open, how many
+were opened and closed, and how much was forwarded each way since the
+previous line:
+
+	Stats 10s: 3 active, 2 opened, 1 closed, 1.2K client→server, 48.0K server→client
+
+With -stats-format json the same comes as one JSON object per line.
+The per-interval counters are swapped back to zero as they are read, so
+nothing counted between two reads is lost.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	stats_interval *time.Duration = flag.Duration("stats-interval", 0, "print aggregate connection and throughput statistics this often, e.g. 10s")
+	stats_format   *string        = flag.String("stats-format", "text", "format of -stats-interval lines: text or json")
+)
+
+// Counters across all connections, updated by process_connection and
+// pass_through without locking
+type GlobalStats struct {
+	active    int64
+	opened    int64 // the rest since the last take
+	closed    int64
+	bytes_c2s int64
+	bytes_s2c int64
+}
+
+var global_stats = &GlobalStats{}
+
+func (s *GlobalStats) connection_opened() {
+	atomic.AddInt64(&s.active, 1)
+	atomic.AddInt64(&s.opened, 1)
+}
+
+func (s *GlobalStats) connection_closed() {
+	atomic.AddInt64(&s.active, -1)
+	atomic.AddInt64(&s.closed, 1)
+}
+
+func (s *GlobalStats) forwarded(direction string, n int) {
+	if direction == client_to_server {
+		atomic.AddInt64(&s.bytes_c2s, int64(n))
+	} else {
+		atomic.AddInt64(&s.bytes_s2c, int64(n))
+	}
+}
+
+type stats_interval_report struct {
+	Time          time.Time `json:"time"`
+	IntervalMS    int64     `json:"interval_ms"`
+	Active        int64     `json:"active_connections"`
+	Opened        int64     `json:"opened"`
+	Closed        int64     `json:"closed"`
+	BytesToServer int64     `json:"bytes_client_to_server"`
+	BytesToClient int64     `json:"bytes_server_to_client"`
+}
+
+// Reads the counters, resetting those of the interval
+func (s *GlobalStats) take(interval time.Duration) stats_interval_report {
+	return stats_interval_report{
+		Time:          time.Now(),
+		IntervalMS:    interval.Milliseconds(),
+		Active:        atomic.LoadInt64(&s.active),
+		Opened:        atomic.SwapInt64(&s.opened, 0),
+		Closed:        atomic.SwapInt64(&s.closed, 0),
+		BytesToServer: atomic.SwapInt64(&s.bytes_c2s, 0),
+		BytesToClient: atomic.SwapInt64(&s.bytes_s2c, 0),
+	}
+}
+
+func (r stats_interval_report) String() string {
+	return fmt.Sprintf("Stats %s: %d active, %d opened, %d closed, %s %s, %s %s",
+		time.Duration(r.IntervalMS)*time.Millisecond, r.Active, r.Opened, r.Closed,
+		tui_bytes(r.BytesToServer), client_to_server, tui_bytes(r.BytesToClient), server_to_client)
+}
+
+// Starts the -stats-interval printer
+func start_stats() {
+	if *stats_interval <= 0 {
+		return
+	}
+	if *stats_format != "text" && *stats_format != "json" {
+		die("Unknown -stats-format %q, use text or json", *stats_format)
+	}
+	go func() {
+		for range time.Tick(*stats_interval) {
+			r := global_stats.take(*stats_interval)
+			if *stats_format == "json" {
+				b, _ := json.Marshal(r)
+				fmt.Println(string(b))
+			} else {
+				fmt.Println(r)
+			}
+		}
+	}()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// After a session through the proxy the counters hold its connection and
+// bytes, and reading them starts the next interval from zero
+func TestGlobalStatsSession(t *testing.T) {
+	saved := *output_dir
+	t.Cleanup(func() { *output_dir = saved })
+	*output_dir = t.TempDir()
+	init_log_names()
+	buffer_pool = NewBufferPool(*buf_size)
+	echo := start_echo_server(t)
+	host, port, _ := net.SplitHostPort(echo.Addr().String())
+	m := &mapping{listen_port: free_port(t), host: host, port: port, log_prefix: filepath.Join(*output_dir, "log")}
+	p := NewProxy(m)
+	sessions := make(chan *Session, 1)
+	p.OnConnection(func(s *Session) { sessions <- s })
+	run_proxy(t, p)
+	global_stats.take(time.Second) // what earlier tests left
+
+	conn := dial_proxy(t, m.listen_port)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := strings.Repeat("x", 2000)
+	conn.Write([]byte(msg))
+	if _, err := io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	<-sessions
+	active_connections.Wait()
+
+	r := global_stats.take(10 * time.Second)
+	if r.Active != 0 || r.Opened != 1 || r.Closed != 1 || r.BytesToServer != 2000 || r.BytesToClient != 2000 {
+		t.Errorf("counted %+v, want one connection opened and closed with 2000 bytes each way", r)
+	}
+	if want := "Stats 10s: 0 active, 1 opened, 1 closed, 2.0K client→server, 2.0K server→client"; r.String() != want {
+		t.Errorf("printed %q, want %q", r.String(), want)
+	}
+	if r = global_stats.take(time.Second); r.Opened != 0 || r.Closed != 0 || r.BytesToServer != 0 || r.BytesToClient != 0 {
+		t.Errorf("the next interval starts with %+v", r)
+	}
+}
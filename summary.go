@@ -0,0 +1,90 @@
+/*
+Session summaries (-summary).
+
+At the end of every connection process_connection writes
+summary-<time>-<conn>.json next to the log files, <time> being when the
+connection started as in the log names (summary-<listen port>-<time>-<conn>.json
+with several mappings, and -<tag> at the end for connections tagged by
+the client) with what went through it in each direction. A connection
+whose logs -grep removed gets no summary either.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+var summary *bool = flag.Bool("summary", true, "write a JSON summary file for every connection")
+
+// Counted by pass_through as chunks are read
+type SessionStats struct {
+	BytesToServer   int64
+	BytesToClient   int64
+	PacketsToServer int64
+	PacketsToClient int64
+}
+
+func (s *SessionStats) add(direction string, n int) {
+	if direction == client_to_server {
+		atomic.AddInt64(&s.BytesToServer, int64(n))
+		atomic.AddInt64(&s.PacketsToServer, 1)
+	} else {
+		atomic.AddInt64(&s.BytesToClient, int64(n))
+		atomic.AddInt64(&s.PacketsToClient, 1)
+	}
+}
+
+type session_summary struct {
+	ConnID          int       `json:"conn_id"`
+	Client          string    `json:"client"`
+	Server          string    `json:"server"`
+	Tag             string    `json:"tag,omitempty"`
+	BytesToServer   int64     `json:"bytes_client_to_server"`
+	BytesToClient   int64     `json:"bytes_server_to_client"`
+	PacketsToServer int64     `json:"packets_client_to_server"`
+	PacketsToClient int64     `json:"packets_server_to_client"`
+	Started         time.Time `json:"start_time"`
+	Finished        time.Time `json:"end_time"`
+	DurationMS      int64     `json:"duration_ms"`
+}
+
+func summary_name(m *mapping, conn_n int, tag string, started time.Time) string {
+	name := fmt.Sprintf("summary-%s-%04d", format_time(started), conn_n)
+	if m.namespace != "" {
+		name = fmt.Sprintf("summary-%s-%s-%04d", m.namespace, format_time(started), conn_n)
+	}
+	if tag != "" {
+		name += "-" + tag
+	}
+	return filepath.Join(*output_dir, name+".json")
+}
+
+func write_summary(m *mapping, conn_n int, client, server, tag string, s *SessionStats, started, finished time.Time) {
+	if !*summary {
+		return
+	}
+	b, _ := json.MarshalIndent(session_summary{
+		ConnID:          conn_n,
+		Client:          client,
+		Server:          server,
+		Tag:             tag,
+		BytesToServer:   atomic.LoadInt64(&s.BytesToServer),
+		BytesToClient:   atomic.LoadInt64(&s.BytesToClient),
+		PacketsToServer: atomic.LoadInt64(&s.PacketsToServer),
+		PacketsToClient: atomic.LoadInt64(&s.PacketsToClient),
+		Started:         started,
+		Finished:        finished,
+		DurationMS:      finished.Sub(started).Milliseconds(),
+	}, "", "  ")
+	name := summary_name(m, conn_n, tag, started)
+	if err := os.WriteFile(name, append(b, '\n'), 0644); err != nil {
+		fmt.Printf("Unable to write %s, %v\n", name, err)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Syslog log backend (-log-backend syslog).
+
+Every event becomes one RFC 5424 message for the server at -syslog-addr:
+the event name is the MSGID, connection, direction and byte count go
+into both the structured data and the message text. log/syslog only
+speaks the older BSD format, and doesn't exist on Windows and Plan 9, so
+the messages are framed and sent here. Over TCP the messages are octet
+counted (RFC 6587); unix:// is a local socket like /dev/log, a datagram
+one if it takes datagrams, else a stream one, octet counted as well.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	syslog_addr     *string = flag.String("syslog-addr", "udp://localhost:514", "syslog server for -log-backend syslog, udp://, tcp:// or unix://")
+	syslog_facility *string = flag.String("syslog-facility", "local0", "syslog facility: user, daemon or local0 to local7")
+)
+
+func init() {
+	backends.Register("syslog", func() (BackendStore, error) { return OpenSyslogStore(*syslog_addr, *syslog_facility) })
+}
+
+// Private enterprise number reserved for documentation (RFC 5612)
+const syslog_sd_id = "gotcpspy@32473"
+
+// Facility codes of RFC 5424, times 8 as they go into the PRI
+var syslog_facilities = map[string]int{
+	"user":   1 << 3,
+	"daemon": 3 << 3,
+	"local0": 16 << 3,
+	"local1": 17 << 3,
+	"local2": 18 << 3,
+	"local3": 19 << 3,
+	"local4": 20 << 3,
+	"local5": 21 << 3,
+	"local6": 22 << 3,
+	"local7": 23 << 3,
+}
+
+const syslog_info = 6 // the severity of every message
+
+type SyslogStore struct {
+	mu       sync.Mutex
+	network  string
+	addr     string
+	conn     net.Conn
+	facility int
+	hostname string
+}
+
+func OpenSyslogStore(addr, facility string) (*SyslogStore, error) {
+	f, ok := syslog_facilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	network, host, ok := strings.Cut(addr, "://")
+	if !ok {
+		network, host = "udp", addr
+	}
+	if network != "udp" && network != "tcp" && network != "unix" {
+		return nil, fmt.Errorf("unsupported syslog network %q", network)
+	}
+	s := &SyslogStore{network: network, addr: host, facility: f, hostname: "-"}
+	if h, err := os.Hostname(); err == nil {
+		s.hostname = h
+	}
+	var err error
+	if network == "unix" {
+		// a datagram socket first, which is what /dev/log usually is
+		if s.conn, err = net.Dial("unixgram", host); err == nil {
+			s.network = "unixgram"
+			return s, nil
+		}
+	}
+	if s.conn, err = net.Dial(s.network, host); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SyslogStore) Open(conn_n int, local_info, remote_info string) (LogBackend, error) {
+	return &syslog_connection{s, conn_n}, nil
+}
+
+func (s *SyslogStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn.Close()
+}
+
+// Sends one message, redialing once if the server went away
+func (s *SyslogStore) send(msg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.network == "tcp" || s.network == "unix" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	_, err := s.conn.Write([]byte(msg))
+	if err != nil && s.network != "udp" {
+		var conn net.Conn
+		if conn, err = net.Dial(s.network, s.addr); err == nil {
+			s.conn.Close()
+			s.conn = conn
+			_, err = conn.Write([]byte(msg))
+		}
+	}
+	return err
+}
+
+// Formats e as an RFC 5424 message
+func (s *SyslogStore) format(conn_n int, e *LogEvent) string {
+	pri := s.facility | syslog_info
+	sd := fmt.Sprintf(`[%s conn="%d" bytes="%d"`, syslog_sd_id, conn_n, e.Length)
+	text := fmt.Sprintf("conn=%d event=%s bytes=%d", conn_n, e.Event, e.Length)
+	if e.Direction != "" {
+		sd += ` direction="` + sd_escape(e.Direction) + `"`
+		text += " direction=" + e.Direction
+	}
+	if e.Peer != "" {
+		sd += ` peer="` + sd_escape(e.Peer) + `"`
+		text += " peer=" + e.Peer
+	}
+	sd += "]"
+	if e.Message != "" {
+		text += " " + e.Message
+	}
+	// The BOM marks the text as UTF-8, which RFC 5424 asks for
+	return fmt.Sprintf("<%d>1 %s %s gotcpspy %d %s %s \ufeff%s",
+		pri, e.Timestamp.Format("2006-01-02T15:04:05.000000Z07:00"), s.hostname,
+		os.Getpid(), e.Event, sd, text)
+}
+
+// Escapes a structured data parameter value
+func sd_escape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(v)
+}
+
+type syslog_connection struct {
+	store  *SyslogStore
+	conn_n int
+}
+
+func (c *syslog_connection) WriteEvent(e *LogEvent) error {
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+	return c.store.send(c.store.format(c.conn_n, e))
+}
+
+func (c *syslog_connection) Close() error {
+	return nil
+}
@@ -0,0 +1,80 @@
+/*
+Connection tags sent by the client (-accept-tags).
+
+A client, or the load balancer in front of it, can name its connection
+by sending one line before anything else:
+
+	GOTCPSPY-TAG: tenant-42\r\n
+
+The line is taken out of the stream, the target never sees it, and the
+value replaces -tag for {{.Tag}} in the log file names of that
+connection; it is also written to its summary. A connection that doesn't
+start with the prefix within tag_wait is passed on untouched, so
+protocols where the server speaks first still work, only later.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var accept_tags *bool = flag.Bool("accept-tags", false, "take a \"GOTCPSPY-TAG: <value>\" first line out of the client's stream and use the value as {{.Tag}}")
+
+const (
+	tag_prefix  = "GOTCPSPY-TAG: "
+	tag_max     = 128 // the whole line
+	tag_wait    = proto_detect_wait
+	tag_max_len = 64 // of the value in file names
+)
+
+// Looks for the tag line at the start of conn. reader gives back whatever
+// was read that isn't part of it; read it instead of conn from now on.
+func ExtractTag(conn net.Conn) (tag string, reader io.Reader, err error) {
+	br := bufio.NewReaderSize(conn, tag_max)
+	conn.SetReadDeadline(time.Now().Add(tag_wait))
+	defer conn.SetReadDeadline(time.Time{})
+	var consumed []byte // not part of a tag after all
+	b, err := br.Peek(len(tag_prefix))
+	if err == nil && string(b) == tag_prefix {
+		var line []byte
+		line, err = br.ReadSlice('\n')
+		if err == nil {
+			tag = sanitize_tag(strings.TrimSpace(string(line[len(tag_prefix):])))
+		} else {
+			consumed = append(consumed, line...)
+		}
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) || err == io.EOF || err == bufio.ErrBufferFull {
+		err = nil // nothing special, or nothing at all
+	}
+	rest, _ := br.Peek(br.Buffered())
+	consumed = append(consumed, rest...)
+	return tag, io.MultiReader(bytes.NewReader(consumed), conn), err
+}
+
+// Tags end up in file names
+func sanitize_tag(s string) string {
+	if len(s) > tag_max_len {
+		s = s[:tag_max_len]
+	}
+	return sanitize_name(s)
+}
+
+// Takes the tag off the connection, if -accept-tags; the returned
+// connection replaces conn
+func accept_tag(conn net.Conn) (net.Conn, string, error) {
+	if !*accept_tags {
+		return conn, "", nil
+	}
+	tag, r, err := ExtractTag(conn)
+	return &preamble_conn{conn, r}, tag, err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExtractTag(t *testing.T) {
+	long := tag_prefix + strings.Repeat("x", tag_max)
+	for _, tt := range []struct {
+		name   string
+		sent   string
+		silent bool // the client waits for the server after sending
+		tag    string
+		rest   string
+	}{
+		{"tagged", "GOTCPSPY-TAG: tenant-42\r\nGET / HTTP/1.0\r\n\r\n", false, "tenant-42", "GET / HTTP/1.0\r\n\r\n"},
+		{"tag only", "GOTCPSPY-TAG: tenant-42\n", false, "tenant-42", ""},
+		{"sanitized", "GOTCPSPY-TAG:  ../a b \r\nhello", false, ".._a_b", "hello"},
+		{"untagged", "GET / HTTP/1.0\r\n\r\n", false, "", "GET / HTTP/1.0\r\n\r\n"},
+		{"shorter than the prefix", "GOT", false, "", "GOT"},
+		{"line too long", long, false, "", long},
+		{"server speaks first", "", true, "", ""},
+		{"unfinished tag line", "GOTCPSPY-TAG: ten", true, "", "GOTCPSPY-TAG: ten"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			go func() {
+				client.Write([]byte(tt.sent))
+				if !tt.silent {
+					client.Close()
+				}
+			}()
+			tag, r, err := ExtractTag(server)
+			if err != nil || tag != tt.tag {
+				t.Errorf("tag %q, %v, want %q", tag, err, tt.tag)
+			}
+			if tt.silent {
+				client.Close() // all of it was read waiting for the rest
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != tt.rest {
+				t.Errorf("left %q for the target, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+// A tagged and an untagged connection through the proxy: the tag line
+// never reaches the target, and only the tagged connection's log and
+// summary names carry it
+func TestProxyAcceptTags(t *testing.T) {
+	saved_accept, saved_template, saved_dir := *accept_tags, *log_name_template, *output_dir
+	t.Cleanup(func() {
+		*accept_tags, *log_name_template, *output_dir = saved_accept, saved_template, saved_dir
+		init_log_names()
+	})
+	*accept_tags = true
+	*log_name_template = `{{.Prefix}}-{{.Tag}}-{{.ConnID}}-{{.Kind}}{{.Peer}}.log`
+	*output_dir = t.TempDir()
+	init_log_names()
+	buffer_pool = NewBufferPool(*buf_size)
+
+	echo := start_echo_server(t)
+	host, port, _ := net.SplitHostPort(echo.Addr().String())
+	m := &mapping{listen_port: free_port(t), host: host, port: port, log_prefix: filepath.Join(*output_dir, "log")}
+	p := NewProxy(m)
+	sessions := make(chan *Session, 2)
+	p.OnConnection(func(s *Session) { sessions <- s })
+	run_proxy(t, p)
+
+	for _, sent := range []string{"GOTCPSPY-TAG: tenant-42\r\nping", "ping"} {
+		conn := dial_proxy(t, m.listen_port)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(sent))
+		reply := make([]byte, 5)
+		n, err := io.ReadAtLeast(conn, reply, 4)
+		if err != nil || string(reply[:n]) != "ping" {
+			t.Fatalf("%q echoed as %q, %v", sent, reply[:n], err)
+		}
+		conn.Close()
+		<-sessions // after the connection was counted
+	}
+	active_connections.Wait()
+
+	for _, pattern := range []string{
+		"log-tenant-42-0001-log.log", "log-tenant-42-0001-binary*.log", "summary-*-0001-tenant-42.json",
+		"log--0002-log.log", "log--0002-binary*.log", "summary-*-0002.json",
+	} {
+		names, _ := filepath.Glob(filepath.Join(*output_dir, pattern))
+		if len(names) == 0 {
+			t.Errorf("no %s in -output-dir", pattern)
+		}
+	}
+	names, _ := filepath.Glob(filepath.Join(*output_dir, "summary-*-0001-tenant-42.json"))
+	if len(names) == 1 {
+		if b, err := os.ReadFile(names[0]); err != nil || !strings.Contains(string(b), `"tag": "tenant-42"`) {
+			t.Errorf("summary %s, %v, without the tag", b, err)
+		}
+	}
+}
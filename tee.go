@@ -0,0 +1,103 @@
+/*
+Connection logs on stdout as well (-tee).
+
+With -tee every event written to a connection's log file is also
+printed to stdout as it happens, in the text format of the log files
+whatever -format says: client→server data in blue, server→client data
+in green and network errors and timeouts in red. The colors are left
+out when stdout is not a terminal, so
+
+	gotcpspy -tee ... | less
+
+gets the plain text. The events of concurrent connections are printed
+whole but interleaved; the connection numbers are in the file names
+only. -tee copies the log files, so it can't be combined with -no-log,
+-binary-only, a -log-backend or -tui.
+*/
+
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+var tee *bool = flag.Bool("tee", false, "also print the connection logs to stdout, in color on a terminal")
+
+const (
+	tee_blue  = "\x1b[34m"
+	tee_green = "\x1b[32m"
+	tee_red   = "\x1b[31m"
+	tee_reset = "\x1b[0m"
+)
+
+// Copies the events a connection's Logger gets to w
+type TeeLogger struct {
+	Logger
+	w     io.Writer
+	color bool
+}
+
+var (
+	tee_mu    sync.Mutex // one event at a time on stdout
+	tee_color bool       // stdout is a terminal
+)
+
+func NewTeeLogger(l Logger, w io.Writer, color bool) *TeeLogger {
+	return &TeeLogger{l, w, color}
+}
+
+func (l *TeeLogger) Log(e *LogEvent) error {
+	err := l.Logger.Log(e)
+	var b strings.Builder
+	(&TextLogger{&b}).Log(e)
+	s := b.String()
+	if c := l.event_color(e); c != "" {
+		s = c + strings.TrimSuffix(s, "\n") + tee_reset + "\n"
+	}
+	tee_mu.Lock()
+	io.WriteString(l.w, s)
+	tee_mu.Unlock()
+	return err
+}
+
+func (l *TeeLogger) event_color(e *LogEvent) string {
+	if !l.color {
+		return ""
+	}
+	switch {
+	case e.Event == "network_error" || e.Event == "write_error" || e.Event == "timeout":
+		return tee_red
+	case e.Direction == client_to_server:
+		return tee_blue
+	case e.Direction == server_to_client:
+		return tee_green
+	}
+	return ""
+}
+
+// Wraps the Logger of a connection's log file with -tee
+func tee_logger(l Logger) Logger {
+	if !*tee {
+		return l
+	}
+	return NewTeeLogger(l, os.Stdout, tee_color)
+}
+
+func is_terminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func init_tee() {
+	if !*tee {
+		return
+	}
+	if *no_log || *binary_only || log_store != nil || tui_enabled() {
+		die("-tee copies the connection log files, it can't be combined with -no-log, -binary-only, -log-backend or -tui")
+	}
+	tee_color = is_terminal(os.Stdout)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func tee_test_events() []*LogEvent {
+	request := new_event(1, client_to_server, "received", "127.0.0.1-50000")
+	request.Length, request.HexPayload = 4, hex.Dump([]byte("ping"))
+	reply := new_event(1, server_to_client, "received", "127.0.0.1-80")
+	reply.Length, reply.HexPayload = 4, hex.Dump([]byte("pong"))
+	failed := new_event(1, server_to_client, "network_error", "127.0.0.1-80")
+	failed.Message = "Network error from 127.0.0.1-80: connection reset by peer"
+	return []*LogEvent{request, reply, failed}
+}
+
+// With stdout going into a pipe -tee prints exactly what the log file gets
+func TestTeeLoggerPipe(t *testing.T) {
+	saved_stdout, saved_tee, saved_color := os.Stdout, *tee, tee_color
+	t.Cleanup(func() { os.Stdout, *tee, tee_color = saved_stdout, saved_tee, saved_color })
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	os.Stdout, *tee = w, true
+	init_tee()
+	if tee_color {
+		t.Error("a pipe taken for a terminal")
+	}
+	var file bytes.Buffer
+	l := tee_logger(&TextLogger{&file})
+	for _, e := range tee_test_events() {
+		l.Log(e)
+	}
+	w.Close()
+	printed, _ := io.ReadAll(r)
+	if strings.Contains(string(printed), "\x1b[") {
+		t.Errorf("color codes in %q", printed)
+	}
+	if string(printed) != file.String() {
+		t.Errorf("printed\n%s\nwhile the log file got\n%s", printed, file.String())
+	}
+}
+
+func TestTeeLoggerColors(t *testing.T) {
+	var out bytes.Buffer
+	l := NewTeeLogger(&TextLogger{io.Discard}, &out, true)
+	var want strings.Builder
+	for i, e := range tee_test_events() {
+		l.Log(e)
+		var plain strings.Builder
+		(&TextLogger{&plain}).Log(e)
+		color := []string{tee_blue, tee_green, tee_red}[i]
+		want.WriteString(color + strings.TrimSuffix(plain.String(), "\n") + tee_reset + "\n")
+	}
+	if out.String() != want.String() {
+		t.Errorf("printed %q, want %q", out.String(), want.String())
+	}
+}
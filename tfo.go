@@ -0,0 +1,83 @@
+/*
+TCP Fast Open to the target (-tfo).
+
+With -tfo the connection to the target is only opened once the client
+has sent its first bytes, and those go in the SYN, so the target gets
+the request a round trip earlier. The target must have TFO enabled for
+its listener (net.ipv4.tcp_fastopen with 0x2 on Linux); the first
+connection from gotcpspy to a target only fetches the cookie and does
+the usual handshake, later ones send data in the SYN. For the client
+side, net.ipv4.tcp_fastopen needs 0x1, the Linux default.
+
+When the client sends nothing within tfo_wait the target is dialed the
+usual way, so protocols where the server speaks first still work, only
+later. -tfo is meant for protocols where the client speaks first, like
+HTTP or TLS. It works for TCP targets in the default forward mode, not
+through -upstream-socks5 or the -pool-size pool, which dial ahead. A
+target that refuses the connection shows up as a network error on the
+first write instead of a failed dial.
+
+The socket option is TCP_FASTOPEN_CONNECT (Linux 4.11), which makes the
+first write on a connected socket carry the SYN. TCP_FASTOPEN itself is
+the listener's side. Linux only, elsewhere -tfo is refused.
+*/
+
+package main
+
+import (
+	"flag"
+	"net"
+	"runtime"
+	"syscall"
+)
+
+var tfo *bool = flag.Bool("tfo", false, "connect to the target with TCP Fast Open, sending the client's first bytes in the SYN")
+
+const (
+	tfo_wait             = proto_detect_wait
+	tcp_fastopen_connect = 30 // Linux's, not in the syscall package
+)
+
+// Sets TCP_FASTOPEN_CONNECT on a socket being dialed, nil where there is none
+var tfo_control func(network, address string, c syscall.RawConn) error
+
+func init() {
+	if runtime.GOOS != "linux" {
+		return
+	}
+	tfo_control = func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcp_fastopen_connect, 1)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+var tfo_dialer = &net.Dialer{}
+
+func init_tfo() {
+	if !*tfo {
+		return
+	}
+	if tfo_control == nil {
+		die("-tfo is only supported on Linux")
+	}
+	if *proto == "udp" || unix_mode() || *mode != "forward" || *upstream_socks5 != "" || *pool_size > 0 {
+		die("-tfo only works for TCP targets in forward mode, without -upstream-socks5 or -pool-size")
+	}
+	tfo_dialer.Control = tfo_control
+}
+
+// Waits for the client's first bytes, reporting whether they came so that
+// the target can be dialed with TFO. The returned connection replaces
+// conn.
+func tfo_first_data(conn net.Conn) (net.Conn, bool) {
+	if !*tfo {
+		return conn, false
+	}
+	conn, b := peek_client(conn, 1, tfo_wait)
+	return conn, len(b) > 0
+}
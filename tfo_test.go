@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// Connection setup to a loopback server that answers the first byte, with
+// and without Fast Open. Without net.ipv4.tcp_fastopen both do the usual
+// handshake.
+func BenchmarkTFODial(b *testing.B) {
+	if tfo_control == nil {
+		b.Skip("no TCP Fast Open here")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 1)
+				if _, err := c.Read(buf); err == nil {
+					c.Write(buf)
+				}
+				c.Close()
+			}()
+		}
+	}()
+	for _, bench := range []struct {
+		name   string
+		dialer *net.Dialer
+	}{
+		{"plain", &net.Dialer{}},
+		{"tfo", &net.Dialer{Control: tfo_control}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			buf := make([]byte, 1)
+			for i := 0; i < b.N; i++ {
+				c, err := bench.dialer.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					b.Fatal(err)
+				}
+				c.Write([]byte("x"))
+				c.Read(buf)
+				c.Close()
+			}
+		})
+	}
+}
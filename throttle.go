@@ -0,0 +1,92 @@
+/*
+Bandwidth throttling to simulate slow links.
+
+The client and server connections can each be limited to a number of
+bytes per second. Only the forwarded data is affected, never the logs.
+With -rules-file the limits can change while a connection is open.
+*/
+
+package main
+
+import (
+	"flag"
+	"net"
+)
+
+var (
+	throttle_client_bps *int = flag.Int("throttle-client-bps", 0, "limit the client link to this many bytes per second each way (0 means unlimited)")
+	throttle_server_bps *int = flag.Int("throttle-server-bps", 0, "limit the server link to this many bytes per second each way (0 means unlimited)")
+	throttle_burst      *int = flag.Int("throttle-burst", 1500, "burst size of the throttles in bytes")
+)
+
+// A net.Conn whose reads and writes are each limited to a rate, like a
+// full duplex link
+type ThrottledConn struct {
+	net.Conn
+	read, write *TokenBucket
+	burst       int
+	bps         func() int // looked up before every read and write
+}
+
+func NewThrottledConn(conn net.Conn, bps func() int, burst int) *ThrottledConn {
+	if burst < 1 {
+		burst = 1
+	}
+	return &ThrottledConn{
+		Conn:  conn,
+		read:  NewTokenBucket(float64(bps()), burst),
+		write: NewTokenBucket(float64(bps()), burst),
+		burst: burst,
+		bps:   bps,
+	}
+}
+
+// Adjusts the bucket to the current limit, false if there is none
+func (c *ThrottledConn) limited(t *TokenBucket) bool {
+	bps := c.bps()
+	if bps <= 0 {
+		return false
+	}
+	t.SetRate(float64(bps))
+	return true
+}
+
+func (c *ThrottledConn) Read(b []byte) (int, error) {
+	if !c.limited(c.read) {
+		return c.Conn.Read(b)
+	}
+	if len(b) > c.burst {
+		b = b[:c.burst]
+	}
+	n, err := c.Conn.Read(b)
+	c.read.WaitN(n)
+	return n, err
+}
+
+func (c *ThrottledConn) Write(b []byte) (int, error) {
+	if !c.limited(c.write) {
+		return c.Conn.Write(b)
+	}
+	written := 0
+	for written < len(b) {
+		end := written + c.burst
+		if end > len(b) {
+			end = len(b)
+		}
+		c.write.WaitN(end - written)
+		n, err := c.Conn.Write(b[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Wraps conn if a throttle is configured for it, or may be later on
+func throttle(conn net.Conn, bps func() int) net.Conn {
+	if bps() <= 0 && rule_engine == nil {
+		return conn
+	}
+	return NewThrottledConn(conn, bps, *throttle_burst)
+}
@@ -0,0 +1,89 @@
+/*
+Per-connection timeouts (-idle-timeout, -max-duration).
+
+A connection is idle when neither direction has forwarded anything for
+-idle-timeout: each pass_through reads with a deadline and, when it
+expires, checks the activity of both directions before giving up, so a
+long download without a word from the client is not cut off. The
+connection's context has a deadline of -max-duration, whether busy or
+not; pass_through gives up when it passes.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	idle_timeout *time.Duration = flag.Duration("idle-timeout", 0, "close connections without traffic for this long (0 means never)")
+	max_duration *time.Duration = flag.Duration("max-duration", 0, "close connections after this long (0 means never)")
+)
+
+// Shared by both directions of a connection
+type conn_timeouts struct {
+	last_activity int64 // unix nanoseconds
+	idle          int32 // set once the idle timeout fired
+	reported      int32 // the reason has been logged
+	ctx           context.Context
+}
+
+// The connection's context, with the -max-duration deadline if there is one
+func with_max_duration(ctx context.Context) (context.Context, context.CancelFunc) {
+	if *max_duration <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, time.Now().Add(*max_duration))
+}
+
+func new_conn_timeouts(ctx context.Context) *conn_timeouts {
+	return &conn_timeouts{last_activity: time.Now().UnixNano(), ctx: ctx}
+}
+
+func (t *conn_timeouts) before_read(conn net.Conn) {
+	if *idle_timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(*idle_timeout))
+	}
+}
+
+func (t *conn_timeouts) touch() {
+	atomic.StoreInt64(&t.last_activity, time.Now().UnixNano())
+}
+
+// Whether a failed read should be retried: the deadline expired but the
+// other direction was busy in the meantime
+func (t *conn_timeouts) retry(err error) bool {
+	if *idle_timeout <= 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&t.last_activity)))
+	if idle < *idle_timeout {
+		return true
+	}
+	atomic.StoreInt32(&t.idle, 1)
+	return false
+}
+
+// Why the connection is being closed, if a timeout did it; only the first
+// caller learns it so the reason is logged once
+func (t *conn_timeouts) reason() string {
+	var r string
+	switch {
+	case errors.Is(t.ctx.Err(), context.DeadlineExceeded):
+		r = "Max duration exceeded"
+	case atomic.LoadInt32(&t.idle) != 0:
+		r = "Idle timeout"
+	default:
+		return ""
+	}
+	if !atomic.CompareAndSwapInt32(&t.reported, 0, 1) {
+		return ""
+	}
+	return r
+}
@@ -0,0 +1,150 @@
+/*
+TLS interception ("man-in-the-middle") mode.
+
+The proxy terminates TLS from the client with a leaf certificate minted
+on the fly for the requested server name and signed by a local CA, and
+opens its own TLS session to the upstream server. The loggers therefore
+see the decrypted plaintext.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	tls_mode        *bool   = flag.Bool("tls", false, "intercept TLS between client and target")
+	ca_cert         *string = flag.String("ca-cert", "", "CA certificate (PEM) used to sign leaf certificates")
+	ca_key          *string = flag.String("ca-key", "", "CA private key (PEM) used to sign leaf certificates")
+	tls_skip_verify *bool   = flag.Bool("tls-skip-verify", false, "do not verify the target's certificate")
+)
+
+// Signs leaf certificates for the names requested by clients
+type CertAuthority struct {
+	ca    tls.Certificate
+	x509  *x509.Certificate
+	key   *rsa.PrivateKey // shared by all leaf certificates
+	mu    sync.Mutex
+	cache map[string]*tls.Certificate
+}
+
+// Loads the CA key pair from disk and prepares the leaf certificate cache
+func load_cert_authority(cert_file, key_file string) (*CertAuthority, error) {
+	ca, err := tls.LoadX509KeyPair(cert_file, key_file)
+	if err != nil {
+		return nil, err
+	}
+	ca_x509, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &CertAuthority{
+		ca:    ca,
+		x509:  ca_x509,
+		key:   key,
+		cache: make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// Returns a (cached) leaf certificate for the given server name
+func (a *CertAuthority) leaf(name string) (*tls.Certificate, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if cert, ok := a.cache[name]; ok {
+		return cert, nil
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{name}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.x509, &a.key.PublicKey, a.ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, a.ca.Certificate[0]},
+		PrivateKey:  a.key,
+	}
+	a.cache[name] = cert
+	return cert, nil
+}
+
+// Server side configuration presented to the connecting client; without
+// SNI the certificate is issued for default_name.
+func (a *CertAuthority) server_config(default_name string) *tls.Config {
+	return require_client_certs(&tls.Config{
+		NextProtos: tls_next_protos(),
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = default_name
+			}
+			return a.leaf(name)
+		},
+	})
+}
+
+// ALPN protocols offered to both sides; gRPC clients insist on h2
+func tls_next_protos() []string {
+	if *proto == "grpc" || *proto == "h2" {
+		return []string{"h2"}
+	}
+	return nil
+}
+
+// Terminates TLS from the client and returns the server name it asked for
+func tls_accept(local net.Conn, ca *CertAuthority, default_name string) (*tls.Conn, string, error) {
+	conn := tls.Server(local, ca.server_config(default_name))
+	if err := conn.Handshake(); err != nil {
+		return nil, "", fmt.Errorf("client handshake: %v", err)
+	}
+	return conn, conn.ConnectionState().ServerName, nil
+}
+
+// Opens a TLS session to the target, forwarding the client's SNI
+func tls_connect(remote net.Conn, server_name string) (*tls.Conn, error) {
+	conn := tls.Client(remote, &tls.Config{
+		ServerName:         server_name,
+		InsecureSkipVerify: *tls_skip_verify,
+		NextProtos:         tls_next_protos(),
+		Certificates:       upstream_certs,
+	})
+	if err := conn.Handshake(); err != nil {
+		return nil, fmt.Errorf("target handshake: %v", err)
+	}
+	if err := check_pins(conn.ConnectionState(), server_name); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
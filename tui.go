@@ -0,0 +1,477 @@
+/*
+Terminal UI (-tui).
+
+A full-screen view of the proxy instead of the plain output: the active
+connections in a table, the latest log lines of the selected one below
+it, and a status bar with the connection counts and the throughput.
+Up/down (or k/j) select a connection, Enter opens its whole log, Esc goes
+back, and q shuts the proxy down as SIGTERM would.
+
+It is drawn with ANSI escape sequences on a terminal in raw mode, so no
+library is needed; raw mode is set with the termios ioctls of Linux,
+macOS and the BSDs. The screen is redrawn at most every tui_refresh,
+from copies of the registry taken under its lock, and only written out
+when it changed. What the proxy
+prints to stdout and stderr meanwhile is shown on the message line.
+*/
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var tui_mode *bool = flag.Bool("tui", false, "full-screen terminal UI instead of the plain output")
+
+const (
+	tui_refresh  = 100 * time.Millisecond
+	tui_messages = 100 // captured output lines kept
+)
+
+type tui_key int
+
+const (
+	key_up tui_key = iota
+	key_down
+	key_page_up
+	key_page_down
+	key_enter
+	key_back
+	key_quit
+)
+
+type TUI struct {
+	term        *os.File // the real stdout
+	saved       syscall.Termios
+	set_termios uintptr // the ioctl restoring saved
+	stdout      *os.File
+	stderr      *os.File
+
+	mu       sync.Mutex
+	messages []string
+
+	keys     chan tui_key
+	resize   chan os.Signal
+	stopped  chan bool
+	stop     sync.Once
+	width    int
+	height   int
+	drawn    time.Time
+	selected int64 // connection ID
+	view     int64 // connection in the log view, 0 for the table
+	scroll   int   // log view: events hidden below the screen
+	frame    string
+
+	last_up, last_down int64
+	last_rate          time.Time
+	rate_up, rate_down float64
+}
+
+var tui *TUI
+
+func tui_enabled() bool {
+	return *tui_mode
+}
+
+// Takes over the terminal; the proxy's own output is captured from here on
+func start_tui() {
+	if !tui_enabled() {
+		return
+	}
+	if *proto == "udp" || *replay_file != "" {
+		die("-tui only works for TCP proxying")
+	}
+	t := &TUI{term: os.Stdout, stdout: os.Stdout, stderr: os.Stderr,
+		keys: make(chan tui_key, 16), resize: make(chan os.Signal, 1), stopped: make(chan bool)}
+	req, ok := tui_termios[runtime.GOOS+"/"+runtime.GOARCH]
+	if !ok {
+		req, ok = tui_termios[runtime.GOOS]
+	}
+	if !ok {
+		die("-tui needs a Unix terminal")
+	}
+	t.set_termios = req.set
+	if err := termios(os.Stdin.Fd(), req.get, &t.saved); err != nil {
+		die("-tui needs a terminal, %v", err)
+	}
+	raw := t.saved
+	raw.Lflag &^= syscall.ICANON | syscall.ECHO // ISIG stays, ^C still shuts down
+	raw.Cc[syscall.VMIN], raw.Cc[syscall.VTIME] = 1, 0
+	if err := termios(os.Stdin.Fd(), t.set_termios, &raw); err != nil {
+		die("Unable to set up the terminal, %v", err)
+	}
+	if !api_enabled() {
+		connections.SetHistorySize(*history_size) // the log view needs them
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		die("Unable to capture output, %v", err)
+	}
+	os.Stdout, os.Stderr = w, w
+	go t.capture(r)
+
+	t.term.WriteString("\x1b[?1049h\x1b[?25l") // alternate screen, no cursor
+	t.update_size()
+	signal.Notify(t.resize, syscall.SIGWINCH)
+	t.last_rate = time.Now()
+	tui = t
+	go t.read_keys()
+	go t.loop()
+}
+
+// Gives the terminal back; safe to call more than once, and without -tui
+func stop_tui() {
+	t := tui
+	if t == nil {
+		return
+	}
+	t.stop.Do(func() {
+		close(t.stopped)
+		signal.Stop(t.resize)
+		t.term.WriteString("\x1b[?25h\x1b[?1049l")
+		termios(os.Stdin.Fd(), t.set_termios, &t.saved)
+		os.Stdout, os.Stderr = t.stdout, t.stderr
+		t.mu.Lock()
+		last := t.messages[max(0, len(t.messages)-20):]
+		t.mu.Unlock()
+		for _, m := range last {
+			fmt.Fprintln(os.Stdout, m)
+		}
+	})
+}
+
+// The ioctls getting and setting the terminal attributes, by GOOS or
+// GOOS/GOARCH where the architectures differ; the syscall package only
+// has them under the name each system uses
+var tui_termios = map[string]struct{ get, set uintptr }{
+	"linux":          {0x5401, 0x5402}, // TCGETS, TCSETS
+	"android":        {0x5401, 0x5402},
+	"linux/mips":     {0x540d, 0x540e},
+	"linux/mipsle":   {0x540d, 0x540e},
+	"linux/mips64":   {0x540d, 0x540e},
+	"linux/mips64le": {0x540d, 0x540e},
+	"linux/ppc64":    {0x402c7413, 0x802c7414},
+	"linux/ppc64le":  {0x402c7413, 0x802c7414},
+	"darwin":         {0x40487413, 0x80487414}, // TIOCGETA, TIOCSETA
+	"freebsd":        {0x402c7413, 0x802c7414},
+	"netbsd":         {0x402c7413, 0x802c7414},
+	"openbsd":        {0x402c7413, 0x802c7414},
+	"dragonfly":      {0x402c7413, 0x802c7414},
+}
+
+func termios(fd uintptr, req uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (t *TUI) update_size() {
+	var ws struct{ rows, cols, x, y uint16 }
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, t.term.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws)))
+	t.width, t.height = 80, 24
+	if errno == 0 && ws.cols > 0 && ws.rows > 0 {
+		t.width, t.height = int(ws.cols), int(ws.rows)
+	}
+}
+
+func (t *TUI) capture(r *os.File) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		t.mu.Lock()
+		t.messages = append(t.messages, s.Text())
+		if len(t.messages) > tui_messages {
+			t.messages = t.messages[1:]
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (t *TUI) read_keys() {
+	b := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(b)
+		if err != nil {
+			return
+		}
+		in := string(b[:n])
+		var k tui_key
+		switch {
+		case in == "q" || in == "Q":
+			k = key_quit
+		case in == "\r" || in == "\n":
+			k = key_enter
+		case in == "\x1b" || in == "\x7f" || in == "\b" || in == "\x1b[D":
+			k = key_back
+		case in == "\x1b[A" || in == "\x1bOA" || in == "k":
+			k = key_up
+		case in == "\x1b[B" || in == "\x1bOB" || in == "j":
+			k = key_down
+		case in == "\x1b[5~":
+			k = key_page_up
+		case in == "\x1b[6~" || in == " ":
+			k = key_page_down
+		default:
+			continue
+		}
+		select {
+		case t.keys <- k:
+		case <-t.stopped:
+			return
+		}
+	}
+}
+
+func (t *TUI) loop() {
+	tick := time.NewTicker(tui_refresh)
+	defer tick.Stop()
+	dirty := true
+	for {
+		select {
+		case <-t.stopped:
+			return
+		case k := <-t.keys:
+			if !t.handle(k) {
+				return
+			}
+			dirty = true
+		case <-t.resize:
+			t.update_size()
+			t.frame = "" // redraw everything
+			dirty = true
+		case <-tick.C:
+			dirty = true
+		}
+		// Keys arriving in a burst share one redraw, which still comes
+		// at most every tui_refresh
+		if dirty && time.Since(t.drawn) >= tui_refresh {
+			t.draw()
+			dirty = false
+		}
+	}
+}
+
+// Reacts to a key; false once the UI is gone
+func (t *TUI) handle(k tui_key) bool {
+	if k == key_quit {
+		stop_tui()
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		return false
+	}
+	if t.view != 0 {
+		switch k {
+		case key_back:
+			t.view, t.scroll = 0, 0
+		case key_up:
+			t.scroll += 1
+		case key_down:
+			t.scroll = max(0, t.scroll-1)
+		case key_page_up:
+			t.scroll += t.height / 2
+		case key_page_down:
+			t.scroll = max(0, t.scroll-t.height/2)
+		}
+		return true
+	}
+	conns := connections.Snapshot()
+	i := tui_index(conns, t.selected)
+	switch k {
+	case key_enter:
+		if i >= 0 {
+			t.view, t.scroll = t.selected, 0
+		}
+		return true
+	case key_up:
+		i -= 1
+	case key_down:
+		i += 1
+	case key_page_up:
+		i -= t.height / 2
+	case key_page_down:
+		i += t.height / 2
+	}
+	if len(conns) > 0 {
+		t.selected = conns[min(max(i, 0), len(conns)-1)].ID
+	}
+	return true
+}
+
+func tui_index(conns []ConnectionInfo, id int64) int {
+	for i := range conns {
+		if conns[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *TUI) draw() {
+	now := time.Now()
+	t.drawn = now
+	up, down := atomic.LoadInt64(&metrics.bytes_c2s), atomic.LoadInt64(&metrics.bytes_s2c)
+	if secs := now.Sub(t.last_rate).Seconds(); secs >= 1 {
+		t.rate_up, t.rate_down = float64(up-t.last_up)/secs, float64(down-t.last_down)/secs
+		t.last_up, t.last_down, t.last_rate = up, down, now
+	}
+
+	var lines []string
+	if t.view != 0 {
+		lines = t.log_view()
+	} else {
+		lines = t.table_view(now)
+	}
+	for len(lines) < t.height-2 {
+		lines = append(lines, "")
+	}
+	lines = lines[:t.height-2]
+
+	t.mu.Lock()
+	message := ""
+	if len(t.messages) > 0 {
+		message = t.messages[len(t.messages)-1]
+	}
+	t.mu.Unlock()
+	lines = append(lines, message)
+
+	keys := "↑↓ select  Enter log  q quit"
+	if t.view != 0 {
+		keys = "↑↓ PgUp PgDn scroll  Esc back  q quit"
+	}
+	status := fmt.Sprintf(" %d active, %d total │ ↑ %s/s ↓ %s/s │ %s",
+		atomic.LoadInt64(&metrics.active_connections), atomic.LoadInt64(&metrics.total_connections),
+		tui_bytes(int64(t.rate_up)), tui_bytes(int64(t.rate_down)), keys)
+	lines = append(lines, "\x1b[7m"+tui_fit(status, t.width)+"\x1b[0m")
+
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for i, l := range lines {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(l)
+		b.WriteString("\x1b[K")
+	}
+	if frame := b.String(); frame != t.frame {
+		t.term.WriteString(frame)
+		t.frame = frame
+	}
+}
+
+// The connection table and the recent log lines of the selected connection
+func (t *TUI) table_view(now time.Time) []string {
+	conns := connections.Snapshot()
+	i := tui_index(conns, t.selected)
+	if i < 0 && len(conns) > 0 {
+		i, t.selected = 0, conns[0].ID
+	}
+
+	rows := max(3, (t.height-2)/2-1)
+	lines := []string{"\x1b[1m" + tui_fit(fmt.Sprintf("%-6s %-24s %-24s %9s %9s %9s",
+		"ID", "CLIENT", "SERVER", "UP", "DOWN", "DURATION"), t.width) + "\x1b[0m"}
+	first := max(0, i-rows+1)
+	for j := first; j < len(conns) && j < first+rows; j++ {
+		c := &conns[j]
+		l := tui_fit(fmt.Sprintf("%-6d %-24s %-24s %9s %9s %9s", c.ID, c.Client, c.Server,
+			tui_bytes(c.BytesToServer), tui_bytes(c.BytesToClient),
+			now.Sub(c.Started).Truncate(time.Second)), t.width)
+		if j == i {
+			l = "\x1b[7m" + l + "\x1b[0m"
+		}
+		lines = append(lines, l)
+	}
+	for len(lines) < rows+1 {
+		lines = append(lines, "")
+	}
+	if len(conns) == 0 {
+		lines[1] = "no active connections"
+		return lines
+	}
+
+	c := connections.Lookup(t.selected)
+	if c == nil { // finished since the snapshot
+		return lines
+	}
+	lines = append(lines, "\x1b[1m"+tui_fit(fmt.Sprintf("── %d: %s → %s ", c.ID, c.Client, c.Server)+
+		strings.Repeat("─", t.width), t.width)+"\x1b[0m")
+	pane := t.height - 2 - len(lines)
+	return append(lines, tui_log_lines(c, 0, pane, t.width)...)
+}
+
+// The whole log of one connection, scrolled by events
+func (t *TUI) log_view() []string {
+	c := connections.Lookup(t.view)
+	if c == nil {
+		t.view = 0
+		return t.table_view(time.Now())
+	}
+	_, total := c.Events(0, 0)
+	t.scroll = min(t.scroll, max(0, total-1))
+	title := fmt.Sprintf("── %d: %s → %s, events %d of %d ", c.ID, c.Client, c.Server, total-t.scroll, total)
+	lines := []string{"\x1b[1m" + tui_fit(title+strings.Repeat("─", t.width), t.width) + "\x1b[0m"}
+	return append(lines, tui_log_lines(c, t.scroll, t.height-3, t.width)...)
+}
+
+// The last n lines of c's log, leaving out the newest skip events
+func tui_log_lines(c *ConnectionInfo, skip, n, width int) []string {
+	if n <= 0 {
+		return nil
+	}
+	_, total := c.Events(0, 0)
+	end := total - skip
+	var lines []string
+	// Every event is at least one line, so n events are enough
+	events, _ := c.Events(max(0, end-n), min(n, end))
+	for k := len(events) - 1; k >= 0 && len(lines) < n; k-- {
+		var b strings.Builder
+		(&TextLogger{&b}).Log(events[k])
+		l := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+		lines = append(l, lines...)
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	for i := range lines {
+		lines[i] = tui_fit(lines[i], width)
+	}
+	return lines
+}
+
+// Cuts s to width runes and pads it; control characters, escape
+// sequences from the traffic included, become dots
+func tui_fit(s string, width int) string {
+	out := make([]rune, 0, width)
+	for _, c := range s {
+		if len(out) == width {
+			break
+		}
+		if c < ' ' || c == 0x7f {
+			c = '.'
+		}
+		out = append(out, c)
+	}
+	return string(out) + strings.Repeat(" ", width-len(out))
+}
+
+func tui_bytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fK", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,233 @@
+/*
+UDP proxy mode.
+
+UDP has no connections, so every client address gets its own session
+with a dedicated upstream socket and its own set of log files. Sessions
+end once no datagram has been seen in either direction for a while.
+
+On shutdown datagrams from new client addresses are dropped while the
+existing sessions carry on, like the connections of the TCP proxy, until
+they end or the drain timeout closes their upstream sockets.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const udp_session_timeout = 2 * time.Minute
+
+// Common view of both ends of a UDP session
+type PacketConn interface {
+	ReadFrom(b []byte) (int, net.Addr, error)
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	Close() error
+	LocalAddr() net.Addr
+}
+
+// The upstream end, a socket connected to the target
+type udp_upstream struct {
+	*net.UDPConn
+}
+
+func (u udp_upstream) ReadFrom(b []byte) (int, net.Addr, error) {
+	u.SetReadDeadline(time.Now().Add(udp_session_timeout))
+	return u.UDPConn.ReadFrom(b)
+}
+
+// Connected sockets refuse WriteTo, the target is implied
+func (u udp_upstream) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return u.Write(b)
+}
+
+// The client end: datagrams demultiplexed from the shared listener
+type udp_client struct {
+	ln     net.PacketConn
+	addr   net.Addr
+	in     chan []byte
+	closed chan bool
+	once   sync.Once
+}
+
+func (u *udp_client) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case d := <-u.in:
+		return copy(b, d), u.addr, nil
+	case <-u.closed:
+		return 0, nil, net.ErrClosed
+	case <-time.After(udp_session_timeout):
+		return 0, nil, fmt.Errorf("session idle for %s", udp_session_timeout)
+	}
+}
+
+func (u *udp_client) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return u.ln.WriteTo(b, u.addr)
+}
+
+// Only the session is closed, the listener is shared
+func (u *udp_client) Close() error {
+	u.once.Do(func() { close(u.closed) })
+	return nil
+}
+
+func (u *udp_client) LocalAddr() net.Addr {
+	return u.addr
+}
+
+type PacketChannel struct {
+	from, to      PacketConn
+	to_addr       net.Addr
+	conn_n        int
+	direction     string
+	logger        chan *LogEvent
+	binary_logger chan []byte
+	ack           chan bool
+}
+
+// Datagram counterpart of pass_through. Every datagram is logged as one
+// unit, together with the address it came from.
+func pass_through_udp(c *PacketChannel) {
+	to_peer := c.to_addr.String()
+
+	b := make([]byte, 65535)
+	offset := 0
+	packet_n := 0
+	for {
+		n, addr, err := c.from.ReadFrom(b)
+		if err != nil {
+			e := new_event(c.conn_n, c.direction, "disconnected", c.from.LocalAddr().String())
+			e.Message = fmt.Sprintf("Disconnected from %s, %v", c.from.LocalAddr(), err)
+			c.logger <- e
+			break
+		}
+		e := new_event(c.conn_n, c.direction, "datagram", addr.String())
+		e.PacketSeq, e.ByteOffset, e.Length = packet_n, offset, n
+		e.dump_later(b[:n])
+		e.Raw = raw_payload(b[:n])
+		c.logger <- e
+		c.binary_logger <- append([]byte(nil), b[:n]...)
+		c.to.WriteTo(b[:n], c.to_addr)
+		e = new_event(c.conn_n, c.direction, "sent", to_peer)
+		e.PacketSeq, e.ByteOffset, e.Length = packet_n, offset, n
+		c.logger <- e
+		offset += n
+		packet_n += 1
+	}
+	c.from.Close()
+	c.to.Close()
+	c.ack <- true
+}
+
+// Handles one client address from connecting upstream to the end of the session
+func process_udp_session(client *udp_client, conn_n int, m *mapping, target *net.UDPAddr, done func()) {
+	defer done()
+
+	conn, err := net.DialUDP("udp", nil, target)
+	if err != nil {
+		fmt.Printf("Unable to connect to %s, %v\n", target, err)
+		return
+	}
+	open_conns.add(conn) // drain closes it when the session outstays the timeout
+	defer open_conns.remove(conn)
+	remote := udp_upstream{conn}
+
+	local_info := printable_addr(remote.LocalAddr())
+	remote_info := printable_addr(remote.RemoteAddr())
+
+	started := time.Now()
+
+	logger, from_logger, to_logger, _, err := start_loggers(context.Background(), m, conn_n, local_info, remote_info, *log_tag, nil)
+	if err != nil {
+		fmt.Printf("%v\n", &ProxyError{ConnID: conn_n, Msg: "Unable to log the session", Err: err})
+		remote.Close()
+		return
+	}
+	logger = NewFormattingLogger(logger).Events()
+	ack := make(chan bool)
+
+	logger <- log_message(conn_n, "connected", "Session from %s to %s at %s",
+		client.addr, target, format_time(started))
+
+	go pass_through_udp(&PacketChannel{from: remote, to: client, to_addr: client.addr, conn_n: conn_n,
+		direction: server_to_client, logger: logger, binary_logger: to_logger, ack: ack})
+	go pass_through_udp(&PacketChannel{from: client, to: remote, to_addr: target, conn_n: conn_n,
+		direction: client_to_server, logger: logger, binary_logger: from_logger, ack: ack})
+	<-ack
+	<-ack
+
+	duration := time.Now().Sub(started)
+	logger <- log_message(conn_n, "finished", "Finished at %s, duration %s",
+		format_time(started), duration.String())
+
+	stop_loggers(logger, from_logger, to_logger)
+}
+
+// Reads datagrams from the mapping's listener and hands them to their
+// session. Once ctx is done no new sessions start, and stopped is told so.
+func listen_udp(ctx context.Context, m *mapping, stopped *sync.WaitGroup) {
+	target_addr, err := net.ResolveUDPAddr("udp", m.target())
+	if err != nil {
+		die("Unable to resolve %s, %v", m.target(), err)
+	}
+	ln, err := listen_config.ListenPacket(context.Background(), listen_network("udp"), m.listen_addr())
+	if err != nil {
+		die("Unable to start listener, %v", err)
+	}
+
+	var mu sync.Mutex
+	sessions := make(map[string]*udp_client)
+	conn_n := 1
+	closing := false
+	context.AfterFunc(ctx, func() {
+		mu.Lock()
+		closing = true
+		mu.Unlock()
+		stopped.Done()
+	})
+
+	b := make([]byte, 65535)
+	for {
+		n, addr, err := ln.ReadFrom(b)
+		if err != nil {
+			fmt.Printf("Read failed, %v\n", err)
+			continue
+		}
+		key := addr.String()
+
+		mu.Lock()
+		client, ok := sessions[key]
+		if !ok && closing {
+			mu.Unlock()
+			continue
+		}
+		if !ok {
+			active_connections.Add(1)
+			client = &udp_client{ln: ln, addr: addr,
+				in: make(chan []byte, 64), closed: make(chan bool)}
+			sessions[key] = client
+			go process_udp_session(client, conn_n, m, target_addr, func() {
+				client.Close()
+				mu.Lock()
+				delete(sessions, key)
+				mu.Unlock()
+				active_connections.Done()
+			})
+			conn_n += 1
+		}
+		mu.Unlock()
+
+		d := make([]byte, n) // b is reused by the next ReadFrom
+		copy(d, b[:n])
+		select {
+		case client.in <- d:
+		case <-client.closed:
+		default:
+			fmt.Printf("Dropped datagram from %s, session is busy\n", key)
+		}
+	}
+}
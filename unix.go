@@ -0,0 +1,51 @@
+/*
+Unix domain sockets (-proto unix).
+
+The proxy listens on -listen-socket and forwards to the socket at -port;
+-host is not used. Everything past the listener only sees net.Conns, so
+logging works as for TCP. Clients of a Unix socket have no address, their
+side of the log is named "unnamed".
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+var (
+	listen_socket  *string = flag.String("listen-socket", "", "path of the listening socket with -proto unix")
+	socket_mode    *string = flag.String("socket-mode", "0600", "permissions of the listening socket, octal")
+	socket_cleanup *bool   = flag.Bool("socket-cleanup", true, "remove a stale listening socket on startup")
+)
+
+func unix_mode() bool {
+	return *proto == "unix"
+}
+
+// Creates the listening socket with -socket-mode permissions
+func listen_unix(path string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(*socket_mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -socket-mode %q", *socket_mode)
+	}
+	if *socket_cleanup {
+		// Only sockets, a typo in the path shouldn't cost a file
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
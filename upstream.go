@@ -0,0 +1,147 @@
+/*
+Load balancing over a pool of targets (-upstream).
+
+	-upstream 10.0.0.1:80,10.0.0.2:80 -upstream 10.0.0.3:80
+
+takes the place of -host and -port. Every connection goes to the next
+upstream in turn, or with -lb-strategy hash to the one the client IP
+hashes to, so that a client keeps talking to the same server. Each
+upstream is dialed every -health-interval; one that doesn't answer is
+skipped until it does again. If none answers, all of them are used as
+if they were healthy, the health checks may simply be behind.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	lb_strategy     *string        = flag.String("lb-strategy", "round-robin", "how -upstream targets are picked: round-robin or hash (of the client IP)")
+	health_interval *time.Duration = flag.Duration("health-interval", 10*time.Second, "how often each -upstream target is dialed to check it is up")
+)
+
+const health_timeout = 2 * time.Second
+
+// Repeated -upstream flags, each a comma separated list of host:port
+type upstream_flags []string
+
+func (f *upstream_flags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *upstream_flags) Set(value string) error {
+	for _, addr := range strings.Split(value, ",") {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("%q is not host:port, %v", addr, err)
+		}
+		*f = append(*f, addr)
+	}
+	return nil
+}
+
+var upstreams upstream_flags
+
+func init() {
+	flag.Var(&upstreams, "upstream", "host:port to balance connections over, comma separated or repeated")
+}
+
+type upstream struct {
+	addr    string
+	healthy int32 // atomic, 1 or 0
+}
+
+type UpstreamPool struct {
+	upstreams []*upstream
+	strategy  string
+	next      uint32 // atomic
+}
+
+func NewUpstreamPool(addrs []string, strategy string) (*UpstreamPool, error) {
+	if strategy != "round-robin" && strategy != "hash" {
+		return nil, fmt.Errorf("unknown -lb-strategy %q", strategy)
+	}
+	p := &UpstreamPool{strategy: strategy}
+	for _, addr := range addrs {
+		p.upstreams = append(p.upstreams, &upstream{addr: addr, healthy: 1})
+	}
+	return p, nil
+}
+
+// Picks the upstream for a connection from client_ip
+func (p *UpstreamPool) Next(client_ip string) string {
+	var healthy []*upstream
+	for _, u := range p.upstreams {
+		if atomic.LoadInt32(&u.healthy) == 1 {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = p.upstreams
+	}
+	if p.strategy == "hash" {
+		h := fnv.New32a()
+		h.Write([]byte(client_ip))
+		return healthy[h.Sum32()%uint32(len(healthy))].addr
+	}
+	n := atomic.AddUint32(&p.next, 1) - 1
+	return healthy[n%uint32(len(healthy))].addr
+}
+
+// Marks an upstream, reporting whether that changed its state
+func (p *UpstreamPool) set_healthy(u *upstream, healthy bool) bool {
+	v := int32(0)
+	if healthy {
+		v = 1
+	}
+	return atomic.SwapInt32(&u.healthy, v) != v
+}
+
+// Dials every upstream each interval, forever
+func (p *UpstreamPool) check_health(interval time.Duration) {
+	for {
+		for _, u := range p.upstreams {
+			conn, err := net.DialTimeout("tcp", u.addr, health_timeout)
+			if err == nil {
+				conn.Close()
+				if p.set_healthy(u, true) {
+					fmt.Printf("Upstream %s is up again\n", u.addr)
+				}
+			} else if p.set_healthy(u, false) {
+				fmt.Printf("Upstream %s is down, %v\n", u.addr, err)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (p *UpstreamPool) String() string {
+	var addrs []string
+	for _, u := range p.upstreams {
+		addrs = append(addrs, u.addr)
+	}
+	return strings.Join(addrs, ", ") + " (" + p.strategy + ")"
+}
+
+// The pool of -upstream, with its health checks running; nil without it
+func upstream_pool() *UpstreamPool {
+	if len(upstreams) == 0 {
+		return nil
+	}
+	if *proto == "udp" || unix_mode() {
+		die("-upstream only works with TCP targets")
+	}
+	p, err := NewUpstreamPool(upstreams, *lb_strategy)
+	if err != nil {
+		die("%v", err)
+	}
+	go p.check_health(*health_interval)
+	return p
+}
@@ -0,0 +1,59 @@
+/*
+-version: which gotcpspy this is.
+
+Release builds set the version with
+
+	go build -ldflags "-X main.Version=v1.2.3"
+
+Otherwise it comes from the module information Go embeds in the binary,
+along with the commit and its date when built from a git checkout. A
+binary made by go run, or from the loose .go files, has neither, and says
+so.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Set with -ldflags "-X main.Version=...", wins over the build info
+var Version = ""
+
+var show_version *bool = flag.Bool("version", false, "print the version and build information and exit")
+
+// Describes the binary, one "key: value" per line
+func version_info() string {
+	version, commit, date, modified := Version, "unknown", "unknown", false
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if version == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			version = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				commit = s.Value
+			case "vcs.time":
+				date = s.Value
+			case "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+	}
+	if version == "" {
+		version = "devel"
+	}
+	if modified {
+		commit += " (with local changes)"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "gotcpspy %s\n", version)
+	fmt.Fprintf(&b, "go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&b, "commit: %s\n", commit)
+	fmt.Fprintf(&b, "built: %s\n", date)
+	return b.String()
+}
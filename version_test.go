@@ -0,0 +1,26 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestVersionInfo(t *testing.T) {
+	saved := Version
+	t.Cleanup(func() { Version = saved })
+
+	// a test binary has no main module version, so this is the go run case
+	Version = ""
+	s := version_info()
+	for _, want := range []string{"gotcpspy ", "go: " + runtime.Version(), "commit: ", "built: "} {
+		if !strings.Contains(s, want) {
+			t.Errorf("version info %q has no %q", s, want)
+		}
+	}
+
+	Version = "v1.2.3"
+	if s := version_info(); !strings.HasPrefix(s, "gotcpspy v1.2.3\n") {
+		t.Errorf("with -X main.Version=v1.2.3: %q", s)
+	}
+}
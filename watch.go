@@ -0,0 +1,112 @@
+/*
+Waiting for the target to come up (-watch).
+
+Without -watch a connection whose target can't be reached is closed
+right away. With it the dial is retried, the wait doubling from
+-watch-backoff up to watch_max_backoff, while what the client sends in
+the meantime is kept, up to -watch-buffer-size bytes. Once the target
+answers those bytes go out first and the connection carries on as
+usual. The client giving up, or sending more than fits, ends the wait.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+var (
+	watch_mode        *bool          = flag.Bool("watch", false, "keep retrying an unreachable target instead of closing the connection")
+	watch_buffer_size *int           = flag.Int("watch-buffer-size", 64*1024, "bytes of client data kept while -watch waits for the target")
+	watch_backoff     *time.Duration = flag.Duration("watch-backoff", 100*time.Millisecond, "wait before the first -watch retry, doubled after each")
+)
+
+const watch_max_backoff = 10 * time.Second
+
+// Dials target until it answers or ctx is done, the wait between attempts
+// doubling from backoff. Every failed attempt is reported to retry.
+func RetryDial(ctx context.Context, network, target string, backoff time.Duration, retry func(attempt int, wait time.Duration, err error)) (net.Conn, error) {
+	for attempt := 1; ; attempt++ {
+		conn, err := dial_target(network, target)
+		if err == nil {
+			return conn, nil
+		}
+		if retry != nil {
+			retry(attempt, backoff, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > watch_max_backoff {
+			backoff = watch_max_backoff
+		}
+	}
+}
+
+// What the client sent while the target was down
+type watch_buffer struct {
+	data bytes.Buffer
+	err  error         // that ended the reading
+	done chan struct{} // closed when the reading stops
+}
+
+func (w *watch_buffer) fill(conn net.Conn, cancel context.CancelFunc) {
+	defer close(w.done)
+	b := make([]byte, 4096)
+	for {
+		n, err := conn.Read(b)
+		w.data.Write(b[:n])
+		if err == nil && w.data.Len() > *watch_buffer_size {
+			err = fmt.Errorf("the client sent more than the %d bytes -watch-buffer-size keeps", *watch_buffer_size)
+		}
+		w.err = err
+		if err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				cancel() // the client is gone, or sent too much
+			}
+			return
+		}
+	}
+}
+
+// Retries the target for local, keeping what the client sends. Returns
+// the target and the client connection to use from now on, which starts
+// with the kept bytes.
+func watch_dial(ctx context.Context, local net.Conn, conn_n int, network, target string, first error) (net.Conn, net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := &watch_buffer{done: make(chan struct{})}
+	go w.fill(local, cancel)
+
+	started := time.Now()
+	fmt.Printf("Connection %d: %s is not reachable (%v), waiting for it\n", conn_n, target, first)
+	remote, err := RetryDial(ctx, network, target, *watch_backoff, func(attempt int, wait time.Duration, err error) {
+		fmt.Printf("Connection %d: attempt %d to reach %s failed, retrying in %s\n", conn_n, attempt, target, wait)
+	})
+
+	local.SetReadDeadline(time.Unix(1, 0)) // ends the pending Read
+	<-w.done
+	local.SetReadDeadline(time.Time{})
+	if err != nil {
+		if w.err != nil && !errors.Is(w.err, os.ErrDeadlineExceeded) {
+			if w.err == io.EOF {
+				return nil, local, fmt.Errorf("the client disconnected while waiting for the target")
+			}
+			return nil, local, w.err
+		}
+		return nil, local, err
+	}
+	fmt.Printf("Connection %d: reached %s after %s, passing on %d bytes\n", conn_n, target,
+		time.Since(started).Round(time.Millisecond), w.data.Len())
+	return remote, &preamble_conn{local, io.MultiReader(&w.data, local)}, nil
+}
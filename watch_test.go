@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The waits between attempts double, and the context ends the retrying
+func TestRetryDial(t *testing.T) {
+	target := net.JoinHostPort("127.0.0.1", free_port(t)) // nothing listens
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	var waits []time.Duration
+	conn, err := RetryDial(ctx, "tcp", target, 10*time.Millisecond, func(attempt int, wait time.Duration, err error) {
+		if attempt != len(waits)+1 {
+			t.Errorf("attempt %d after %d", attempt, len(waits))
+		}
+		waits = append(waits, wait)
+	})
+	if err == nil {
+		conn.Close()
+		t.Fatalf("reached %s", target)
+	}
+	if len(waits) < 3 || waits[0] != 10*time.Millisecond || waits[1] != 20*time.Millisecond || waits[2] != 40*time.Millisecond {
+		t.Errorf("waited %v between attempts", waits)
+	}
+	if !strings.Contains(err.Error(), "gave up after") {
+		t.Errorf("ended with %v", err)
+	}
+}
+
+// The proxy is up before its target: with -watch what the client sends
+// in the meantime reaches the target once it listens
+func TestProxyWatch(t *testing.T) {
+	saved_watch, saved_backoff, saved_dir := *watch_mode, *watch_backoff, *output_dir
+	t.Cleanup(func() { *watch_mode, *watch_backoff, *output_dir = saved_watch, saved_backoff, saved_dir })
+	*watch_mode, *watch_backoff = true, 10*time.Millisecond
+	*output_dir = t.TempDir()
+	init_log_names()
+	buffer_pool = NewBufferPool(*buf_size)
+
+	port := free_port(t)
+	m := &mapping{listen_port: free_port(t), host: "127.0.0.1", port: port, log_prefix: filepath.Join(*output_dir, "log")}
+	p := NewProxy(m)
+	sessions := make(chan *Session, 1)
+	p.OnConnection(func(s *Session) { sessions <- s })
+	run_proxy(t, p)
+
+	conn := dial_proxy(t, m.listen_port)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	const request = "sent while the target was down"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond) // a few failed attempts
+	server, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	received := make(chan string, 1)
+	go func() {
+		c, err := server.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer c.Close()
+		b := make([]byte, 64)
+		n, _ := io.ReadAtLeast(c, b, len(request))
+		c.Write([]byte("and answered"))
+		received <- string(b[:n])
+	}()
+	reply, err := io.ReadAll(conn)
+	if err != nil || string(reply) != "and answered" {
+		t.Errorf("the client got %q, %v", reply, err)
+	}
+	if got := <-received; got != request {
+		t.Errorf("the target got %q", got)
+	}
+	conn.Close()
+	<-sessions
+	active_connections.Wait()
+}
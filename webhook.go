@@ -0,0 +1,192 @@
+/*
+Connection event webhooks (-webhook-url).
+
+Every connected, data and disconnected event of TCP and Unix socket
+connections is POSTed to the URL as JSON:
+
+	{"event": "data", "conn_id": 3, "timestamp": "...", "direction": "client→server",
+	 "peer": "127.0.0.1-8080", "bytes": 1380, "sample": "<base64 of the first 256 bytes>"}
+
+data events are the received chunks; with a -proto decoder there are
+no raw chunks and so no data events. disconnected events say in "reason"
+whether it was a clean disconnect, a network_error or a timeout, and
+"message" has the text of the log.
+
+-webhook-workers POSTs go out at a time. Events wait in a queue of
+webhook_queue_size; when the receiver can't keep up and the queue is
+full, new events are dropped rather than holding up the connections.
+A POST that fails, or gets an answer other than 2xx, is tried once
+more a second later. Dropped and failed events are reported on stderr
+and counted in gotcpspy_webhook_errors_total.
+
+With -webhook-hmac-secret the body is signed with HMAC-SHA256 and the
+signature sent as
+
+	X-Gotcpspy-Signature: sha256=<hex>
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+var (
+	webhook_url         *string = flag.String("webhook-url", "", "POST connection events as JSON to this URL")
+	webhook_workers     *int    = flag.Int("webhook-workers", 4, "most -webhook-url requests in flight at once")
+	webhook_hmac_secret *string = flag.String("webhook-hmac-secret", "", "sign -webhook-url bodies with HMAC-SHA256, in X-Gotcpspy-Signature")
+)
+
+const (
+	webhook_queue_size  = 1024
+	webhook_sample_size = 256
+	webhook_timeout     = 5 * time.Second
+	webhook_retry_delay = time.Second
+)
+
+type WebhookEvent struct {
+	Event     string    `json:"event"` // connected, data or disconnected
+	ConnID    int       `json:"conn_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Direction string    `json:"direction,omitempty"`
+	Peer      string    `json:"peer,omitempty"`
+	Bytes     int       `json:"bytes,omitempty"`
+	Sample    []byte    `json:"sample,omitempty"` // base64 in the JSON
+	Reason    string    `json:"reason,omitempty"` // disconnected, network_error or timeout
+	Message   string    `json:"message,omitempty"`
+}
+
+// POSTs events from a bounded queue with a fixed number of workers
+type WebhookSender struct {
+	url    string
+	secret []byte // nil to leave the bodies unsigned
+	client *http.Client
+	queue  chan *WebhookEvent
+}
+
+func NewWebhookSender(url, secret string, workers int) *WebhookSender {
+	w := &WebhookSender{
+		url:    url,
+		client: &http.Client{Timeout: webhook_timeout},
+		queue:  make(chan *WebhookEvent, webhook_queue_size),
+	}
+	if secret != "" {
+		w.secret = []byte(secret)
+	}
+	for i := 0; i < max(workers, 1); i++ {
+		go w.worker()
+	}
+	return w
+}
+
+// Queues ev, or drops it if the queue is full; never blocks
+func (w *WebhookSender) Send(ev *WebhookEvent) bool {
+	select {
+	case w.queue <- ev:
+		return true
+	default:
+		metrics.error(&metrics.webhook_dropped)
+		fmt.Fprintf(os.Stderr, "Webhook queue full, dropped the %s event of connection %d\n", ev.Event, ev.ConnID)
+		return false
+	}
+}
+
+func (w *WebhookSender) worker() {
+	for ev := range w.queue {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			continue
+		}
+		if err = w.post(body); err != nil {
+			time.Sleep(webhook_retry_delay)
+			err = w.post(body)
+		}
+		if err != nil {
+			metrics.error(&metrics.webhook_failures)
+			fmt.Fprintf(os.Stderr, "Webhook failed for the %s event of connection %d, %v\n", ev.Event, ev.ConnID, err)
+		}
+	}
+}
+
+// Hex HMAC-SHA256 of body, as sent in X-Gotcpspy-Signature
+func webhook_signature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *WebhookSender) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhook_timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.secret != nil {
+		req.Header.Set("X-Gotcpspy-Signature", "sha256="+webhook_signature(w.secret, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", w.url, resp.Status)
+	}
+	return nil
+}
+
+// The webhook event for a log event, nil for those that aren't sent
+func webhook_event(e *LogEvent) *WebhookEvent {
+	ev := &WebhookEvent{ConnID: e.ConnID, Timestamp: e.Timestamp, Direction: e.Direction, Peer: e.Peer}
+	switch e.Event {
+	case "connected":
+		ev.Event, ev.Message = "connected", e.Message
+	case "received":
+		ev.Event, ev.Bytes = "data", e.Length
+		sample := e.payload()
+		ev.Sample = sample[:min(len(sample), webhook_sample_size)]
+	case "disconnected", "network_error", "timeout":
+		ev.Event, ev.Reason, ev.Message = "disconnected", e.Event, e.Message
+	default:
+		return nil
+	}
+	return ev
+}
+
+// Hands the events a Logger is given to the sender
+type webhook_logger struct {
+	sender *WebhookSender
+}
+
+func (l *webhook_logger) Log(e *LogEvent) error {
+	if ev := webhook_event(e); ev != nil {
+		l.sender.Send(ev)
+	}
+	return nil
+}
+
+var webhook_sender *WebhookSender // shared by all listeners
+
+// Sends the connection events of p to -webhook-url, if given
+func add_webhook(p *Proxy) {
+	if *webhook_url == "" {
+		return
+	}
+	if webhook_sender == nil {
+		webhook_sender = NewWebhookSender(*webhook_url, *webhook_hmac_secret, *webhook_workers)
+	}
+	l := &webhook_logger{webhook_sender}
+	p.OnConnection(func(s *Session) { s.AddLogger(l) })
+}
@@ -0,0 +1,132 @@
+/*
+WebSocket frame decoding (RFC 6455) for the HTTP mode.
+
+After a successful "Upgrade: websocket" handshake both directions of the
+connection carry frames instead of HTTP messages. Only the log is
+affected; the forwarded bytes are never touched.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	ws_continuation = 0x0
+	ws_text         = 0x1
+	ws_binary       = 0x2
+	ws_close        = 0x8
+	ws_ping         = 0x9
+	ws_pong         = 0xa
+)
+
+var ws_frame_types = map[byte]string{
+	ws_continuation: "continuation",
+	ws_text:         "text",
+	ws_binary:       "binary",
+	ws_close:        "close",
+	ws_ping:         "ping",
+	ws_pong:         "pong",
+}
+
+type WebSocketRecord struct {
+	Fin        bool   `json:"fin"`
+	Opcode     byte   `json:"opcode"`
+	Type       string `json:"type"`
+	Message    string `json:"message_type,omitempty"` // for continuation frames
+	Masked     bool   `json:"masked"`
+	MaskKey    string `json:"mask_key,omitempty"`
+	Length     uint64 `json:"length"`
+	Text       string `json:"text,omitempty"`
+	HexPayload string `json:"hex_payload,omitempty"`
+	Truncated  bool   `json:"truncated,omitempty"`
+}
+
+// Decodes the frames of one direction; fragmented messages keep the
+// type of their first frame
+type WebSocketFrameParser struct {
+	message byte
+}
+
+func is_websocket_upgrade(h http.Header) bool {
+	return strings.EqualFold(h.Get("Upgrade"), "websocket")
+}
+
+func (p *WebSocketFrameParser) decode(r *bufio.Reader) (*LogEvent, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	rec := &WebSocketRecord{
+		Fin:    hdr[0]&0x80 != 0,
+		Opcode: hdr[0] & 0x0f,
+		Masked: hdr[1]&0x80 != 0,
+		Length: uint64(hdr[1] & 0x7f),
+	}
+	rec.Type = ws_frame_types[rec.Opcode]
+	if rec.Type == "" {
+		return nil, fmt.Errorf("reserved WebSocket opcode %d", rec.Opcode)
+	}
+
+	switch rec.Length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return nil, err
+		}
+		rec.Length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return nil, err
+		}
+		rec.Length = binary.BigEndian.Uint64(ext)
+	}
+	var key []byte
+	if rec.Masked {
+		key = make([]byte, 4)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return nil, err
+		}
+		rec.MaskKey = hex.EncodeToString(key)
+	}
+
+	keep := rec.Length
+	if keep > uint64(*max_body) {
+		keep, rec.Truncated = uint64(*max_body), true
+	}
+	payload := make([]byte, keep)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(rec.Length-keep)); err != nil {
+		return nil, err
+	}
+	if key != nil {
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+
+	kind := rec.Opcode
+	if kind == ws_continuation {
+		kind = p.message
+		rec.Message = ws_frame_types[kind]
+	} else if kind == ws_text || kind == ws_binary {
+		p.message = kind
+	}
+	if (kind == ws_text || kind == ws_close) && utf8.Valid(payload) {
+		rec.Text = string(payload)
+	} else if len(payload) > 0 {
+		rec.HexPayload = hex.Dump(payload)
+	}
+	return &LogEvent{Event: "websocket_frame", WebSocket: rec}, nil
+}